@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 	"github/martinmaurice/rlim/internal/server"
+	"github/martinmaurice/rlim/pkg/access_list"
+	"github/martinmaurice/rlim/pkg/admission"
+	"github/martinmaurice/rlim/pkg/api_key_store"
+	"github/martinmaurice/rlim/pkg/config"
 	"github/martinmaurice/rlim/pkg/env"
+	"github/martinmaurice/rlim/pkg/jwt_auth"
+	"github/martinmaurice/rlim/pkg/override_store"
 	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"github/martinmaurice/rlim/pkg/redis_client"
+	"github/martinmaurice/rlim/pkg/webhook"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
@@ -29,6 +44,201 @@ func setupLogger(appName, env, version string, logLevel slog.Level) {
 	slog.SetDefault(logger.With("appName", appName, "env", env, "version", version))
 }
 
+// setupAccessList loads the allow and deny lists from the config, they are
+// reloaded on SIGHUP and, if configured, periodically
+func setupAccessList(cfg *config.Config) *access_list.AccessList {
+	toListOptions := func(listCfg config.AccessListConfig) access_list.ListOptions {
+		return access_list.ListOptions{
+			CIDRs:       listCfg.CIDRs,
+			CIDRsFile:   listCfg.CIDRsFile,
+			APIKeys:     listCfg.APIKeys,
+			APIKeysFile: listCfg.APIKeysFile,
+		}
+	}
+
+	accessList, err := access_list.New(access_list.Options{
+		Allow: toListOptions(cfg.AccessLists.Allow),
+		Deny:  toListOptions(cfg.AccessLists.Deny),
+	})
+	if err != nil {
+		panic(fmt.Errorf("could not be able to load the access lists: %v", err))
+	}
+
+	if cfg.AccessLists.ReloadInterval > 0 {
+		accessList.ReloadEvery(cfg.AccessLists.ReloadInterval, nil)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("reloading the access lists")
+			if err := accessList.Reload(); err != nil {
+				slog.Error("could not reload the access lists", "error", err)
+			}
+		}
+	}()
+
+	return accessList
+}
+
+// setupLoadShedding returns the server options enabling the admission
+// controller when the config has a load_shedding section
+func setupLoadShedding(cfg *config.Config) []server.Option {
+	if !cfg.LoadShedding.Enabled {
+		return nil
+	}
+
+	return []server.Option{
+		server.WithAdmissionController(admission.New(admission.Options{
+			MaxConcurrency:       cfg.LoadShedding.MaxConcurrency,
+			MaxRequestsPerSecond: cfg.LoadShedding.MaxRequestsPerSecond,
+			ShedThreshold:        cfg.LoadShedding.ShedThreshold,
+			Priorities:           cfg.Priorities,
+		})),
+	}
+}
+
+// setupAuthentication returns the server option enabling the authentication
+// method selected in the env
+func setupAuthentication(envObj *env.Specification) server.Option {
+	switch envObj.AuthMethod {
+	case "jwt":
+		verifier, err := jwt_auth.NewVerifier(jwt_auth.Options{
+			Algorithms:    envObj.JwtAlgorithms,
+			HMACSecret:    []byte(envObj.JwtHmacSecret),
+			PublicKeyFile: envObj.JwtPublicKeyFile,
+			JWKSFile:      envObj.JwtJwksFile,
+			Issuer:        envObj.JwtIssuer,
+			Audience:      envObj.JwtAudience,
+			TierClaim:     envObj.JwtTierClaim,
+			SubjectClaim:  envObj.JwtSubjectClaim,
+			Leeway:        envObj.JwtLeeway,
+		})
+		if err != nil {
+			panic(fmt.Errorf("could not be able to create the jwt verifier: %v", err))
+		}
+		return server.WithTokenVerifier(verifier)
+
+	case "api_key":
+		apiKeyStore, err := api_key_store.New()
+		if err != nil {
+			panic(fmt.Errorf("could not be able to create the api key store: %v", err))
+		}
+		return server.WithAPIKeyStore(apiKeyStore)
+
+	default:
+		panic(fmt.Errorf("unknown auth method %q, must be one of api_key, jwt", envObj.AuthMethod))
+	}
+}
+
+// setupStorage opens the storage picked by the env when it is not one the
+// client builds itself (memory or redis), it returns nil otherwise. Redis is
+// wrapped by the leasing storage when groups are leased and by the near cache
+// when it is enabled.
+func setupStorage(cfg *config.Config, envObj *env.Specification) rate_limiter.Storer {
+	if envObj.UsePeerStorage {
+		slog.Info("using the peer storage", "self", envObj.PeerSelf, "peers", envObj.Peers)
+		storage, err := rate_limiter.NewPeerStorage(rate_limiter.PeerStorageOptions{
+			Secret:        envObj.PeerSecret,
+			Self:          envObj.PeerSelf,
+			Peers:         envObj.Peers,
+			Timeout:       envObj.PeerTimeout,
+			RetryInterval: envObj.PeerRetryInterval,
+			Local:         rate_limiter.NewMemory(),
+		})
+		if err != nil {
+			panic(fmt.Errorf("could not be able to create the peer storage: %v", err))
+		}
+		return storage
+	}
+	if envObj.UseGossipStorage {
+		slog.Info("using the gossip storage", "node", envObj.GossipNode, "peers", envObj.GossipPeers)
+		storage, err := rate_limiter.NewGossipStorage(rate_limiter.GossipStorageOptions{
+			Secret:   envObj.GossipSecret,
+			Node:     envObj.GossipNode,
+			Peers:    envObj.GossipPeers,
+			Interval: envObj.GossipInterval,
+			Timeout:  envObj.GossipTimeout,
+			MaxKeys:  envObj.GossipMaxKeys,
+			Local:    rate_limiter.NewMemory(),
+		})
+		if err != nil {
+			panic(fmt.Errorf("could not be able to create the gossip storage: %v", err))
+		}
+		return storage
+	}
+	if !envObj.UseMemoryStorage && !envObj.UseBoltStorage && (envObj.UseNearCache || len(cfg.Leasing) > 0) {
+		client := redis_client.New()
+		redisStorage := rate_limiter.NewRedisStorage(client)
+
+		var storage rate_limiter.RetryAtStorer = redisStorage
+		if len(cfg.Leasing) > 0 {
+			slog.Info("leasing the tokens of the redis storage", "groups", len(cfg.Leasing))
+			storage = rate_limiter.NewLeasingStorage(redisStorage, rate_limiter.LeasingOptions{Groups: cfg.Leasing})
+		}
+		if !envObj.UseNearCache {
+			return storage
+		}
+
+		slog.Info("using the redis storage behind a near cache", "maxKeys", envObj.NearCacheMaxKeys)
+		return rate_limiter.NewNearCacheStorage(storage, rate_limiter.NearCacheOptions{
+			MaxKeys:              envObj.NearCacheMaxKeys,
+			Invalidations:        client,
+			InvalidationsChannel: envObj.NearCacheInvalidationsChannel,
+		})
+	}
+	if !envObj.UseBoltStorage {
+		return nil
+	}
+
+	storage, err := rate_limiter.NewBoltStorage(rate_limiter.BoltStorageOptions{
+		Path:   envObj.BoltStoragePath,
+		NoSync: envObj.BoltStorageNoSync,
+	})
+	if err != nil {
+		panic(fmt.Errorf("could not be able to open the bolt storage: %v", err))
+	}
+	slog.Info("using the bolt storage", "path", envObj.BoltStoragePath)
+	return storage
+}
+
+// servePeers listens to the other instances of a peer or gossip storage until
+// the server is shut down
+func servePeers(addr string, handler http.Handler, timeout time.Duration) *http.Server {
+	peerServer := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeout,
+	}
+	go func() {
+		slog.Info("listening to the peers", "addr", addr)
+		if err := peerServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(fmt.Errorf("could not be able to listen to the peers: %v", err))
+		}
+	}()
+	return peerServer
+}
+
+// setupNotifier delivers the usage notifications as webhooks when they are
+// enabled in the config, it returns nil otherwise
+func setupNotifier(cfg *config.Config, envObj *env.Specification) *webhook.Notifier {
+	if !cfg.Notifications.Enabled {
+		return nil
+	}
+
+	if envObj.WebhookSecret == "" {
+		slog.Warn("RLIM_WEBHOOK_SECRET is not set, the webhooks are not signed")
+	}
+
+	return webhook.New(webhook.Options{
+		URL:        cfg.Notifications.WebhookURL,
+		Secret:     envObj.WebhookSecret,
+		MaxRetries: cfg.Notifications.MaxRetries,
+		Timeout:    cfg.Notifications.Timeout,
+	})
+}
+
 func main() {
 	flag.Parse()
 
@@ -54,12 +264,62 @@ func main() {
 	}
 
 	// initialize the rate limiter client
-	rateLimiter := rate_limiter.New(
-		&rate_limiter.ClientOptions{
-			UseMemoryStorage: envObj.UseMemoryStorage,
-		},
-	)
+	overrides := override_store.New()
+	storage := setupStorage(config.GetConfig(), envObj)
+	clientOptions := &rate_limiter.ClientOptions{
+		UseMemoryStorage:  envObj.UseMemoryStorage,
+		Storage:           storage,
+		Overrides:         overrides,
+		OverridesCacheTTL: envObj.OverridesCacheTTL,
+	}
+	notifier := setupNotifier(config.GetConfig(), envObj)
+	if notifier != nil {
+		clientOptions.Notifier = notifier
+	}
+	rateLimiter := rate_limiter.New(clientOptions)
+
+	prometheus.MustRegister(rate_limiter.NewActiveBansCollector(rateLimiter))
+
+	opts := []server.Option{
+		server.WithDisableRateLimiter(disableRateLimiter),
+		server.WithAccessList(setupAccessList(config.GetConfig())),
+		setupAuthentication(envObj),
+		server.WithOverrideStore(overrides),
+		server.WithBanLister(rateLimiter),
+		server.WithQuotaCreditor(rateLimiter),
+		server.WithLimitsInvalidator(rateLimiter),
+	}
+	opts = append(opts, setupLoadShedding(config.GetConfig())...)
+
+	// the peers forward their calls or gossip their counts to this instance
+	var peerServer *http.Server
+	switch storage := storage.(type) {
+	case *rate_limiter.PeerStorage:
+		peerServer = servePeers(envObj.PeerListenAddr, storage.Handler(), envObj.PeerTimeout)
+	case *rate_limiter.GossipStorage:
+		peerServer = servePeers(envObj.GossipListenAddr, storage.Handler(), envObj.GossipTimeout)
+	}
 
-	srv := server.NewServer(rateLimiter, server.WithDisableRateLimiter(disableRateLimiter))
+	srv := server.NewServer(rateLimiter, opts...)
 	srv.Run()
+
+	if peerServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), envObj.ServerWriteTimeoutInSecond)
+		if err := peerServer.Shutdown(ctx); err != nil {
+			slog.Error("could not shut down the peer server", "error", err)
+		}
+		cancel()
+	}
+
+	if notifier != nil {
+		// deliver the pending notifications, the ones left at the deadline are dropped
+		ctx, cancel := context.WithTimeout(context.Background(), envObj.ServerWriteTimeoutInSecond)
+		if err := notifier.Close(ctx); err != nil {
+			slog.Error("could not deliver every pending notification", "error", err)
+		}
+		cancel()
+	}
+	if err := rateLimiter.Close(); err != nil {
+		slog.Error("could not close the rate limiter storage", "error", err)
+	}
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github/martinmaurice/rlim/pkg/webhook"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+var (
+	addr   string
+	secret string
+)
+
+func init() {
+	flag.StringVar(&addr, "addr", ":9090", "Address the receiver listens on")
+	flag.StringVar(&secret, "secret", os.Getenv("RLIM_WEBHOOK_SECRET"), "Secret the webhooks are signed with, defaults to RLIM_WEBHOOK_SECRET")
+}
+
+// webhook_receiver prints the webhooks sent by rlim, it is meant to test the
+// notifications locally by setting notifications.webhook_url to http://localhost:9090/
+func main() {
+	flag.Parse()
+
+	if secret == "" {
+		slog.Warn("no secret given, the signature of the webhooks is not checked")
+	}
+
+	handler := webhook.NewReceiver(secret, func(payload webhook.Payload) {
+		body, _ := json.MarshalIndent(payload, "", "  ")
+		fmt.Println(string(body))
+	})
+
+	slog.Info("starting the webhook receiver", "addr", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		slog.Error("could not listen", "error", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"log/slog"
+	"net/http"
+)
+
+type BanLister interface {
+	ListBans(ctx context.Context) ([]rate_limiter.Ban, error)
+}
+
+// banHandler lists the keys banned after repeated rejections
+type banHandler struct {
+	lister BanLister
+}
+
+func (h banHandler) list(ctx *gin.Context) {
+	bans, err := h.lister.ListBans(ctx)
+	if err != nil {
+		slog.Error("could not list the bans", "error", err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	if bans == nil {
+		bans = []rate_limiter.Ban{}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"bans": bans})
+}
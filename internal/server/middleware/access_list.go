@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/access_list"
+	"log/slog"
+	"net/http"
+	"net/netip"
+)
+
+type AccessListChecker interface {
+	Check(ip netip.Addr, apiKey string) access_list.Verdict
+}
+
+const IsRateLimitExemptContextValueKey = "isRateLimitExempt"
+
+// AccessListMiddleware blocks denylisted clients with a 403 and flags the
+// allowlisted ones so that the rate limit middlewares let them through
+func AccessListMiddleware(checker AccessListChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// an unparsable ip is left invalid, it then only matches on the api key
+		ip, _ := netip.ParseAddr(c.ClientIP())
+		apiKey := c.GetHeader(apiKeyHeader)
+
+		switch checker.Check(ip, apiKey) {
+		case access_list.Denied:
+			slog.Info("Request denied by the access list", "ip", c.ClientIP())
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		case access_list.Allowed:
+			slog.Debug("Request exempted from rate limiting by the access list", "ip", c.ClientIP())
+			c.Set(IsRateLimitExemptContextValueKey, true)
+		}
+
+		c.Next()
+	}
+}
+
+func isRateLimitExempt(c *gin.Context) bool {
+	return c.GetBool(IsRateLimitExemptContextValueKey)
+}
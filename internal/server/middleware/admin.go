@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminAuthenticationMiddleware only lets through the requests bearing the
+// admin token in the Authorization header
+func AdminAuthenticationMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bearer, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			slog.Info("Admin request with an invalid token", "ip", c.ClientIP())
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -1,44 +1,69 @@
 package middleware
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/api_key_store"
 	"log/slog"
+	"net/http"
 )
 
-type User struct {
-	ApiKey string
-	Tier   string
-}
-
-// This is for demo purpose
-// In production you must not store your api keys here
-var users = []User{
-	{"live-is-easy-and-hard", "free"},
-	{"fight-for-freedom", "premium"},
-	{"change-your-perspective", "enterprise"},
-}
-
 const (
 	apiKeyHeader                   = "X-API-KEY"
 	TierContextKey                 = "authenticatedUserTier"
+	SubjectContextKey              = "authenticatedUserSubject"
 	IsAuthenticatedContextValueKey = "isUserAuthenticated"
 )
 
-func AuthenticationMiddleware(c *gin.Context) {
-	apiKey := c.GetHeader(apiKeyHeader)
-	if apiKey == "" {
-		c.Next()
-		return
+// knownTiers returns the tier of an authenticated user, a tier missing from
+// tiers, the configured groups of rate limiters, falls back to the default one
+// instead of going through unlimited. No tiers accepts any tier.
+func knownTiers(tiers []string) func(subject, tier string) string {
+	known := make(map[string]bool, len(tiers))
+	for _, tier := range tiers {
+		known[tier] = true
 	}
 
-	for _, user := range users {
-		if user.ApiKey == apiKey {
-			slog.Debug("User is authenticated", "tier", user.Tier)
-			c.Set(TierContextKey, user.Tier)
-			c.Set(IsAuthenticatedContextValueKey, true)
-			break
+	return func(subject, tier string) string {
+		if len(known) > 0 && !known[tier] {
+			slog.Warn("Unknown tier, using the default one", "subject", subject, "tier", tier)
+			return DefaultRateLimitersId
 		}
+		return tier
 	}
+}
+
+// AuthenticationMiddleware authenticates the request using the api key header,
+// an unknown api key leaves the request anonymous. The tier of the api key
+// falls back to the default one when it is missing from tiers.
+func AuthenticationMiddleware(store api_key_store.APIKeyStore, tiers []string) gin.HandlerFunc {
+	tierOf := knownTiers(tiers)
+	return func(c *gin.Context) {
+		apiKey := c.GetHeader(apiKeyHeader)
+		if apiKey == "" {
+			c.Next()
+			return
+		}
+
+		key, err := store.Lookup(c, apiKey)
+		if err != nil {
+			if !errors.Is(err, api_key_store.KeyNotFoundErr) {
+				slog.Error("could not look up the api key", "error", err)
+				c.AbortWithStatus(http.StatusServiceUnavailable)
+				return
+			}
+
+			slog.Debug("Unknown api key")
+			c.Next()
+			return
+		}
 
-	c.Next()
+		tier := tierOf(key.ID, key.Tier)
+		slog.Debug("User is authenticated", "subject", key.ID, "tier", tier)
+		c.Set(TierContextKey, tier)
+		c.Set(SubjectContextKey, key.ID)
+		c.Set(IsAuthenticatedContextValueKey, true)
+
+		c.Next()
+	}
 }
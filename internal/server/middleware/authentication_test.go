@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github/martinmaurice/rlim/pkg/api_key_store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubAPIKeyStore reads the tier from the api key, "unknown" is not found
+type stubAPIKeyStore struct{}
+
+func (stubAPIKeyStore) Lookup(_ context.Context, apiKey string) (*api_key_store.APIKey, error) {
+	if apiKey == "unknown" {
+		return nil, api_key_store.KeyNotFoundErr
+	}
+	return &api_key_store.APIKey{ID: "john", Tier: apiKey}, nil
+}
+
+func TestAuthenticationMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		tiers        []string
+		apiKey       string
+		expectedTier string
+	}{
+		{name: "Configured tier", tiers: []string{"default", "premium"}, apiKey: "premium", expectedTier: "premium"},
+		{name: "Unknown tier falls back to the default one", tiers: []string{"default", "premium"}, apiKey: "premuim", expectedTier: DefaultRateLimitersId},
+		{name: "No configured tiers", apiKey: "enterprise", expectedTier: "enterprise"},
+		{name: "Unknown api key stays anonymous", tiers: []string{"default"}, apiKey: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(AuthenticationMiddleware(stubAPIKeyStore{}, tt.tiers))
+			var tier string
+			router.GET("/data", func(c *gin.Context) {
+				tier = c.GetString(TierContextKey)
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/data", nil)
+			req.Header.Set(apiKeyHeader, tt.apiKey)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.expectedTier, tier)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/jwt_auth"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+type TokenVerifier interface {
+	Verify(token string) (*jwt_auth.Identity, error)
+}
+
+// JWTAuthenticationMiddleware is an alternative to AuthenticationMiddleware
+// authenticating the request with a bearer token. Requests without token stay
+// anonymous while requests with an invalid token are rejected. The tier claim
+// comes from the token issuer: a tier missing from tiers, the configured
+// groups of rate limiters, falls back to the default one instead of going
+// through unlimited. No tiers accepts any tier.
+func JWTAuthenticationMiddleware(verifier TokenVerifier, tiers []string) gin.HandlerFunc {
+	tierOf := knownTiers(tiers)
+	return func(c *gin.Context) {
+		header := c.GetHeader(authorizationHeader)
+		if header == "" {
+			c.Next()
+			return
+		}
+
+		if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		identity, err := verifier.Verify(strings.TrimSpace(header[len(bearerPrefix):]))
+		if err != nil {
+			slog.Info("Invalid bearer token", "error", err)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		tier := tierOf(identity.Subject, identity.Tier)
+		slog.Debug("User is authenticated", "subject", identity.Subject, "tier", tier)
+		c.Set(TierContextKey, tier)
+		c.Set(SubjectContextKey, identity.Subject)
+		c.Set(IsAuthenticatedContextValueKey, true)
+
+		c.Next()
+	}
+}
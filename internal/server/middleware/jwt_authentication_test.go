@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github/martinmaurice/rlim/pkg/jwt_auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubTokenVerifier reads the tier from the token, "invalid" is rejected
+type stubTokenVerifier struct{}
+
+func (stubTokenVerifier) Verify(token string) (*jwt_auth.Identity, error) {
+	if token == "invalid" {
+		return nil, errors.New("invalid token")
+	}
+	return &jwt_auth.Identity{Subject: "john", Tier: token}, nil
+}
+
+func TestJWTAuthenticationMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		tiers        []string
+		token        string
+		expectedCode int
+		expectedTier string
+	}{
+		{name: "Configured tier", tiers: []string{"default", "premium"}, token: "premium", expectedCode: http.StatusOK, expectedTier: "premium"},
+		{name: "Unknown tier falls back to the default one", tiers: []string{"default", "premium"}, token: "enterprise", expectedCode: http.StatusOK, expectedTier: DefaultRateLimitersId},
+		{name: "Empty tier falls back to the default one", tiers: []string{"default", "premium"}, token: "", expectedCode: http.StatusOK, expectedTier: DefaultRateLimitersId},
+		{name: "No configured tiers", token: "enterprise", expectedCode: http.StatusOK, expectedTier: "enterprise"},
+		{name: "Invalid token", tiers: []string{"default"}, token: "invalid", expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(JWTAuthenticationMiddleware(stubTokenVerifier{}, tt.tiers))
+			var tier string
+			router.GET("/data", func(c *gin.Context) {
+				tier = c.GetString(TierContextKey)
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/data", nil)
+			req.Header.Set(authorizationHeader, bearerPrefix+tt.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+			assert.Equal(t, tt.expectedTier, tier)
+		})
+	}
+}
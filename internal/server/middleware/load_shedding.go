@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// AdmissionController bounds the aggregate load of the server, shedding the
+// lowest priority tiers first
+type AdmissionController interface {
+	Admit(tier string) (release func(), ok bool)
+}
+
+// WithAdmissionController sheds the requests of the tiers the controller
+// does not admit before checking their per-key rate limits
+func WithAdmissionController(controller AdmissionController) RateLimitOption {
+	return func(options *rateLimitOptions) {
+		options.admission = controller
+	}
+}
+
+// admit asks the admission controller, if any, whether the request of the
+// tier can go through and aborts it with a 503 otherwise. The returned
+// release function must be called once the request is done.
+func admit(c *gin.Context, options *rateLimitOptions, tier string) (func(), bool) {
+	if options.admission == nil {
+		return func() {}, true
+	}
+
+	release, ok := options.admission.Admit(tier)
+	if !ok {
+		c.Header("Retry-After", "1")
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	return release, true
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+type stubAdmissionController struct {
+	admit    bool
+	tiers    []string
+	released int
+}
+
+func (s *stubAdmissionController) Admit(tier string) (func(), bool) {
+	s.tiers = append(s.tiers, tier)
+	if !s.admit {
+		return nil, false
+	}
+	return func() { s.released++ }, true
+}
+
+func TestRateLimitMiddleware_AdmissionController(t *testing.T) {
+	t.Run("Shed requests are rejected before the rate limit check", func(t *testing.T) {
+		controller := &stubAdmissionController{}
+		w := serve(newTestRouter(WithAdmissionController(controller)), "/data")
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		assert.Equal(t, []string{DefaultRateLimitersId}, controller.tiers)
+	})
+
+	t.Run("Admitted requests are released once done", func(t *testing.T) {
+		controller := &stubAdmissionController{admit: true}
+		w := serve(newTestRouter(WithAdmissionController(controller)), "/data")
+
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, "the per-key rate limit still applies")
+		assert.Equal(t, 1, controller.released)
+	})
+}
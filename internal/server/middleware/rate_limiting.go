@@ -4,31 +4,46 @@ import (
 	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
 	"log/slog"
 	"net/http"
+	"time"
 )
 
 type RateLimitMiddlewareServicer interface {
-	CheckRateLimit(ctx context.Context, key string, tier string) (string, bool)
+	Check(ctx context.Context, key string, tier string) rate_limiter.Decision
 }
 
 const (
 	DefaultRateLimitersId = "default"
 )
 
-func checkRateLimit(ctx context.Context, servicer RateLimitMiddlewareServicer, key, rateLimiterId string) bool {
-	_, ok := servicer.CheckRateLimit(ctx, key, rateLimiterId)
-	if ok {
+func checkRateLimit(ctx context.Context, servicer RateLimitMiddlewareServicer, key, rateLimiterId string) rate_limiter.Decision {
+	decision := servicer.Check(ctx, key, rateLimiterId)
+	if decision.Allowed {
 		slog.Info("Request allowed", "key", key, "rate_limiter_id", rateLimiterId)
-		return true
+		return decision
 	}
 
-	slog.Info("Request not allowed", "key", key, "rate_limiter_id", rateLimiterId)
-	return false
+	slog.Info("Request not allowed", "key", key, "rate_limiter_id", rateLimiterId, "limiter_id", decision.LimiterID)
+	return decision
 }
 
-func RateLimitAnonymousUserMiddleware(servicer RateLimitMiddlewareServicer) gin.HandlerFunc {
+// serveAndObserve runs the handler and reports its response to the adaptive rate limiters
+func serveAndObserve(c *gin.Context, decision *rate_limiter.Decision) {
+	start := time.Now()
+	c.Next()
+	decision.Observe(c.Writer.Status(), time.Since(start))
+}
+
+func RateLimitAnonymousUserMiddleware(servicer RateLimitMiddlewareServicer, opts ...RateLimitOption) gin.HandlerFunc {
+	options := newRateLimitOptions(opts)
 	return func(c *gin.Context) {
+		if isRateLimitExempt(c) {
+			c.Next()
+			return
+		}
+
 		// if the user is authenticated go forward
 		isAuth, exists := c.Get(IsAuthenticatedContextValueKey)
 		if exists && isAuth.(bool) == true {
@@ -37,18 +52,34 @@ func RateLimitAnonymousUserMiddleware(servicer RateLimitMiddlewareServicer) gin.
 		}
 
 		// forge rate limit key prefix using the ip (you could have used something different)
+		// anonymous requests are shed along with the default tier
+		release, ok := admit(c, options, DefaultRateLimitersId)
+		if !ok {
+			return
+		}
+		defer release()
+
 		key := fmt.Sprintf("anonymous:%s", c.ClientIP())
-		if ok := checkRateLimit(c, servicer, key, DefaultRateLimitersId); ok {
-			c.Next()
+		decision := checkRateLimit(c.Request.Context(), servicer, key, DefaultRateLimitersId)
+		if !decision.Allowed {
+			reject(c, options, decision)
 			return
 		}
 
-		c.AbortWithStatus(http.StatusTooManyRequests)
+		// release the concurrency leases once the handler returns
+		defer decision.Release(context.WithoutCancel(c.Request.Context()))
+		serveAndObserve(c, &decision)
 	}
 }
 
-func RateLimitAuthenticatedUserBasedOnTierMiddleware(servicer RateLimitMiddlewareServicer) gin.HandlerFunc {
+func RateLimitAuthenticatedUserBasedOnTierMiddleware(servicer RateLimitMiddlewareServicer, opts ...RateLimitOption) gin.HandlerFunc {
+	options := newRateLimitOptions(opts)
 	return func(c *gin.Context) {
+		if isRateLimitExempt(c) {
+			c.Next()
+			return
+		}
+
 		// if the user is not authenticated call next
 		isAuth, exists := c.Get(IsAuthenticatedContextValueKey)
 		if !exists || isAuth.(bool) == false {
@@ -64,14 +95,25 @@ func RateLimitAuthenticatedUserBasedOnTierMiddleware(servicer RateLimitMiddlewar
 			return
 		}
 
-		// forge the rate limit bucket key prefix
+		// under heavy load the lowest priority tiers are shed first
+		release, ok := admit(c, options, tier.(string))
+		if !ok {
+			return
+		}
+		defer release()
+
+		// forge the rate limit bucket key prefix from the subject rather than
+		// the credentials so that they never end up in the storage
 		// and check whether the request is allowed
-		key := fmt.Sprintf("auth:%s", c.GetHeader(apiKeyHeader))
-		if ok := checkRateLimit(c, servicer, key, tier.(string)); ok {
-			c.Next()
+		key := fmt.Sprintf("auth:%s", c.GetString(SubjectContextKey))
+		decision := checkRateLimit(c.Request.Context(), servicer, key, tier.(string))
+		if !decision.Allowed {
+			reject(c, options, decision)
 			return
 		}
 
-		c.AbortWithStatus(http.StatusTooManyRequests)
+		// release the concurrency leases once the handler returns
+		defer decision.Release(context.WithoutCancel(c.Request.Context()))
+		serveAndObserve(c, &decision)
 	}
 }
@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const concurrencyTestConfig = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 100
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    reports:
+      algorithm: concurrency
+      capacity: 1
+      expiration: 60
+`
+
+func newConcurrencyTestClient(t *testing.T) *rate_limiter.Client {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(concurrencyTestConfig), 0o600))
+	t.Setenv("RLIM_ENV", "test")
+	t.Setenv("RLIM_VERSION", "1")
+	t.Setenv("RLIM_REDIS_ADDR", "localhost")
+	t.Setenv("RLIM_CONFIG_FILE", configFile)
+
+	return rate_limiter.New(&rate_limiter.ClientOptions{Storage: rate_limiter.NewMemoryStorage()})
+}
+
+func TestRateLimitMiddleware_ReleasesConcurrencyLease(t *testing.T) {
+	client := newConcurrencyTestClient(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(gin.RecoveryWithWriter(io.Discard), func(c *gin.Context) {
+		c.Set(IsAuthenticatedContextValueKey, true)
+		c.Set(TierContextKey, "reports")
+		c.Set(SubjectContextKey, "acme")
+	})
+	router.Use(RateLimitAuthenticatedUserBasedOnTierMiddleware(client))
+
+	// the lease of the request must be held while its handler runs
+	assertLeaseHeld := func() {
+		inFlight := client.Check(context.Background(), "auth:acme", "reports")
+		inFlight.Release(context.Background())
+		assert.False(t, inFlight.Allowed, "the lease is held while the handler runs")
+	}
+	router.GET("/ok", func(c *gin.Context) {
+		assertLeaseHeld()
+		c.Status(http.StatusOK)
+	})
+	router.GET("/abort", func(c *gin.Context) {
+		assertLeaseHeld()
+		c.AbortWithStatus(http.StatusForbidden)
+	})
+	router.GET("/panic", func(c *gin.Context) {
+		assertLeaseHeld()
+		panic("handler failure")
+	})
+
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{name: "Handler returns", path: "/ok", code: http.StatusOK},
+		{name: "Handler aborts", path: "/abort", code: http.StatusForbidden},
+		{name: "Handler panics", path: "/panic", code: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the concurrency capacity is 1, a lease kept by a request rejects the next one
+			for i := 0; i < 2; i++ {
+				w := serve(router, tt.path)
+				assert.Equal(t, tt.code, w.Code)
+			}
+
+			decision := client.Check(context.Background(), "auth:acme", "reports")
+			defer decision.Release(context.Background())
+			assert.True(t, decision.Allowed, "the lease was released")
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"text/template"
+)
+
+const (
+	problemJSONContentType     = "application/problem+json"
+	defaultTemplateContentType = "text/plain; charset=utf-8"
+)
+
+// OnRejectedFunc renders the response of a rate limited request, the status
+// code must be written by the function. The Retry-After header is already set
+// unless the decision has no estimate, e.g. for an exhausted quota.
+type OnRejectedFunc func(c *gin.Context, decision rate_limiter.Decision)
+
+type RateLimitOption func(options *rateLimitOptions)
+
+type rateLimitOptions struct {
+	onRejected OnRejectedFunc
+	admission  AdmissionController
+}
+
+func newRateLimitOptions(opts []RateLimitOption) *rateLimitOptions {
+	options := &rateLimitOptions{onRejected: WriteProblemJSON}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// WithOnRejected replaces the default problem+json rejection response
+func WithOnRejected(onRejected OnRejectedFunc) RateLimitOption {
+	return func(options *rateLimitOptions) {
+		options.onRejected = onRejected
+	}
+}
+
+type problemDetails struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Detail         string `json:"detail"`
+	Instance       string `json:"instance"`
+	RateLimitersID string `json:"rate_limiters_id"`
+	LimiterID      string `json:"limiter_id"`
+	RetryAfter     int    `json:"retry_after"`
+	Policy         string `json:"policy"`
+}
+
+// WriteProblemJSON writes a RFC 9457 problem details body describing the rejection
+func WriteProblemJSON(c *gin.Context, decision rate_limiter.Decision) {
+	c.Header("Content-Type", problemJSONContentType)
+	c.JSON(http.StatusTooManyRequests, problemDetails{
+		Type:           "about:blank",
+		Title:          http.StatusText(http.StatusTooManyRequests),
+		Status:         http.StatusTooManyRequests,
+		Detail:         fmt.Sprintf("Rate limit exceeded, retry in %d seconds", decision.RetryAfterSeconds()),
+		Instance:       c.Request.URL.Path,
+		RateLimitersID: decision.RateLimitersID,
+		LimiterID:      decision.LimiterID,
+		RetryAfter:     decision.RetryAfterSeconds(),
+		Policy:         decision.Policy(),
+	})
+}
+
+// rejectionTemplateData is given to the user templates, the methods of the
+// decision such as RetryAfterSeconds and Policy are available as well
+type rejectionTemplateData struct {
+	rate_limiter.Decision
+	Route string
+	Path  string
+}
+
+type rejectionResponse struct {
+	contentType string
+	template    *template.Template // nil means problem+json
+}
+
+// RejectionRenderer renders the rejections using the templates of the
+// config, the route template takes precedence over the tier one which takes
+// precedence over the default one
+type RejectionRenderer struct {
+	defaultResponse rejectionResponse
+	tiers           map[string]rejectionResponse
+	routes          map[string]rejectionResponse
+}
+
+func newRejectionResponse(name string, cfg config.RejectionResponseConfig) (rejectionResponse, error) {
+	if cfg.Template == "" {
+		return rejectionResponse{}, nil
+	}
+
+	tmpl, err := template.New(name).Parse(cfg.Template)
+	if err != nil {
+		return rejectionResponse{}, fmt.Errorf("invalid rejection template %s: %w", name, err)
+	}
+
+	contentType := cfg.ContentType
+	if contentType == "" {
+		contentType = defaultTemplateContentType
+	}
+
+	return rejectionResponse{contentType: contentType, template: tmpl}, nil
+}
+
+func newRejectionResponses(kind string, cfgs map[string]config.RejectionResponseConfig) (map[string]rejectionResponse, error) {
+	responses := make(map[string]rejectionResponse, len(cfgs))
+	for k, cfg := range cfgs {
+		response, err := newRejectionResponse(fmt.Sprintf("%s %s", kind, k), cfg)
+		if err != nil {
+			return nil, err
+		}
+		responses[k] = response
+	}
+	return responses, nil
+}
+
+func NewRejectionRenderer(cfg *config.Config) (*RejectionRenderer, error) {
+	var (
+		r   RejectionRenderer
+		err error
+	)
+
+	if r.defaultResponse, err = newRejectionResponse("default", cfg.Rejection.Default); err != nil {
+		return nil, err
+	}
+	if r.tiers, err = newRejectionResponses("tier", cfg.Rejection.Tiers); err != nil {
+		return nil, err
+	}
+	if r.routes, err = newRejectionResponses("route", cfg.Rejection.Routes); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (r *RejectionRenderer) response(c *gin.Context, decision rate_limiter.Decision) rejectionResponse {
+	if response, ok := r.routes[c.FullPath()]; ok {
+		return response
+	}
+	if response, ok := r.tiers[decision.RateLimitersID]; ok {
+		return response
+	}
+	return r.defaultResponse
+}
+
+// Render is an OnRejectedFunc
+func (r *RejectionRenderer) Render(c *gin.Context, decision rate_limiter.Decision) {
+	response := r.response(c, decision)
+	if response.template == nil {
+		WriteProblemJSON(c, decision)
+		return
+	}
+
+	var body bytes.Buffer
+	err := response.template.Execute(&body, rejectionTemplateData{
+		Decision: decision,
+		Route:    c.FullPath(),
+		Path:     c.Request.URL.Path,
+	})
+	if err != nil {
+		slog.Error("could not render the rejection template", "template", response.template.Name(), "error", err)
+		WriteProblemJSON(c, decision)
+		return
+	}
+
+	c.Data(http.StatusTooManyRequests, response.contentType, body.Bytes())
+}
+
+// reject aborts the request once the rejection has been rendered,
+// falling back to an empty 429 if the hook wrote nothing
+func reject(c *gin.Context, options *rateLimitOptions, decision rate_limiter.Decision) {
+	if decision.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(decision.RetryAfterSeconds()))
+	}
+	options.onRejected(c, decision)
+
+	if !c.Writer.Written() {
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+	c.Abort()
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type rejectingServicer struct{}
+
+func (rejectingServicer) Check(_ context.Context, key, rateLimitersId string) rate_limiter.Decision {
+	return rate_limiter.Decision{
+		Key:            key + ":" + rateLimitersId,
+		RateLimitersID: rateLimitersId,
+		LimiterID:      "rpm",
+		Capacity:       10,
+		Rate:           1,
+		RetryAfter:     1500 * time.Millisecond,
+	}
+}
+
+func newTestRouter(opts ...RateLimitOption) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RateLimitAnonymousUserMiddleware(rejectingServicer{}, opts...))
+	router.GET("/login", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/data", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return router
+}
+
+func serve(router *gin.Engine, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestRateLimitMiddleware_DefaultRejection(t *testing.T) {
+	w := serve(newTestRouter(), "/data")
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, map[string]any{
+		"type":             "about:blank",
+		"title":            "Too Many Requests",
+		"status":           429.0,
+		"detail":           "Rate limit exceeded, retry in 2 seconds",
+		"instance":         "/data",
+		"rate_limiters_id": "default",
+		"limiter_id":       "rpm",
+		"retry_after":      2.0,
+		"policy":           "10;w=10",
+	}, body)
+}
+
+func TestRateLimitMiddleware_RejectionRenderer(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Rejection.Tiers = map[string]config.RejectionResponseConfig{
+		"default": {Template: "Slow down, retry in {{.RetryAfterSeconds}}s ({{.Policy}})"},
+	}
+	cfg.Rejection.Routes = map[string]config.RejectionResponseConfig{
+		"/login": {ContentType: "application/json", Template: `{"route": "{{.Route}}", "limiter": "{{.LimiterID}}"}`},
+	}
+	renderer, err := NewRejectionRenderer(cfg)
+	require.NoError(t, err)
+
+	router := newTestRouter(WithOnRejected(renderer.Render))
+
+	t.Run("Tier template", func(t *testing.T) {
+		w := serve(router, "/data")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "Slow down, retry in 2s (10;w=10)", w.Body.String())
+	})
+
+	t.Run("Route template takes precedence", func(t *testing.T) {
+		w := serve(router, "/login")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"route": "/login", "limiter": "rpm"}`, w.Body.String())
+	})
+
+	t.Run("Invalid template", func(t *testing.T) {
+		cfg := &config.Config{}
+		cfg.Rejection.Default = config.RejectionResponseConfig{Template: "{{.Unclosed"}
+		_, err := NewRejectionRenderer(cfg)
+		require.Error(t, err)
+	})
+}
+
+func TestRateLimitMiddleware_OnRejectedHook(t *testing.T) {
+	t.Run("Hook renders its own response", func(t *testing.T) {
+		var got rate_limiter.Decision
+		router := newTestRouter(WithOnRejected(func(c *gin.Context, decision rate_limiter.Decision) {
+			got = decision
+			c.String(http.StatusServiceUnavailable, "busy")
+		}))
+
+		w := serve(router, "/data")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "busy", w.Body.String())
+		assert.Equal(t, "anonymous:192.0.2.1:default", got.Key)
+	})
+
+	t.Run("Hook writing nothing falls back to an empty 429", func(t *testing.T) {
+		router := newTestRouter(WithOnRejected(func(c *gin.Context, decision rate_limiter.Decision) {}))
+
+		w := serve(router, "/data")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+}
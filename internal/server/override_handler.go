@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/override_store"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type overrideRequest struct {
+	Capacity int     `json:"capacity"`
+	Rate     float64 `json:"rate"`
+	Scale    float64 `json:"scale"`
+	TTL      int     `json:"ttl"` // seconds before the override expires, 0 means never
+}
+
+// LimitsInvalidator drops what the instances cached from the limits of a
+// rate-limit key, e.g. the rejections of the near cache
+type LimitsInvalidator interface {
+	Invalidate(ctx context.Context, keyPrefix string) error
+}
+
+// overrideHandler manages the per-key limit overrides, the key is the
+// rate-limit key of the group, e.g. auth:acme:premium
+type overrideHandler struct {
+	store       override_store.OverrideStore
+	invalidator LimitsInvalidator // optional
+}
+
+// invalidate makes the new limits of the key apply at once, the cache
+// otherwise catches up when its entries expire
+func (h overrideHandler) invalidate(ctx context.Context, key string) {
+	if h.invalidator == nil {
+		return
+	}
+	if err := h.invalidator.Invalidate(ctx, key); err != nil {
+		slog.Error("could not invalidate the cached limits", "key", key, "error", err)
+	}
+}
+
+func (h overrideHandler) get(ctx *gin.Context) {
+	override, err := h.store.Get(ctx, ctx.Param("key"))
+	if errors.Is(err, override_store.OverrideNotFoundErr) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not get the override", "key", ctx.Param("key"), "error", err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, override)
+}
+
+func (h overrideHandler) set(ctx *gin.Context) {
+	var req overrideRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.TTL < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid override"})
+		return
+	}
+
+	override := override_store.Override{
+		Capacity: req.Capacity,
+		Rate:     req.Rate,
+		Scale:    req.Scale,
+	}
+	if req.TTL > 0 {
+		override.ExpiresAt = time.Now().Add(time.Second * time.Duration(req.TTL))
+	}
+
+	err := h.store.Set(ctx, ctx.Param("key"), override)
+	if errors.Is(err, override_store.InvalidOverrideErr) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.Error("could not set the override", "key", ctx.Param("key"), "error", err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	h.invalidate(ctx, ctx.Param("key"))
+	slog.Info("override set", "key", ctx.Param("key"), "override", override)
+	ctx.JSON(http.StatusOK, override)
+}
+
+func (h overrideHandler) delete(ctx *gin.Context) {
+	if err := h.store.Delete(ctx, ctx.Param("key")); err != nil {
+		slog.Error("could not delete the override", "key", ctx.Param("key"), "error", err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	h.invalidate(ctx, ctx.Param("key"))
+	slog.Info("override deleted", "key", ctx.Param("key"))
+	ctx.Status(http.StatusNoContent)
+}
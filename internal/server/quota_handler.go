@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"log/slog"
+	"net/http"
+)
+
+type QuotaCreditor interface {
+	Credit(ctx context.Context, key string, amount int) (int, error)
+}
+
+type creditRequest struct {
+	Amount int `json:"amount" binding:"required,gt=0"`
+}
+
+// quotaHandler tops up the prepaid quotas, the key is the rate-limit key
+// of the group, e.g. auth:acme:calls
+type quotaHandler struct {
+	creditor QuotaCreditor
+}
+
+func (h quotaHandler) credit(ctx *gin.Context) {
+	var req creditRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid credit"})
+		return
+	}
+
+	balance, err := h.creditor.Credit(ctx, ctx.Param("key"), req.Amount)
+	if errors.Is(err, rate_limiter.NoQuotaErr) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not credit the quota", "key", ctx.Param("key"), "error", err)
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"balance": balance})
+}
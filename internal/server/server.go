@@ -2,21 +2,26 @@ package server
 
 import (
 	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github/martinmaurice/rlim/internal/server/middleware"
+	"github/martinmaurice/rlim/pkg/api_key_store"
+	"github/martinmaurice/rlim/pkg/config"
 	"github/martinmaurice/rlim/pkg/env"
+	"github/martinmaurice/rlim/pkg/override_store"
 	"github/martinmaurice/rlim/pkg/rate_limiter"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
 const (
-	DefaultGracefulShutdownTimeout = 10
+	DefaultGracefulShutdownTimeout = 10 * time.Second
 )
 
 type Config struct {
@@ -27,6 +32,15 @@ type Config struct {
 	handler               *gin.Engine
 	servicer              rate_limiter.Servicer
 	disableRateLimiter    bool
+	accessList            middleware.AccessListChecker
+	apiKeyStore           api_key_store.APIKeyStore
+	tokenVerifier         middleware.TokenVerifier
+	admissionController   middleware.AdmissionController
+	overrideStore         override_store.OverrideStore
+	limitsInvalidator     LimitsInvalidator
+	banLister             BanLister
+	quotaCreditor         QuotaCreditor
+	adminToken            string
 }
 
 type Option func(config *Config)
@@ -37,6 +51,66 @@ func WithDisableRateLimiter(value bool) Option {
 	}
 }
 
+func WithAccessList(accessList middleware.AccessListChecker) Option {
+	return func(config *Config) {
+		config.accessList = accessList
+	}
+}
+
+func WithAPIKeyStore(store api_key_store.APIKeyStore) Option {
+	return func(config *Config) {
+		config.apiKeyStore = store
+	}
+}
+
+// WithTokenVerifier authenticates the requests with JWT bearer tokens
+// instead of api keys
+func WithTokenVerifier(verifier middleware.TokenVerifier) Option {
+	return func(config *Config) {
+		config.tokenVerifier = verifier
+	}
+}
+
+// WithAdmissionController sheds the lowest priority tiers first when the
+// server is overloaded
+func WithAdmissionController(controller middleware.AdmissionController) Option {
+	return func(config *Config) {
+		config.admissionController = controller
+	}
+}
+
+// WithOverrideStore exposes the per-key limit overrides on the /admin
+// endpoints, which are only enabled when an admin token is set
+func WithOverrideStore(store override_store.OverrideStore) Option {
+	return func(config *Config) {
+		config.overrideStore = store
+	}
+}
+
+// WithLimitsInvalidator invalidates the cached limits of a key when its
+// override is set or deleted on the /admin endpoints
+func WithLimitsInvalidator(invalidator LimitsInvalidator) Option {
+	return func(config *Config) {
+		config.limitsInvalidator = invalidator
+	}
+}
+
+// WithBanLister exposes the active bans on the /admin endpoints,
+// which are only enabled when an admin token is set
+func WithBanLister(lister BanLister) Option {
+	return func(config *Config) {
+		config.banLister = lister
+	}
+}
+
+// WithQuotaCreditor exposes the top-up of the prepaid quotas on the /admin
+// endpoints, which are only enabled when an admin token is set
+func WithQuotaCreditor(creditor QuotaCreditor) Option {
+	return func(config *Config) {
+		config.quotaCreditor = creditor
+	}
+}
+
 func NewServer(servicer rate_limiter.Servicer, opts ...Option) *Config {
 	envObj := env.GetEnv()
 	c := &Config{
@@ -47,6 +121,7 @@ func NewServer(servicer rate_limiter.Servicer, opts ...Option) *Config {
 		handler:               gin.Default(),
 		servicer:              servicer,
 		disableRateLimiter:    false,
+		adminToken:            envObj.AdminToken,
 	}
 
 	for _, opt := range opts {
@@ -56,18 +131,66 @@ func NewServer(servicer rate_limiter.Servicer, opts ...Option) *Config {
 	return c
 }
 
-func (s *Config) Run() {
+// setupRoutes registers the endpoints: the admin ones are only behind the
+// admin token, the access list, the authentication and the rate limiting only
+// apply to the public ones
+func (s *Config) setupRoutes() {
 	s.handler.Use(middleware.QueueTimeMiddleware)
-	s.handler.Use(middleware.AuthenticationMiddleware)
+
+	if s.adminToken != "" {
+		admin := s.handler.Group("/admin", middleware.AdminAuthenticationMiddleware(s.adminToken))
+		if s.overrideStore != nil {
+			overrides := overrideHandler{store: s.overrideStore, invalidator: s.limitsInvalidator}
+			admin.GET("/overrides/:key", overrides.get)
+			admin.PUT("/overrides/:key", overrides.set)
+			admin.DELETE("/overrides/:key", overrides.delete)
+		}
+		if s.banLister != nil {
+			admin.GET("/bans", banHandler{lister: s.banLister}.list)
+		}
+		if s.quotaCreditor != nil {
+			admin.POST("/quotas/:key/credit", quotaHandler{creditor: s.quotaCreditor}.credit)
+		}
+	}
+
+	public := s.handler.Group("/")
+	if s.accessList != nil {
+		public.Use(middleware.AccessListMiddleware(s.accessList))
+	}
+	// the tiers of the credentials are checked against the configured ones
+	var tiers []string
+	if s.disableRateLimiter == false {
+		for tier := range config.GetConfig().RateLimiters {
+			tiers = append(tiers, tier)
+		}
+	}
+	if s.tokenVerifier != nil {
+		public.Use(middleware.JWTAuthenticationMiddleware(s.tokenVerifier, tiers))
+	} else if s.apiKeyStore != nil {
+		public.Use(middleware.AuthenticationMiddleware(s.apiKeyStore, tiers))
+	}
 
 	if s.disableRateLimiter == false {
-		s.handler.Use(middleware.RateLimitAnonymousUserMiddleware(s.servicer))
-		s.handler.Use(middleware.RateLimitAuthenticatedUserBasedOnTierMiddleware(s.servicer))
+		rejectionRenderer, err := middleware.NewRejectionRenderer(config.GetConfig())
+		if err != nil {
+			log.Fatalf("Could not create the rejection renderer: %v", err)
+		}
+		opts := []middleware.RateLimitOption{middleware.WithOnRejected(rejectionRenderer.Render)}
+		if s.admissionController != nil {
+			opts = append(opts, middleware.WithAdmissionController(s.admissionController))
+		}
+
+		public.Use(middleware.RateLimitAnonymousUserMiddleware(s.servicer, opts...))
+		public.Use(middleware.RateLimitAuthenticatedUserBasedOnTierMiddleware(s.servicer, opts...))
 	}
 
-	s.handler.GET("/health", healthHandler)
+	public.GET("/health", healthHandler)
 
-	s.handler.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	public.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
+func (s *Config) Run() {
+	s.setupRoutes()
 
 	srv := &http.Server{
 		Addr:           s.port,
@@ -79,14 +202,14 @@ func (s *Config) Run() {
 
 	go func() {
 		slog.Info("starting the server", "port", s.port)
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("Could not listen: %v", err)
 		}
 	}()
 
 	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
-	<-stop // block until interrupt signal
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop // block until interrupt or termination signal
 	slog.Info("shutting down the server...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), DefaultGracefulShutdownTimeout)
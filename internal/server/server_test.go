@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github/martinmaurice/rlim/pkg/access_list"
+	"github/martinmaurice/rlim/pkg/jwt_auth"
+	"github/martinmaurice/rlim/pkg/override_store"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "admin-token"
+
+// stubTokenVerifier only accepts the "valid" token
+type stubTokenVerifier struct{}
+
+func (stubTokenVerifier) Verify(token string) (*jwt_auth.Identity, error) {
+	if token != "valid" {
+		return nil, errors.New("invalid token")
+	}
+	return &jwt_auth.Identity{Subject: "john", Tier: "premium"}, nil
+}
+
+type denyingAccessList struct{}
+
+func (denyingAccessList) Check(netip.Addr, string) access_list.Verdict {
+	return access_list.Denied
+}
+
+func newTestServer(opts ...Option) *Config {
+	gin.SetMode(gin.TestMode)
+	s := &Config{
+		handler:            gin.New(),
+		disableRateLimiter: true,
+		overrideStore:      override_store.NewMemoryStore(),
+		adminToken:         testAdminToken,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.setupRoutes()
+	return s
+}
+
+func request(s *Config, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestServer_AdminRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "JWT authentication", opts: []Option{WithTokenVerifier(stubTokenVerifier{})}},
+		{name: "JWT authentication behind a denying access list", opts: []Option{WithTokenVerifier(stubTokenVerifier{}), WithAccessList(denyingAccessList{})}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(tt.opts...)
+
+			w := request(s, http.MethodPut, "/admin/overrides/auth:acme:premium", testAdminToken, `{"scale": 2}`)
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			w = request(s, http.MethodGet, "/admin/overrides/auth:acme:premium", testAdminToken, "")
+			assert.Equal(t, http.StatusOK, w.Code, "the admin token is not parsed as a JWT")
+			assert.Contains(t, w.Body.String(), `"scale":2`)
+
+			w = request(s, http.MethodGet, "/admin/overrides/auth:acme:premium", "valid", "")
+			assert.Equal(t, http.StatusUnauthorized, w.Code, "a JWT does not grant the admin endpoints")
+		})
+	}
+}
+
+func TestServer_PublicRoutes(t *testing.T) {
+	s := newTestServer(WithTokenVerifier(stubTokenVerifier{}))
+
+	assert.Equal(t, http.StatusOK, request(s, http.MethodGet, "/health", "valid", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(s, http.MethodGet, "/health", testAdminToken, "").Code, "the public routes are authenticated")
+
+	s = newTestServer(WithAccessList(denyingAccessList{}))
+	assert.Equal(t, http.StatusForbidden, request(s, http.MethodGet, "/health", "", "").Code, "the public routes go through the access list")
+}
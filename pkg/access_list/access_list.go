@@ -0,0 +1,238 @@
+package access_list
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	InvalidEntryErr = errors.New("invalid access list entry")
+	FileReadErr     = errors.New("failed to read the access list file")
+)
+
+type Verdict int
+
+const (
+	NoMatch Verdict = iota // neither allowlisted nor denylisted, the request must be rate limited
+	Allowed                // allowlisted, the request is exempted from rate limiting
+	Denied                 // denylisted, the request must be blocked
+)
+
+func (v Verdict) String() string {
+	return [...]string{"no_match", "allowed", "denied"}[v]
+}
+
+// ListOptions describes where the entries of one list come from.
+// Entries given inline and entries read from the files are merged.
+type ListOptions struct {
+	CIDRs       []string // CIDRs or bare IP addresses
+	CIDRsFile   string   // file with one CIDR or IP address per line
+	APIKeys     []string
+	APIKeysFile string // file with one api key per line
+}
+
+type Options struct {
+	Allow ListOptions
+	Deny  ListOptions
+}
+
+type list struct {
+	cidrs   *prefixTrie
+	apiKeys map[string]struct{}
+}
+
+func (l *list) match(ip netip.Addr, apiKey string) bool {
+	if ip.IsValid() && l.cidrs.Contains(ip) {
+		return true
+	}
+
+	if apiKey != "" {
+		_, ok := l.apiKeys[apiKey]
+		return ok
+	}
+
+	return false
+}
+
+// AccessList holds an allowlist and a denylist matched against the client IP
+// and the api key of a request. The lists can be reloaded at runtime, readers
+// always see either the previous or the new version of both lists.
+type AccessList struct {
+	mu      sync.RWMutex
+	options Options
+	allow   *list
+	deny    *list
+}
+
+func New(options Options) (*AccessList, error) {
+	al := &AccessList{options: options}
+	if err := al.Reload(); err != nil {
+		return nil, err
+	}
+
+	return al, nil
+}
+
+// readFileEntries returns the non-empty lines of the given file,
+// anything following a # is considered as a comment
+func readFileEntries(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Join(FileReadErr, err)
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Join(FileReadErr, err)
+	}
+
+	return entries, nil
+}
+
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, errors.Join(InvalidEntryErr, err)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix, nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, errors.Join(InvalidEntryErr, err)
+	}
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func buildList(options ListOptions) (*list, error) {
+	var (
+		cidrs   = options.CIDRs
+		apiKeys = options.APIKeys
+	)
+
+	if options.CIDRsFile != "" {
+		entries, err := readFileEntries(options.CIDRsFile)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs[:len(cidrs):len(cidrs)], entries...)
+	}
+
+	if options.APIKeysFile != "" {
+		entries, err := readFileEntries(options.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys[:len(apiKeys):len(apiKeys)], entries...)
+	}
+
+	l := &list{
+		cidrs:   newPrefixTrie(),
+		apiKeys: make(map[string]struct{}, len(apiKeys)),
+	}
+
+	for _, cidr := range cidrs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", err, cidr)
+		}
+		l.cidrs.Insert(prefix)
+	}
+
+	for _, apiKey := range apiKeys {
+		l.apiKeys[apiKey] = struct{}{}
+	}
+
+	return l, nil
+}
+
+// Reload rebuilds both lists from the options and their files.
+// On error the lists currently in use are kept.
+func (a *AccessList) Reload() error {
+	allow, err := buildList(a.options.Allow)
+	if err != nil {
+		return fmt.Errorf("allowlist: %w", err)
+	}
+
+	deny, err := buildList(a.options.Deny)
+	if err != nil {
+		return fmt.Errorf("denylist: %w", err)
+	}
+
+	a.mu.Lock()
+	a.allow, a.deny = allow, deny
+	a.mu.Unlock()
+
+	slog.Debug(
+		"access lists loaded",
+		"allowCIDRs", allow.cidrs.Len(),
+		"allowAPIKeys", len(allow.apiKeys),
+		"denyCIDRs", deny.cidrs.Len(),
+		"denyAPIKeys", len(deny.apiKeys),
+	)
+
+	return nil
+}
+
+// ReloadEvery reloads the lists periodically until stop is closed
+func (a *AccessList) ReloadEvery(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.Reload(); err != nil {
+					slog.Error("could not reload the access lists", "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Check matches the client ip and api key against the lists, the denylist
+// takes precedence over the allowlist. An invalid ip or an empty api key is
+// simply not matched.
+func (a *AccessList) Check(ip netip.Addr, apiKey string) Verdict {
+	a.mu.RLock()
+	allow, deny := a.allow, a.deny
+	a.mu.RUnlock()
+
+	ip = ip.Unmap()
+	if deny.match(ip, apiKey) {
+		return Denied
+	}
+
+	if allow.match(ip, apiKey) {
+		return Allowed
+	}
+
+	return NoMatch
+}
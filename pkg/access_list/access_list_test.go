@@ -0,0 +1,87 @@
+package access_list
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeListFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestAccessList_Check(t *testing.T) {
+	denyCIDRsFile := writeListFile(t, `
+# abusive networks
+203.0.113.0/24
+198.51.100.7   # single address
+`)
+
+	accessList, err := New(Options{
+		Allow: ListOptions{
+			CIDRs:   []string{"10.0.0.0/8", "203.0.113.5"},
+			APIKeys: []string{"health-checker"},
+		},
+		Deny: ListOptions{
+			CIDRsFile: denyCIDRsFile,
+			APIKeys:   []string{"leaked-key"},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		ip     string
+		apiKey string
+		want   Verdict
+	}{
+		{name: "Allowlisted ip", ip: "10.2.3.4", want: Allowed},
+		{name: "Allowlisted api key", ip: "8.8.8.8", apiKey: "health-checker", want: Allowed},
+		{name: "Denylisted ip read from file", ip: "198.51.100.7", want: Denied},
+		{name: "Denylisted api key", ip: "8.8.8.8", apiKey: "leaked-key", want: Denied},
+		{name: "Denylist takes precedence over allowlist", ip: "203.0.113.5", want: Denied},
+		{name: "Denylisted api key from an allowlisted ip", ip: "10.2.3.4", apiKey: "leaked-key", want: Denied},
+		{name: "Unknown client", ip: "8.8.8.8", apiKey: "another-key", want: NoMatch},
+		{name: "Invalid ip only matches on api key", apiKey: "health-checker", want: Allowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, _ := netip.ParseAddr(tt.ip)
+			assert.Equal(t, tt.want, accessList.Check(ip, tt.apiKey))
+		})
+	}
+}
+
+func TestAccessList_Reload(t *testing.T) {
+	path := writeListFile(t, "blocked-key\n")
+
+	accessList, err := New(Options{Deny: ListOptions{APIKeysFile: path}})
+	require.NoError(t, err)
+	assert.Equal(t, Denied, accessList.Check(netip.Addr{}, "blocked-key"))
+
+	t.Run("Lists are rebuilt from the files", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("another-blocked-key\n"), 0o600))
+		require.NoError(t, accessList.Reload())
+
+		assert.Equal(t, NoMatch, accessList.Check(netip.Addr{}, "blocked-key"))
+		assert.Equal(t, Denied, accessList.Check(netip.Addr{}, "another-blocked-key"))
+	})
+
+	t.Run("Current lists are kept when the reload fails", func(t *testing.T) {
+		require.NoError(t, os.Remove(path))
+		require.ErrorIs(t, accessList.Reload(), FileReadErr)
+
+		assert.Equal(t, Denied, accessList.Check(netip.Addr{}, "another-blocked-key"))
+	})
+}
+
+func TestNew_InvalidEntry(t *testing.T) {
+	_, err := New(Options{Allow: ListOptions{CIDRs: []string{"not-an-ip"}}})
+	require.ErrorIs(t, err, InvalidEntryErr)
+}
@@ -0,0 +1,107 @@
+package access_list
+
+import (
+	"net/netip"
+)
+
+// prefixTrieNode is a node of a binary trie where each level represents one
+// bit of an IP address. A node flagged as terminal means that a prefix ends
+// there, so every address going through it is matched.
+type prefixTrieNode struct {
+	children [2]*prefixTrieNode
+	terminal bool
+}
+
+// prefixTrie stores IPv4 and IPv6 prefixes in two separate binary tries so a
+// lookup costs at most 32 (IPv4) or 128 (IPv6) steps whatever the number of
+// prefixes stored.
+type prefixTrie struct {
+	v4   *prefixTrieNode
+	v6   *prefixTrieNode
+	size int
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{
+		v4: &prefixTrieNode{},
+		v6: &prefixTrieNode{},
+	}
+}
+
+func bitAt(b []byte, i int) int {
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (t *prefixTrie) root(addr netip.Addr) *prefixTrieNode {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// Insert adds the given prefix to the trie
+func (t *prefixTrie) Insert(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	bytes := addr.AsSlice()
+
+	node := t.root(addr)
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal { // a shorter prefix already covers this one
+			return
+		}
+		bit := bitAt(bytes, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixTrieNode{}
+		}
+		node = node.children[bit]
+	}
+
+	if !node.terminal {
+		// the prefixes below are now covered by this one
+		t.size -= node.terminals()
+		node.terminal = true
+		node.children = [2]*prefixTrieNode{}
+		t.size++
+	}
+}
+
+// terminals returns the number of prefixes ending below the node
+func (n *prefixTrieNode) terminals() int {
+	count := 0
+	for _, child := range n.children {
+		if child == nil {
+			continue
+		}
+		if child.terminal {
+			count++
+		}
+		count += child.terminals()
+	}
+	return count
+}
+
+// Contains returns true if one of the stored prefixes contains the given address
+func (t *prefixTrie) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	bytes := addr.AsSlice()
+
+	node := t.root(addr)
+	for i := 0; i < addr.BitLen(); i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[bitAt(bytes, i)]
+		if node == nil {
+			return false
+		}
+	}
+
+	return node.terminal
+}
+
+// Len returns the number of prefixes stored, the ones covered by a shorter
+// prefix are not counted
+func (t *prefixTrie) Len() int {
+	return t.size
+}
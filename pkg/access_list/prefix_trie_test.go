@@ -0,0 +1,87 @@
+package access_list
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixTrie_Contains(t *testing.T) {
+	trie := newPrefixTrie()
+	for _, prefix := range []string{"10.0.0.0/8", "192.168.1.0/24", "172.16.5.4/32", "2001:db8::/32"} {
+		trie.Insert(netip.MustParsePrefix(prefix))
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "10.1.2.3", want: true},
+		{addr: "11.0.0.1", want: false},
+		{addr: "192.168.1.255", want: true},
+		{addr: "192.168.2.1", want: false},
+		{addr: "172.16.5.4", want: true},
+		{addr: "172.16.5.5", want: false},
+		{addr: "::ffff:10.0.0.1", want: true},
+		{addr: "2001:db8:1::1", want: true},
+		{addr: "2001:db9::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			assert.Equal(t, tt.want, trie.Contains(netip.MustParseAddr(tt.addr)))
+		})
+	}
+}
+
+func TestPrefixTrie_Insert(t *testing.T) {
+	t.Run("Shorter prefix covers the longer ones", func(t *testing.T) {
+		trie := newPrefixTrie()
+		trie.Insert(netip.MustParsePrefix("10.1.0.0/16"))
+		trie.Insert(netip.MustParsePrefix("10.2.3.0/24"))
+		trie.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+		trie.Insert(netip.MustParsePrefix("10.3.0.0/16"))
+
+		assert.True(t, trie.Contains(netip.MustParseAddr("10.200.0.1")))
+		assert.Equal(t, 1, trie.Len(), "the longer prefixes inserted before are not counted")
+	})
+
+	t.Run("Len counts the prefixes left", func(t *testing.T) {
+		trie := newPrefixTrie()
+		trie.Insert(netip.MustParsePrefix("10.0.0.0/24"))
+		trie.Insert(netip.MustParsePrefix("192.168.0.0/16"))
+		trie.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+		trie.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+
+		assert.Equal(t, 2, trie.Len())
+	})
+
+	t.Run("Prefix is masked before insertion", func(t *testing.T) {
+		trie := newPrefixTrie()
+		trie.Insert(netip.MustParsePrefix("10.1.2.3/16"))
+
+		assert.True(t, trie.Contains(netip.MustParseAddr("10.1.200.1")))
+	})
+
+	t.Run("Zero length prefix matches every address of the family", func(t *testing.T) {
+		trie := newPrefixTrie()
+		trie.Insert(netip.MustParsePrefix("0.0.0.0/0"))
+
+		assert.True(t, trie.Contains(netip.MustParseAddr("8.8.8.8")))
+		assert.False(t, trie.Contains(netip.MustParseAddr("2001:db8::1")))
+	})
+}
+
+func BenchmarkPrefixTrie_Contains(b *testing.B) {
+	trie := newPrefixTrie()
+	for i := 0; i < 10000; i++ {
+		trie.Insert(netip.MustParsePrefix(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)))
+	}
+	addr := netip.MustParseAddr("10.39.15.7")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Contains(addr)
+	}
+}
@@ -0,0 +1,133 @@
+package admission
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	shedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_load_shedding_shed_total",
+		Help: "Number of requests shed by the admission controller by tier.",
+	}, []string{"tier"})
+
+	inFlightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rlim_load_shedding_in_flight_requests",
+		Help: "Number of requests admitted by the admission controller and not done yet.",
+	})
+)
+
+type Options struct {
+	MaxConcurrency       int            // max in-flight requests, 0 means unbounded
+	MaxRequestsPerSecond int            // max admitted requests per second, 0 means unbounded
+	ShedThreshold        float64        // share of the max load at which the lowest priority starts being shed
+	Priorities           map[string]int // priority by tier, unknown tiers have the priority 0
+}
+
+// Controller admits the requests while the aggregate load of the server,
+// across every key, is below the threshold of their priority. The lowest
+// priority is shed once the load reaches ShedThreshold, the highest one only
+// when the server is at full load, the thresholds of the priorities in between
+// are evenly spread.
+type Controller struct {
+	maxConcurrency       int
+	maxRequestsPerSecond int
+	thresholds           map[int]float64 // indexed by priority
+	priorities           map[string]int
+	now                  func() time.Time
+
+	mu       sync.Mutex
+	inFlight int
+	second   int64 // unix second counted by current
+	current  int   // admitted requests during the current second
+	previous int   // admitted requests during the previous second
+}
+
+func New(options Options) *Controller {
+	levels := []int{0} // the priority of the tiers not listed
+	for _, priority := range options.Priorities {
+		levels = append(levels, priority)
+	}
+	slices.Sort(levels)
+	levels = slices.Compact(levels)
+
+	thresholds := make(map[int]float64, len(levels))
+	for i, priority := range levels {
+		thresholds[priority] = 1
+		if len(levels) > 1 {
+			thresholds[priority] = options.ShedThreshold + (1-options.ShedThreshold)*float64(i)/float64(len(levels)-1)
+		}
+	}
+
+	return &Controller{
+		maxConcurrency:       options.MaxConcurrency,
+		maxRequestsPerSecond: options.MaxRequestsPerSecond,
+		thresholds:           thresholds,
+		priorities:           options.Priorities,
+		now:                  time.Now,
+	}
+}
+
+// rate estimates the admitted requests over the last second by weighting the
+// previous second with the part of it still in the sliding window
+func (c *Controller) rate(now time.Time) float64 {
+	second := now.Unix()
+	switch {
+	case second == c.second+1:
+		c.previous, c.current = c.current, 0
+	case second != c.second:
+		c.previous, c.current = 0, 0
+	}
+	c.second = second
+
+	elapsed := float64(now.Nanosecond()) / float64(time.Second)
+	return float64(c.previous)*(1-elapsed) + float64(c.current)
+}
+
+// load returns the share of the max load the server would reach by admitting one more request
+func (c *Controller) load(now time.Time) float64 {
+	var load float64
+	if c.maxConcurrency > 0 {
+		load = float64(c.inFlight+1) / float64(c.maxConcurrency)
+	}
+	if c.maxRequestsPerSecond > 0 {
+		load = max(load, (c.rate(now)+1)/float64(c.maxRequestsPerSecond))
+	}
+	return load
+}
+
+// Admit decides whether a request of the tier can go through. When admitted,
+// the returned release function must be called once the request is done.
+func (c *Controller) Admit(tier string) (func(), bool) {
+	threshold := c.thresholds[c.priorities[tier]]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if load := c.load(now); load > threshold {
+		slog.Warn("shedding request", "tier", tier, "load", load, "threshold", threshold)
+		shedTotal.WithLabelValues(tier).Inc()
+		return nil, false
+	}
+
+	c.inFlight++
+	c.current++
+	inFlightRequests.Inc()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.inFlight--
+			inFlightRequests.Dec()
+		})
+	}
+
+	return release, true
+}
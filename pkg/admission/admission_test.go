@@ -0,0 +1,95 @@
+package admission
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestController_Admit_Concurrency(t *testing.T) {
+	controller := New(Options{
+		MaxConcurrency: 10,
+		ShedThreshold:  0.6,
+		Priorities:     map[string]int{"premium": 1, "enterprise": 2},
+	})
+
+	// free (priority 0) is admitted up to 60% of the load, premium up to 80%
+	// and enterprise up to the full load
+	var releases []func()
+	admit := func(tier string, expected int) {
+		admitted := 0
+		for {
+			release, ok := controller.Admit(tier)
+			if !ok {
+				break
+			}
+			releases = append(releases, release)
+			admitted++
+		}
+		assert.Equal(t, expected, admitted, "tier %s", tier)
+	}
+
+	admit("free", 6)
+	admit("unknown", 0)
+	admit("premium", 2)
+	admit("enterprise", 2)
+
+	releases[0]()
+	releases[0]()
+	_, ok := controller.Admit("free")
+	assert.False(t, ok, "the load is still above the free threshold")
+	release, ok := controller.Admit("enterprise")
+	require.True(t, ok, "releasing a request frees one slot")
+	release()
+
+	for _, release := range releases[1:] {
+		release()
+	}
+	_, ok = controller.Admit("free")
+	assert.True(t, ok)
+}
+
+func TestController_Admit_RequestsPerSecond(t *testing.T) {
+	controller := New(Options{
+		MaxRequestsPerSecond: 10,
+		ShedThreshold:        0.5,
+		Priorities:           map[string]int{"enterprise": 1},
+	})
+	now := time.Unix(100, 0)
+	controller.now = func() time.Time { return now }
+
+	admitted := func(tier string) int {
+		n := 0
+		for {
+			release, ok := controller.Admit(tier)
+			if !ok {
+				return n
+			}
+			release() // the throughput is bounded even for requests already done
+			n++
+		}
+	}
+
+	assert.Equal(t, 5, admitted("free"))
+	assert.Equal(t, 5, admitted("enterprise"))
+
+	// half of the previous second is still in the sliding window
+	now = now.Add(1500 * time.Millisecond)
+	assert.Equal(t, 0, admitted("free"))
+	assert.Equal(t, 5, admitted("enterprise"))
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 5, admitted("free"))
+}
+
+func TestController_SinglePriority(t *testing.T) {
+	controller := New(Options{MaxConcurrency: 2, ShedThreshold: 0.5})
+
+	_, ok := controller.Admit("free")
+	assert.True(t, ok)
+	_, ok = controller.Admit("free")
+	assert.True(t, ok, "with a single priority requests are only shed at full load")
+	_, ok = controller.Admit("free")
+	assert.False(t, ok)
+}
@@ -0,0 +1,42 @@
+package api_key_store
+
+import (
+	"fmt"
+	"github/martinmaurice/rlim/pkg/env"
+	"github/martinmaurice/rlim/pkg/redis_client"
+	"log/slog"
+)
+
+const (
+	FileStoreType  = "file"
+	RedisStoreType = "redis"
+)
+
+// New creates the api key store selected in the env,
+// wrapped in a CachedStore when a cache ttl is set
+func New() (APIKeyStore, error) {
+	var (
+		envObj = env.GetEnv()
+		store  APIKeyStore
+	)
+
+	slog.Info("creating the api key store", "type", envObj.ApiKeyStore)
+	switch envObj.ApiKeyStore {
+	case FileStoreType:
+		fileStore, err := NewFileStore(envObj.ApiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	case RedisStoreType:
+		store = NewRedisStore(redis_client.New(), envObj.ApiKeysRedisHash, envObj.ApiKeysRedisHashed)
+	default:
+		return nil, fmt.Errorf("unknown api key store type %q, must be one of %s, %s", envObj.ApiKeyStore, FileStoreType, RedisStoreType)
+	}
+
+	if envObj.ApiKeysCacheTtl > 0 {
+		store = NewCachedStore(store, envObj.ApiKeysCacheTtl, envObj.ApiKeysCacheMaxEntries)
+	}
+
+	return store, nil
+}
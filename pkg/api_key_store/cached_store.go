@@ -0,0 +1,124 @@
+package api_key_store
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMaxEntries = 10000
+)
+
+type cachedAPIKey struct {
+	hash      string
+	key       *APIKey // nil when the key is unknown
+	expiresAt time.Time
+}
+
+// CachedStore keeps the lookups of the wrapped store in memory for ttl,
+// unknown keys are cached as well so that random keys do not hit the
+// underlying store on every request. Once maxEntries are cached, the least
+// recently used entry is evicted. Errors other than KeyNotFoundErr are never
+// cached.
+type CachedStore struct {
+	mu         sync.Mutex
+	store      APIKeyStore
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element // of *cachedAPIKey, indexed by the key hash
+	lru        *list.List               // front is the most recently used entry
+	now        func() time.Time
+}
+
+func NewCachedStore(store APIKeyStore, ttl time.Duration, maxEntries int) *CachedStore {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+
+	return &CachedStore{
+		store:      store,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// cached returns the live entry of the hash, the expired entry is removed
+func (c *CachedStore) cached(hash string, now time.Time) (*cachedAPIKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cachedAPIKey)
+	if !now.Before(entry.expiresAt) {
+		c.lru.Remove(element)
+		delete(c.entries, hash)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+// cache stores the lookup and evicts the least recently used entry if the
+// cache is full
+func (c *CachedStore) cache(hash string, key *APIKey, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[hash]; ok {
+		entry := element.Value.(*cachedAPIKey)
+		entry.key, entry.expiresAt = key, now.Add(c.ttl)
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[hash] = c.lru.PushFront(&cachedAPIKey{hash: hash, key: key, expiresAt: now.Add(c.ttl)})
+	if c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedAPIKey).hash)
+	}
+}
+
+func (c *CachedStore) Lookup(ctx context.Context, apiKey string) (*APIKey, error) {
+	hash := HashAPIKey(apiKey)
+	now := c.now()
+
+	if entry, ok := c.cached(hash, now); ok {
+		if entry.key == nil {
+			return nil, KeyNotFoundErr
+		}
+		return entry.key, nil
+	}
+
+	key, err := c.store.Lookup(ctx, apiKey)
+	if err != nil && !errors.Is(err, KeyNotFoundErr) {
+		return nil, err
+	}
+
+	c.cache(hash, key, now)
+
+	return key, err
+}
+
+// Invalidate removes the given api key from the cache
+func (c *CachedStore) Invalidate(apiKey string) {
+	hash := HashAPIKey(apiKey)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[hash]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, hash)
+	}
+}
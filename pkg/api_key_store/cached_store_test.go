@@ -0,0 +1,123 @@
+package api_key_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type countingStore struct {
+	keys    map[string]APIKey
+	err     error
+	lookups int
+}
+
+func (s *countingStore) Lookup(_ context.Context, apiKey string) (*APIKey, error) {
+	s.lookups++
+	if s.err != nil {
+		return nil, s.err
+	}
+	key, ok := s.keys[apiKey]
+	if !ok {
+		return nil, KeyNotFoundErr
+	}
+	return &key, nil
+}
+
+func TestCachedStore_Lookup(t *testing.T) {
+	var (
+		now     = time.Now()
+		backend = &countingStore{keys: map[string]APIKey{"k1": {ID: "acme", Tier: "free"}}}
+		store   = NewCachedStore(backend, time.Minute, 0)
+	)
+	store.now = func() time.Time { return now }
+
+	t.Run("Known keys are cached", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			key, err := store.Lookup(context.Background(), "k1")
+			require.NoError(t, err)
+			assert.Equal(t, "acme", key.ID)
+		}
+		assert.Equal(t, 1, backend.lookups)
+	})
+
+	t.Run("Unknown keys are cached", func(t *testing.T) {
+		backend.lookups = 0
+		for i := 0; i < 3; i++ {
+			_, err := store.Lookup(context.Background(), "unknown")
+			require.ErrorIs(t, err, KeyNotFoundErr)
+		}
+		assert.Equal(t, 1, backend.lookups)
+	})
+
+	t.Run("Entries expire after the ttl", func(t *testing.T) {
+		backend.lookups = 0
+		now = now.Add(time.Minute)
+
+		_, err := store.Lookup(context.Background(), "k1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, backend.lookups)
+	})
+
+	t.Run("Invalidated entries are looked up again", func(t *testing.T) {
+		backend.lookups = 0
+		store.Invalidate("k1")
+
+		_, err := store.Lookup(context.Background(), "k1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, backend.lookups)
+	})
+
+	t.Run("Store errors are not cached", func(t *testing.T) {
+		backend.lookups = 0
+		backend.err = errors.New("store unavailable")
+
+		for i := 0; i < 2; i++ {
+			_, err := store.Lookup(context.Background(), "k2")
+			require.ErrorIs(t, err, backend.err)
+		}
+		assert.Equal(t, 2, backend.lookups)
+		backend.err = nil
+	})
+}
+
+func TestCachedStore_IsBounded(t *testing.T) {
+	store := NewCachedStore(&countingStore{}, time.Minute, 10)
+
+	for i := 0; i < 100; i++ {
+		_, err := store.Lookup(context.Background(), fmt.Sprintf("random-key-%d", i))
+		require.ErrorIs(t, err, KeyNotFoundErr)
+		assert.LessOrEqual(t, len(store.entries), 10)
+	}
+}
+
+func TestCachedStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	backend := &countingStore{keys: map[string]APIKey{
+		"k1": {ID: "acme", Tier: "free"},
+		"k2": {ID: "globex", Tier: "free"},
+		"k3": {ID: "initech", Tier: "free"},
+	}}
+	store := NewCachedStore(backend, time.Minute, 2)
+	lookup := func(apiKey string) {
+		_, err := store.Lookup(context.Background(), apiKey)
+		require.NoError(t, err)
+	}
+
+	lookup("k1")
+	lookup("k2")
+	lookup("k1") // k2 becomes the least recently used entry
+	lookup("k3")
+	assert.Len(t, store.entries, 2, "one entry is evicted at a time")
+
+	backend.lookups = 0
+	lookup("k1")
+	lookup("k3")
+	assert.Equal(t, 0, backend.lookups, "the recently used entries are kept")
+
+	lookup("k2")
+	assert.Equal(t, 1, backend.lookups, "the least recently used entry was evicted")
+}
@@ -0,0 +1,89 @@
+package api_key_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/spf13/viper"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	FileReadErr            = errors.New("failed to read the api keys file")
+	FileValidationErr      = errors.New("api keys file validation error")
+	DuplicatedKeyInFileErr = errors.New("api key defined more than once")
+)
+
+type apiKeyRawEntry struct {
+	Key       string `mapstructure:"key" validate:"required_without=KeySHA256,excluded_with=KeySHA256"`
+	KeySHA256 string `mapstructure:"key_sha256" validate:"omitempty,len=64,hexadecimal"`
+	ID        string `mapstructure:"id" validate:"required"`
+	Tier      string `mapstructure:"tier" validate:"required"`
+}
+
+type apiKeysRawFile struct {
+	Keys []apiKeyRawEntry `mapstructure:"keys" validate:"dive"`
+}
+
+// FileStore serves api keys loaded from a YAML or JSON file such as
+//
+//	keys:
+//	  - key: "my-plain-api-key"
+//	    id: "acme"
+//	    tier: "premium"
+//	  - key_sha256: "<hex encoded sha256 of the api key>"
+//	    id: "globex"
+//	    tier: "enterprise"
+//
+// Plain and hashed entries can be mixed, the plain keys are hashed on load so
+// that only hashes are kept in memory.
+type FileStore struct {
+	keys map[string]APIKey // indexed by the key hash
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType(strings.TrimPrefix(filepath.Ext(path), "."))
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Join(FileReadErr, err)
+	}
+
+	var raw apiKeysRawFile
+	if err := v.Unmarshal(&raw); err != nil {
+		return nil, errors.Join(FileReadErr, err)
+	}
+
+	if err := validator.New().Struct(raw); err != nil {
+		return nil, errors.Join(FileValidationErr, err)
+	}
+
+	store := &FileStore{keys: make(map[string]APIKey, len(raw.Keys))}
+	for _, entry := range raw.Keys {
+		hash := strings.ToLower(entry.KeySHA256)
+		if entry.Key != "" {
+			hash = HashAPIKey(entry.Key)
+		}
+
+		if _, exists := store.keys[hash]; exists {
+			return nil, fmt.Errorf("%w: id %s", DuplicatedKeyInFileErr, entry.ID)
+		}
+		store.keys[hash] = APIKey{ID: entry.ID, Tier: entry.Tier}
+	}
+
+	slog.Info("api keys loaded", "path", path, "count", len(store.keys))
+
+	return store, nil
+}
+
+func (f *FileStore) Lookup(_ context.Context, apiKey string) (*APIKey, error) {
+	key, ok := f.keys[HashAPIKey(apiKey)]
+	if !ok {
+		return nil, KeyNotFoundErr
+	}
+
+	return &key, nil
+}
@@ -0,0 +1,99 @@
+package api_key_store
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeAPIKeysFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestFileStore_Lookup(t *testing.T) {
+	var (
+		yamlContent = `
+keys:
+  - key: "plain-key"
+    id: "acme"
+    tier: "free"
+  - key_sha256: "` + HashAPIKey("hashed-key") + `"
+    id: "globex"
+    tier: "enterprise"
+`
+		jsonContent = `{"keys": [
+  {"key": "plain-key", "id": "acme", "tier": "free"},
+  {"key_sha256": "` + HashAPIKey("hashed-key") + `", "id": "globex", "tier": "enterprise"}
+]}`
+	)
+
+	for name, path := range map[string]string{
+		"yaml": writeAPIKeysFile(t, "api_keys.yaml", yamlContent),
+		"json": writeAPIKeysFile(t, "api_keys.json", jsonContent),
+	} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewFileStore(path)
+			require.NoError(t, err)
+
+			key, err := store.Lookup(context.Background(), "plain-key")
+			require.NoError(t, err)
+			assert.Equal(t, &APIKey{ID: "acme", Tier: "free"}, key)
+
+			key, err = store.Lookup(context.Background(), "hashed-key")
+			require.NoError(t, err)
+			assert.Equal(t, &APIKey{ID: "globex", Tier: "enterprise"}, key)
+
+			_, err = store.Lookup(context.Background(), HashAPIKey("hashed-key"))
+			require.ErrorIs(t, err, KeyNotFoundErr, "the hash itself must not be accepted as a key")
+
+			_, err = store.Lookup(context.Background(), "unknown-key")
+			require.ErrorIs(t, err, KeyNotFoundErr)
+		})
+	}
+}
+
+func TestNewFileStore_Errors(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError error
+	}{
+		{
+			name:          "Missing tier",
+			content:       "keys:\n  - key: k1\n    id: acme\n",
+			expectedError: FileValidationErr,
+		},
+		{
+			name:          "Both key and key_sha256",
+			content:       "keys:\n  - key: k1\n    key_sha256: " + HashAPIKey("k1") + "\n    id: acme\n    tier: free\n",
+			expectedError: FileValidationErr,
+		},
+		{
+			name:          "Invalid hash",
+			content:       "keys:\n  - key_sha256: not-a-hash\n    id: acme\n    tier: free\n",
+			expectedError: FileValidationErr,
+		},
+		{
+			name:          "Same key given plain and hashed",
+			content:       "keys:\n  - key: k1\n    id: acme\n    tier: free\n  - key_sha256: " + HashAPIKey("k1") + "\n    id: globex\n    tier: free\n",
+			expectedError: DuplicatedKeyInFileErr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFileStore(writeAPIKeysFile(t, "api_keys.yaml", tt.content))
+			require.ErrorIs(t, err, tt.expectedError)
+		})
+	}
+
+	t.Run("File does not exist", func(t *testing.T) {
+		_, err := NewFileStore("wrong_file_path.yaml")
+		require.ErrorIs(t, err, FileReadErr)
+	})
+}
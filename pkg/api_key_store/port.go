@@ -0,0 +1,29 @@
+package api_key_store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	KeyNotFoundErr = errors.New("api key not found")
+)
+
+type APIKey struct {
+	ID   string // stable identifier of the key owner, used instead of the key in rate limit keys and logs
+	Tier string
+}
+
+type APIKeyStore interface {
+	// Lookup returns the api key matching the given raw key or KeyNotFoundErr
+	Lookup(ctx context.Context, apiKey string) (*APIKey, error)
+}
+
+// HashAPIKey returns the hex encoded SHA-256 of the api key,
+// this is the format expected by the stores configured with hashed keys
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,76 @@
+package api_key_store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	InvalidRedisEntryErr = errors.New("invalid api key entry in redis")
+)
+
+type redisAPIKeyEntry struct {
+	ID   string `json:"id"`
+	Tier string `json:"tier"`
+}
+
+// RedisStore serves api keys stored in a redis hash where each field is an
+// api key (or its hex encoded SHA-256 when hashed is set) and each value a
+// JSON object like {"id": "acme", "tier": "premium"}
+type RedisStore struct {
+	dB     redis.Cmdable
+	hash   string
+	hashed bool
+}
+
+func NewRedisStore(dB redis.Cmdable, hash string, hashed bool) *RedisStore {
+	return &RedisStore{
+		dB:     dB,
+		hash:   hash,
+		hashed: hashed,
+	}
+}
+
+func (r *RedisStore) field(apiKey string) string {
+	if r.hashed {
+		return HashAPIKey(apiKey)
+	}
+	return apiKey
+}
+
+func (r *RedisStore) Lookup(ctx context.Context, apiKey string) (*APIKey, error) {
+	value, err := r.dB.HGet(ctx, r.hash, r.field(apiKey)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, KeyNotFoundErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry redisAPIKeyEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil, errors.Join(InvalidRedisEntryErr, err)
+	}
+	if entry.ID == "" || entry.Tier == "" {
+		return nil, errors.Join(InvalidRedisEntryErr, errors.New("id and tier are required"))
+	}
+
+	return &APIKey{ID: entry.ID, Tier: entry.Tier}, nil
+}
+
+// Set adds or replaces the given api key
+func (r *RedisStore) Set(ctx context.Context, apiKey string, key APIKey) error {
+	value, err := json.Marshal(redisAPIKeyEntry{ID: key.ID, Tier: key.Tier})
+	if err != nil {
+		return err
+	}
+
+	return r.dB.HSet(ctx, r.hash, r.field(apiKey), value).Err()
+}
+
+// Delete removes the given api key
+func (r *RedisStore) Delete(ctx context.Context, apiKey string) error {
+	return r.dB.HDel(ctx, r.hash, r.field(apiKey)).Err()
+}
@@ -0,0 +1,73 @@
+package api_key_store
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func newTestRedisStore(t *testing.T, hashed bool) (*miniredis.Miniredis, *RedisStore) {
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rc.Close()
+	})
+
+	return mr, NewRedisStore(rc, "rlim:api_keys", hashed)
+}
+
+func TestRedisStore_Lookup(t *testing.T) {
+	t.Run("Plain keys", func(t *testing.T) {
+		mr, store := newTestRedisStore(t, false)
+		mr.HSet("rlim:api_keys", "plain-key", `{"id": "acme", "tier": "premium"}`)
+
+		key, err := store.Lookup(context.Background(), "plain-key")
+		require.NoError(t, err)
+		assert.Equal(t, &APIKey{ID: "acme", Tier: "premium"}, key)
+
+		_, err = store.Lookup(context.Background(), "unknown-key")
+		require.ErrorIs(t, err, KeyNotFoundErr)
+	})
+
+	t.Run("Hashed keys", func(t *testing.T) {
+		mr, store := newTestRedisStore(t, true)
+		mr.HSet("rlim:api_keys", HashAPIKey("secret-key"), `{"id": "globex", "tier": "free"}`)
+
+		key, err := store.Lookup(context.Background(), "secret-key")
+		require.NoError(t, err)
+		assert.Equal(t, &APIKey{ID: "globex", Tier: "free"}, key)
+	})
+
+	t.Run("Invalid entries", func(t *testing.T) {
+		mr, store := newTestRedisStore(t, false)
+		mr.HSet("rlim:api_keys", "not-json", `free`)
+		mr.HSet("rlim:api_keys", "missing-tier", `{"id": "acme"}`)
+
+		_, err := store.Lookup(context.Background(), "not-json")
+		require.ErrorIs(t, err, InvalidRedisEntryErr)
+
+		_, err = store.Lookup(context.Background(), "missing-tier")
+		require.ErrorIs(t, err, InvalidRedisEntryErr)
+	})
+
+	t.Run("Keys set through the store can be looked up and deleted", func(t *testing.T) {
+		mr, store := newTestRedisStore(t, true)
+
+		require.NoError(t, store.Set(context.Background(), "new-key", APIKey{ID: "initech", Tier: "enterprise"}))
+		fields, err := mr.HKeys("rlim:api_keys")
+		require.NoError(t, err)
+		assert.NotContains(t, fields, "new-key", "the raw key must not be stored")
+		assert.Contains(t, fields, HashAPIKey("new-key"))
+
+		key, err := store.Lookup(context.Background(), "new-key")
+		require.NoError(t, err)
+		assert.Equal(t, &APIKey{ID: "initech", Tier: "enterprise"}, key)
+
+		require.NoError(t, store.Delete(context.Background(), "new-key"))
+		_, err = store.Lookup(context.Background(), "new-key")
+		require.ErrorIs(t, err, KeyNotFoundErr)
+	})
+}
@@ -2,13 +2,16 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/viper"
 	"github/martinmaurice/rlim/pkg/enum"
 	"github/martinmaurice/rlim/pkg/env"
 	"log"
 	"log/slog"
+	"slices"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,22 +20,94 @@ const (
 
 	requestPerMinRateLimiterKey  = "rpm"
 	requestPerHourRateLimiterKey = "rph"
+	concurrencyRateLimiterKey    = "concurrency"
+	quotaRateLimiterKey          = "quota"
 	defaultRateLimiterKey        = "default"
+
+	defaultShedThreshold       = 0.8
+	defaultMaxBanDuration      = 24 * time.Hour
+	defaultForgetOffencesAfter = 24 * time.Hour
+
+	defaultWebhookMaxRetries = 3
+	defaultWebhookTimeout    = 5 * time.Second
+
+	defaultLeaseTTL = time.Second
 )
 
+var defaultUsageThresholds = []float64{0.8, 1}
+
 var (
 	RawConfigStructValidationErr             = errors.New("config validation error")
 	FileReadErr                              = errors.New("failed to read the config file")
 	MissingRefillRateInDefaultRateLimiterErr = errors.New("you must specify the refill_rate for the default rate limiter")
 	MissingLeakRateInDefaultRateLimiterErr   = errors.New("you must specify the leak_rate for the default rate limiter")
+	UnknownHierarchyGroupErr                 = errors.New("hierarchy level references an unknown group of rate limiters")
+	UnsupportedHierarchyGroupErr             = errors.New("hierarchy levels only support token_bucket, leaky_bucket and adaptive groups in enforce mode")
 )
 
 type rateLimiterRawConfig struct {
-	Algorithm         string `validate:"required,oneof=token_bucket leaky_bucket"`
-	RequestsPerMinute *int   `mapstructure:"requests_per_minute" validate:"required_without=RequestsPerHour"`
-	RequestsPerHour   *int   `mapstructure:"requests_per_hour" validate:"required_without=RequestsPerMinute"`
-	Capacity          int    `mapstructure:"capacity" validate:"required"`
-	Expiration        int    `mapstructure:"expiration" validate:"required"`
+	Algorithm           string `validate:"required,oneof=token_bucket leaky_bucket concurrency adaptive quota"`
+	RequestsPerMinute   *int   `mapstructure:"requests_per_minute"`
+	RequestsPerHour     *int   `mapstructure:"requests_per_hour"`
+	Capacity            int    `mapstructure:"capacity" validate:"required_unless=Algorithm quota,gte=0"`
+	Expiration          int    `mapstructure:"expiration" validate:"required_unless=Algorithm quota"`
+	Mode                string `mapstructure:"mode" validate:"omitempty,oneof=enforce shadow"`
+	Priority            int    `mapstructure:"priority" validate:"gte=0"`
+	LowBalanceThreshold int    `mapstructure:"low_balance_threshold" validate:"gte=0"`
+	Shaping             *struct {
+		MaxQueue int `mapstructure:"max_queue" validate:"required,gt=0"`
+		MaxWait  int `mapstructure:"max_wait" validate:"required,gt=0"`
+	} `mapstructure:"shaping"`
+	Adaptive  *adaptiveRawConfig  `mapstructure:"adaptive"`
+	Timezone  string              `mapstructure:"timezone" validate:"omitempty,timezone"`
+	Schedules []scheduleRawConfig `mapstructure:"schedules" validate:"dive"`
+	Penalty   *struct {
+		MaxRejections  int `mapstructure:"max_rejections" validate:"required,gt=0"`
+		Window         int `mapstructure:"window" validate:"required,gt=0"`
+		BanDuration    int `mapstructure:"ban_duration" validate:"required,gt=0"`
+		MaxBanDuration int `mapstructure:"max_ban_duration" validate:"omitempty,gtefield=BanDuration"`
+		ForgetAfter    int `mapstructure:"forget_after" validate:"gte=0"`
+	} `mapstructure:"penalty"`
+	Leasing *struct {
+		Share float64 `mapstructure:"share" validate:"required,gt=0,lte=1"`
+		TTL   int     `mapstructure:"ttl" validate:"gte=0"`
+	} `mapstructure:"leasing"`
+}
+
+type scheduleRawConfig struct {
+	Name              string   `mapstructure:"name" validate:"required"`
+	Days              []string `mapstructure:"days" validate:"dive,oneof=mon tue wed thu fri sat sun"`
+	Start             string   `mapstructure:"start" validate:"required,datetime=15:04"`
+	End               string   `mapstructure:"end" validate:"required,datetime=15:04"`
+	RequestsPerMinute *int     `mapstructure:"requests_per_minute" validate:"omitempty,gt=0"`
+	RequestsPerHour   *int     `mapstructure:"requests_per_hour" validate:"omitempty,gt=0"`
+	Capacity          int      `mapstructure:"capacity" validate:"gte=0"`
+}
+
+type adaptiveRawConfig struct {
+	LatencyThreshold   int     `mapstructure:"latency_threshold" validate:"omitempty,gt=0"`
+	ErrorRateThreshold float64 `mapstructure:"error_rate_threshold" validate:"omitempty,gt=0,lte=1"`
+	IncreaseStep       float64 `mapstructure:"increase_step" validate:"omitempty,gt=0,lte=1"`
+	DecreaseFactor     float64 `mapstructure:"decrease_factor" validate:"omitempty,gt=0,lt=1"`
+	MinRatio           float64 `mapstructure:"min_ratio" validate:"omitempty,gt=0,lte=1"`
+	Window             int     `mapstructure:"window" validate:"omitempty,gt=0"`
+}
+
+type accessListRawConfig struct {
+	CIDRs       []string `mapstructure:"cidrs" validate:"dive,cidr|ip"`
+	CIDRsFile   string   `mapstructure:"cidrs_file"`
+	APIKeys     []string `mapstructure:"api_keys" validate:"dive,required"`
+	APIKeysFile string   `mapstructure:"api_keys_file"`
+}
+
+type hierarchyLevelRawConfig struct {
+	Group string `mapstructure:"group" validate:"required"`
+	Key   string `mapstructure:"key" validate:"required"`
+}
+
+type rejectionResponseRawConfig struct {
+	ContentType string `mapstructure:"content_type"`
+	Template    string `mapstructure:"template"`
 }
 
 type rawConfig struct {
@@ -43,6 +118,8 @@ type rawConfig struct {
 			RefillRate *float64 `mapstructure:"refill_rate" validate:"required_if=Algorithm token_bucket"`
 			LeakRate   *float64 `mapstructure:"leak_rate" validate:"required_if=Algorithm leaky_bucket"`
 			Expiration int      `validate:"required"`
+			Mode       string   `mapstructure:"mode" validate:"omitempty,oneof=enforce shadow"`
+			Priority   int      `mapstructure:"priority" validate:"gte=0"`
 		} `mapstructure:"default"`
 		Items map[string]rateLimiterRawConfig `validate:"dive,required"`
 	} `mapstructure:"rate_limits"`
@@ -50,6 +127,47 @@ type rawConfig struct {
 		Enabled *bool
 		Path    string
 	}
+	AccessLists *struct {
+		ReloadInterval int                 `mapstructure:"reload_interval" validate:"gte=0"`
+		Allow          accessListRawConfig `mapstructure:"allow"`
+		Deny           accessListRawConfig `mapstructure:"deny"`
+	} `mapstructure:"access_lists"`
+	Rejection *struct {
+		rejectionResponseRawConfig `mapstructure:",squash"`
+		Tiers                      map[string]rejectionResponseRawConfig `mapstructure:"tiers"`
+		Routes                     map[string]rejectionResponseRawConfig `mapstructure:"routes"`
+	} `mapstructure:"rejection"`
+	Hierarchies  map[string][]hierarchyLevelRawConfig `mapstructure:"hierarchies" validate:"dive,min=1,dive"`
+	LoadShedding *struct {
+		MaxConcurrency       int     `mapstructure:"max_concurrency" validate:"required_without=MaxRequestsPerSecond,gte=0"`
+		MaxRequestsPerSecond int     `mapstructure:"max_requests_per_second" validate:"required_without=MaxConcurrency,gte=0"`
+		ShedThreshold        float64 `mapstructure:"shed_threshold" validate:"omitempty,gt=0,lte=1"`
+	} `mapstructure:"load_shedding"`
+	Notifications *struct {
+		WebhookURL string    `mapstructure:"webhook_url" validate:"required,url"`
+		Thresholds []float64 `mapstructure:"thresholds" validate:"dive,gt=0,lte=1"`
+		MaxRetries *int      `mapstructure:"max_retries" validate:"omitempty,gte=0"`
+		Timeout    int       `mapstructure:"timeout" validate:"gte=0"`
+	} `mapstructure:"notifications"`
+}
+
+// validateRateLimiterRawConfig requires requests_per_minute or requests_per_hour
+// except for the concurrency algorithm which only limits in-flight requests
+// and the quota algorithm which never refills. Only token buckets are leased.
+func validateRateLimiterRawConfig(sl validator.StructLevel) {
+	rlCfg := sl.Current().Interface().(rateLimiterRawConfig)
+	if rlCfg.Leasing != nil && rlCfg.Algorithm != "token_bucket" && rlCfg.Algorithm != "adaptive" {
+		sl.ReportError(rlCfg.Leasing, "Leasing", "leasing", "token_bucket_or_adaptive", rlCfg.Algorithm)
+	}
+
+	if rlCfg.Algorithm == "concurrency" || rlCfg.Algorithm == "quota" {
+		return
+	}
+
+	if rlCfg.RequestsPerMinute == nil && rlCfg.RequestsPerHour == nil {
+		sl.ReportError(rlCfg.RequestsPerMinute, "RequestsPerMinute", "requests_per_minute", "required_without", "RequestsPerHour")
+		sl.ReportError(rlCfg.RequestsPerHour, "RequestsPerHour", "requests_per_hour", "required_without", "RequestsPerMinute")
+	}
 }
 
 func loadRawConfig() (*rawConfig, error) {
@@ -59,6 +177,7 @@ func loadRawConfig() (*rawConfig, error) {
 	}
 
 	validate := validator.New()
+	validate.RegisterStructValidation(validateRateLimiterRawConfig, rateLimiterRawConfig{})
 	if err := validate.Struct(rc); err != nil {
 		return nil, errors.Join(RawConfigStructValidationErr, err)
 	}
@@ -67,12 +186,28 @@ func loadRawConfig() (*rawConfig, error) {
 }
 
 type RateLimiterConfig struct {
-	ID         string
-	Algorithm  enum.Algorithm
-	Capacity   int
-	RefillRate float64 // Token Bucket Specific
-	LeakRate   float64 // Leaky Bucket Specific
-	Expiration int
+	ID                  string
+	Algorithm           enum.Algorithm
+	Capacity            int             // for the quota algorithm this is the balance of a new key
+	RefillRate          float64         // Token Bucket Specific
+	LeakRate            float64         // Leaky Bucket Specific
+	Expiration          int             // bucket expiration in seconds, for the concurrency algorithm this is the lease ttl
+	Mode                enum.Mode       // in shadow mode rejections are only recorded, the request is allowed
+	Adaptive            *AdaptiveConfig // only set for the adaptive algorithm
+	LowBalanceThreshold int             // Quota specific, balance at which the low balance callback fires
+}
+
+// AdaptiveConfig drives the AIMD controller of an adaptive group of rate
+// limiters: while the upstream is healthy the share of the configured limits
+// grows by IncreaseStep every Window, it is multiplied by DecreaseFactor as
+// soon as the latency or the error rate of a Window exceeds its threshold
+type AdaptiveConfig struct {
+	LatencyThreshold   time.Duration // mean handler duration above which the upstream is degraded
+	ErrorRateThreshold float64       // ratio of 5xx responses above which the upstream is degraded
+	IncreaseStep       float64       // share of the configured limits added after a healthy window
+	DecreaseFactor     float64       // the share is multiplied by it after a degraded window
+	MinRatio           float64       // the share never goes below it
+	Window             time.Duration // observations are evaluated once per window
 }
 
 type metricConfig struct {
@@ -80,9 +215,117 @@ type metricConfig struct {
 	Path    string
 }
 
+type AccessListConfig struct {
+	CIDRs       []string
+	CIDRsFile   string
+	APIKeys     []string
+	APIKeysFile string
+}
+
+type accessListsConfig struct {
+	ReloadInterval time.Duration // 0 means the lists are never reloaded periodically
+	Allow          AccessListConfig
+	Deny           AccessListConfig
+}
+
+// RejectionResponseConfig describes the body written when a request is rate
+// limited, an empty Template means the default problem+json body
+type RejectionResponseConfig struct {
+	ContentType string
+	Template    string
+}
+
+type rejectionConfig struct {
+	Default RejectionResponseConfig
+	Tiers   map[string]RejectionResponseConfig // indexed by rate limiters id
+	Routes  map[string]RejectionResponseConfig // indexed by route path, takes precedence over Tiers
+}
+
+// ShapingConfig makes rejected requests wait for the bucket to free capacity
+// instead of failing immediately
+type ShapingConfig struct {
+	MaxQueue int           // max number of requests waiting at the same time for the group
+	MaxWait  time.Duration // max time a request waits before being rejected
+}
+
+// LoadSheddingConfig bounds the aggregate load of the server, once the load
+// reaches ShedThreshold the requests of the lowest priority are shed first
+type LoadSheddingConfig struct {
+	Enabled              bool
+	MaxConcurrency       int     // max in-flight requests across every key, 0 means unbounded
+	MaxRequestsPerSecond int     // max admitted requests per second across every key, 0 means unbounded
+	ShedThreshold        float64 // share of the max load at which the lowest priority starts being shed
+}
+
+// NotificationsConfig sends a webhook the first time a key uses each of the
+// Thresholds of the hourly quota (requests_per_hour) of its group in a window
+type NotificationsConfig struct {
+	Enabled    bool
+	WebhookURL string
+	Thresholds []float64     // shares of the hourly quota, sorted
+	MaxRetries int           // retries of a failed delivery
+	Timeout    time.Duration // timeout of a delivery attempt
+}
+
+// HierarchyLevelConfig is one of the nested buckets a request is charged
+// against, KeyTemplate builds the key of the level from the attributes of the
+// request, e.g. "org:{org}" or "user:{subject}:{route}"
+type HierarchyLevelConfig struct {
+	RateLimitersID string
+	KeyTemplate    string
+}
+
+// ScheduleConfig replaces the rate limiters of a group during a time window,
+// the window wraps past midnight when End is not after Start and then belongs
+// to the day it starts. The rate limiters keep the ids of the group ones so
+// that switching schedules keeps the state of the buckets.
+type ScheduleConfig struct {
+	Name         string
+	Days         []time.Weekday // days the window starts, empty means every day
+	Start        time.Duration  // offset of the start of the window from midnight
+	End          time.Duration  // offset of the end of the window from midnight
+	RateLimiters []RateLimiterConfig
+}
+
+// SchedulesConfig lists the schedules of a group, the first active one applies
+type SchedulesConfig struct {
+	Location  *time.Location
+	Schedules []ScheduleConfig
+}
+
+// PenaltyConfig bans a key rejected MaxRejections times within Window for
+// BanDuration, the duration doubles on each repeat offence up to MaxBanDuration.
+// The offences are forgotten ForgetAfter the end of the last ban.
+type PenaltyConfig struct {
+	MaxRejections  int
+	Window         time.Duration
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+	ForgetAfter    time.Duration
+}
+
+// LeasingConfig lets each instance take Share of the capacity of a token
+// bucket at once and serve it locally for at most TTL, the unused tokens are
+// then given back. A larger share means fewer calls to the storage but a less
+// even split of the limit between instances.
+type LeasingConfig struct {
+	Share float64
+	TTL   time.Duration
+}
+
 type Config struct {
-	RateLimiters map[string][]RateLimiterConfig
-	Metrics      metricConfig
+	RateLimiters  map[string][]RateLimiterConfig
+	Hierarchies   map[string][]HierarchyLevelConfig // indexed by hierarchy id
+	Shaping       map[string]ShapingConfig          // indexed by rate limiters id
+	Penalties     map[string]PenaltyConfig          // indexed by rate limiters id
+	Schedules     map[string]SchedulesConfig        // indexed by rate limiters id
+	Leasing       map[string]LeasingConfig          // indexed by rate limiters id
+	Priorities    map[string]int                    // indexed by rate limiters id, missing groups have the priority 0
+	Metrics       metricConfig
+	AccessLists   accessListsConfig
+	Rejection     rejectionConfig
+	LoadShedding  LoadSheddingConfig
+	Notifications NotificationsConfig
 }
 
 func parseAlgorithmConfig(algorithm string) enum.Algorithm {
@@ -91,36 +334,190 @@ func parseAlgorithmConfig(algorithm string) enum.Algorithm {
 		return enum.TokenBucket
 	case "leaky_bucket":
 		return enum.LeakyBucket
+	case "concurrency":
+		return enum.Concurrency
+	case "adaptive":
+		return enum.Adaptive
+	case "quota":
+		return enum.Quota
 	default:
 		return enum.TokenBucket
 	}
 }
 
+// parseAdaptiveConfig applies the defaults to the settings missing from the
+// adaptive section, which is optional
+func parseAdaptiveConfig(raw *adaptiveRawConfig) *AdaptiveConfig {
+	adaptive := AdaptiveConfig{
+		LatencyThreshold:   time.Second,
+		ErrorRateThreshold: 0.1,
+		IncreaseStep:       0.1,
+		DecreaseFactor:     0.5,
+		MinRatio:           0.1,
+		Window:             10 * time.Second,
+	}
+	if raw == nil {
+		return &adaptive
+	}
+
+	if raw.LatencyThreshold != 0 {
+		adaptive.LatencyThreshold = time.Millisecond * time.Duration(raw.LatencyThreshold)
+	}
+	if raw.ErrorRateThreshold != 0 {
+		adaptive.ErrorRateThreshold = raw.ErrorRateThreshold
+	}
+	if raw.IncreaseStep != 0 {
+		adaptive.IncreaseStep = raw.IncreaseStep
+	}
+	if raw.DecreaseFactor != 0 {
+		adaptive.DecreaseFactor = raw.DecreaseFactor
+	}
+	if raw.MinRatio != 0 {
+		adaptive.MinRatio = raw.MinRatio
+	}
+	if raw.Window != 0 {
+		adaptive.Window = time.Second * time.Duration(raw.Window)
+	}
+
+	return &adaptive
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseTimeOfDay returns the offset from midnight of a validated hh:mm time
+func parseTimeOfDay(value string) time.Duration {
+	t, _ := time.Parse("15:04", value)
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+// parseSchedulesConfig builds the rate limiters of each schedule from the
+// ones of the group, a schedule only replaces the limits it specifies
+func parseSchedulesConfig(rlCfg rateLimiterRawConfig) (SchedulesConfig, error) {
+	location := time.UTC
+	if rlCfg.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(rlCfg.Timezone); err != nil {
+			return SchedulesConfig{}, err
+		}
+	}
+
+	schedules := SchedulesConfig{Location: location}
+	for _, raw := range rlCfg.Schedules {
+		scheduled := rlCfg
+		if raw.RequestsPerMinute != nil {
+			scheduled.RequestsPerMinute = raw.RequestsPerMinute
+		}
+		if raw.RequestsPerHour != nil {
+			scheduled.RequestsPerHour = raw.RequestsPerHour
+		}
+		if raw.Capacity > 0 {
+			scheduled.Capacity = raw.Capacity
+		}
+
+		schedule := ScheduleConfig{
+			Name:         raw.Name,
+			Start:        parseTimeOfDay(raw.Start),
+			End:          parseTimeOfDay(raw.End),
+			RateLimiters: parseRateLimiterConfig(scheduled),
+		}
+		for _, day := range raw.Days {
+			schedule.Days = append(schedule.Days, weekdays[day])
+		}
+
+		schedules.Schedules = append(schedules.Schedules, schedule)
+	}
+
+	return schedules, nil
+}
+
+// parsePenaltyConfig converts the durations given in seconds, by default the
+// ban duration is capped to a day (or to the base duration if longer) and the
+// offences are forgotten a day after the end of the last ban
+func parsePenaltyConfig(maxRejections, window, banDuration, maxBanDuration, forgetAfter int) PenaltyConfig {
+	penalty := PenaltyConfig{
+		MaxRejections:  maxRejections,
+		Window:         time.Second * time.Duration(window),
+		BanDuration:    time.Second * time.Duration(banDuration),
+		MaxBanDuration: time.Second * time.Duration(maxBanDuration),
+		ForgetAfter:    time.Second * time.Duration(forgetAfter),
+	}
+
+	if penalty.MaxBanDuration == 0 {
+		penalty.MaxBanDuration = max(defaultMaxBanDuration, penalty.BanDuration)
+	}
+	if penalty.ForgetAfter == 0 {
+		penalty.ForgetAfter = defaultForgetOffencesAfter
+	}
+
+	return penalty
+}
+
+func parseModeConfig(mode string) enum.Mode {
+	switch mode {
+	case "shadow":
+		return enum.Shadow
+	default:
+		return enum.Enforce
+	}
+}
+
 func parseRateLimiterConfig(rlCfg rateLimiterRawConfig) []RateLimiterConfig {
 	var (
 		rateLimiters []RateLimiterConfig
 		algorithm    = parseAlgorithmConfig(rlCfg.Algorithm)
 		capacity     = rlCfg.Capacity
 		expiration   = rlCfg.Expiration
+		mode         = parseModeConfig(rlCfg.Mode)
+		adaptive     *AdaptiveConfig
 	)
 
+	if algorithm == enum.Adaptive {
+		adaptive = parseAdaptiveConfig(rlCfg.Adaptive)
+	}
+
 	createNewRateLimiter := func(id string, refillOrLeakRate float64) RateLimiterConfig {
 		rateLimitConfig := RateLimiterConfig{
 			ID:         id,
 			Algorithm:  algorithm,
 			Capacity:   capacity,
 			Expiration: expiration,
+			Mode:       mode,
 		}
 
-		if algorithm == enum.TokenBucket {
+		if algorithm == enum.TokenBucket || algorithm == enum.Adaptive {
 			rateLimitConfig.RefillRate = refillOrLeakRate
 		} else if algorithm == enum.LeakyBucket {
 			rateLimitConfig.LeakRate = refillOrLeakRate
 		}
 
+		// the rate limiters of an adaptive group share the same controller settings
+		if algorithm == enum.Adaptive {
+			rateLimitConfig.Adaptive = adaptive
+		}
+
 		return rateLimitConfig
 	}
 
+	// the capacity of a concurrency rate limiter is the max number of in-flight requests
+	if algorithm == enum.Concurrency {
+		return append(rateLimiters, createNewRateLimiter(concurrencyRateLimiterKey, 0))
+	}
+
+	// a quota never refills, its balance only grows when credited
+	if algorithm == enum.Quota {
+		quota := createNewRateLimiter(quotaRateLimiterKey, 0)
+		quota.LowBalanceThreshold = rlCfg.LowBalanceThreshold
+		return append(rateLimiters, quota)
+	}
+
 	if rlCfg.RequestsPerMinute != nil {
 		refillOrLeakRate := float64(*rlCfg.RequestsPerMinute) / minuteInSeconds
 		rateLimiters = append(rateLimiters, createNewRateLimiter(requestPerMinRateLimiterKey, refillOrLeakRate))
@@ -155,6 +552,132 @@ func parseMetricConfig(rc *rawConfig) (*metricConfig, error) {
 	return &metrics, nil
 }
 
+func parseAccessListsConfig(rc *rawConfig) accessListsConfig {
+	var accessLists accessListsConfig
+	if rc.AccessLists == nil {
+		return accessLists
+	}
+
+	parseAccessList := func(raw accessListRawConfig) AccessListConfig {
+		return AccessListConfig{
+			CIDRs:       raw.CIDRs,
+			CIDRsFile:   raw.CIDRsFile,
+			APIKeys:     raw.APIKeys,
+			APIKeysFile: raw.APIKeysFile,
+		}
+	}
+
+	accessLists.ReloadInterval = time.Second * time.Duration(rc.AccessLists.ReloadInterval)
+	accessLists.Allow = parseAccessList(rc.AccessLists.Allow)
+	accessLists.Deny = parseAccessList(rc.AccessLists.Deny)
+
+	return accessLists
+}
+
+func parseLoadSheddingConfig(rc *rawConfig) LoadSheddingConfig {
+	if rc.LoadShedding == nil {
+		return LoadSheddingConfig{}
+	}
+
+	loadShedding := LoadSheddingConfig{
+		Enabled:              true,
+		MaxConcurrency:       rc.LoadShedding.MaxConcurrency,
+		MaxRequestsPerSecond: rc.LoadShedding.MaxRequestsPerSecond,
+		ShedThreshold:        rc.LoadShedding.ShedThreshold,
+	}
+	if loadShedding.ShedThreshold == 0 {
+		loadShedding.ShedThreshold = defaultShedThreshold
+	}
+
+	return loadShedding
+}
+
+func parseNotificationsConfig(rc *rawConfig) NotificationsConfig {
+	if rc.Notifications == nil {
+		return NotificationsConfig{}
+	}
+
+	notifications := NotificationsConfig{
+		Enabled:    true,
+		WebhookURL: rc.Notifications.WebhookURL,
+		Thresholds: slices.Sorted(slices.Values(rc.Notifications.Thresholds)),
+		MaxRetries: defaultWebhookMaxRetries,
+		Timeout:    time.Second * time.Duration(rc.Notifications.Timeout),
+	}
+	if len(notifications.Thresholds) == 0 {
+		notifications.Thresholds = defaultUsageThresholds
+	}
+	if rc.Notifications.MaxRetries != nil {
+		notifications.MaxRetries = *rc.Notifications.MaxRetries
+	}
+	if notifications.Timeout == 0 {
+		notifications.Timeout = defaultWebhookTimeout
+	}
+
+	return notifications
+}
+
+// parseHierarchiesConfig checks that every level references a group whose
+// rate limiters can be charged atomically
+func parseHierarchiesConfig(rc *rawConfig, rateLimiters map[string][]RateLimiterConfig) (map[string][]HierarchyLevelConfig, error) {
+	if rc.Hierarchies == nil {
+		return nil, nil
+	}
+
+	hierarchies := make(map[string][]HierarchyLevelConfig, len(rc.Hierarchies))
+	for id, levels := range rc.Hierarchies {
+		for _, level := range levels {
+			group, ok := rateLimiters[level.Group]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s in hierarchy %s", UnknownHierarchyGroupErr, level.Group, id)
+			}
+			for _, rl := range group {
+				if rl.Algorithm == enum.Concurrency || rl.Algorithm == enum.Quota || rl.Mode == enum.Shadow {
+					return nil, fmt.Errorf("%w: %s in hierarchy %s", UnsupportedHierarchyGroupErr, level.Group, id)
+				}
+			}
+
+			hierarchies[id] = append(hierarchies[id], HierarchyLevelConfig{
+				RateLimitersID: level.Group,
+				KeyTemplate:    level.Key,
+			})
+		}
+	}
+
+	return hierarchies, nil
+}
+
+func parseRejectionConfig(rc *rawConfig) rejectionConfig {
+	var rejection rejectionConfig
+	if rc.Rejection == nil {
+		return rejection
+	}
+
+	parseResponse := func(raw rejectionResponseRawConfig) RejectionResponseConfig {
+		return RejectionResponseConfig{
+			ContentType: raw.ContentType,
+			Template:    raw.Template,
+		}
+	}
+
+	parseResponses := func(raw map[string]rejectionResponseRawConfig) map[string]RejectionResponseConfig {
+		if raw == nil {
+			return nil
+		}
+		responses := make(map[string]RejectionResponseConfig, len(raw))
+		for k, response := range raw {
+			responses[k] = parseResponse(response)
+		}
+		return responses
+	}
+
+	rejection.Default = parseResponse(rc.Rejection.rejectionResponseRawConfig)
+	rejection.Tiers = parseResponses(rc.Rejection.Tiers)
+	rejection.Routes = parseResponses(rc.Rejection.Routes)
+
+	return rejection
+}
+
 func parseDefaultRateLimiterConfig(rc *rawConfig) (*RateLimiterConfig, error) {
 	defaultAlgorithm := parseAlgorithmConfig(rc.RateLimits.Default.Algorithm)
 	defaultRateLimiter := RateLimiterConfig{
@@ -162,6 +685,7 @@ func parseDefaultRateLimiterConfig(rc *rawConfig) (*RateLimiterConfig, error) {
 		Algorithm:  defaultAlgorithm,
 		Capacity:   rc.RateLimits.Default.Capacity,
 		Expiration: rc.RateLimits.Default.Expiration,
+		Mode:       parseModeConfig(rc.RateLimits.Default.Mode),
 	}
 
 	if defaultAlgorithm == enum.TokenBucket {
@@ -190,6 +714,25 @@ func parseRawConfig(rc *rawConfig) (*Config, error) {
 		defaultRateLimiterKey: {*defaultRateLimiter},
 	}
 
+	var (
+		shaping    map[string]ShapingConfig
+		penalties  map[string]PenaltyConfig
+		schedules  map[string]SchedulesConfig
+		leasing    map[string]LeasingConfig
+		priorities map[string]int
+	)
+
+	setPriority := func(k string, priority int) {
+		if priority == 0 {
+			return
+		}
+		if priorities == nil {
+			priorities = make(map[string]int)
+		}
+		priorities[k] = priority
+	}
+	setPriority(defaultRateLimiterKey, rc.RateLimits.Default.Priority)
+
 	if rc.RateLimits.Items != nil {
 		for k, rateLimiterCfg := range rc.RateLimits.Items {
 			var (
@@ -200,6 +743,53 @@ func parseRawConfig(rc *rawConfig) (*Config, error) {
 			if len(rateLimiters) > 0 {
 				rateLimitersMap[k] = rateLimiters
 			}
+			setPriority(k, rateLimiterCfg.Priority)
+
+			if rateLimiterCfg.Shaping != nil {
+				if shaping == nil {
+					shaping = make(map[string]ShapingConfig)
+				}
+				shaping[k] = ShapingConfig{
+					MaxQueue: rateLimiterCfg.Shaping.MaxQueue,
+					MaxWait:  time.Second * time.Duration(rateLimiterCfg.Shaping.MaxWait),
+				}
+			}
+
+			if len(rateLimiterCfg.Schedules) > 0 {
+				if schedules == nil {
+					schedules = make(map[string]SchedulesConfig)
+				}
+				if schedules[k], err = parseSchedulesConfig(rateLimiterCfg); err != nil {
+					return nil, err
+				}
+			}
+
+			if rateLimiterCfg.Penalty != nil {
+				if penalties == nil {
+					penalties = make(map[string]PenaltyConfig)
+				}
+				penalties[k] = parsePenaltyConfig(
+					rateLimiterCfg.Penalty.MaxRejections,
+					rateLimiterCfg.Penalty.Window,
+					rateLimiterCfg.Penalty.BanDuration,
+					rateLimiterCfg.Penalty.MaxBanDuration,
+					rateLimiterCfg.Penalty.ForgetAfter,
+				)
+			}
+
+			if rateLimiterCfg.Leasing != nil {
+				if leasing == nil {
+					leasing = make(map[string]LeasingConfig)
+				}
+				lease := LeasingConfig{
+					Share: rateLimiterCfg.Leasing.Share,
+					TTL:   time.Millisecond * time.Duration(rateLimiterCfg.Leasing.TTL),
+				}
+				if lease.TTL == 0 {
+					lease.TTL = defaultLeaseTTL
+				}
+				leasing[k] = lease
+			}
 		}
 	}
 
@@ -208,9 +798,24 @@ func parseRawConfig(rc *rawConfig) (*Config, error) {
 		return nil, err
 	}
 
+	hierarchies, err := parseHierarchiesConfig(rc, rateLimitersMap)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
-		RateLimiters: rateLimitersMap,
-		Metrics:      *metric,
+		RateLimiters:  rateLimitersMap,
+		Hierarchies:   hierarchies,
+		Shaping:       shaping,
+		Penalties:     penalties,
+		Schedules:     schedules,
+		Leasing:       leasing,
+		Priorities:    priorities,
+		Metrics:       *metric,
+		AccessLists:   parseAccessListsConfig(rc),
+		Rejection:     parseRejectionConfig(rc),
+		LoadShedding:  parseLoadSheddingConfig(rc),
+		Notifications: parseNotificationsConfig(rc),
 	}, nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func setRequiredEnvVars(t *testing.T) {
@@ -67,6 +68,28 @@ rate_limits:
       requests_per_minute: 60
       capacity: 10
       expiration: 400
+      mode: shadow
+      shaping:
+        max_queue: 50
+        max_wait: 5
+      penalty:
+        max_rejections: 5
+        window: 600
+        ban_duration: 3600
+
+    reports:
+      algorithm: concurrency
+      capacity: 5
+      expiration: 30
+
+    search:
+      algorithm: adaptive
+      requests_per_minute: 120
+      capacity: 20
+      expiration: 60
+      adaptive:
+        latency_threshold: 250
+        decrease_factor: 0.7
 
 metrics:
   enabled: true
@@ -132,6 +155,380 @@ rate_limits:
       algorithm: token_bucket
       capacity: 10
       expiration: 20
+`
+		configWithUnknownMode = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+    mode: dry_run
+`
+		configWithInvalidShaping = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    batch:
+      algorithm: leaky_bucket
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 60
+      shaping:
+        max_queue: 10
+`
+		configWithInvalidPenalty = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    login:
+      algorithm: token_bucket
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 60
+      penalty:
+        max_rejections: 5
+        window: 600
+        ban_duration: 3600
+        max_ban_duration: 60
+`
+		configWithSchedules = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    batch:
+      algorithm: token_bucket
+      requests_per_minute: 600
+      requests_per_hour: 36000
+      capacity: 100
+      expiration: 3600
+      timezone: Europe/Paris
+      schedules:
+        - name: business_hours
+          days: [mon, fri]
+          start: "09:00"
+          end: "18:30"
+          requests_per_minute: 60
+          capacity: 10
+`
+		configWithInvalidSchedule = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    batch:
+      algorithm: token_bucket
+      requests_per_minute: 600
+      capacity: 100
+      expiration: 3600
+      timezone: Mars/Olympus
+      schedules:
+        - name: night
+          start: "22:00"
+          end: "25:00"
+`
+		configWithQuota = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    calls:
+      algorithm: quota
+      capacity: 0
+      low_balance_threshold: 100
+`
+		configWithQuotaInHierarchy = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    calls:
+      algorithm: quota
+      capacity: 1000
+
+hierarchies:
+  api:
+    - group: calls
+      key: "org:{org}"
+`
+		configWithNotifications = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+notifications:
+  webhook_url: https://billing.example.com/hooks/rlim
+  thresholds: [1, 0.5]
+  max_retries: 0
+`
+		configWithInvalidNotifications = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+notifications:
+  webhook_url: billing
+  thresholds: [0.8, 1.5]
+`
+		configWithInvalidAdaptive = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    search:
+      algorithm: adaptive
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 60
+      adaptive:
+        decrease_factor: 1.5
+`
+		configWithLeasing = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    search:
+      algorithm: token_bucket
+      requests_per_minute: 6000
+      capacity: 1000
+      expiration: 60
+      leasing:
+        share: 0.1
+
+    feed:
+      algorithm: token_bucket
+      requests_per_minute: 600
+      capacity: 100
+      expiration: 60
+      leasing:
+        share: 0.05
+        ttl: 250
+`
+		configWithLeasingOnLeakyBucket = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    search:
+      algorithm: leaky_bucket
+      requests_per_minute: 6000
+      capacity: 1000
+      expiration: 60
+      leasing:
+        share: 0.1
+`
+		configWithAccessLists = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+access_lists:
+  reload_interval: 30
+  allow:
+    cidrs: ["10.0.0.0/8", "192.168.1.10", "fd00::/8"]
+    api_keys: ["health-checker"]
+  deny:
+    cidrs_file: "./deny_cidrs.txt"
+    api_keys_file: "./deny_api_keys.txt"
+`
+		configWithLoadShedding = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    enterprise:
+      algorithm: token_bucket
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 3600
+      priority: 2
+
+load_shedding:
+  max_concurrency: 200
+`
+		configWithInvalidLoadShedding = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+load_shedding:
+  shed_threshold: 0.5
+`
+		configWithHierarchies = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    org:
+      algorithm: token_bucket
+      requests_per_minute: 600
+      capacity: 100
+      expiration: 60
+    user:
+      algorithm: leaky_bucket
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 60
+    reports:
+      algorithm: concurrency
+      capacity: 5
+      expiration: 30
+
+hierarchies:
+  api:
+    - group: org
+      key: "org:{org}"
+    - group: user
+      key: "user:{subject}"
+`
+		configWithHierarchyUnknownGroup = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    org:
+      algorithm: token_bucket
+      requests_per_minute: 600
+      capacity: 100
+      expiration: 60
+    user:
+      algorithm: leaky_bucket
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 60
+    reports:
+      algorithm: concurrency
+      capacity: 5
+      expiration: 30
+
+hierarchies:
+  api:
+    - group: team
+      key: "team:{team}"
+`
+		configWithHierarchyConcurrencyGroup = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+  items:
+    org:
+      algorithm: token_bucket
+      requests_per_minute: 600
+      capacity: 100
+      expiration: 60
+    user:
+      algorithm: leaky_bucket
+      requests_per_minute: 60
+      capacity: 10
+      expiration: 60
+    reports:
+      algorithm: concurrency
+      capacity: 5
+      expiration: 30
+
+hierarchies:
+  api:
+    - group: reports
+      key: "user:{subject}"
+`
+		configWithRejection = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+rejection:
+  content_type: application/json
+  template: '{"error": "too many requests"}'
+  tiers:
+    free:
+      template: "Upgrade your plan"
+  routes:
+    /login:
+      content_type: text/html
+      template: "<p>Retry in {{.RetryAfterSeconds}}s</p>"
+`
+		configWithInvalidAccessListCIDR = `
+rate_limits:
+  default:
+    algorithm: token_bucket
+    capacity: 10
+    refill_rate: 10
+    expiration: 3600
+
+access_lists:
+  deny:
+    cidrs: ["10.0.0.0/33"]
 `
 	)
 
@@ -184,8 +581,46 @@ rate_limits:
 							Capacity:   10,
 							LeakRate:   1,
 							Expiration: 400,
+							Mode:       enum.Shadow,
 						},
 					},
+					"reports": {
+						{
+							ID:         "concurrency",
+							Algorithm:  enum.Concurrency,
+							Capacity:   5,
+							Expiration: 30,
+						},
+					},
+					"search": {
+						{
+							ID:         "rpm",
+							Algorithm:  enum.Adaptive,
+							Capacity:   20,
+							RefillRate: 2,
+							Expiration: 60,
+							Adaptive: &AdaptiveConfig{
+								LatencyThreshold:   250 * time.Millisecond,
+								ErrorRateThreshold: 0.1,
+								IncreaseStep:       0.1,
+								DecreaseFactor:     0.7,
+								MinRatio:           0.1,
+								Window:             10 * time.Second,
+							},
+						},
+					},
+				},
+				Shaping: map[string]ShapingConfig{
+					"login": {MaxQueue: 50, MaxWait: 5 * time.Second},
+				},
+				Penalties: map[string]PenaltyConfig{
+					"login": {
+						MaxRejections:  5,
+						Window:         10 * time.Minute,
+						BanDuration:    time.Hour,
+						MaxBanDuration: 24 * time.Hour,
+						ForgetAfter:    24 * time.Hour,
+					},
 				},
 				Metrics: metricConfig{
 					Enabled: true,
@@ -253,6 +688,357 @@ rate_limits:
 			wantError:         true,
 			expectedError:     RawConfigStructValidationErr,
 		},
+		{
+			name:              "config using unknown mode",
+			configFileContent: configWithUnknownMode,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with shaping missing max_wait",
+			configFileContent: configWithInvalidShaping,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with penalty max_ban_duration below ban_duration",
+			configFileContent: configWithInvalidPenalty,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with schedules",
+			configFileContent: configWithSchedules,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+					"batch": {
+						{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 100, RefillRate: 10, Expiration: 3600},
+						{ID: "rph", Algorithm: enum.TokenBucket, Capacity: 100, RefillRate: 10, Expiration: 3600},
+					},
+				},
+				Schedules: map[string]SchedulesConfig{
+					"batch": {
+						Location: mustLoadLocation(t, "Europe/Paris"),
+						Schedules: []ScheduleConfig{
+							{
+								Name:  "business_hours",
+								Days:  []time.Weekday{time.Monday, time.Friday},
+								Start: 9 * time.Hour,
+								End:   18*time.Hour + 30*time.Minute,
+								RateLimiters: []RateLimiterConfig{
+									{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 10, RefillRate: 1, Expiration: 3600},
+									{ID: "rph", Algorithm: enum.TokenBucket, Capacity: 10, RefillRate: 10, Expiration: 3600},
+								},
+							},
+						},
+					},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+			},
+		},
+		{
+			name:              "config with invalid timezone and schedule end",
+			configFileContent: configWithInvalidSchedule,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with quota",
+			configFileContent: configWithQuota,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+					"calls": {
+						{ID: "quota", Algorithm: enum.Quota, LowBalanceThreshold: 100},
+					},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+			},
+		},
+		{
+			name:              "config with quota group in hierarchy",
+			configFileContent: configWithQuotaInHierarchy,
+			wantError:         true,
+			expectedError:     UnsupportedHierarchyGroupErr,
+		},
+		{
+			name:              "config with notifications",
+			configFileContent: configWithNotifications,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+				Notifications: NotificationsConfig{
+					Enabled:    true,
+					WebhookURL: "https://billing.example.com/hooks/rlim",
+					Thresholds: []float64{0.5, 1},
+					MaxRetries: 0,
+					Timeout:    5 * time.Second,
+				},
+			},
+		},
+		{
+			name:              "config with invalid webhook url and threshold",
+			configFileContent: configWithInvalidNotifications,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with adaptive decrease_factor out of range",
+			configFileContent: configWithInvalidAdaptive,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with leasing",
+			configFileContent: configWithLeasing,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+					"search": {
+						{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 1000, RefillRate: 100, Expiration: 60},
+					},
+					"feed": {
+						{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 100, RefillRate: 10, Expiration: 60},
+					},
+				},
+				Leasing: map[string]LeasingConfig{
+					"search": {Share: 0.1, TTL: time.Second},
+					"feed":   {Share: 0.05, TTL: 250 * time.Millisecond},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+			},
+		},
+		{
+			name:              "config with leasing on a leaky bucket",
+			configFileContent: configWithLeasingOnLeakyBucket,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with access lists",
+			configFileContent: configWithAccessLists,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+				AccessLists: accessListsConfig{
+					ReloadInterval: 30 * time.Second,
+					Allow: AccessListConfig{
+						CIDRs:   []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"},
+						APIKeys: []string{"health-checker"},
+					},
+					Deny: AccessListConfig{
+						CIDRsFile:   "./deny_cidrs.txt",
+						APIKeysFile: "./deny_api_keys.txt",
+					},
+				},
+			},
+		},
+		{
+			name:              "config with load shedding and priorities",
+			configFileContent: configWithLoadShedding,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+					"enterprise": {
+						{
+							ID:         "rpm",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 1,
+							Expiration: 3600,
+						},
+					},
+				},
+				Priorities: map[string]int{"enterprise": 2},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+				LoadShedding: LoadSheddingConfig{
+					Enabled:        true,
+					MaxConcurrency: 200,
+					ShedThreshold:  0.8,
+				},
+			},
+		},
+		{
+			name:              "config with load shedding without any max",
+			configFileContent: configWithInvalidLoadShedding,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
+		{
+			name:              "config with hierarchies",
+			configFileContent: configWithHierarchies,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+					"org": {
+						{
+							ID:         "rpm",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   100,
+							RefillRate: 10,
+							Expiration: 60,
+						},
+					},
+					"user": {
+						{
+							ID:         "rpm",
+							Algorithm:  enum.LeakyBucket,
+							Capacity:   10,
+							LeakRate:   1,
+							Expiration: 60,
+						},
+					},
+					"reports": {
+						{
+							ID:         "concurrency",
+							Algorithm:  enum.Concurrency,
+							Capacity:   5,
+							Expiration: 30,
+						},
+					},
+				},
+				Hierarchies: map[string][]HierarchyLevelConfig{
+					"api": {
+						{RateLimitersID: "org", KeyTemplate: "org:{org}"},
+						{RateLimitersID: "user", KeyTemplate: "user:{subject}"},
+					},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+			},
+		},
+		{
+			name:              "config with hierarchy referencing an unknown group",
+			configFileContent: configWithHierarchyUnknownGroup,
+			wantError:         true,
+			expectedError:     UnknownHierarchyGroupErr,
+		},
+		{
+			name:              "config with hierarchy referencing a concurrency group",
+			configFileContent: configWithHierarchyConcurrencyGroup,
+			wantError:         true,
+			expectedError:     UnsupportedHierarchyGroupErr,
+		},
+		{
+			name:              "config with rejection responses",
+			configFileContent: configWithRejection,
+			expectedConfig: &Config{
+				RateLimiters: map[string][]RateLimiterConfig{
+					"default": {
+						{
+							ID:         "default",
+							Algorithm:  enum.TokenBucket,
+							Capacity:   10,
+							RefillRate: 10,
+							Expiration: 3600,
+						},
+					},
+				},
+				Metrics: metricConfig{
+					Enabled: true,
+					Path:    "/metrics",
+				},
+				Rejection: rejectionConfig{
+					Default: RejectionResponseConfig{
+						ContentType: "application/json",
+						Template:    `{"error": "too many requests"}`,
+					},
+					Tiers: map[string]RejectionResponseConfig{
+						"free": {Template: "Upgrade your plan"},
+					},
+					Routes: map[string]RejectionResponseConfig{
+						"/login": {ContentType: "text/html", Template: "<p>Retry in {{.RetryAfterSeconds}}s</p>"},
+					},
+				},
+			},
+		},
+		{
+			name:              "config with invalid access list cidr",
+			configFileContent: configWithInvalidAccessListCIDR,
+			wantError:         true,
+			expectedError:     RawConfigStructValidationErr,
+		},
 		{
 			name:              "config missing both requests_per_minute and requests_per_hour",
 			configFileContent: configWithItemsMissingBothRequestsPerMinuteAndRequestsPerHour,
@@ -294,3 +1080,9 @@ rate_limits:
 		})
 	}
 }
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return location
+}
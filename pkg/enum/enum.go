@@ -5,8 +5,22 @@ type Algorithm int
 const (
 	TokenBucket Algorithm = iota
 	LeakyBucket
+	Concurrency
+	Adaptive
+	Quota
 )
 
 func (t Algorithm) String() string {
-	return [...]string{"token_bucket", "leaky_bucket"}[t]
+	return [...]string{"token_bucket", "leaky_bucket", "concurrency", "adaptive", "quota"}[t]
+}
+
+type Mode int
+
+const (
+	Enforce Mode = iota
+	Shadow
+)
+
+func (m Mode) String() string {
+	return [...]string{"enforce", "shadow"}[m]
 }
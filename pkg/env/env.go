@@ -39,12 +39,71 @@ type Specification struct {
 	ServerWriteTimeoutInSecond time.Duration `default:"10s" split_words:"true"`
 	ServerMaxHeaderBytes       int           `default:"1048576" split_words:"true"`
 
-	RedisAddr     string `required:"true" split_words:"true"`
-	RedisPassword string `default:"" split_words:"true"`
-	RedisDb       int    `default:"0" split_words:"true"`
-	RedisPoolSize int    `default:"100" split_words:"true"`
+	RedisAddr               string   `required:"true" split_words:"true"`
+	RedisPassword           string   `default:"" split_words:"true"`
+	RedisDb                 int      `default:"0" split_words:"true"`
+	RedisPoolSize           int      `default:"100" split_words:"true"`
+	RedisClusterAddrs       []string `split_words:"true"`
+	RedisSentinelMasterName string   `split_words:"true"`
+	RedisSentinelAddrs      []string `split_words:"true"`
+	RedisSentinelPassword   string   `split_words:"true"`
 
-	UseMemoryStorage bool `default:"false" split_words:"true"`
+	UseMemoryStorage              bool          `default:"false" split_words:"true"`
+	MemoryStorageShards           int           `default:"64" split_words:"true"`
+	MemoryStorageMaxKeys          int           `default:"1000000" split_words:"true"`
+	MemoryStorageCleanupInterval  time.Duration `default:"1s" split_words:"true"`
+	MemoryStorageSnapshotFile     string        `default:"" split_words:"true"`
+	MemoryStorageSnapshotInterval time.Duration `default:"1m" split_words:"true"`
+
+	UseNearCache                  bool   `default:"false" split_words:"true"`
+	NearCacheMaxKeys              int    `default:"100000" split_words:"true"`
+	NearCacheInvalidationsChannel string `default:"rlim:near_cache:invalidations" split_words:"true"`
+
+	UseBoltStorage    bool   `default:"false" split_words:"true"`
+	BoltStoragePath   string `default:"./rlim.db" split_words:"true"`
+	BoltStorageNoSync bool   `default:"false" split_words:"true"`
+
+	UsePeerStorage    bool          `default:"false" split_words:"true"`
+	PeerSecret        string        `split_words:"true"`
+	PeerSelf          string        `split_words:"true"`
+	Peers             []string      `split_words:"true"`
+	PeerListenAddr    string        `default:"127.0.0.1:7946" split_words:"true"`
+	PeerTimeout       time.Duration `default:"500ms" split_words:"true"`
+	PeerRetryInterval time.Duration `default:"5s" split_words:"true"`
+
+	UseGossipStorage bool          `default:"false" split_words:"true"`
+	GossipSecret     string        `split_words:"true"`
+	GossipNode       string        `split_words:"true"`
+	GossipPeers      []string      `split_words:"true"`
+	GossipListenAddr string        `default:"127.0.0.1:7947" split_words:"true"`
+	GossipInterval   time.Duration `default:"1s" split_words:"true"`
+	GossipTimeout    time.Duration `default:"1s" split_words:"true"`
+	GossipMaxKeys    int           `default:"1000000" split_words:"true"`
+
+	AuthMethod string `default:"api_key" split_words:"true"`
+
+	ApiKeyStore            string        `default:"file" split_words:"true"`
+	ApiKeysFile            string        `default:"./api_keys.yaml" split_words:"true"`
+	ApiKeysRedisHash       string        `default:"rlim:api_keys" split_words:"true"`
+	ApiKeysRedisHashed     bool          `default:"false" split_words:"true"`
+	ApiKeysCacheTtl        time.Duration `default:"1m" split_words:"true"`
+	ApiKeysCacheMaxEntries int           `default:"10000" split_words:"true"`
+
+	JwtAlgorithms    []string      `split_words:"true"`
+	JwtHmacSecret    string        `split_words:"true"`
+	JwtPublicKeyFile string        `split_words:"true"`
+	JwtJwksFile      string        `split_words:"true"`
+	JwtIssuer        string        `split_words:"true"`
+	JwtAudience      string        `split_words:"true"`
+	JwtTierClaim     string        `default:"plan" split_words:"true"`
+	JwtSubjectClaim  string        `default:"sub" split_words:"true"`
+	JwtLeeway        time.Duration `default:"0s" split_words:"true"`
+
+	OverridesRedisPrefix string        `default:"rlim:overrides:" split_words:"true"`
+	OverridesCacheTTL    time.Duration `default:"5s" split_words:"true"`
+	AdminToken           string        `split_words:"true"`
+
+	WebhookSecret string `split_words:"true"`
 
 	ConfigFile string `default:"./config.yaml" split_words:"true"`
 
@@ -56,5 +56,41 @@ func TestGetEnv_SpecificationIsValid(t *testing.T) {
 	assert.Equal(t, envObj.RedisDb, 0, "Redis DB")
 	assert.Equal(t, envObj.RedisPassword, "", "Redis Password")
 	assert.Equal(t, envObj.RedisPoolSize, 100, "Redis Pool Size")
+	assert.Empty(t, envObj.RedisClusterAddrs, "Redis Cluster Addrs")
+	assert.Equal(t, envObj.RedisSentinelMasterName, "", "Redis Sentinel Master Name")
+	assert.Empty(t, envObj.RedisSentinelAddrs, "Redis Sentinel Addrs")
 	assert.Equal(t, envObj.ConfigFile, "./config.yaml", "Config Dir Path")
+	assert.Equal(t, envObj.AuthMethod, "api_key", "Auth Method")
+	assert.Equal(t, envObj.ApiKeyStore, "file", "Api Key Store")
+	assert.Equal(t, envObj.ApiKeysFile, "./api_keys.yaml", "Api Keys File")
+	assert.Equal(t, envObj.ApiKeysRedisHash, "rlim:api_keys", "Api Keys Redis Hash")
+	assert.Equal(t, envObj.ApiKeysRedisHashed, false, "Api Keys Redis Hashed")
+	assert.Equal(t, envObj.ApiKeysCacheTtl, time.Minute, "Api Keys Cache TTL")
+	assert.Equal(t, envObj.ApiKeysCacheMaxEntries, 10000, "Api Keys Cache Max Entries")
+	assert.Equal(t, envObj.JwtTierClaim, "plan", "JWT Tier Claim")
+	assert.Equal(t, envObj.JwtSubjectClaim, "sub", "JWT Subject Claim")
+	assert.Equal(t, envObj.MemoryStorageShards, 64, "Memory Storage Shards")
+	assert.Equal(t, envObj.MemoryStorageMaxKeys, 1000000, "Memory Storage Max Keys")
+	assert.Equal(t, envObj.MemoryStorageCleanupInterval, time.Second, "Memory Storage Cleanup Interval")
+	assert.Equal(t, envObj.MemoryStorageSnapshotFile, "", "Memory Storage Snapshot File")
+	assert.Equal(t, envObj.MemoryStorageSnapshotInterval, time.Minute, "Memory Storage Snapshot Interval")
+	assert.Equal(t, envObj.UseNearCache, false, "Use Near Cache")
+	assert.Equal(t, envObj.NearCacheMaxKeys, 100000, "Near Cache Max Keys")
+	assert.Equal(t, envObj.NearCacheInvalidationsChannel, "rlim:near_cache:invalidations", "Near Cache Invalidations Channel")
+	assert.Equal(t, envObj.UseBoltStorage, false, "Use Bolt Storage")
+	assert.Equal(t, envObj.BoltStoragePath, "./rlim.db", "Bolt Storage Path")
+	assert.Equal(t, envObj.BoltStorageNoSync, false, "Bolt Storage No Sync")
+	assert.Equal(t, envObj.UsePeerStorage, false, "Use Peer Storage")
+	assert.Equal(t, envObj.PeerListenAddr, "127.0.0.1:7946", "Peer Listen Addr")
+	assert.Equal(t, envObj.PeerTimeout, 500*time.Millisecond, "Peer Timeout")
+	assert.Equal(t, envObj.PeerRetryInterval, 5*time.Second, "Peer Retry Interval")
+	assert.Equal(t, envObj.UseGossipStorage, false, "Use Gossip Storage")
+	assert.Equal(t, envObj.GossipListenAddr, "127.0.0.1:7947", "Gossip Listen Addr")
+	assert.Equal(t, envObj.GossipInterval, time.Second, "Gossip Interval")
+	assert.Equal(t, envObj.GossipTimeout, time.Second, "Gossip Timeout")
+	assert.Equal(t, envObj.GossipMaxKeys, 1000000, "Gossip Max Keys")
+	assert.Equal(t, envObj.OverridesRedisPrefix, "rlim:overrides:", "Overrides Redis Prefix")
+	assert.Equal(t, envObj.OverridesCacheTTL, 5*time.Second, "Overrides Cache TTL")
+	assert.Equal(t, envObj.AdminToken, "", "Admin Token")
+	assert.Equal(t, envObj.WebhookSecret, "", "Webhook Secret")
 }
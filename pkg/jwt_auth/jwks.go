@@ -0,0 +1,128 @@
+package jwt_auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+var (
+	JWKSReadErr    = errors.New("failed to read the jwks file")
+	InvalidJWKErr  = errors.New("invalid json web key")
+	EmptyJWKSetErr = errors.New("the jwks file does not contain any usable key")
+)
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type verificationKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 2 {
+			return nil, errors.New("invalid rsa modulus or exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// loadJWKS reads the RSA and EC public keys of a local JWKS file,
+// keys not meant for signature verification are skipped
+func loadJWKS(path string) ([]verificationKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(JWKSReadErr, err)
+	}
+
+	var set jsonWebKeySet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, errors.Join(JWKSReadErr, err)
+	}
+
+	var keys []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%w (kid %q): %v", InvalidJWKErr, jwk.Kid, err)
+		}
+		keys = append(keys, verificationKey{kid: jwk.Kid, key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, EmptyJWKSetErr
+	}
+
+	return keys, nil
+}
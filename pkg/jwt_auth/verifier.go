@@ -0,0 +1,213 @@
+package jwt_auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	DefaultTierClaim    = "plan"
+	DefaultSubjectClaim = "sub"
+)
+
+var (
+	SupportedAlgorithms = []string{"HS256", "RS256", "ES256"}
+
+	UnsupportedAlgorithmErr = errors.New("unsupported jwt algorithm")
+	MissingKeyErr           = errors.New("no key configured for the jwt algorithm")
+	PublicKeyReadErr        = errors.New("failed to read the public key file")
+	InvalidTokenErr         = errors.New("invalid jwt")
+	MissingClaimErr         = errors.New("missing or invalid claim")
+)
+
+type Options struct {
+	Algorithms    []string // accepted signing algorithms, defaults to the ones a key is configured for
+	HMACSecret    []byte   // HS256 secret
+	PublicKeyFile string   // PEM encoded RSA or EC public key
+	JWKSFile      string   // local JWKS file holding RSA and EC public keys
+	Issuer        string   // expected iss claim if not empty
+	Audience      string   // expected aud claim if not empty
+	TierClaim     string   // claim holding the tier, defaults to DefaultTierClaim
+	SubjectClaim  string   // claim identifying the caller, defaults to DefaultSubjectClaim
+	Leeway        time.Duration
+}
+
+// Identity is what the rate limiter needs to know about the token bearer
+type Identity struct {
+	Subject string
+	Tier    string
+}
+
+type Verifier struct {
+	parser       *jwt.Parser
+	hmacSecret   []byte
+	publicKeys   []verificationKey
+	tierClaim    string
+	subjectClaim string
+}
+
+func readPublicKeyFile(path string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Join(PublicKeyReadErr, err)
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(content); err == nil {
+		return key, nil
+	}
+
+	key, err := jwt.ParseECPublicKeyFromPEM(content)
+	if err != nil {
+		return nil, errors.Join(PublicKeyReadErr, errors.New("the file must hold a PEM encoded RSA or EC public key"))
+	}
+
+	return key, nil
+}
+
+func NewVerifier(options Options) (*Verifier, error) {
+	v := &Verifier{
+		hmacSecret:   options.HMACSecret,
+		tierClaim:    options.TierClaim,
+		subjectClaim: options.SubjectClaim,
+	}
+
+	if v.tierClaim == "" {
+		v.tierClaim = DefaultTierClaim
+	}
+	if v.subjectClaim == "" {
+		v.subjectClaim = DefaultSubjectClaim
+	}
+
+	if options.PublicKeyFile != "" {
+		key, err := readPublicKeyFile(options.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKeys = append(v.publicKeys, verificationKey{key: key})
+	}
+
+	if options.JWKSFile != "" {
+		keys, err := loadJWKS(options.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKeys = append(v.publicKeys, keys...)
+	}
+
+	// without explicit algorithms accept every algorithm a key is configured for
+	algorithms := options.Algorithms
+	if len(algorithms) == 0 {
+		for _, algorithm := range SupportedAlgorithms {
+			if len(v.keysFor(algorithm, "")) > 0 {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+		if len(algorithms) == 0 {
+			return nil, MissingKeyErr
+		}
+	}
+
+	for _, algorithm := range algorithms {
+		if !slices.Contains(SupportedAlgorithms, algorithm) {
+			return nil, fmt.Errorf("%w: %s", UnsupportedAlgorithmErr, algorithm)
+		}
+		if len(v.keysFor(algorithm, "")) == 0 {
+			return nil, fmt.Errorf("%w: %s", MissingKeyErr, algorithm)
+		}
+	}
+
+	parserOptions := []jwt.ParserOption{
+		jwt.WithValidMethods(algorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(options.Leeway),
+	}
+	if options.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(options.Issuer))
+	}
+	if options.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(options.Audience))
+	}
+	v.parser = jwt.NewParser(parserOptions...)
+
+	return v, nil
+}
+
+// keysFor returns the keys usable with the given algorithm,
+// restricted to the key matching kid when there is one
+func (v *Verifier) keysFor(algorithm, kid string) []jwt.VerificationKey {
+	if algorithm == "HS256" {
+		if len(v.hmacSecret) == 0 {
+			return nil
+		}
+		return []jwt.VerificationKey{v.hmacSecret}
+	}
+
+	var keys []jwt.VerificationKey
+	for _, k := range v.publicKeys {
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if algorithm != "RS256" {
+				continue
+			}
+		case *ecdsa.PublicKey:
+			if algorithm != "ES256" || key.Curve.Params().Name != "P-256" {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if kid != "" && k.kid == kid {
+			return []jwt.VerificationKey{k.key}
+		}
+		keys = append(keys, k.key)
+	}
+
+	return keys
+}
+
+func (v *Verifier) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	keys := v.keysFor(token.Method.Alg(), kid)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %s", MissingKeyErr, token.Method.Alg())
+	}
+
+	return jwt.VerificationKeySet{Keys: keys}, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) (string, error) {
+	value, ok := claims[name].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("%w: %s", MissingClaimErr, name)
+	}
+	return value, nil
+}
+
+// Verify checks the signature and the registered claims of the token
+// and extracts the identity of its bearer
+func (v *Verifier) Verify(tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenString, claims, v.keyFunc); err != nil {
+		return nil, errors.Join(InvalidTokenErr, err)
+	}
+
+	subject, err := stringClaim(claims, v.subjectClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	tier, err := stringClaim(claims, v.tierClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{Subject: subject, Tier: tier}, nil
+}
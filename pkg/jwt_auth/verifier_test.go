@@ -0,0 +1,233 @@
+package jwt_auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var hmacSecret = []byte("a-very-secret-secret")
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+	return path
+}
+
+func writePublicKeyPEM(t *testing.T, key any) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return writeTestFile(t, "public_key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	content, err := json.Marshal(map[string]any{"keys": keys})
+	require.NoError(t, err)
+	return writeTestFile(t, "jwks.json", content)
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":  "user-42",
+		"plan": "premium",
+		"iss":  "https://gateway.example.com",
+		"aud":  "rlim",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	verifier, err := NewVerifier(Options{
+		HMACSecret:    hmacSecret,
+		PublicKeyFile: writePublicKeyPEM(t, &rsaKey.PublicKey),
+		JWKSFile: writeJWKS(t,
+			map[string]string{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encodeBigInt(ecKey.X), "y": encodeBigInt(ecKey.Y)},
+			map[string]string{"kty": "EC", "kid": "ec-2", "crv": "P-256", "x": encodeBigInt(otherECKey.X), "y": encodeBigInt(otherECKey.Y)},
+		),
+		Issuer:   "https://gateway.example.com",
+		Audience: "rlim",
+	})
+	require.NoError(t, err)
+
+	withClaims := func(update func(claims jwt.MapClaims)) jwt.MapClaims {
+		claims := validClaims()
+		update(claims)
+		return claims
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		expected      *Identity
+		expectedError error
+	}{
+		{
+			name:     "HS256 token",
+			token:    signToken(t, jwt.SigningMethodHS256, hmacSecret, "", validClaims()),
+			expected: &Identity{Subject: "user-42", Tier: "premium"},
+		},
+		{
+			name:     "RS256 token verified with the PEM public key",
+			token:    signToken(t, jwt.SigningMethodRS256, rsaKey, "", validClaims()),
+			expected: &Identity{Subject: "user-42", Tier: "premium"},
+		},
+		{
+			name:     "ES256 token verified with the JWKS key matching the kid",
+			token:    signToken(t, jwt.SigningMethodES256, otherECKey, "ec-2", validClaims()),
+			expected: &Identity{Subject: "user-42", Tier: "premium"},
+		},
+		{
+			name:     "ES256 token without kid verified with any JWKS key",
+			token:    signToken(t, jwt.SigningMethodES256, ecKey, "", validClaims()),
+			expected: &Identity{Subject: "user-42", Tier: "premium"},
+		},
+		{
+			name:          "Token signed with an unknown key",
+			token:         signToken(t, jwt.SigningMethodHS256, []byte("another-secret"), "", validClaims()),
+			expectedError: InvalidTokenErr,
+		},
+		{
+			name:          "Algorithm not accepted",
+			token:         signToken(t, jwt.SigningMethodHS384, hmacSecret, "", validClaims()),
+			expectedError: InvalidTokenErr,
+		},
+		{
+			name:          "Expired token",
+			token:         signToken(t, jwt.SigningMethodHS256, hmacSecret, "", withClaims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })),
+			expectedError: InvalidTokenErr,
+		},
+		{
+			name:          "Token without expiration",
+			token:         signToken(t, jwt.SigningMethodHS256, hmacSecret, "", withClaims(func(c jwt.MapClaims) { delete(c, "exp") })),
+			expectedError: InvalidTokenErr,
+		},
+		{
+			name:          "Wrong issuer",
+			token:         signToken(t, jwt.SigningMethodHS256, hmacSecret, "", withClaims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })),
+			expectedError: InvalidTokenErr,
+		},
+		{
+			name:          "Wrong audience",
+			token:         signToken(t, jwt.SigningMethodHS256, hmacSecret, "", withClaims(func(c jwt.MapClaims) { c["aud"] = "another-service" })),
+			expectedError: InvalidTokenErr,
+		},
+		{
+			name:          "Missing tier claim",
+			token:         signToken(t, jwt.SigningMethodHS256, hmacSecret, "", withClaims(func(c jwt.MapClaims) { delete(c, "plan") })),
+			expectedError: MissingClaimErr,
+		},
+		{
+			name:          "Malformed token",
+			token:         "not.a.token",
+			expectedError: InvalidTokenErr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := verifier.Verify(tt.token)
+			if tt.expectedError != nil {
+				require.ErrorIs(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, identity)
+		})
+	}
+}
+
+func TestVerifier_CustomClaims(t *testing.T) {
+	verifier, err := NewVerifier(Options{
+		HMACSecret:   hmacSecret,
+		TierClaim:    "tier",
+		SubjectClaim: "org_id",
+	})
+	require.NoError(t, err)
+
+	identity, err := verifier.Verify(signToken(t, jwt.SigningMethodHS256, hmacSecret, "", jwt.MapClaims{
+		"org_id": "acme",
+		"tier":   "enterprise",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, &Identity{Subject: "acme", Tier: "enterprise"}, identity)
+}
+
+func TestNewVerifier_Errors(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       Options
+		expectedError error
+	}{
+		{
+			name:          "No key configured",
+			expectedError: MissingKeyErr,
+		},
+		{
+			name:          "Algorithm without key",
+			options:       Options{Algorithms: []string{"RS256"}, HMACSecret: hmacSecret},
+			expectedError: MissingKeyErr,
+		},
+		{
+			name:          "Unsupported algorithm",
+			options:       Options{Algorithms: []string{"none"}, HMACSecret: hmacSecret},
+			expectedError: UnsupportedAlgorithmErr,
+		},
+		{
+			name:          "Public key file does not exist",
+			options:       Options{PublicKeyFile: "wrong_file_path.pem"},
+			expectedError: PublicKeyReadErr,
+		},
+		{
+			name:          "Invalid JWK",
+			options:       Options{JWKSFile: writeJWKS(t, map[string]string{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"})},
+			expectedError: InvalidJWKErr,
+		},
+		{
+			name:          "JWKS without signature keys",
+			options:       Options{JWKSFile: writeJWKS(t, map[string]string{"kty": "RSA", "use": "enc", "n": "AQ", "e": "AQAB"})},
+			expectedError: EmptyJWKSetErr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewVerifier(tt.options)
+			require.ErrorIs(t, err, tt.expectedError)
+		})
+	}
+}
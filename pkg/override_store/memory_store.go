@@ -0,0 +1,64 @@
+package override_store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the overrides in the process, they are lost on restart
+// and not shared between instances
+type MemoryStore struct {
+	mu        sync.RWMutex
+	overrides map[string]Override
+	now       func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		overrides: make(map[string]Override),
+		now:       time.Now,
+	}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (*Override, error) {
+	m.mu.RLock()
+	override, ok := m.overrides[key]
+	m.mu.RUnlock()
+
+	if !ok {
+		return nil, OverrideNotFoundErr
+	}
+
+	if override.expired(m.now()) {
+		m.mu.Lock()
+		// the override may have been replaced in between
+		if current, ok := m.overrides[key]; ok && current.expired(m.now()) {
+			delete(m.overrides, key)
+		}
+		m.mu.Unlock()
+		return nil, OverrideNotFoundErr
+	}
+
+	return &override, nil
+}
+
+func (m *MemoryStore) Set(ctx context.Context, key string, override Override) error {
+	if err := override.Validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.overrides[key] = override
+
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.overrides, key)
+
+	return nil
+}
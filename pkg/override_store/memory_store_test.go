@@ -0,0 +1,37 @@
+package override_store
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	_, err := store.Get(context.Background(), "auth:acme:premium")
+	require.ErrorIs(t, err, OverrideNotFoundErr)
+
+	override := Override{Scale: 2, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, store.Set(context.Background(), "auth:acme:premium", override))
+
+	got, err := store.Get(context.Background(), "auth:acme:premium")
+	require.NoError(t, err)
+	assert.Equal(t, &override, got)
+
+	now = now.Add(time.Hour)
+	_, err = store.Get(context.Background(), "auth:acme:premium")
+	require.ErrorIs(t, err, OverrideNotFoundErr, "the override expired")
+	assert.Empty(t, store.overrides)
+
+	require.NoError(t, store.Set(context.Background(), "auth:acme:premium", Override{Capacity: 100}))
+	require.NoError(t, store.Delete(context.Background(), "auth:acme:premium"))
+	_, err = store.Get(context.Background(), "auth:acme:premium")
+	require.ErrorIs(t, err, OverrideNotFoundErr)
+
+	require.ErrorIs(t, store.Set(context.Background(), "auth:acme:premium", Override{}), InvalidOverrideErr)
+}
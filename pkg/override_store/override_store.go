@@ -0,0 +1,21 @@
+package override_store
+
+import (
+	"github/martinmaurice/rlim/pkg/env"
+	"github/martinmaurice/rlim/pkg/redis_client"
+	"log/slog"
+)
+
+// New creates the override store matching the rate limit storage of the
+// env, overrides are shared between instances only with redis. The bolt, peer
+// and gossip storages run without redis, their overrides are kept in memory.
+func New() OverrideStore {
+	envObj := env.GetEnv()
+	if envObj.UseMemoryStorage || envObj.UseBoltStorage || envObj.UsePeerStorage || envObj.UseGossipStorage {
+		slog.Info("creating the override store", "type", "memory")
+		return NewMemoryStore()
+	}
+
+	slog.Info("creating the override store", "type", "redis")
+	return NewRedisStore(redis_client.New(), envObj.OverridesRedisPrefix)
+}
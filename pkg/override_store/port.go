@@ -0,0 +1,68 @@
+package override_store
+
+import (
+	"context"
+	"errors"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"math"
+	"time"
+)
+
+var (
+	OverrideNotFoundErr = errors.New("override not found")
+	InvalidOverrideErr  = errors.New("invalid override")
+)
+
+// Override replaces or scales the limits of a group of rate limiters for one
+// rate-limit key (e.g. "auth:acme:premium"). The replacements apply to every
+// rate limiter of the group, then Scale multiplies the resulting limits.
+type Override struct {
+	Capacity  int       `json:"capacity,omitempty"`  // replaces the capacity when > 0
+	Rate      float64   `json:"rate,omitempty"`      // replaces the refill (or leak) rate, in tokens per second, when > 0
+	Scale     float64   `json:"scale,omitempty"`     // multiplies the capacity and the rate when > 0
+	ExpiresAt time.Time `json:"expires_at,omitzero"` // zero means the override never expires
+}
+
+type OverrideStore interface {
+	// Get returns the override of the given rate-limit key or OverrideNotFoundErr
+	Get(ctx context.Context, key string) (*Override, error)
+	Set(ctx context.Context, key string, override Override) error
+	Delete(ctx context.Context, key string) error
+}
+
+func (o Override) Validate() error {
+	if o.Capacity < 0 || o.Rate < 0 || o.Scale < 0 {
+		return errors.Join(InvalidOverrideErr, errors.New("capacity, rate and scale cannot be negative"))
+	}
+	if o.Capacity == 0 && o.Rate == 0 && o.Scale == 0 {
+		return errors.Join(InvalidOverrideErr, errors.New("one of capacity, rate or scale is required"))
+	}
+	return nil
+}
+
+func (o Override) expired(now time.Time) bool {
+	return !o.ExpiresAt.IsZero() && !now.Before(o.ExpiresAt)
+}
+
+// Apply returns the config of the rate limiter with the override applied,
+// the capacity never goes below one request
+func (o Override) Apply(cfg config.RateLimiterConfig) config.RateLimiterConfig {
+	rate := &cfg.RefillRate
+	if cfg.Algorithm == enum.LeakyBucket {
+		rate = &cfg.LeakRate
+	}
+
+	if o.Capacity > 0 {
+		cfg.Capacity = o.Capacity
+	}
+	if o.Rate > 0 {
+		*rate = o.Rate
+	}
+	if o.Scale > 0 {
+		cfg.Capacity = max(int(math.Round(float64(cfg.Capacity)*o.Scale)), 1)
+		*rate *= o.Scale
+	}
+
+	return cfg
+}
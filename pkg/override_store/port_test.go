@@ -0,0 +1,64 @@
+package override_store
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"testing"
+)
+
+func TestOverride_Apply(t *testing.T) {
+	tokenBucket := config.RateLimiterConfig{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 10, RefillRate: 1}
+	leakyBucket := config.RateLimiterConfig{ID: "rpm", Algorithm: enum.LeakyBucket, Capacity: 10, LeakRate: 2}
+
+	tests := []struct {
+		name     string
+		override Override
+		cfg      config.RateLimiterConfig
+		expected config.RateLimiterConfig
+	}{
+		{
+			name:     "Replace the capacity",
+			override: Override{Capacity: 50},
+			cfg:      tokenBucket,
+			expected: config.RateLimiterConfig{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 50, RefillRate: 1},
+		},
+		{
+			name:     "Replace the leak rate",
+			override: Override{Rate: 5},
+			cfg:      leakyBucket,
+			expected: config.RateLimiterConfig{ID: "rpm", Algorithm: enum.LeakyBucket, Capacity: 10, LeakRate: 5},
+		},
+		{
+			name:     "Scale the limits",
+			override: Override{Scale: 2.5},
+			cfg:      tokenBucket,
+			expected: config.RateLimiterConfig{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 25, RefillRate: 2.5},
+		},
+		{
+			name:     "Scale applies after the replacements",
+			override: Override{Capacity: 4, Rate: 4, Scale: 0.5},
+			cfg:      leakyBucket,
+			expected: config.RateLimiterConfig{ID: "rpm", Algorithm: enum.LeakyBucket, Capacity: 2, LeakRate: 2},
+		},
+		{
+			name:     "Capacity never goes below one request",
+			override: Override{Scale: 0.01},
+			cfg:      tokenBucket,
+			expected: config.RateLimiterConfig{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 1, RefillRate: 0.01},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.override.Apply(tt.cfg))
+		})
+	}
+}
+
+func TestOverride_Validate(t *testing.T) {
+	require.NoError(t, Override{Scale: 2}.Validate())
+	require.ErrorIs(t, Override{}.Validate(), InvalidOverrideErr)
+	require.ErrorIs(t, Override{Capacity: -1, Scale: 2}.Validate(), InvalidOverrideErr)
+}
@@ -0,0 +1,68 @@
+package override_store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+var (
+	InvalidRedisEntryErr = errors.New("invalid override entry in redis")
+)
+
+// RedisStore keeps each override as a JSON string under prefix+key,
+// expiring overrides are given the matching redis ttl
+type RedisStore struct {
+	dB     redis.Cmdable
+	prefix string
+}
+
+func NewRedisStore(dB redis.Cmdable, prefix string) *RedisStore {
+	return &RedisStore{
+		dB:     dB,
+		prefix: prefix,
+	}
+}
+
+func (r *RedisStore) Get(ctx context.Context, key string) (*Override, error) {
+	value, err := r.dB.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, OverrideNotFoundErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var override Override
+	if err := json.Unmarshal(value, &override); err != nil {
+		return nil, errors.Join(InvalidRedisEntryErr, err)
+	}
+
+	return &override, nil
+}
+
+func (r *RedisStore) Set(ctx context.Context, key string, override Override) error {
+	if err := override.Validate(); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+
+	var ttl time.Duration // 0 keeps the key forever
+	if !override.ExpiresAt.IsZero() {
+		if ttl = time.Until(override.ExpiresAt); ttl <= 0 {
+			return r.Delete(ctx, key)
+		}
+	}
+
+	return r.dB.Set(ctx, r.prefix+key, value, ttl).Err()
+}
+
+func (r *RedisStore) Delete(ctx context.Context, key string) error {
+	return r.dB.Del(ctx, r.prefix+key).Err()
+}
@@ -0,0 +1,65 @@
+package override_store
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newTestRedisStore(t *testing.T) (*miniredis.Miniredis, *RedisStore) {
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		rc.Close()
+	})
+
+	return mr, NewRedisStore(rc, "rlim:overrides:")
+}
+
+func TestRedisStore(t *testing.T) {
+	t.Run("Set, get and delete", func(t *testing.T) {
+		mr, store := newTestRedisStore(t)
+
+		_, err := store.Get(context.Background(), "auth:acme:premium")
+		require.ErrorIs(t, err, OverrideNotFoundErr)
+
+		require.NoError(t, store.Set(context.Background(), "auth:acme:premium", Override{Capacity: 100, Rate: 10}))
+		assert.JSONEq(t, `{"capacity": 100, "rate": 10}`, mustGet(t, mr, "rlim:overrides:auth:acme:premium"))
+
+		got, err := store.Get(context.Background(), "auth:acme:premium")
+		require.NoError(t, err)
+		assert.Equal(t, &Override{Capacity: 100, Rate: 10}, got)
+
+		require.NoError(t, store.Delete(context.Background(), "auth:acme:premium"))
+		assert.False(t, mr.Exists("rlim:overrides:auth:acme:premium"))
+	})
+
+	t.Run("Expiring overrides are given a ttl", func(t *testing.T) {
+		mr, store := newTestRedisStore(t)
+
+		require.NoError(t, store.Set(context.Background(), "auth:acme:premium", Override{Scale: 2, ExpiresAt: time.Now().Add(time.Hour)}))
+		assert.InDelta(t, time.Hour.Seconds(), mr.TTL("rlim:overrides:auth:acme:premium").Seconds(), 1)
+
+		mr.FastForward(time.Hour)
+		_, err := store.Get(context.Background(), "auth:acme:premium")
+		require.ErrorIs(t, err, OverrideNotFoundErr)
+	})
+
+	t.Run("Invalid entry", func(t *testing.T) {
+		mr, store := newTestRedisStore(t)
+		require.NoError(t, mr.Set("rlim:overrides:auth:acme:premium", "not json"))
+
+		_, err := store.Get(context.Background(), "auth:acme:premium")
+		require.ErrorIs(t, err, InvalidRedisEntryErr)
+	})
+}
+
+func mustGet(t *testing.T, mr *miniredis.Miniredis, key string) string {
+	value, err := mr.Get(key)
+	require.NoError(t, err)
+	return value
+}
@@ -0,0 +1,118 @@
+package rate_limiter
+
+import (
+	"context"
+	"github/martinmaurice/rlim/pkg/config"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AIMDController tracks the health of an upstream from the responses of the
+// requests it served and derives the share of the configured limits that can
+// be used: additive increase while the upstream is healthy, multiplicative
+// decrease as soon as its latency or its error rate degrades.
+// The state is local to the process.
+type AIMDController struct {
+	cfg config.AdaptiveConfig
+	now func() time.Time
+
+	mu          sync.Mutex
+	ratio       float64
+	windowStart time.Time
+	samples     int
+	errors      int
+	latencySum  time.Duration
+}
+
+func NewAIMDController(cfg config.AdaptiveConfig) *AIMDController {
+	return &AIMDController{
+		cfg:   cfg,
+		now:   time.Now,
+		ratio: 1,
+	}
+}
+
+// Observe records the outcome of a request, a 5xx status counts as an error.
+// The window is evaluated by the first observation made after it ended.
+func (a *AIMDController) Observe(statusCode int, latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if a.windowStart.IsZero() {
+		a.windowStart = now
+	}
+	if now.Sub(a.windowStart) >= a.cfg.Window {
+		a.evaluate()
+		a.windowStart = now
+	}
+
+	a.samples++
+	a.latencySum += latency
+	if statusCode >= http.StatusInternalServerError {
+		a.errors++
+	}
+}
+
+// evaluate adjusts the ratio from the observations of the ended window, a
+// window without observation says nothing about the upstream and leaves it as is
+func (a *AIMDController) evaluate() {
+	if a.samples == 0 {
+		return
+	}
+
+	var (
+		meanLatency = a.latencySum / time.Duration(a.samples)
+		errorRate   = float64(a.errors) / float64(a.samples)
+	)
+
+	if meanLatency > a.cfg.LatencyThreshold || errorRate > a.cfg.ErrorRateThreshold {
+		a.ratio = max(a.ratio*a.cfg.DecreaseFactor, a.cfg.MinRatio)
+		slog.Warn("upstream degraded, decreasing the adaptive limits",
+			"meanLatency", meanLatency,
+			"errorRate", errorRate,
+			"ratio", a.ratio,
+		)
+	} else {
+		a.ratio = min(a.ratio+a.cfg.IncreaseStep, 1)
+	}
+
+	a.samples, a.errors, a.latencySum = 0, 0, 0
+}
+
+// Ratio returns the share of the configured limits currently allowed, between MinRatio and 1
+func (a *AIMDController) Ratio() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ratio
+}
+
+// AdaptiveLimiter is a token bucket whose capacity and refill rate are
+// scaled by the ratio of its controller
+type AdaptiveLimiter struct {
+	Capacity         int           // max tokens allowed in the bucket when the upstream is healthy
+	RefillRate       float64       // number of tokens refilled per second when the upstream is healthy
+	ExpiresIn        time.Duration // remove the bucket when it expires
+	Controller       *AIMDController
+	rateLimitHandler TokenBucketHandler
+}
+
+func NewAdaptiveLimiter(handler TokenBucketHandler, options *AdaptiveLimiter) *AdaptiveLimiter {
+	options.rateLimitHandler = handler
+	return options
+}
+
+// limits returns the capacity and the refill rate currently allowed,
+// the capacity never goes below one request
+func (al *AdaptiveLimiter) limits() (int, float64) {
+	ratio := al.Controller.Ratio()
+	return max(int(math.Round(float64(al.Capacity)*ratio)), 1), al.RefillRate * ratio
+}
+
+func (al *AdaptiveLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	capacity, refillRate := al.limits()
+	return al.rateLimitHandler.CheckAndUpdateTokenBucket(ctx, key, capacity, refillRate, al.ExpiresIn)
+}
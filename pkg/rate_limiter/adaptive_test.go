@@ -0,0 +1,123 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var testAdaptiveConfig = config.AdaptiveConfig{
+	LatencyThreshold:   100 * time.Millisecond,
+	ErrorRateThreshold: 0.2,
+	IncreaseStep:       0.1,
+	DecreaseFactor:     0.5,
+	MinRatio:           0.2,
+	Window:             time.Second,
+}
+
+// newTestAIMDController returns a controller whose clock only moves with the returned function
+func newTestAIMDController() (*AIMDController, func(d time.Duration)) {
+	controller := NewAIMDController(testAdaptiveConfig)
+	now := time.Unix(0, 0)
+	controller.now = func() time.Time { return now }
+	return controller, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestAIMDController(t *testing.T) {
+	t.Run("Healthy upstream keeps the full limits", func(t *testing.T) {
+		controller, advance := newTestAIMDController()
+		controller.Observe(http.StatusOK, 10*time.Millisecond)
+		advance(time.Second)
+		controller.Observe(http.StatusOK, 10*time.Millisecond)
+		assert.Equal(t, 1.0, controller.Ratio())
+	})
+
+	t.Run("Slow upstream decreases multiplicatively down to the min ratio", func(t *testing.T) {
+		controller, advance := newTestAIMDController()
+		expected := []float64{0.5, 0.25, 0.2, 0.2}
+		for _, ratio := range expected {
+			controller.Observe(http.StatusOK, 500*time.Millisecond)
+			advance(time.Second)
+			controller.Observe(http.StatusOK, 500*time.Millisecond)
+			assert.Equal(t, ratio, controller.Ratio())
+		}
+	})
+
+	t.Run("Failing upstream decreases the limits", func(t *testing.T) {
+		controller, advance := newTestAIMDController()
+		controller.Observe(http.StatusOK, time.Millisecond)
+		controller.Observe(http.StatusBadGateway, time.Millisecond)
+		advance(time.Second)
+		controller.Observe(http.StatusOK, time.Millisecond)
+		assert.Equal(t, 0.5, controller.Ratio())
+	})
+
+	t.Run("Client errors do not count as upstream errors", func(t *testing.T) {
+		controller, advance := newTestAIMDController()
+		controller.Observe(http.StatusNotFound, time.Millisecond)
+		advance(time.Second)
+		controller.Observe(http.StatusOK, time.Millisecond)
+		assert.Equal(t, 1.0, controller.Ratio())
+	})
+
+	t.Run("Recovered upstream increases additively", func(t *testing.T) {
+		controller, advance := newTestAIMDController()
+		controller.Observe(http.StatusServiceUnavailable, time.Millisecond)
+		advance(time.Second)
+		for _, ratio := range []float64{0.5, 0.6, 0.7} {
+			controller.Observe(http.StatusOK, time.Millisecond)
+			assert.InDelta(t, ratio, controller.Ratio(), 1e-9)
+			advance(time.Second)
+		}
+	})
+}
+
+func TestClient_Check_Adaptive(t *testing.T) {
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		controllers: make(map[string]*AIMDController),
+	}
+
+	adaptiveCfg := testAdaptiveConfig
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.Adaptive,
+		Capacity:   4,
+		RefillRate: 2,
+		Expiration: 60,
+		Adaptive:   &adaptiveCfg,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"search": {{id: rpm.ID, rl: c.newRateLimiter("search", rpm), cfg: rpm}},
+	}
+
+	controller := c.controllers["search"]
+	now := time.Unix(0, 0)
+	controller.now = func() time.Time { return now }
+
+	// a degraded window halves the limits of the group
+	decision := c.Check(context.Background(), "k1", "search")
+	assert.True(t, decision.Allowed)
+	decision.Observe(http.StatusInternalServerError, time.Millisecond)
+	now = now.Add(time.Second)
+	decision.Observe(http.StatusOK, time.Millisecond)
+	assert.Equal(t, 0.5, controller.Ratio())
+
+	// the bucket of another key starts with the reduced capacity
+	for i := 0; i < 2; i++ {
+		assert.True(t, c.Check(context.Background(), "k2", "search").Allowed)
+	}
+	rejected := c.Check(context.Background(), "k2", "search")
+	assert.False(t, rejected.Allowed)
+	assert.Equal(t, 2, rejected.Capacity)
+	assert.Equal(t, 1.0, rejected.Rate)
+	assert.Equal(t, time.Second, rejected.RetryAfter)
+
+	// rejected requests never reached the upstream
+	rejected.Observe(http.StatusInternalServerError, time.Second)
+	assert.Equal(t, 0.5, controller.Ratio())
+}
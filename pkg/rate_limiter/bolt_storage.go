@@ -0,0 +1,366 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github/martinmaurice/rlim/pkg/config"
+	"go.etcd.io/bbolt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBoltStorageCleanupInterval = time.Second
+	// boltCleanupBatchSize bounds the expired keys removed by a transaction
+	// so that the cleanup never holds the writer lock for long
+	boltCleanupBatchSize = 1000
+)
+
+var (
+	boltEntriesBucket     = []byte("entries")
+	boltExpirationsBucket = []byte("expirations") // <expiresAt (8 bytes)><key> -> nil
+)
+
+// BoltStorage keeps the keys in a bbolt file, each operation running in its
+// own transaction, so that the limits of a single node survive restarts and
+// crashes. The writes are serialized by bbolt, the expired keys are removed
+// in the background until Close is called.
+type BoltStorage struct {
+	db          *bbolt.DB
+	requestCost float64
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	closeOnce   sync.Once
+}
+
+type BoltStorageOptions struct {
+	Path            string        // path of the database file, created if missing
+	CleanupInterval time.Duration // interval between two removals of the expired keys (default: 1s)
+	// NoSync skips the fsync of each transaction: faster, but the last
+	// writes can be lost on a crash of the host
+	NoSync bool
+}
+
+func NewBoltStorage(options BoltStorageOptions) (*BoltStorage, error) {
+	db, err := bbolt.Open(options.Path, 0o600, &bbolt.Options{Timeout: time.Second, NoSync: options.NoSync})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltEntriesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltExpirationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	cleanupInterval := defaultBoltStorageCleanupInterval
+	if options.CleanupInterval > 0 {
+		cleanupInterval = options.CleanupInterval
+	}
+
+	b := &BoltStorage{
+		db:          db,
+		requestCost: 1.0,
+		stop:        make(chan struct{}),
+	}
+	b.wg.Go(func() { b.removeExpiredKeys(cleanupInterval) })
+
+	return b, nil
+}
+
+// boltEntries is the entryStore of a transaction, the first error is kept
+// and returned by the transaction
+type boltEntries struct {
+	entries     *bbolt.Bucket
+	expirations *bbolt.Bucket
+	err         error
+}
+
+func newBoltEntries(tx *bbolt.Tx) *boltEntries {
+	return &boltEntries{
+		entries:     tx.Bucket(boltEntriesBucket),
+		expirations: tx.Bucket(boltExpirationsBucket),
+	}
+}
+
+func boltExpirationKey(expiresAt int64, key string) []byte {
+	expirationKey := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(expirationKey, uint64(expiresAt))
+	return append(expirationKey, key...)
+}
+
+// entry returns the entry of the key, even expired
+func (b *boltEntries) entry(key string) (memoryEntry, bool) {
+	data := b.entries.Get([]byte(key))
+	if data == nil {
+		return memoryEntry{}, false
+	}
+	entry, err := decodeEntry(data)
+	if err != nil {
+		b.err = errors.Join(b.err, err)
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+func (b *boltEntries) get(key string, now int64) any {
+	entry, ok := b.entry(key)
+	if !ok || (entry.expiresAt != 0 && entry.expiresAt <= now) {
+		return nil // the expired keys are removed in the background
+	}
+	return entry.value
+}
+
+func (b *boltEntries) set(key string, value any, expiresAt int64) {
+	b.delete(key)
+
+	data, err := encodeEntry(memoryEntry{key: key, value: value, expiresAt: expiresAt})
+	if err == nil {
+		err = b.entries.Put([]byte(key), data)
+	}
+	if err == nil && expiresAt != 0 {
+		err = b.expirations.Put(boltExpirationKey(expiresAt, key), nil)
+	}
+	b.err = errors.Join(b.err, err)
+}
+
+// pin is set, the bolt storage never evicts keys
+func (b *boltEntries) pin(key string, value any, expiresAt int64) {
+	b.set(key, value, expiresAt)
+}
+
+func (b *boltEntries) delete(key string) {
+	entry, ok := b.entry(key)
+	if !ok {
+		return
+	}
+	if entry.expiresAt != 0 {
+		b.err = errors.Join(b.err, b.expirations.Delete(boltExpirationKey(entry.expiresAt, key)))
+	}
+	b.err = errors.Join(b.err, b.entries.Delete([]byte(key)))
+}
+
+// update runs fn against the entries in a read-write transaction
+func (b *BoltStorage) update(fn func(store entryStore)) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		store := newBoltEntries(tx)
+		fn(store)
+		return store.err
+	})
+}
+
+// removeExpired deletes a batch of the keys whose expiration is past, it
+// returns whether expired keys may be left
+func (b *BoltStorage) removeExpired(now int64) (bool, error) {
+	removed := 0
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		var (
+			store   = newBoltEntries(tx)
+			cursor  = store.expirations.Cursor()
+			expired [][]byte
+		)
+		// the keys are deleted once the cursor is done, deleting while
+		// iterating skips keys
+		for k, _ := cursor.First(); k != nil && len(expired) < boltCleanupBatchSize; k, _ = cursor.Next() {
+			if int64(binary.BigEndian.Uint64(k[:8])) > now {
+				break
+			}
+			expired = append(expired, bytes.Clone(k))
+		}
+		for _, k := range expired {
+			if err := store.entries.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := store.expirations.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	boltStorageExpirationsTotal.Add(float64(removed))
+	return removed == boltCleanupBatchSize, nil
+}
+
+func (b *BoltStorage) removeExpiredKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for more := true; more; {
+				var err error
+				if more, err = b.removeExpired(time.Now().UnixNano()); err != nil {
+					slog.Error("could not remove the expired keys of the bolt storage", "error", err)
+				}
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background cleanup and closes the database file
+func (b *BoltStorage) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		b.wg.Wait()
+		err = b.db.Close()
+	})
+	return err
+}
+
+func (b *BoltStorage) CheckAndUpdateTokenBucket(
+	ctx context.Context,
+	key string,
+	capacity int,
+	refillRate float64,
+	expiresIn time.Duration,
+) (bool, error) {
+	var allowed bool
+	err := b.update(func(store entryStore) {
+		allowed = checkAndUpdateTokenBucket(store, key, capacity, refillRate, expiresIn, b.requestCost, time.Now())
+	})
+	return allowed, err
+}
+
+func (b *BoltStorage) CheckAndUpdateLeakyBucket(
+	ctx context.Context,
+	key string,
+	maxTokens int,
+	leakRate float64,
+	expiresIn time.Duration,
+) (bool, error) {
+	var allowed bool
+	err := b.update(func(store entryStore) {
+		allowed = checkAndUpdateLeakyBucket(store, key, maxTokens, leakRate, expiresIn, b.requestCost, time.Now())
+	})
+	return allowed, err
+}
+
+func (b *BoltStorage) AcquireConcurrencyLease(
+	ctx context.Context,
+	key string,
+	limit int,
+	leaseID string,
+	leaseTTL time.Duration,
+) (bool, error) {
+	var acquired bool
+	err := b.update(func(store entryStore) {
+		acquired = acquireConcurrencyLease(store, key, limit, leaseID, leaseTTL, time.Now())
+	})
+	return acquired, err
+}
+
+func (b *BoltStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	return b.update(func(store entryStore) {
+		releaseConcurrencyLease(store, key, leaseID, time.Now())
+	})
+}
+
+func (b *BoltStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	rejected := -1
+	err := b.update(func(store entryStore) {
+		storeOf := func(string) entryStore { return store }
+		rejected = checkAndUpdateBuckets(storeOf, buckets, b.requestCost, time.Now())
+	})
+	return rejected, err
+}
+
+func (b *BoltStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	var duration time.Duration
+	err := b.update(func(store entryStore) {
+		duration = recordRejection(store, key, penalty, time.Now())
+	})
+	return duration, err
+}
+
+func (b *BoltStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	var remaining time.Duration
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		store := newBoltEntries(tx)
+		remaining = banRemaining(store, key, time.Now())
+		return store.err
+	})
+	return remaining, err
+}
+
+func (b *BoltStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	now := time.Now().UnixNano()
+
+	var bans []Ban
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltEntriesBucket).ForEach(func(k, v []byte) error {
+			if !bytes.HasSuffix(k, []byte(":penalty")) {
+				return nil
+			}
+			entry, err := decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			if match, ok := entry.value.(memoryPenalty); ok && match.bannedUntilUnixNano > now {
+				bans = append(bans, Ban{
+					Key:   strings.TrimSuffix(entry.key, ":penalty"),
+					Until: time.Unix(0, match.bannedUntilUnixNano),
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return a.Until.Compare(b.Until) })
+
+	return bans, nil
+}
+
+func (b *BoltStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	var (
+		allowed bool
+		balance int
+	)
+	err := b.update(func(store entryStore) {
+		allowed, balance = checkAndUpdateQuota(store, key, initialBalance, time.Now())
+	})
+	return allowed, balance, err
+}
+
+func (b *BoltStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	var balance int
+	err := b.update(func(store entryStore) {
+		balance = creditQuota(store, key, initialBalance, amount, time.Now())
+	})
+	return balance, err
+}
+
+func (b *BoltStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	var value int
+	err := b.update(func(store entryStore) {
+		value = incrementCounter(store, key, ttl, time.Now())
+	})
+	return value, err
+}
+
+func (b *BoltStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	var marked bool
+	err := b.update(func(store entryStore) {
+		marked = markOnce(store, key, ttl, time.Now())
+	})
+	return marked, err
+}
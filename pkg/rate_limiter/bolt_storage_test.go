@@ -0,0 +1,165 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBoltStorage(t *testing.T, options BoltStorageOptions) *BoltStorage {
+	if options.Path == "" {
+		options.Path = filepath.Join(t.TempDir(), "rlim.db")
+	}
+	storage, err := NewBoltStorage(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+// len returns the number of keys and of expirations held, expired or not
+func (b *BoltStorage) len(t *testing.T) (int, int) {
+	var keys, expirations int
+	require.NoError(t, b.db.View(func(tx *bbolt.Tx) error {
+		keys = tx.Bucket(boltEntriesBucket).Stats().KeyN
+		expirations = tx.Bucket(boltExpirationsBucket).Stats().KeyN
+		return nil
+	}))
+	return keys, expirations
+}
+
+func TestBoltStorage_Buckets(t *testing.T) {
+	storage := newTestBoltStorage(t, BoltStorageOptions{})
+	ctx := context.Background()
+
+	for range 2 {
+		ok, err := storage.CheckAndUpdateTokenBucket(ctx, "john:search:rpm", 2, 0, time.Minute)
+		assertAllowed(t, ok, err, "The token bucket has tokens left")
+	}
+	ok, err := storage.CheckAndUpdateTokenBucket(ctx, "john:search:rpm", 2, 0, time.Minute)
+	assertNotAllowed(t, ok, err, "The token bucket is empty")
+
+	for range 2 {
+		ok, err = storage.CheckAndUpdateLeakyBucket(ctx, "john:upload:rpm", 2, 0, time.Minute)
+		assertAllowed(t, ok, err, "The leaky bucket is not full")
+	}
+	ok, err = storage.CheckAndUpdateLeakyBucket(ctx, "john:upload:rpm", 2, 0, time.Minute)
+	assertNotAllowed(t, ok, err, "The leaky bucket is full")
+
+	buckets := []Bucket{
+		{Key: "org:acme", Algorithm: enum.TokenBucket, Capacity: 3, ExpiresIn: time.Minute},
+		{Key: "user:jane", Algorithm: enum.LeakyBucket, Capacity: 1, ExpiresIn: time.Minute},
+	}
+	rejected, err := storage.CheckAndUpdateBuckets(ctx, buckets)
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected)
+	rejected, err = storage.CheckAndUpdateBuckets(ctx, buckets)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rejected, "The user bucket is full")
+
+	require.NoError(t, storage.db.View(func(tx *bbolt.Tx) error {
+		bucket := newBoltEntries(tx).get("org:acme", time.Now().UnixNano()).(memoryTokenBucket)
+		assert.Equal(t, 2.0, bucket.bucketSize, "The org bucket must not be charged by the rejected request")
+		return nil
+	}))
+}
+
+func TestBoltStorage_ConcurrencyLeases(t *testing.T) {
+	storage := newTestBoltStorage(t, BoltStorageOptions{})
+	ctx := context.Background()
+	key := "john:export:concurrency"
+
+	ok, err := storage.AcquireConcurrencyLease(ctx, key, 1, "lease-1", time.Minute)
+	assertAllowed(t, ok, err, "The first lease is acquired")
+	ok, err = storage.AcquireConcurrencyLease(ctx, key, 1, "lease-2", time.Minute)
+	assertNotAllowed(t, ok, err, "The limit is reached")
+
+	require.NoError(t, storage.ReleaseConcurrencyLease(ctx, key, "lease-1"))
+	ok, err = storage.AcquireConcurrencyLease(ctx, key, 1, "lease-2", time.Millisecond)
+	assertAllowed(t, ok, err, "A released lease frees its slot")
+
+	time.Sleep(time.Millisecond * 5)
+	ok, err = storage.AcquireConcurrencyLease(ctx, key, 1, "lease-3", time.Minute)
+	assertAllowed(t, ok, err, "The expired lease is reclaimed")
+}
+
+func TestBoltStorage_PenaltyQuotaAndCounters(t *testing.T) {
+	storage := newTestBoltStorage(t, BoltStorageOptions{})
+	ctx := context.Background()
+	penalty := config.PenaltyConfig{MaxRejections: 1, Window: time.Minute, BanDuration: time.Hour, MaxBanDuration: time.Hour, ForgetAfter: time.Hour}
+
+	duration, err := storage.RecordRejection(ctx, "auth:john:login", penalty)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, duration)
+	remaining, err := storage.BanRemaining(ctx, "auth:john:login")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), remaining.Seconds(), 1)
+	bans, err := storage.ListBans(ctx)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, "auth:john:login", bans[0].Key)
+
+	ok, balance, err := storage.CheckAndUpdateQuota(ctx, "auth:john:calls:quota", 1)
+	assertAllowed(t, ok, err, "The quota has a balance")
+	assert.Equal(t, 0, balance)
+	ok, _, err = storage.CheckAndUpdateQuota(ctx, "auth:john:calls:quota", 1)
+	assertNotAllowed(t, ok, err, "The quota is exhausted")
+	balance, err = storage.CreditQuota(ctx, "auth:john:calls:quota", 1, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 5, balance)
+
+	for _, expected := range []int{1, 2} {
+		value, err := storage.IncrementCounter(ctx, "auth:john:usage", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+	first, err := storage.MarkOnce(ctx, "auth:john:usage:80", time.Hour)
+	assertAllowed(t, first, err, "The key is marked")
+	first, err = storage.MarkOnce(ctx, "auth:john:usage:80", time.Hour)
+	assertNotAllowed(t, first, err, "The key is already marked")
+}
+
+func TestBoltStorage_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rlim.db")
+	storage, err := NewBoltStorage(BoltStorageOptions{Path: path})
+	require.NoError(t, err)
+	for range 2 {
+		ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), "john:search:rpm", 2, 0, time.Minute)
+		assertAllowed(t, ok, err, "The token bucket has tokens left")
+	}
+	require.NoError(t, storage.Close())
+	require.NoError(t, storage.Close(), "Closing twice is a no-op")
+
+	restarted := newTestBoltStorage(t, BoltStorageOptions{Path: path})
+	ok, err := restarted.CheckAndUpdateTokenBucket(context.Background(), "john:search:rpm", 2, 0, time.Minute)
+	assertNotAllowed(t, ok, err, "The bucket emptied before the restart is still empty")
+}
+
+func TestBoltStorage_Expiration(t *testing.T) {
+	storage := newTestBoltStorage(t, BoltStorageOptions{CleanupInterval: time.Millisecond * 10})
+	ctx := context.Background()
+
+	ok, err := storage.CheckAndUpdateTokenBucket(ctx, "john:search:rpm", 1, 0, time.Millisecond*20)
+	assertAllowed(t, ok, err, "The bucket is created")
+	ok, err = storage.CheckAndUpdateTokenBucket(ctx, "john:search:rpm", 1, 0, time.Millisecond*20)
+	assertNotAllowed(t, ok, err, "The bucket is empty")
+	_, _, err = storage.CheckAndUpdateQuota(ctx, "john:calls:quota", 10)
+	require.NoError(t, err)
+
+	keys, expirations := storage.len(t)
+	assert.Equal(t, 2, keys)
+	assert.Equal(t, 1, expirations, "The refreshed bucket has a single expiration, quotas have none")
+
+	assert.Eventually(t, func() bool {
+		keys, expirations := storage.len(t)
+		return keys == 1 && expirations == 0
+	}, time.Second, time.Millisecond*10, "The expired bucket is removed, the quota is kept")
+
+	ok, err = storage.CheckAndUpdateTokenBucket(ctx, "john:search:rpm", 1, 0, time.Millisecond*20)
+	assertAllowed(t, ok, err, "The bucket is created again")
+}
@@ -2,30 +2,62 @@ package rate_limiter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github/martinmaurice/rlim/pkg/config"
 	"github/martinmaurice/rlim/pkg/enum"
+	"github/martinmaurice/rlim/pkg/override_store"
 	"log"
 	"log/slog"
+	"strings"
 	"time"
 )
 
+var (
+	NoQuotaErr             = errors.New("the group of the key has no quota")
+	InvalidCreditAmountErr = errors.New("the credited amount must be positive")
+)
+
 type Servicer interface {
 	CheckRateLimit(ctx context.Context, key string, rateLimitersId string) (string, bool)
+	Check(ctx context.Context, key string, rateLimitersId string) Decision
+	CheckHierarchy(ctx context.Context, hierarchyId string, attributes map[string]string) Decision
 }
 
 type rateLimiterWithID struct {
-	id string
-	rl RateLimiter
+	id  string
+	rl  RateLimiter
+	cfg config.RateLimiterConfig
 }
 
 type Client struct {
-	rateStorage  Storer
-	cfg          *config.Config
-	rateLimiters map[string][]rateLimiterWithID
+	rateStorage   Storer
+	cfg           *config.Config
+	rateLimiters  map[string][]rateLimiterWithID
+	shapers       map[string]*shaper
+	penalties     map[string]config.PenaltyConfig
+	schedules     map[string]*groupSchedules
+	controllers   map[string]*AIMDController // adaptive groups share one controller
+	overrides     override_store.OverrideStore
+	overrideCache *overrideCache // nil reads the overrides from the store on every check
+	onLowBalance  func(ctx context.Context, key string, balance int)
+	notifier      UsageNotifier
+}
+
+// effectiveCfg returns the config of the rate limiter scaled down to the
+// limits it currently applies, only adaptive rate limiters differ
+func (rl rateLimiterWithID) effectiveCfg() config.RateLimiterConfig {
+	limiter, ok := rl.rl.(*AdaptiveLimiter)
+	if !ok {
+		return rl.cfg
+	}
+
+	cfg := rl.cfg
+	cfg.Capacity, cfg.RefillRate = limiter.limits()
+	return cfg
 }
 
-func (c *Client) newRateLimiter(rateLimiterConfig config.RateLimiterConfig) RateLimiter {
+func (c *Client) newRateLimiter(rateLimitersId string, rateLimiterConfig config.RateLimiterConfig) RateLimiter {
 	slog.Debug("newRateLimiter", "ID", rateLimiterConfig.ID, "algorithm", rateLimiterConfig.Algorithm)
 	switch rateLimiterConfig.Algorithm {
 	case enum.TokenBucket:
@@ -40,6 +72,36 @@ func (c *Client) newRateLimiter(rateLimiterConfig config.RateLimiterConfig) Rate
 			LeakRate:  rateLimiterConfig.LeakRate,
 			ExpiresIn: time.Second * time.Duration(rateLimiterConfig.Expiration),
 		})
+	case enum.Concurrency:
+		return NewConcurrencyLimiter(c.rateStorage, &ConcurrencyLimiter{
+			Limit:    rateLimiterConfig.Capacity,
+			LeaseTTL: time.Second * time.Duration(rateLimiterConfig.Expiration),
+		})
+	case enum.Adaptive:
+		controller, ok := c.controllers[rateLimitersId]
+		if !ok {
+			controller = NewAIMDController(*rateLimiterConfig.Adaptive)
+			c.controllers[rateLimitersId] = controller
+		}
+		return NewAdaptiveLimiter(c.rateStorage, &AdaptiveLimiter{
+			Capacity:   rateLimiterConfig.Capacity,
+			RefillRate: rateLimiterConfig.RefillRate,
+			ExpiresIn:  time.Second * time.Duration(rateLimiterConfig.Expiration),
+			Controller: controller,
+		})
+	case enum.Quota:
+		return NewQuotaLimiter(c.rateStorage, &QuotaLimiter{
+			InitialBalance:      rateLimiterConfig.Capacity,
+			LowBalanceThreshold: rateLimiterConfig.LowBalanceThreshold,
+			OnLowBalance: func(ctx context.Context, key string, balance int) {
+				keyPrefix := keyPrefixOf(key, rateLimiterConfig.ID)
+				slog.Warn("quota balance is low", "key", keyPrefix, "balance", balance)
+				quotaLowBalanceTotal.WithLabelValues(rateLimitersId).Inc()
+				if c.onLowBalance != nil {
+					c.onLowBalance(ctx, keyPrefix, balance)
+				}
+			},
+		})
 
 	default:
 		log.Fatalf("Unknown rate limiter algorithm: %v", rateLimiterConfig.Algorithm)
@@ -48,16 +110,103 @@ func (c *Client) newRateLimiter(rateLimiterConfig config.RateLimiterConfig) Rate
 	return nil
 }
 
+// override returns the override of the rate-limit key, nil when there is
+// none or when the store could not be reached
+func (c *Client) override(ctx context.Context, keyPrefix string) *override_store.Override {
+	if c.overrides == nil {
+		return nil
+	}
+
+	var version uint64
+	if c.overrideCache != nil {
+		override, cached, v := c.overrideCache.get(keyPrefix)
+		if cached {
+			return override
+		}
+		version = v
+	}
+
+	override, err := c.overrides.Get(ctx, keyPrefix)
+	switch {
+	case errors.Is(err, override_store.OverrideNotFoundErr):
+		override = nil
+	case err != nil:
+		// the failed reads are not cached, the store is read again on the next check
+		slog.Error("could not get the override, using the configured limits", "key", keyPrefix, "error", err)
+		return nil
+	}
+
+	if c.overrideCache != nil {
+		c.overrideCache.set(keyPrefix, override, version)
+	}
+	return override
+}
+
+// Invalidate makes the new limits of the rate-limit key (<key>:<rateLimitersId>)
+// apply at once: its cached override is dropped and, behind a near cache, the
+// invalidation is published to every instance subscribed to it which drops
+// the override and the rejections it cached for the key. The other instances
+// catch up once their cached override expires.
+func (c *Client) Invalidate(ctx context.Context, keyPrefix string) error {
+	if c.overrideCache != nil {
+		c.overrideCache.drop(keyPrefix)
+	}
+	if nearCache, ok := c.rateStorage.(*NearCacheStorage); ok {
+		return nearCache.Invalidate(ctx, keyPrefix)
+	}
+	return nil
+}
+
+// withOverride builds the rate limiter again from its config with the override applied
+func (c *Client) withOverride(rateLimitersId string, rl rateLimiterWithID, override *override_store.Override) rateLimiterWithID {
+	if override == nil {
+		return rl
+	}
+
+	cfg := override.Apply(rl.cfg)
+	return rateLimiterWithID{
+		id:  rl.id,
+		rl:  c.newRateLimiter(rateLimitersId, cfg),
+		cfg: cfg,
+	}
+}
+
 func (c *Client) setTierRateLimiters() {
 	c.rateLimiters = make(map[string][]rateLimiterWithID)
+	c.controllers = make(map[string]*AIMDController)
 	for k, rateLimitersCfg := range c.cfg.RateLimiters {
 		for _, rl := range rateLimitersCfg {
 			c.rateLimiters[k] = append(c.rateLimiters[k], rateLimiterWithID{
-				id: rl.ID,
-				rl: c.newRateLimiter(rl),
+				id:  rl.ID,
+				rl:  c.newRateLimiter(k, rl),
+				cfg: rl,
 			})
 		}
 	}
+
+	c.shapers = make(map[string]*shaper)
+	for k, shapingCfg := range c.cfg.Shaping {
+		c.shapers[k] = newShaper(k, shapingCfg.MaxQueue, shapingCfg.MaxWait)
+	}
+
+	c.penalties = c.cfg.Penalties
+
+	c.schedules = make(map[string]*groupSchedules)
+	for k, schedulesCfg := range c.cfg.Schedules {
+		gs := &groupSchedules{location: schedulesCfg.Location}
+		for _, schedule := range schedulesCfg.Schedules {
+			scheduled := scheduledRateLimiters{schedule: schedule}
+			for _, rl := range schedule.RateLimiters {
+				scheduled.rateLimiters = append(scheduled.rateLimiters, rateLimiterWithID{
+					id:  rl.ID,
+					rl:  c.newRateLimiter(k, rl),
+					cfg: rl,
+				})
+			}
+			gs.schedules = append(gs.schedules, scheduled)
+		}
+		c.schedules[k] = gs
+	}
 }
 
 func (c *Client) checkRateLimit(ctx context.Context, key string, rateLimiter RateLimiter) bool {
@@ -74,42 +223,318 @@ func (c *Client) checkRateLimit(ctx context.Context, key string, rateLimiter Rat
 	return true
 }
 
-func (c *Client) CheckRateLimit(ctx context.Context, key, rateLimitersId string) (string, bool) {
-	slog.Info("checking rate limit", "key", key, "rateLimitersId", rateLimitersId)
+// acquireLease takes a lease on the concurrency limiter and keeps
+// the function releasing it in the decision
+func (c *Client) acquireLease(ctx context.Context, key string, limiter *ConcurrencyLimiter, decision *Decision) bool {
+	release, ok, err := limiter.Acquire(ctx, key)
+	if err != nil {
+		slog.Error("unexpected error while acquiring a concurrency lease", "error", err)
+		return false
+	}
+	if ok {
+		decision.releases = append(decision.releases, release)
+	}
 
-	if key == "" || rateLimitersId == "" {
-		slog.Debug(
-			"CheckRateLimit called with empty key or rateLimitersId",
-			"key", key,
-			"rateLimitersId", rateLimitersId,
-		)
-		return "", true
+	return ok
+}
+
+// check runs the request through every rate limiter of the group once
+func (c *Client) check(ctx context.Context, key, rateLimitersId string) Decision {
+	decision, rateLimiters := c.newDecision(ctx, key, rateLimitersId)
+	if !c.runRateLimiters(ctx, &decision, rateLimiters) {
+		return decision
 	}
 
+	c.observe(&decision)
+	return decision
+}
+
+// checkAtOnce is check for the shaped groups: the buckets of the group are
+// charged together, either every bucket accepts the request or none of them
+// is charged, so that a request retried by the shaping queue is only charged
+// once it is admitted. The other rate limiters (concurrency, quota, shadow
+// mode) are checked once the buckets accepted the request.
+func (c *Client) checkAtOnce(ctx context.Context, key, rateLimitersId string) Decision {
+	decision, rateLimiters := c.newDecision(ctx, key, rateLimitersId)
+
+	var (
+		buckets []Bucket
+		cfgs    []config.RateLimiterConfig
+		others  []rateLimiterWithID
+	)
+	for _, rl := range rateLimiters {
+		switch {
+		case rl.cfg.Mode == enum.Shadow, rl.cfg.Algorithm == enum.Concurrency, rl.cfg.Algorithm == enum.Quota:
+			others = append(others, rl)
+		default:
+			cfg := rl.effectiveCfg()
+			buckets = append(buckets, toBucket(limiterKey(decision.Key, rl.id), cfg))
+			cfgs = append(cfgs, cfg)
+		}
+	}
+
+	if len(buckets) > 0 {
+		rejected, err := c.rateStorage.CheckAndUpdateBuckets(ctx, buckets)
+		switch {
+		case err != nil:
+			slog.Error("unexpected error while checking request against rate limit", "error", err)
+			decision.reject(cfgs[0])
+			return decision
+		case rejected >= 0:
+			slog.Debug("request rejected by one of the rate limiter", "key", buckets[rejected].Key)
+			decision.reject(cfgs[rejected])
+			return decision
+		}
+	}
+
+	if !c.runRateLimiters(ctx, &decision, others) {
+		return decision
+	}
+
+	c.observe(&decision)
+	return decision
+}
+
+// newDecision returns the decision allowing the request along with the
+// active rate limiters of the group, the override of the key applied
+func (c *Client) newDecision(ctx context.Context, key, rateLimitersId string) (Decision, []rateLimiterWithID) {
 	finalKeyPrefix := fmt.Sprintf("%s:%s", key, rateLimitersId)
-	for _, rl := range c.rateLimiters[rateLimitersId] {
-		finalKey := fmt.Sprintf("%s:%s", finalKeyPrefix, rl.id)
+	decision := Decision{
+		Key:            finalKeyPrefix,
+		RateLimitersID: rateLimitersId,
+		Allowed:        true,
+	}
+
+	override := c.override(ctx, finalKeyPrefix)
+	var rateLimiters []rateLimiterWithID
+	for _, rl := range c.activeRateLimiters(rateLimitersId, time.Now()) {
+		rl = c.withOverride(rateLimitersId, rl, override)
+		if rl.id == hourlyRateLimiterID {
+			decision.hourlyLimit = hourlyLimit(rl.effectiveCfg())
+		}
+		rateLimiters = append(rateLimiters, rl)
+	}
+
+	return decision, rateLimiters
+}
+
+// runRateLimiters checks the request against the rate limiters one by one,
+// it returns false once one of them rejects it
+func (c *Client) runRateLimiters(ctx context.Context, decision *Decision, rateLimiters []rateLimiterWithID) bool {
+	for _, rl := range rateLimiters {
+		finalKey := limiterKey(decision.Key, rl.id)
 		slog.Debug(
 			"checking against",
 			"key", finalKey,
 			"rateLimiterId", rl.id,
 		)
 
-		if c.checkRateLimit(ctx, finalKey, rl.rl) == false {
-			slog.Debug(
-				"request rejected by one of the rate limiter",
+		var allowed bool
+		if limiter, ok := rl.rl.(*ConcurrencyLimiter); ok {
+			allowed = c.acquireLease(ctx, finalKey, limiter, decision)
+		} else {
+			allowed = c.checkRateLimit(ctx, finalKey, rl.rl)
+		}
+
+		if allowed {
+			continue
+		}
+
+		// in shadow mode the remaining buckets are still updated
+		// as if the request went through
+		if rl.cfg.Mode == enum.Shadow {
+			slog.Warn(
+				"request would have been rejected by a rate limiter in shadow mode",
 				"key", finalKey,
 				"rateLimiterID", rl.id,
 			)
-			return finalKeyPrefix, false
+			shadowRejectionsTotal.WithLabelValues(decision.RateLimitersID, rl.id).Inc()
+			if !decision.Shadowed {
+				decision.reject(rl.effectiveCfg())
+				decision.Allowed = true
+				decision.Shadowed = true
+			}
+			continue
+		}
+
+		slog.Debug(
+			"request rejected by one of the rate limiter",
+			"key", finalKey,
+			"rateLimiterID", rl.id,
+		)
+		decision.reject(rl.effectiveCfg())
+		decision.Shadowed = false
+		decision.Release(ctx) // the request will not run, give back the leases taken so far
+		return false
+	}
+
+	return true
+}
+
+// observe reports the response to the adaptive rate limiters of the group,
+// only the requests that actually reach the upstream tell about its health
+func (c *Client) observe(decision *Decision) {
+	if controller, ok := c.controllers[decision.RateLimitersID]; ok {
+		decision.observers = append(decision.observers, controller.Observe)
+	}
+}
+
+// banned short-circuits the check of the keys serving a ban, a ban that
+// cannot be read does not block the request which is still rate limited
+func (c *Client) banned(ctx context.Context, key, rateLimitersId string) (Decision, bool) {
+	finalKeyPrefix := fmt.Sprintf("%s:%s", key, rateLimitersId)
+	remaining, err := c.rateStorage.BanRemaining(ctx, finalKeyPrefix)
+	if err != nil {
+		slog.Error("unexpected error while reading the ban", "key", finalKeyPrefix, "error", err)
+		return Decision{}, false
+	}
+	if remaining <= 0 {
+		return Decision{}, false
+	}
+
+	slog.Debug("request rejected because the key is banned", "key", finalKeyPrefix, "remaining", remaining)
+	return Decision{
+		Key:            finalKeyPrefix,
+		RateLimitersID: rateLimitersId,
+		Banned:         true,
+		RetryAfter:     remaining,
+	}, true
+}
+
+// recordRejection counts the rejection against the penalty of the group
+// and bans the key once the threshold is reached
+func (c *Client) recordRejection(ctx context.Context, decision *Decision, penalty config.PenaltyConfig) {
+	duration, err := c.rateStorage.RecordRejection(ctx, decision.Key, penalty)
+	if err != nil {
+		slog.Error("unexpected error while recording the rejection", "key", decision.Key, "error", err)
+		return
+	}
+	if duration <= 0 {
+		return
+	}
+
+	slog.Warn("key banned after repeated rejections", "key", decision.Key, "duration", duration)
+	bansTotal.WithLabelValues(decision.RateLimitersID).Inc()
+	decision.Banned = true
+	decision.RetryAfter = duration
+}
+
+// Credit tops up the quota of the rate-limit key, given as
+// Decision.Key (<key>:<rateLimitersId>), and returns the new balance
+func (c *Client) Credit(ctx context.Context, key string, amount int) (int, error) {
+	if amount <= 0 {
+		return 0, InvalidCreditAmountErr
+	}
+
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("%w: %s", NoQuotaErr, key)
+	}
+
+	for _, rl := range c.rateLimiters[key[i+1:]] {
+		quota, ok := c.withOverride(key[i+1:], rl, c.override(ctx, key)).rl.(*QuotaLimiter)
+		if !ok {
+			continue
 		}
+
+		balance, err := quota.Credit(ctx, limiterKey(key, rl.id), amount)
+		if err != nil {
+			return 0, err
+		}
+		slog.Info("quota credited", "key", key, "amount", amount, "balance", balance)
+		return balance, nil
 	}
 
-	return finalKeyPrefix, true
+	return 0, fmt.Errorf("%w: %s", NoQuotaErr, key)
+}
+
+// Close releases the storage of the client, it must not be used afterwards
+func (c *Client) Close() error {
+	return c.rateStorage.Close()
+}
+
+// ListBans returns the keys currently banned
+func (c *Client) ListBans(ctx context.Context) ([]Ban, error) {
+	return c.rateStorage.ListBans(ctx)
+}
+
+// Check checks the request identified by key against every rate limiter of
+// the rateLimitersId group and describes the outcome. When the group is
+// configured for shaping, a rejected request waits, within the limits of the
+// shaping config and of ctx, behind the requests of the same key already
+// waiting for the buckets to free capacity. Decision.Release must be called
+// once the request is done to release the concurrency leases.
+func (c *Client) Check(ctx context.Context, key, rateLimitersId string) Decision {
+	slog.Info("checking rate limit", "key", key, "rateLimitersId", rateLimitersId)
+
+	if key == "" || rateLimitersId == "" {
+		slog.Debug(
+			"CheckRateLimit called with empty key or rateLimitersId",
+			"key", key,
+			"rateLimitersId", rateLimitersId,
+		)
+		return Decision{Allowed: true}
+	}
+
+	penalty, hasPenalty := c.penalties[rateLimitersId]
+	if hasPenalty {
+		if decision, banned := c.banned(ctx, key, rateLimitersId); banned {
+			decisionsTotal.WithLabelValues(rateLimitersId, bannedResult).Inc()
+			return decision
+		}
+	}
+
+	var decision Decision
+	if s, ok := c.shapers[rateLimitersId]; ok {
+		decision = s.shape(ctx, fmt.Sprintf("%s:%s", key, rateLimitersId), func() Decision {
+			return c.checkAtOnce(ctx, key, rateLimitersId)
+		})
+	} else {
+		decision = c.check(ctx, key, rateLimitersId)
+	}
+
+	if hasPenalty && !decision.Allowed {
+		c.recordRejection(ctx, &decision, penalty)
+	}
+
+	switch {
+	case decision.Banned:
+		decisionsTotal.WithLabelValues(rateLimitersId, bannedResult).Inc()
+	case !decision.Allowed:
+		decisionsTotal.WithLabelValues(rateLimitersId, rejectedResult).Inc()
+	case decision.Shadowed:
+		decisionsTotal.WithLabelValues(rateLimitersId, shadowRejectedResult).Inc()
+	default:
+		decisionsTotal.WithLabelValues(rateLimitersId, allowedResult).Inc()
+	}
+
+	c.trackUsage(ctx, decision)
+
+	return decision
+}
+
+func (c *Client) CheckRateLimit(ctx context.Context, key, rateLimitersId string) (string, bool) {
+	decision := c.Check(ctx, key, rateLimitersId)
+	return decision.Key, decision.Allowed
 }
 
 type ClientOptions struct {
 	UseMemoryStorage bool
+	// Storage is used instead of the memory or redis storage when set,
+	// the client closes it on Close
+	Storage   Storer
+	Overrides override_store.OverrideStore // per-key limit overrides, optional
+	// OverridesCacheTTL is how long an override read from the store is used
+	// before being read again, default DefaultOverridesCacheTTL, negative
+	// reads the store on every check
+	OverridesCacheTTL time.Duration
+	// OnLowBalance is called with the rate-limit key (<key>:<rateLimitersId>)
+	// whose quota balance went down to the low balance threshold of its group.
+	// It runs synchronously in the request, slow work must be handed off.
+	OnLowBalance func(ctx context.Context, key string, balance int)
+	// Notifier receives the usage thresholds reached by the keys when
+	// notifications are enabled in the config, optional
+	Notifier UsageNotifier
 }
 
 func New(options *ClientOptions) *Client {
@@ -119,15 +544,36 @@ func New(options *ClientOptions) *Client {
 	)
 	var c Client
 	c.cfg = config.GetConfig()
+	c.overrides = options.Overrides
+	c.onLowBalance = options.OnLowBalance
+	if c.cfg.Notifications.Enabled {
+		c.notifier = options.Notifier
+	}
 
-	if options.UseMemoryStorage {
+	switch {
+	case options.Storage != nil:
+		slog.Debug("creating the client with the given storage")
+		c.rateStorage = options.Storage
+	case options.UseMemoryStorage:
 		slog.Debug("creating the client with memory storage")
-		c.rateStorage = NewMemoryStorage()
-	} else {
+		c.rateStorage = NewMemory()
+	default:
 		slog.Debug("creating the client with redis storage")
 		c.rateStorage = NewRedis()
 	}
 
+	if c.overrides != nil && options.OverridesCacheTTL >= 0 {
+		ttl := options.OverridesCacheTTL
+		if ttl == 0 {
+			ttl = DefaultOverridesCacheTTL
+		}
+		c.overrideCache = newOverrideCache(ttl, DefaultOverridesCacheMaxKeys)
+		// the invalidations published by the other instances drop the override too
+		if nearCache, ok := c.rateStorage.(*NearCacheStorage); ok {
+			nearCache.onInvalidate(c.overrideCache.drop)
+		}
+	}
+
 	c.setTierRateLimiters()
 
 	slog.Debug("rate limiter client created", "client", c)
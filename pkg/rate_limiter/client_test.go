@@ -2,10 +2,16 @@ package rate_limiter
 
 import (
 	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github/martinmaurice/rlim/pkg/config"
 	"github/martinmaurice/rlim/pkg/enum"
+	"github/martinmaurice/rlim/pkg/override_store"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestClient_CheckRateLimit(t *testing.T) {
@@ -69,7 +75,7 @@ func TestClient_CheckRateLimit(t *testing.T) {
 		"test1": {
 			{
 				id: "rpm",
-				rl: c.newRateLimiter(config.RateLimiterConfig{
+				rl: c.newRateLimiter("test1", config.RateLimiterConfig{
 					ID:         "rpm",
 					Algorithm:  enum.TokenBucket,
 					Capacity:   1,
@@ -80,7 +86,7 @@ func TestClient_CheckRateLimit(t *testing.T) {
 		"test2": {
 			{
 				id: "rpm",
-				rl: c.newRateLimiter(config.RateLimiterConfig{
+				rl: c.newRateLimiter("test2", config.RateLimiterConfig{
 					ID:         "rpm",
 					Algorithm:  enum.LeakyBucket,
 					Capacity:   1,
@@ -89,7 +95,7 @@ func TestClient_CheckRateLimit(t *testing.T) {
 			},
 			{
 				id: "rph",
-				rl: c.newRateLimiter(config.RateLimiterConfig{
+				rl: c.newRateLimiter("test2", config.RateLimiterConfig{
 					ID:         "rph",
 					Algorithm:  enum.LeakyBucket,
 					Capacity:   4,
@@ -114,3 +120,343 @@ func TestClient_CheckRateLimit(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_Check(t *testing.T) {
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+	}
+
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   1,
+		RefillRate: .5,
+		Expiration: 60,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"free": {{id: rpm.ID, rl: c.newRateLimiter("free", rpm), cfg: rpm}},
+	}
+
+	decision := c.Check(context.Background(), "k1", "free")
+	assert.Equal(t, Decision{Key: "k1:free", RateLimitersID: "free", Allowed: true}, decision)
+
+	decision = c.Check(context.Background(), "k1", "free")
+	assert.Equal(t, Decision{
+		Key:            "k1:free",
+		RateLimitersID: "free",
+		Allowed:        false,
+		LimiterID:      "rpm",
+		Capacity:       1,
+		Rate:           .5,
+		RetryAfter:     2 * time.Second,
+	}, decision)
+	assert.Equal(t, 2, decision.RetryAfterSeconds())
+	assert.Equal(t, "1;w=2", decision.Policy())
+}
+
+func TestClient_Check_ShadowMode(t *testing.T) {
+	storage := newTestMemoryStorage()
+	c := &Client{
+		rateStorage: storage,
+	}
+
+	shadowRpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   1,
+		RefillRate: .1,
+		Mode:       enum.Shadow,
+	}
+	shadowRph := config.RateLimiterConfig{
+		ID:         "rph",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   2,
+		RefillRate: .1,
+		Mode:       enum.Shadow,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"batch": {
+			{id: shadowRpm.ID, rl: c.newRateLimiter("batch", shadowRpm), cfg: shadowRpm},
+			{id: shadowRph.ID, rl: c.newRateLimiter("batch", shadowRph), cfg: shadowRph},
+		},
+	}
+
+	shadowRejections := func() float64 {
+		return testutil.ToFloat64(shadowRejectionsTotal.WithLabelValues("batch", "rpm"))
+	}
+	before := shadowRejections()
+
+	decision := c.Check(context.Background(), "k1", "batch")
+	assert.True(t, decision.Allowed)
+	assert.False(t, decision.Shadowed)
+
+	decision = c.Check(context.Background(), "k1", "batch")
+	assert.True(t, decision.Allowed, "shadow mode must not reject")
+	assert.True(t, decision.Shadowed)
+	assert.Equal(t, "rpm", decision.LimiterID)
+	assert.Equal(t, before+1, shadowRejections())
+
+	// the second bucket is still updated even though the first one would have rejected
+	bucket := storage.load("{k1:batch}:rph").(memoryTokenBucket)
+	assert.Equal(t, 0.0, bucket.bucketSize)
+}
+
+func TestClient_Check_Concurrency(t *testing.T) {
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+	}
+
+	concurrency := config.RateLimiterConfig{
+		ID:         "concurrency",
+		Algorithm:  enum.Concurrency,
+		Capacity:   1,
+		Expiration: 60,
+	}
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   2,
+		RefillRate: .1,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"reports": {
+			{id: concurrency.ID, rl: c.newRateLimiter("reports", concurrency), cfg: concurrency},
+			{id: rpm.ID, rl: c.newRateLimiter("reports", rpm), cfg: rpm},
+		},
+	}
+
+	first := c.Check(context.Background(), "k1", "reports")
+	assert.True(t, first.Allowed)
+
+	second := c.Check(context.Background(), "k1", "reports")
+	assert.False(t, second.Allowed, "only one request can be in flight")
+	assert.Equal(t, "concurrency", second.LimiterID)
+	assert.Equal(t, time.Second, second.RetryAfter)
+
+	first.Release(context.Background())
+	first.Release(context.Background())
+
+	third := c.Check(context.Background(), "k1", "reports")
+	assert.True(t, third.Allowed, "the lease was released")
+
+	t.Run("Leases are released when another rate limiter rejects", func(t *testing.T) {
+		third.Release(context.Background())
+
+		rejected := c.Check(context.Background(), "k1", "reports")
+		assert.False(t, rejected.Allowed)
+		assert.Equal(t, "rpm", rejected.LimiterID)
+
+		// the rpm bucket is empty but the concurrency lease must be free
+		release, ok, err := c.rateLimiters["reports"][0].rl.(*ConcurrencyLimiter).Acquire(context.Background(), "k1:reports:concurrency")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		require.NoError(t, release(context.Background()))
+	})
+}
+
+func TestClient_Check_Override(t *testing.T) {
+	overrides := override_store.NewMemoryStore()
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		overrides:   overrides,
+	}
+
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   1,
+		RefillRate: .01,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"free": {{id: rpm.ID, rl: c.newRateLimiter("free", rpm), cfg: rpm}},
+	}
+
+	require.NoError(t, overrides.Set(context.Background(), "acme:free", override_store.Override{Capacity: 3}))
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, c.Check(context.Background(), "acme", "free").Allowed, "request %d is within the override", i)
+	}
+	rejected := c.Check(context.Background(), "acme", "free")
+	assert.False(t, rejected.Allowed)
+	assert.Equal(t, 3, rejected.Capacity)
+
+	// other keys keep the configured limits
+	assert.True(t, c.Check(context.Background(), "globex", "free").Allowed)
+	assert.False(t, c.Check(context.Background(), "globex", "free").Allowed)
+}
+
+// countingOverrideStore counts the reads of the override store
+type countingOverrideStore struct {
+	override_store.OverrideStore
+	gets atomic.Int64
+}
+
+func (c *countingOverrideStore) Get(ctx context.Context, key string) (*override_store.Override, error) {
+	c.gets.Add(1)
+	return c.OverrideStore.Get(ctx, key)
+}
+
+func TestClient_Check_OverrideCache(t *testing.T) {
+	overrides := &countingOverrideStore{OverrideStore: override_store.NewMemoryStore()}
+	c := &Client{
+		rateStorage:   NewMemoryStorage(),
+		overrides:     overrides,
+		overrideCache: newOverrideCache(time.Minute, DefaultOverridesCacheMaxKeys),
+	}
+	now := time.Now()
+	c.overrideCache.now = func() time.Time { return now }
+
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   1,
+		RefillRate: .01,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"free": {{id: rpm.ID, rl: c.newRateLimiter("free", rpm), cfg: rpm}},
+	}
+
+	check := func() Decision {
+		return c.Check(context.Background(), "acme", "free")
+	}
+
+	assert.True(t, check().Allowed)
+	assert.Equal(t, 1, check().Capacity)
+	assert.Equal(t, int64(1), overrides.gets.Load(), "a key without override is read once")
+
+	require.NoError(t, overrides.Set(context.Background(), "acme:free", override_store.Override{Capacity: 3}))
+	assert.Equal(t, 1, check().Capacity, "the cached override is used until it is invalidated")
+
+	require.NoError(t, c.Invalidate(context.Background(), "acme:free"))
+	assert.Equal(t, 3, check().Capacity, "the override applies once invalidated")
+	assert.Equal(t, int64(2), overrides.gets.Load())
+
+	require.NoError(t, overrides.Delete(context.Background(), "acme:free"))
+	now = now.Add(time.Minute)
+	assert.Equal(t, 1, check().Capacity, "the cached override expires")
+	assert.Equal(t, int64(3), overrides.gets.Load())
+
+	t.Run("An override is not cached past its expiration", func(t *testing.T) {
+		expiresAt := now.Add(time.Second)
+		c.overrideCache.set("globex:free", &override_store.Override{Capacity: 3, ExpiresAt: expiresAt}, c.overrideCache.invalidations)
+		_, cached, _ := c.overrideCache.get("globex:free")
+		assert.True(t, cached)
+
+		now = expiresAt
+		_, cached, _ = c.overrideCache.get("globex:free")
+		assert.False(t, cached)
+	})
+
+	t.Run("A read started before an invalidation is not cached", func(t *testing.T) {
+		_, _, version := c.overrideCache.get("initech:free")
+		c.overrideCache.drop("initech:free")
+		c.overrideCache.set("initech:free", nil, version)
+		_, cached, _ := c.overrideCache.get("initech:free")
+		assert.False(t, cached)
+	})
+
+	t.Run("The least recently read key prefix is evicted", func(t *testing.T) {
+		cache := newOverrideCache(time.Minute, 2)
+		cache.set("k1:free", nil, 0)
+		cache.set("k2:free", nil, 0)
+		cache.get("k1:free")
+		cache.set("k3:free", nil, 0)
+
+		_, cached, _ := cache.get("k2:free")
+		assert.False(t, cached)
+		_, cached, _ = cache.get("k1:free")
+		assert.True(t, cached)
+	})
+}
+
+func TestClient_Check_Penalty(t *testing.T) {
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		penalties: map[string]config.PenaltyConfig{
+			"login": {
+				MaxRejections:  2,
+				Window:         time.Minute,
+				BanDuration:    time.Hour,
+				MaxBanDuration: time.Hour,
+				ForgetAfter:    time.Hour,
+			},
+		},
+	}
+
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   1,
+		RefillRate: 1,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"login": {{id: rpm.ID, rl: c.newRateLimiter("login", rpm), cfg: rpm}},
+	}
+
+	assert.True(t, c.Check(context.Background(), "john", "login").Allowed)
+
+	rejected := c.Check(context.Background(), "john", "login")
+	assert.False(t, rejected.Allowed)
+	assert.False(t, rejected.Banned)
+
+	banned := c.Check(context.Background(), "john", "login")
+	assert.False(t, banned.Allowed)
+	assert.True(t, banned.Banned, "the second rejection bans the key")
+	assert.Equal(t, time.Hour, banned.RetryAfter)
+
+	// the ban outlasts the bucket refill
+	c.rateStorage.(*MemoryStorage).store("{john:login}:rpm", memoryTokenBucket{lastRefillUnixNano: time.Now().UnixNano(), bucketSize: 1})
+	stillBanned := c.Check(context.Background(), "john", "login")
+	assert.False(t, stillBanned.Allowed)
+	assert.True(t, stillBanned.Banned)
+	assert.Empty(t, stillBanned.LimiterID)
+
+	bans, err := c.ListBans(context.Background())
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, "john:login", bans[0].Key)
+}
+
+func TestClient_Check_Quota(t *testing.T) {
+	var lowBalances []string
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		onLowBalance: func(ctx context.Context, key string, balance int) {
+			lowBalances = append(lowBalances, fmt.Sprintf("%s=%d", key, balance))
+		},
+	}
+
+	quota := config.RateLimiterConfig{
+		ID:                  "quota",
+		Algorithm:           enum.Quota,
+		Capacity:            3,
+		LowBalanceThreshold: 1,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"calls": {{id: quota.ID, rl: c.newRateLimiter("calls", quota), cfg: quota}},
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, c.Check(context.Background(), "acme", "calls").Allowed)
+	}
+	assert.Equal(t, []string{"acme:calls=1"}, lowBalances, "the callback fires once when the balance reaches the threshold")
+
+	rejected := c.Check(context.Background(), "acme", "calls")
+	assert.False(t, rejected.Allowed)
+	assert.Equal(t, "quota", rejected.LimiterID)
+	assert.Zero(t, rejected.RetryAfter)
+
+	balance, err := c.Credit(context.Background(), "acme:calls", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, balance)
+
+	assert.True(t, c.Check(context.Background(), "acme", "calls").Allowed)
+	assert.Equal(t, []string{"acme:calls=1", "acme:calls=1"}, lowBalances)
+
+	_, err = c.Credit(context.Background(), "acme:calls", 0)
+	assert.ErrorIs(t, err, InvalidCreditAmountErr)
+	_, err = c.Credit(context.Background(), "acme:unknown", 2)
+	assert.ErrorIs(t, err, NoQuotaErr)
+	_, err = c.Credit(context.Background(), "acme", 2)
+	assert.ErrorIs(t, err, NoQuotaErr)
+}
@@ -0,0 +1,57 @@
+package rate_limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type ConcurrencyHandler interface {
+	AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error)
+	ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error
+}
+
+// ConcurrencyLimiter limits the number of in-flight requests per key. Each
+// request holds a lease until it is released or its ttl elapses, so leases
+// of crashed holders are eventually reclaimed.
+type ConcurrencyLimiter struct {
+	Limit            int           // max number of leases held at the same time
+	LeaseTTL         time.Duration // a lease not released after this delay is reclaimed
+	rateLimitHandler ConcurrencyHandler
+}
+
+func NewConcurrencyLimiter(handler ConcurrencyHandler, options *ConcurrencyLimiter) *ConcurrencyLimiter {
+	options.rateLimitHandler = handler
+	return options
+}
+
+func newRandomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Acquire tries to take a lease, the returned release function must be
+// called once the request is done. It is nil when no lease was taken.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (func(ctx context.Context) error, bool, error) {
+	leaseID := newRandomID()
+	ok, err := cl.rateLimitHandler.AcquireConcurrencyLease(ctx, key, cl.Limit, leaseID, cl.LeaseTTL)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	release := func(ctx context.Context) error {
+		return cl.rateLimitHandler.ReleaseConcurrencyLease(ctx, key, leaseID)
+	}
+
+	return release, true, nil
+}
+
+// Allow makes ConcurrencyLimiter a RateLimiter, the lease taken is never
+// released explicitly and is only reclaimed once its ttl elapses.
+// Use Acquire to release it when the request is done.
+func (cl *ConcurrencyLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	_, ok, err := cl.Acquire(ctx, key)
+	return ok, err
+}
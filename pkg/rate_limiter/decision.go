@@ -0,0 +1,101 @@
+package rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Decision describes the outcome of a rate limit check
+type Decision struct {
+	Key            string        // key prefix of the buckets checked
+	RateLimitersID string        // group of rate limiters checked (tier, endpoint...)
+	Allowed        bool          // whether the request can go through
+	Shadowed       bool          // the request is allowed only because the rejecting rate limiter is in shadow mode
+	Banned         bool          // the key is banned after repeated rejections, RetryAfter is the end of the ban
+	LimiterID      string        // id of the rate limiter that rejected (or would have rejected) the request (rpm, rph...)
+	Capacity       int           // capacity of the rate limiter that rejected the request
+	Rate           float64       // tokens refilled (or leaked) per second by the rate limiter that rejected the request
+	RetryAfter     time.Duration // approximate delay before the rejecting bucket accepts a request again
+	Waited         time.Duration // time spent waiting in the shaping queue
+	Err            error         // why the request was rejected without being checked (MissingHierarchyAttributeErr...)
+	releases       []func(ctx context.Context) error
+	observers      []func(statusCode int, latency time.Duration)
+	hourlyLimit    int // requests allowed per hour by the hourly rate limiter checked, 0 when none was
+}
+
+// Release gives back the concurrency leases taken for the request,
+// it is safe to call it more than once
+func (d *Decision) Release(ctx context.Context) {
+	for _, release := range d.releases {
+		if err := release(ctx); err != nil {
+			slog.Error("could not release the concurrency lease", "key", d.Key, "error", err)
+		}
+	}
+	d.releases = nil
+}
+
+// Observe reports the response of the allowed request to the adaptive
+// rate limiters of the group, it does nothing for the other groups
+func (d *Decision) Observe(statusCode int, latency time.Duration) {
+	for _, observe := range d.observers {
+		observe(statusCode, latency)
+	}
+}
+
+// retryAfter estimates the time needed for one token to be refilled (or leaked),
+// buckets that never refill are only reset when they expire
+func retryAfter(cfg config.RateLimiterConfig) time.Duration {
+	rate := cfg.RefillRate
+	if cfg.Algorithm == enum.LeakyBucket {
+		rate = cfg.LeakRate
+	}
+
+	switch {
+	case cfg.Algorithm == enum.Concurrency:
+		return time.Second // a lease may be released at any time
+	case cfg.Algorithm == enum.Quota:
+		return 0 // an exhausted quota only accepts requests once credited
+	case rate <= 0:
+		return time.Second * time.Duration(cfg.Expiration)
+	}
+
+	return time.Duration(math.Ceil(float64(time.Second) / rate))
+}
+
+func (d *Decision) reject(cfg config.RateLimiterConfig) {
+	d.Allowed = false
+	d.LimiterID = cfg.ID
+	d.Capacity = cfg.Capacity
+	d.Rate = cfg.RefillRate
+	if cfg.Algorithm == enum.LeakyBucket {
+		d.Rate = cfg.LeakRate
+	}
+	d.RetryAfter = retryAfter(cfg)
+}
+
+// RetryAfterSeconds returns RetryAfter rounded up to the second as expected
+// by the Retry-After header
+func (d Decision) RetryAfterSeconds() int {
+	return int(math.Ceil(d.RetryAfter.Seconds()))
+}
+
+// Policy describes the rejecting rate limiter following the quota policy
+// syntax of the IETF RateLimit headers draft, e.g. "10;w=60" for 10 requests
+// over a window of 60 seconds. It is empty when no rate limiter rejected the request.
+func (d Decision) Policy() string {
+	if d.LimiterID == "" {
+		return ""
+	}
+
+	if d.Rate <= 0 {
+		return fmt.Sprintf("%d", d.Capacity)
+	}
+
+	window := int(math.Ceil(float64(d.Capacity) / d.Rate))
+	return fmt.Sprintf("%d;w=%d", d.Capacity, window)
+}
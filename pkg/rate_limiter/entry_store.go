@@ -0,0 +1,357 @@
+package rate_limiter
+
+import (
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// entryStore is the view of a storage the algorithms below run against. The
+// caller makes the calls atomic: the lock of a memory shard, a bolt
+// transaction...
+type entryStore interface {
+	// get returns the value of the key, nil when it is missing or expired
+	get(key string, now int64) any
+	// set stores the value of the key until expiresAt, 0 meaning it never expires
+	set(key string, value any, expiresAt int64)
+	// pin stores the value of the key until expiresAt like set, but the key is
+	// never evicted to make room for other keys
+	pin(key string, value any, expiresAt int64)
+	delete(key string)
+}
+
+// expiresAt returns the expiration of a key written at now for ttl, a key
+// without ttl never expires
+func expiresAt(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
+
+func checkAndUpdateTokenBucket(
+	store entryStore,
+	key string,
+	capacity int,
+	refillRate float64,
+	expiresIn time.Duration,
+	requestCost float64,
+	now time.Time,
+) bool {
+	updateTokenBucket := func(bucketSize float64) {
+		// a bucket left alone until it expires is full again, the same as a missing one
+		store.set(key, memoryTokenBucket{
+			lastRefillUnixNano: now.UnixNano(),
+			bucketSize:         bucketSize,
+		}, expiresAt(now, expiresIn))
+	}
+
+	slog.Debug("looking for bucket with", "key", key)
+	match, ok := store.get(key, now.UnixNano()).(memoryTokenBucket)
+	if !ok { // if no token_bucket match the key create one
+		bucketSize := float64(capacity) - requestCost
+		slog.Debug("creating new token bucket", "key", key, "bucketSize", bucketSize)
+		updateTokenBucket(bucketSize) // remove the cost of the ongoing request
+		return true
+	}
+
+	elapsedSecondsSinceLastRefill := math.Round(now.Sub(time.Unix(0, match.lastRefillUnixNano)).Seconds())
+	tokensToRefill := elapsedSecondsSinceLastRefill * refillRate
+	bucketSize := math.Min(float64(capacity), tokensToRefill+match.bucketSize)
+
+	if bucketSize >= requestCost {
+		slog.Debug("refilling token bucket", "key", key, "bucketSize", bucketSize)
+		updateTokenBucket(bucketSize - requestCost)
+		return true
+	}
+
+	return false
+}
+
+func checkAndUpdateLeakyBucket(
+	store entryStore,
+	key string,
+	maxTokens int,
+	leakRate float64,
+	expiresIn time.Duration,
+	requestCost float64,
+	now time.Time,
+) bool {
+	updateLeakyBucket := func(bucketSize float64) {
+		store.set(key, memoryLeakyBucket{
+			lastLeakUnixNano: now.UnixNano(),
+			bucketSize:       bucketSize,
+		}, expiresAt(now, expiresIn))
+	}
+
+	slog.Debug("looking for bucket with", "key", key)
+	match, ok := store.get(key, now.UnixNano()).(memoryLeakyBucket)
+	if !ok { // if no leaky_bucket match the key create one
+		bucketSize := requestCost
+		slog.Debug("creating new leaky bucket", "key", key, "bucketSize", bucketSize)
+		updateLeakyBucket(bucketSize)
+		return true
+	}
+
+	elapsedSecondsSinceLastLeak := math.Round(now.Sub(time.Unix(0, match.lastLeakUnixNano)).Seconds())
+	nbTokensToLeak := elapsedSecondsSinceLastLeak * leakRate
+	bucketSize := math.Max(0, match.bucketSize-nbTokensToLeak)
+
+	if n := bucketSize + requestCost; n <= float64(maxTokens) {
+		slog.Debug("leaking tokens", "key", key, "bucketSize", bucketSize)
+		updateLeakyBucket(n)
+		return true
+	}
+
+	return false
+}
+
+func acquireConcurrencyLease(
+	store entryStore,
+	key string,
+	limit int,
+	leaseID string,
+	leaseTTL time.Duration,
+	now time.Time,
+) bool {
+	match, ok := store.get(key, now.UnixNano()).(memoryConcurrencyLeases)
+	if !ok {
+		match = memoryConcurrencyLeases{leases: make(map[string]int64)}
+	}
+
+	// reclaim the leases whose holder did not release them in time
+	for id, expiredAt := range match.leases {
+		if expiredAt <= now.UnixNano() {
+			delete(match.leases, id)
+		}
+	}
+
+	if len(match.leases) >= limit {
+		slog.Debug("too many in-flight requests", "key", key, "inFlight", len(match.leases))
+		return false
+	}
+
+	// the leases share the same ttl, the last one acquired expires last. They
+	// are pinned, evicting them would let more requests in flight than the limit
+	match.leases[leaseID] = now.Add(leaseTTL).UnixNano()
+	store.pin(key, match, match.leases[leaseID])
+
+	return true
+}
+
+func releaseConcurrencyLease(store entryStore, key string, leaseID string, now time.Time) {
+	match, ok := store.get(key, now.UnixNano()).(memoryConcurrencyLeases)
+	if !ok {
+		return
+	}
+
+	delete(match.leases, leaseID)
+	if len(match.leases) == 0 {
+		store.delete(key)
+		return
+	}
+
+	var expiredAt int64
+	for _, leaseExpiredAt := range match.leases {
+		expiredAt = max(expiredAt, leaseExpiredAt)
+	}
+	store.pin(key, match, expiredAt)
+}
+
+// chargeBucket returns the state of the bucket once the request is charged
+// against it, ok is false when the bucket has not enough capacity
+func chargeBucket(store entryStore, bucket Bucket, requestCost float64, now time.Time) (state any, ok bool) {
+	if bucket.Algorithm == enum.LeakyBucket {
+		bucketSize := 0.0
+		if match, found := store.get(bucket.Key, now.UnixNano()).(memoryLeakyBucket); found {
+			elapsedSecondsSinceLastLeak := math.Round(now.Sub(time.Unix(0, match.lastLeakUnixNano)).Seconds())
+			bucketSize = math.Max(0, match.bucketSize-elapsedSecondsSinceLastLeak*bucket.Rate)
+		}
+		if bucketSize+requestCost > float64(bucket.Capacity) {
+			return nil, false
+		}
+		return memoryLeakyBucket{
+			lastLeakUnixNano: now.UnixNano(),
+			bucketSize:       bucketSize + requestCost,
+		}, true
+	}
+
+	bucketSize := float64(bucket.Capacity)
+	if match, found := store.get(bucket.Key, now.UnixNano()).(memoryTokenBucket); found {
+		elapsedSecondsSinceLastRefill := math.Round(now.Sub(time.Unix(0, match.lastRefillUnixNano)).Seconds())
+		bucketSize = math.Min(float64(bucket.Capacity), match.bucketSize+elapsedSecondsSinceLastRefill*bucket.Rate)
+	}
+	if bucketSize < requestCost {
+		return nil, false
+	}
+	return memoryTokenBucket{
+		lastRefillUnixNano: now.UnixNano(),
+		bucketSize:         bucketSize - requestCost,
+	}, true
+}
+
+// checkAndUpdateBuckets charges the request against every bucket or against
+// none of them, storeOf returns the store holding a key
+func checkAndUpdateBuckets(storeOf func(key string) entryStore, buckets []Bucket, requestCost float64, now time.Time) int {
+	// nothing is written until every bucket accepted the request
+	states := make([]any, len(buckets))
+	for i, bucket := range buckets {
+		state, ok := chargeBucket(storeOf(bucket.Key), bucket, requestCost, now)
+		if !ok {
+			slog.Debug("bucket rejected the request", "key", bucket.Key)
+			return i
+		}
+		states[i] = state
+	}
+
+	for i, bucket := range buckets {
+		storeOf(bucket.Key).set(bucket.Key, states[i], expiresAt(now, bucket.ExpiresIn))
+	}
+
+	return -1
+}
+
+// checkBuckets returns the index of the first bucket without enough capacity
+// for the request, -1 when every bucket would accept it. Nothing is written.
+func checkBuckets(storeOf func(key string) entryStore, buckets []Bucket, requestCost float64, now time.Time) int {
+	for i, bucket := range buckets {
+		if _, ok := chargeBucket(storeOf(bucket.Key), bucket, requestCost, now); !ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// penaltyDuration doubles the ban duration on each repeat offence up to the max
+func penaltyDuration(penalty config.PenaltyConfig, offences int) time.Duration {
+	duration := penalty.BanDuration
+	for i := 1; i < offences && duration < penalty.MaxBanDuration; i++ {
+		duration *= 2
+	}
+	return min(duration, penalty.MaxBanDuration)
+}
+
+func penaltyKey(key string) string {
+	return key + ":penalty"
+}
+
+func recordRejection(store entryStore, key string, penalty config.PenaltyConfig, now time.Time) time.Duration {
+	var (
+		stateKey    = penaltyKey(key)
+		nowUnixNano = now.UnixNano()
+	)
+
+	match, _ := store.get(stateKey, nowUnixNano).(memoryPenalty)
+	if match.windowEndUnixNano <= nowUnixNano {
+		match.rejections = 0
+		match.windowEndUnixNano = nowUnixNano + penalty.Window.Nanoseconds()
+	}
+	if match.offencesExpireAtUnixNano <= nowUnixNano {
+		match.offences = 0
+	}
+
+	match.rejections++
+	var duration time.Duration
+	if match.rejections >= penalty.MaxRejections {
+		match.rejections = 0
+		match.offences++
+		duration = penaltyDuration(penalty, match.offences)
+		match.bannedUntilUnixNano = nowUnixNano + duration.Nanoseconds()
+		match.offencesExpireAtUnixNano = match.bannedUntilUnixNano + penalty.ForgetAfter.Nanoseconds()
+		slog.Debug("banning key", "key", key, "offences", match.offences, "duration", duration)
+	}
+
+	expiresAt := max(match.windowEndUnixNano, match.offencesExpireAtUnixNano)
+	if pinnedEntry(match) {
+		store.pin(stateKey, match, expiresAt)
+	} else {
+		store.set(stateKey, match, expiresAt)
+	}
+
+	return duration
+}
+
+// pinnedEntry reports whether the value must never be evicted: the quota
+// balances spent or credited, the bans and the offences they escalate from,
+// and the concurrency leases. The rejections counted before a ban and the
+// balances still at their initial value stay evictable, so that a flood of
+// keys cannot grow the storage past its bound.
+func pinnedEntry(value any) bool {
+	switch value := value.(type) {
+	case memoryConcurrencyLeases:
+		return true
+	case memoryQuota:
+		return value.pinned
+	case memoryPenalty:
+		return value.offences > 0
+	}
+	return false
+}
+
+// storeQuota keeps the balance for good, the ones differing from the initial
+// balance are pinned: evicting them would give back the spent calls or lose
+// the credits already paid for
+func storeQuota(store entryStore, key string, quota memoryQuota, initialBalance int) {
+	quota.pinned = quota.balance != initialBalance
+	if pinnedEntry(quota) {
+		store.pin(key, quota, 0)
+	} else {
+		store.set(key, quota, 0)
+	}
+}
+
+func banRemaining(store entryStore, key string, now time.Time) time.Duration {
+	match, ok := store.get(penaltyKey(key), now.UnixNano()).(memoryPenalty)
+	if !ok {
+		return 0
+	}
+
+	return max(time.Duration(match.bannedUntilUnixNano-now.UnixNano()), 0)
+}
+
+func checkAndUpdateQuota(store entryStore, key string, initialBalance int, now time.Time) (bool, int) {
+	match, ok := store.get(key, now.UnixNano()).(memoryQuota)
+	if !ok {
+		match = memoryQuota{balance: initialBalance}
+	}
+	if match.balance <= 0 {
+		return false, match.balance
+	}
+
+	match.balance--
+	storeQuota(store, key, match, initialBalance)
+	return true, match.balance
+}
+
+func creditQuota(store entryStore, key string, initialBalance int, amount int, now time.Time) int {
+	match, ok := store.get(key, now.UnixNano()).(memoryQuota)
+	if !ok {
+		match = memoryQuota{balance: initialBalance}
+	}
+
+	match.balance += amount
+	storeQuota(store, key, match, initialBalance)
+	return match.balance
+}
+
+func incrementCounter(store entryStore, key string, ttl time.Duration, now time.Time) int {
+	match, ok := store.get(key, now.UnixNano()).(memoryCounter)
+	if !ok || match.expiredAtInUnixNano <= now.UnixNano() {
+		match = memoryCounter{expiredAtInUnixNano: now.Add(ttl).UnixNano()}
+	}
+
+	match.value++
+	store.set(key, match, match.expiredAtInUnixNano)
+	return match.value
+}
+
+func markOnce(store entryStore, key string, ttl time.Duration, now time.Time) bool {
+	if match, ok := store.get(key, now.UnixNano()).(memoryCounter); ok && match.expiredAtInUnixNano > now.UnixNano() {
+		return false
+	}
+
+	store.set(key, memoryCounter{value: 1, expiredAtInUnixNano: now.Add(ttl).UnixNano()}, now.Add(ttl).UnixNano())
+	return true
+}
@@ -0,0 +1,500 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github/martinmaurice/rlim/pkg/config"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	GossipPath = "/gossip/v1/deltas"
+
+	DefaultGossipMaxKeys = 1000000
+
+	defaultGossipInterval = time.Second
+	defaultGossipTimeout  = time.Second
+)
+
+// GossipDelta is the count of the requests a node allowed for a key in a
+// window, counts only grow so a delta can be merged any number of times and
+// in any order
+type GossipDelta struct {
+	Key      string        `json:"key"`
+	Window   time.Duration `json:"window"`
+	Start    int64         `json:"start"` // start of the window, in unix nanoseconds
+	Capacity int           `json:"capacity"`
+	Node     string        `json:"node"`
+	Count    uint64        `json:"count"` // never above the capacity
+}
+
+type GossipMessage struct {
+	From   string        `json:"from"`
+	Deltas []GossipDelta `json:"deltas"`
+}
+
+// GossipTransport delivers the deltas of a node to one of its peers, which
+// merges them with GossipStorage.Merge
+type GossipTransport interface {
+	Send(ctx context.Context, peer string, message GossipMessage) error
+}
+
+type GossipStorageOptions struct {
+	Secret    string          // shared by the nodes to sign their messages, required
+	Node      string          // id of the node, the host:port its peers reach it on with the default transport
+	Peers     []string        // ids of the other nodes, the node itself is ignored
+	Interval  time.Duration   // how often the deltas are sent, default 1s
+	Timeout   time.Duration   // max duration of a send to a peer, default 1s
+	MaxKeys   int             // max counters kept (a key in a window), default DefaultGossipMaxKeys
+	Transport GossipTransport // default posts the deltas to GossipPath over HTTP
+	Local     *MemoryStorage  // every other algorithm, default an unbounded memory storage
+}
+
+// gossipSlot is the counter of a key in a window
+type gossipSlot struct {
+	key    string
+	window time.Duration
+	start  int64
+}
+
+// gossipCounter is a G-counter: the count of each node, merged by keeping the
+// highest count seen for the node. A node never counts more requests than the
+// capacity, a higher count received is capped.
+type gossipCounter struct {
+	slot     gossipSlot
+	capacity int
+	counts   map[string]uint64
+	total    uint64
+	element  *list.Element // position in the LRU list
+}
+
+// gossipEntry is the count of a node in a slot waiting to be sent to a peer
+type gossipEntry struct {
+	slot gossipSlot
+	node string
+}
+
+// GossipStorage enforces the token and leaky buckets without any call to
+// another node: they are approximated by a sliding window allowing capacity
+// requests per the time the bucket takes to refill entirely. Each node counts
+// the requests it allows per key and window in a G-counter, and gossips the
+// counts that changed to its peers every interval. The limit is checked
+// against the merged counts, so the nodes can allow up to a gossip interval
+// of requests more than the limit altogether, and each side of a partition
+// allows the whole limit. The counts not delivered to a peer are sent again
+// until it gets them, the nodes converge once the partition heals.
+//
+// The counts are forwarded to the other peers on merge, a node also learns
+// the counts of the peers it cannot reach directly. Every other algorithm
+// (concurrency, quotas, bans, usage) is kept by the local storage of the node.
+//
+// The messages are signed with the shared secret, replayed ones are dropped,
+// and only the counts of the configured peers are merged. Up to maxKeys
+// counters are kept, the least recently used one is evicted first: its key is
+// then allowed its limit again.
+type GossipStorage struct {
+	secret    string
+	nonces    *peerNonces
+	node      string
+	peers     []string
+	peerSet   map[string]bool
+	transport GossipTransport
+	timeout   time.Duration
+	local     *MemoryStorage
+	now       func() time.Time
+
+	mu       sync.Mutex
+	counters map[gossipSlot]*gossipCounter
+	lru      *list.List // of *gossipCounter, front is the most recently used
+	maxKeys  int
+	pending  map[string]map[gossipEntry]GossipDelta // by peer, the counts it was not sent yet
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewGossipStorage(options GossipStorageOptions) (*GossipStorage, error) {
+	if options.Secret == "" {
+		return nil, MissingPeerSecretErr
+	}
+	interval := options.Interval
+	if interval <= 0 {
+		interval = defaultGossipInterval
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultGossipTimeout
+	}
+	transport := options.Transport
+	if transport == nil {
+		transport = &httpGossipTransport{client: &http.Client{Timeout: timeout}, secret: options.Secret}
+	}
+	local := options.Local
+	if local == nil {
+		local = NewMemoryStorageWithOptions(MemoryStorageOptions{})
+	}
+	maxKeys := options.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultGossipMaxKeys
+	}
+
+	g := &GossipStorage{
+		secret:    options.Secret,
+		nonces:    newPeerNonces(),
+		node:      options.Node,
+		peerSet:   make(map[string]bool),
+		transport: transport,
+		timeout:   timeout,
+		local:     local,
+		now:       time.Now,
+		counters:  make(map[gossipSlot]*gossipCounter),
+		lru:       list.New(),
+		maxKeys:   maxKeys,
+		pending:   make(map[string]map[gossipEntry]GossipDelta),
+		stop:      make(chan struct{}),
+	}
+	for _, peer := range options.Peers {
+		if peer != options.Node {
+			g.peers = append(g.peers, peer)
+			g.peerSet[peer] = true
+			g.pending[peer] = make(map[gossipEntry]GossipDelta)
+		}
+	}
+	g.wg.Go(func() { g.gossipEvery(interval) })
+
+	return g, nil
+}
+
+// gossipWindow is the time a bucket takes to refill entirely, the window of
+// the sliding window allowing as many requests as the bucket. A bucket that
+// never refills counts the requests over its expiration.
+func gossipWindow(capacity int, rate float64, expiresIn time.Duration) time.Duration {
+	window := expiresIn
+	if rate > 0 {
+		window = time.Duration(float64(capacity) / rate * float64(time.Second))
+	}
+	return max(window, time.Millisecond)
+}
+
+// gossipSlots returns the slots of the current and previous windows of the key
+func gossipSlots(key string, window time.Duration, now int64) (gossipSlot, gossipSlot) {
+	start := now - now%int64(window)
+	return gossipSlot{key: key, window: window, start: start},
+		gossipSlot{key: key, window: window, start: start - int64(window)}
+}
+
+// estimate returns the requests allowed by every node over the window ending
+// now: all those of the current window and the part of the previous window
+// still covered, assuming they were evenly spread. The lock must be held.
+func (g *GossipStorage) estimate(current, previous gossipSlot, now int64) float64 {
+	var count float64
+	if counter, ok := g.counters[current]; ok {
+		count += float64(counter.total)
+	}
+	if counter, ok := g.counters[previous]; ok {
+		covered := 1 - float64(now-current.start)/float64(current.window)
+		count += float64(counter.total) * covered
+	}
+	return count
+}
+
+// saturatingAdd returns a+b, or the max uint64 when the sum overflows
+func saturatingAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// record sets the count of the node in the slot when it is higher than the
+// known one and queues it for every peer but the node and except, the peer it
+// came from, which already have it. The count is capped at the capacity the
+// counter was created with. The lock must be held.
+func (g *GossipStorage) record(slot gossipSlot, capacity int, node string, count uint64, except string) bool {
+	counter, ok := g.counters[slot]
+	if !ok {
+		counter = &gossipCounter{slot: slot, capacity: capacity, counts: make(map[string]uint64)}
+		counter.element = g.lru.PushFront(counter)
+		g.counters[slot] = counter
+		for g.lru.Len() > g.maxKeys {
+			g.remove(g.lru.Back().Value.(*gossipCounter))
+			gossipEvictionsTotal.Inc()
+		}
+	}
+	count = min(count, uint64(counter.capacity))
+	if count <= counter.counts[node] {
+		return false
+	}
+	counter.total = saturatingAdd(counter.total, count-counter.counts[node])
+	counter.counts[node] = count
+
+	entry := gossipEntry{slot: slot, node: node}
+	delta := GossipDelta{Key: slot.key, Window: slot.window, Start: slot.start, Capacity: counter.capacity, Node: node, Count: count}
+	for _, peer := range g.peers {
+		if peer != except && peer != node {
+			g.pending[peer][entry] = delta
+		}
+	}
+	return true
+}
+
+// allow checks the sliding window of every bucket and counts the request in
+// all of them when none is full, it returns the index of the first full one
+func (g *GossipStorage) allow(buckets []Bucket) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now().UnixNano()
+	currents := make([]gossipSlot, len(buckets))
+	for i, bucket := range buckets {
+		current, previous := gossipSlots(bucket.Key, gossipWindow(bucket.Capacity, bucket.Rate, bucket.ExpiresIn), now)
+		if g.estimate(current, previous, now)+1 > float64(bucket.Capacity) {
+			return i
+		}
+		currents[i] = current
+	}
+
+	for i, current := range currents {
+		var count uint64
+		if counter, ok := g.counters[current]; ok {
+			counter.capacity = buckets[i].Capacity // the local limit prevails over the received one
+			count = counter.counts[g.node]
+			g.lru.MoveToFront(counter.element)
+		}
+		g.record(current, buckets[i].Capacity, g.node, count+1, "")
+	}
+	return -1
+}
+
+func (g *GossipStorage) CheckAndUpdateTokenBucket(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, error) {
+	return g.allow([]Bucket{{Key: key, Capacity: capacity, Rate: refillRate, ExpiresIn: expiresIn}}) < 0, nil
+}
+
+func (g *GossipStorage) CheckAndUpdateLeakyBucket(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, error) {
+	return g.allow([]Bucket{{Key: key, Capacity: capacity, Rate: leakRate, ExpiresIn: expiresIn}}) < 0, nil
+}
+
+// CheckAndUpdateBuckets counts the request in every level of the hierarchy
+// or in none of them, as seen by the node
+func (g *GossipStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	return g.allow(buckets), nil
+}
+
+// Merge keeps the highest count of each node in the deltas, the counts that
+// changed are forwarded to the other peers on the next round. The messages
+// of a node that is not a peer are dropped, as are the deltas of a node that
+// is not a peer, of the node itself (it knows its own counts better) or of a
+// window that is expired or not started yet.
+func (g *GossipStorage) Merge(message GossipMessage) {
+	if !g.peerSet[message.From] {
+		slog.Warn("dropping the gossip of an unknown node", "from", message.From)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now().UnixNano()
+	merged := 0
+	for _, delta := range message.Deltas {
+		if !g.peerSet[delta.Node] || delta.Window <= 0 || delta.Capacity <= 0 ||
+			expiredGossipSlot(delta.Start, delta.Window, now) || delta.Start-int64(delta.Window) > now {
+			continue
+		}
+		slot := gossipSlot{key: delta.Key, window: delta.Window, start: delta.Start}
+		if g.record(slot, delta.Capacity, delta.Node, delta.Count, message.From) {
+			merged++
+		}
+	}
+	gossipDeltasMergedTotal.Add(float64(merged))
+}
+
+// expiredGossipSlot tells whether the window is neither the current nor the
+// previous one anymore, its count is not needed by the sliding window
+func expiredGossipSlot(start int64, window time.Duration, now int64) bool {
+	return start+2*int64(window) <= now
+}
+
+// remove forgets the counter and its counts not sent yet, the lock must be held
+func (g *GossipStorage) remove(counter *gossipCounter) {
+	delete(g.counters, counter.slot)
+	g.lru.Remove(counter.element)
+	for node := range counter.counts {
+		for _, entries := range g.pending {
+			delete(entries, gossipEntry{slot: counter.slot, node: node})
+		}
+	}
+}
+
+// expire forgets the counters and the pending counts of the expired windows,
+// the lock must be held
+func (g *GossipStorage) expire(now int64) {
+	for slot, counter := range g.counters {
+		if expiredGossipSlot(slot.start, slot.window, now) {
+			g.remove(counter)
+		}
+	}
+	for _, entries := range g.pending {
+		for entry := range entries {
+			if expiredGossipSlot(entry.slot.start, entry.slot.window, now) {
+				delete(entries, entry)
+			}
+		}
+	}
+}
+
+func (g *GossipStorage) gossipEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.gossip()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// gossip sends to each peer the counts it was not sent yet, they stay pending
+// for the next round when the peer cannot be reached
+func (g *GossipStorage) gossip() {
+	g.mu.Lock()
+	g.expire(g.now().UnixNano())
+	batches := make(map[string][]GossipDelta, len(g.pending))
+	for peer, entries := range g.pending {
+		for _, delta := range entries {
+			batches[peer] = append(batches[peer], delta)
+		}
+	}
+	g.mu.Unlock()
+
+	for peer, deltas := range batches {
+		ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+		err := g.transport.Send(ctx, peer, GossipMessage{From: g.node, Deltas: deltas})
+		cancel()
+		if err != nil {
+			slog.Warn("could not gossip to the peer", "peer", peer, "deltas", len(deltas), "error", err)
+			gossipSendFailuresTotal.Inc()
+			continue
+		}
+		gossipDeltasSentTotal.Add(float64(len(deltas)))
+
+		// a count raised while sending is kept for the next round
+		g.mu.Lock()
+		for _, delta := range deltas {
+			entry := gossipEntry{slot: gossipSlot{key: delta.Key, window: delta.Window, start: delta.Start}, node: delta.Node}
+			if pending, ok := g.pending[peer][entry]; ok && pending.Count <= delta.Count {
+				delete(g.pending[peer], entry)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// Handler merges the deltas signed by the peers
+func (g *GossipStorage) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+GossipPath, func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readSignedPeerBody(w, r, g.secret, g.nonces)
+		if !ok {
+			return
+		}
+
+		var message GossipMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			http.Error(w, "invalid gossip message", http.StatusBadRequest)
+			return
+		}
+		g.Merge(message)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+type httpGossipTransport struct {
+	client *http.Client
+	secret string
+}
+
+func (t *httpGossipTransport) Send(ctx context.Context, peer string, message GossipMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+GossipPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signPeerRequest(req, t.secret, body)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s replied %s", peer, resp.Status)
+	}
+	return nil
+}
+
+func (g *GossipStorage) AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error) {
+	return g.local.AcquireConcurrencyLease(ctx, key, limit, leaseID, leaseTTL)
+}
+
+func (g *GossipStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	return g.local.ReleaseConcurrencyLease(ctx, key, leaseID)
+}
+
+func (g *GossipStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	return g.local.RecordRejection(ctx, key, penalty)
+}
+
+func (g *GossipStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	return g.local.BanRemaining(ctx, key)
+}
+
+func (g *GossipStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	return g.local.ListBans(ctx)
+}
+
+func (g *GossipStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	return g.local.CheckAndUpdateQuota(ctx, key, initialBalance)
+}
+
+func (g *GossipStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	return g.local.CreditQuota(ctx, key, initialBalance, amount)
+}
+
+func (g *GossipStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	return g.local.IncrementCounter(ctx, key, ttl)
+}
+
+func (g *GossipStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return g.local.MarkOnce(ctx, key, ttl)
+}
+
+// Close stops the gossip after a last round, so that the peers get the last
+// counts of the node, then closes the local storage
+func (g *GossipStorage) Close() error {
+	var err error
+	g.closeOnce.Do(func() {
+		close(g.stop)
+		g.wg.Wait()
+		g.gossip()
+		err = g.local.Close()
+	})
+	return err
+}
@@ -0,0 +1,378 @@
+package rate_limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gossipSimulation runs gossip storages in the process, delivering their
+// messages directly to each other unless a partition separates them. The
+// nodes share a clock and gossip only when the test says so.
+type gossipSimulation struct {
+	mu    sync.Mutex
+	nodes map[string]*GossipStorage
+	now   time.Time
+	cut   map[[2]string]bool // pairs of nodes that cannot reach each other
+}
+
+func newGossipSimulation(t *testing.T, names ...string) (*gossipSimulation, []*GossipStorage) {
+	sim := &gossipSimulation{
+		nodes: make(map[string]*GossipStorage),
+		now:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		cut:   make(map[[2]string]bool),
+	}
+
+	nodes := make([]*GossipStorage, len(names))
+	for i, name := range names {
+		var err error
+		nodes[i], err = NewGossipStorage(GossipStorageOptions{
+			Secret:    testPeerSecret,
+			Node:      name,
+			Peers:     names,
+			Interval:  time.Hour, // rounds are run by the test
+			Transport: sim,
+		})
+		require.NoError(t, err)
+		nodes[i].now = sim.clock
+		sim.nodes[name] = nodes[i]
+		t.Cleanup(func() {
+			assert.NoError(t, nodes[i].Close())
+		})
+	}
+
+	return sim, nodes
+}
+
+func (s *gossipSimulation) clock() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *gossipSimulation) advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+}
+
+// partition cuts the links between the groups, the nodes of a group still
+// reach each other
+func (s *gossipSimulation) partition(groups ...[]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, group := range groups {
+		for _, other := range groups[i+1:] {
+			for _, a := range group {
+				for _, b := range other {
+					s.cut[[2]string{a, b}] = true
+					s.cut[[2]string{b, a}] = true
+				}
+			}
+		}
+	}
+}
+
+func (s *gossipSimulation) heal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cut = make(map[[2]string]bool)
+}
+
+func (s *gossipSimulation) Send(ctx context.Context, peer string, message GossipMessage) error {
+	s.mu.Lock()
+	cut := s.cut[[2]string{message.From, peer}]
+	node := s.nodes[peer]
+	s.mu.Unlock()
+
+	if cut {
+		return errors.New("partitioned")
+	}
+	node.Merge(message)
+	return nil
+}
+
+// round runs a gossip round on every node
+func (s *gossipSimulation) round(nodes []*GossipStorage) {
+	for _, node := range nodes {
+		node.gossip()
+	}
+}
+
+// request sends a request to the token bucket of the key on the node
+func request(t *testing.T, node *GossipStorage, key string, capacity int, refillRate float64) bool {
+	ok, err := node.CheckAndUpdateTokenBucket(context.Background(), key, capacity, refillRate, time.Hour)
+	require.NoError(t, err)
+	return ok
+}
+
+func estimateOf(node *GossipStorage, key string, window time.Duration) float64 {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	now := node.now().UnixNano()
+	current, previous := gossipSlots(key, window, now)
+	return node.estimate(current, previous, now)
+}
+
+func TestGossipWindow(t *testing.T) {
+	assert.Equal(t, time.Minute, gossipWindow(30, 0.5, time.Hour))
+	assert.Equal(t, time.Hour, gossipWindow(30, 0, time.Hour), "a bucket that never refills counts over its expiration")
+	assert.Equal(t, time.Millisecond, gossipWindow(1, 1e6, time.Hour))
+}
+
+func TestGossipStorage_Converges(t *testing.T) {
+	sim, nodes := newGossipSimulation(t, "eu", "us", "ap")
+	key := limiterKey("k1:search", "rpm")
+
+	allowed := 0
+	for i := range 60 {
+		if request(t, nodes[i%3], key, 30, 0.5) {
+			allowed++
+		}
+		if i%3 == 2 {
+			sim.round(nodes)
+		}
+	}
+	assert.GreaterOrEqual(t, allowed, 30)
+	assert.LessOrEqual(t, allowed, 32, "the nodes only exceed the limit by the requests of a gossip round")
+
+	sim.round(nodes)
+	for _, node := range nodes {
+		assert.Equal(t, float64(allowed), estimateOf(node, key, time.Minute), node.node)
+		assert.False(t, request(t, node, key, 30, 0.5), node.node)
+	}
+}
+
+func TestGossipStorage_Partition(t *testing.T) {
+	sim, nodes := newGossipSimulation(t, "eu", "us", "ap")
+	key := limiterKey("k1:search", "rpm")
+
+	sim.partition([]string{"eu"}, []string{"us", "ap"})
+	allowed := map[string]int{}
+	for i := range 40 {
+		node := nodes[i%3]
+		if request(t, node, key, 10, 10.0/60) {
+			allowed[node.node]++
+		}
+		sim.round(nodes)
+	}
+	assert.Equal(t, 10, allowed["eu"], "the isolated node allows the whole limit")
+	assert.Equal(t, 10, allowed["us"]+allowed["ap"], "the connected nodes share the limit")
+
+	sim.heal()
+	sim.round(nodes)
+	for _, node := range nodes {
+		assert.Equal(t, 20.0, estimateOf(node, key, time.Minute), "the counts of the partition are delivered once it heals, %s", node.node)
+	}
+
+	t.Run("Counts are forwarded to the peers a node cannot reach", func(t *testing.T) {
+		key := limiterKey("k2:search", "rpm")
+		sim.partition([]string{"eu"}, []string{"ap"})
+		defer sim.heal()
+
+		for range 5 {
+			require.True(t, request(t, nodes[0], key, 10, 10.0/60))
+		}
+		sim.round(nodes) // eu -> us
+		sim.round(nodes) // us -> ap
+		assert.Equal(t, 5.0, estimateOf(nodes[2], key, time.Minute))
+	})
+}
+
+func TestGossipStorage_SlidingWindow(t *testing.T) {
+	sim, nodes := newGossipSimulation(t, "eu", "us")
+	key := limiterKey("k1:search", "rpm")
+
+	for range 10 {
+		require.True(t, request(t, nodes[0], key, 10, 10.0/60))
+	}
+	sim.round(nodes)
+	assert.False(t, request(t, nodes[1], key, 10, 10.0/60))
+
+	// half of the previous window is still covered
+	sim.advance(90 * time.Second)
+	for range 5 {
+		assert.True(t, request(t, nodes[1], key, 10, 10.0/60))
+	}
+	assert.False(t, request(t, nodes[1], key, 10, 10.0/60))
+
+	sim.advance(2 * time.Minute)
+	sim.round(nodes)
+	for _, node := range nodes {
+		node.mu.Lock()
+		assert.Empty(t, node.counters, "the expired windows are forgotten, %s", node.node)
+		for peer, entries := range node.pending {
+			assert.Empty(t, entries, "the expired counts are not sent to %s", peer)
+		}
+		node.mu.Unlock()
+	}
+}
+
+func TestGossipStorage_MaxKeys(t *testing.T) {
+	_, nodes := newGossipSimulation(t, "eu", "us")
+	nodes[0].maxKeys = 2
+
+	for i := range 1000 {
+		require.True(t, request(t, nodes[0], limiterKey(fmt.Sprintf("10.0.0.%d:default", i), "rpm"), 10, 10.0/3600))
+	}
+	require.True(t, request(t, nodes[0], limiterKey("10.0.0.998:default", "rpm"), 10, 10.0/3600))
+
+	nodes[0].mu.Lock()
+	defer nodes[0].mu.Unlock()
+	assert.Len(t, nodes[0].counters, 2, "a flood of keys does not grow the counters")
+	assert.Equal(t, 2, nodes[0].lru.Len())
+	assert.Len(t, nodes[0].pending["us"], 2, "the counts of the evicted counters are not sent")
+	assert.Equal(t, limiterKey("10.0.0.998:default", "rpm"), nodes[0].lru.Front().Value.(*gossipCounter).slot.key, "the counter used last is kept")
+}
+
+func TestGossipStorage_CheckAndUpdateBuckets(t *testing.T) {
+	_, nodes := newGossipSimulation(t, "eu")
+	buckets := []Bucket{
+		{Key: limiterKey("acme:search", "rpm"), Capacity: 1, Rate: 1.0 / 60, ExpiresIn: time.Hour},
+		{Key: limiterKey("k1:search", "rpm"), Capacity: 2, Rate: 2.0 / 60, ExpiresIn: time.Hour},
+	}
+
+	rejected, err := nodes[0].CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected)
+
+	rejected, err = nodes[0].CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, 0, rejected)
+	assert.Equal(t, 1.0, estimateOf(nodes[0], buckets[1].Key, time.Minute), "the rejected request is not counted")
+}
+
+func TestGossipStorage_Handler(t *testing.T) {
+	listeners := make([]net.Listener, 2)
+	addrs := make([]string, 2)
+	for i := range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	now := time.Now().Truncate(time.Minute) // the requests stay in the same window
+	nodes := make([]*GossipStorage, 2)
+	for i := range 2 {
+		var err error
+		nodes[i], err = NewGossipStorage(GossipStorageOptions{Secret: testPeerSecret, Node: addrs[i], Peers: addrs, Interval: time.Hour})
+		require.NoError(t, err)
+		nodes[i].now = func() time.Time { return now }
+		server := httptest.NewUnstartedServer(nodes[i].Handler())
+		server.Listener.Close()
+		server.Listener = listeners[i]
+		server.Start()
+		t.Cleanup(server.Close)
+		t.Cleanup(func() {
+			assert.NoError(t, nodes[i].Close())
+		})
+	}
+
+	key := limiterKey("k1:search", "rpm")
+	for range 3 {
+		require.True(t, request(t, nodes[0], key, 10, 10.0/60))
+	}
+	nodes[0].gossip()
+	assert.Equal(t, 3.0, estimateOf(nodes[1], key, time.Minute))
+
+	// the deltas are idempotent
+	current, _ := gossipSlots(key, time.Minute, now.UnixNano())
+	nodes[1].Merge(GossipMessage{From: addrs[0], Deltas: []GossipDelta{
+		{Key: key, Window: time.Minute, Start: current.start, Capacity: 10, Node: addrs[0], Count: 2},
+		{Key: key, Window: time.Minute, Start: current.start, Capacity: 10, Node: addrs[0], Count: 3},
+	}})
+	assert.Equal(t, 3.0, estimateOf(nodes[1], key, time.Minute))
+
+	forged := fmt.Sprintf(`{"from":%q,"deltas":[{"key":%q,"window":60000000000,"start":%d,"capacity":10,"node":%q,"count":10}]}`,
+		addrs[0], key, current.start, addrs[0])
+	tests := []struct {
+		name     string
+		secret   string
+		body     string
+		expected int
+	}{
+		{name: "Unsigned message", body: forged, expected: http.StatusUnauthorized},
+		{name: "Message signed with another secret", secret: "forged", body: forged, expected: http.StatusUnauthorized},
+		{name: "Invalid message", secret: testPeerSecret, body: `{`, expected: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", addrs[1], GossipPath), strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.secret != "" {
+				signPeerRequest(req, tt.secret, []byte(tt.body))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.expected, resp.StatusCode)
+		})
+	}
+	assert.Equal(t, 3.0, estimateOf(nodes[1], key, time.Minute), "the rejected messages are not merged")
+}
+
+func TestNewGossipStorage_RequiresSecret(t *testing.T) {
+	_, err := NewGossipStorage(GossipStorageOptions{Node: "eu", Peers: []string{"eu", "us"}})
+	assert.ErrorIs(t, err, MissingPeerSecretErr)
+}
+
+func TestGossipStorage_Merge(t *testing.T) {
+	sim, nodes := newGossipSimulation(t, "eu", "us")
+	key := limiterKey("k1:search", "rpm")
+	current, _ := gossipSlots(key, time.Minute, sim.clock().UnixNano())
+	delta := func(node string, count uint64) GossipDelta {
+		return GossipDelta{Key: key, Window: time.Minute, Start: current.start, Capacity: 10, Node: node, Count: count}
+	}
+
+	tests := []struct {
+		name     string
+		message  GossipMessage
+		expected float64
+	}{
+		{
+			name:    "Message of an unknown node",
+			message: GossipMessage{From: "attacker", Deltas: []GossipDelta{delta("us", 10)}},
+		},
+		{
+			name:    "Count of an unknown node",
+			message: GossipMessage{From: "us", Deltas: []GossipDelta{delta("attacker", 10)}},
+		},
+		{
+			name:    "Count of the node itself",
+			message: GossipMessage{From: "us", Deltas: []GossipDelta{delta("eu", 10)}},
+		},
+		{
+			name: "Window not started yet",
+			message: GossipMessage{From: "us", Deltas: []GossipDelta{
+				{Key: key, Window: time.Minute, Start: current.start + int64(time.Hour), Capacity: 10, Node: "us", Count: 10},
+			}},
+		},
+		{
+			name:     "Count above the capacity",
+			message:  GossipMessage{From: "us", Deltas: []GossipDelta{delta("us", math.MaxUint64)}},
+			expected: 10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes[0].Merge(tt.message)
+			assert.Equal(t, tt.expected, estimateOf(nodes[0], key, time.Minute))
+		})
+	}
+
+	nodes[0].Merge(GossipMessage{From: "us", Deltas: []GossipDelta{delta("us", math.MaxUint64-1)}})
+	assert.Equal(t, 10.0, estimateOf(nodes[0], key, time.Minute), "the total never wraps around")
+	assert.False(t, request(t, nodes[0], key, 10, 10.0/60))
+}
@@ -0,0 +1,138 @@
+package rate_limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"log/slog"
+	"regexp"
+	"time"
+)
+
+var MissingHierarchyAttributeErr = errors.New("missing attribute to build the key of a hierarchy level")
+
+var keyTemplatePlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// expandKeyTemplate replaces the {name} placeholders of the template with the attributes
+func expandKeyTemplate(template string, attributes map[string]string) (string, error) {
+	var missing []string
+	key := keyTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := attributes[name]
+		if !ok || value == "" {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: %v in %q", MissingHierarchyAttributeErr, missing, template)
+	}
+
+	return key, nil
+}
+
+// hierarchyBucket keeps track of the level and the rate limiter a bucket belongs to
+type hierarchyBucket struct {
+	keyPrefix      string
+	rateLimitersId string
+	cfg            config.RateLimiterConfig
+}
+
+func toBucket(key string, cfg config.RateLimiterConfig) Bucket {
+	bucket := Bucket{
+		Key:       key,
+		Algorithm: enum.TokenBucket, // adaptive rate limiters are token buckets
+		Capacity:  cfg.Capacity,
+		Rate:      cfg.RefillRate,
+		ExpiresIn: time.Second * time.Duration(cfg.Expiration),
+	}
+	if cfg.Algorithm == enum.LeakyBucket {
+		bucket.Algorithm = enum.LeakyBucket
+		bucket.Rate = cfg.LeakRate
+	}
+
+	return bucket
+}
+
+// CheckHierarchy charges the request against the rate limiters of every level
+// of the hierarchyId hierarchy at once: either every bucket accepts the
+// request or none of them is charged. The key of each level is built from its
+// template and the attributes of the request (org, subject, route...). The
+// levels are stored under the hash tag of the first one so that a redis
+// cluster charges them in a single script: only the first level shares its
+// buckets with Check called with the same key and group.
+// A request missing an attribute of a template is rejected with Err set to
+// MissingHierarchyAttributeErr. Shaping does not apply to hierarchies.
+func (c *Client) CheckHierarchy(ctx context.Context, hierarchyId string, attributes map[string]string) Decision {
+	slog.Info("checking hierarchical rate limit", "hierarchyId", hierarchyId)
+
+	var levels []config.HierarchyLevelConfig
+	if c.cfg != nil {
+		levels = c.cfg.Hierarchies[hierarchyId]
+	}
+	if len(levels) == 0 {
+		slog.Debug("CheckHierarchy called with an unknown hierarchy", "hierarchyId", hierarchyId)
+		return Decision{Allowed: true}
+	}
+
+	var (
+		buckets       []Bucket
+		owners        []hierarchyBucket
+		rootKeyPrefix string
+		now           = time.Now()
+	)
+	for _, level := range levels {
+		key, err := expandKeyTemplate(level.KeyTemplate, attributes)
+		if err != nil {
+			slog.Error("could not build the key of the hierarchy level", "hierarchyId", hierarchyId, "error", err)
+			decisionsTotal.WithLabelValues(hierarchyId, rejectedResult).Inc()
+			return Decision{Key: hierarchyId, RateLimitersID: hierarchyId, Err: err}
+		}
+
+		keyPrefix := fmt.Sprintf("%s:%s", key, level.RateLimitersID)
+		if rootKeyPrefix == "" {
+			rootKeyPrefix = keyPrefix
+		}
+		override := c.override(ctx, keyPrefix)
+		for _, rl := range c.activeRateLimiters(level.RateLimitersID, now) {
+			cfg := c.withOverride(level.RateLimitersID, rl, override).effectiveCfg()
+			buckets = append(buckets, toBucket(hierarchyLevelKey(rootKeyPrefix, keyPrefix, rl.id), cfg))
+			owners = append(owners, hierarchyBucket{keyPrefix: keyPrefix, rateLimitersId: level.RateLimitersID, cfg: cfg})
+		}
+	}
+
+	decision := Decision{
+		Key:            hierarchyId,
+		RateLimitersID: hierarchyId,
+	}
+
+	rejected, err := c.rateStorage.CheckAndUpdateBuckets(ctx, buckets)
+	switch {
+	case err != nil:
+		slog.Error("unexpected error while checking request against hierarchical rate limit", "error", err)
+	case rejected >= 0:
+		slog.Debug("request rejected by one of the hierarchy levels", "key", buckets[rejected].Key)
+		owner := owners[rejected]
+		decision.Key = owner.keyPrefix
+		decision.RateLimitersID = owner.rateLimitersId
+		decision.reject(owner.cfg)
+	default:
+		decision.Allowed = true
+		for _, level := range levels {
+			if controller, ok := c.controllers[level.RateLimitersID]; ok {
+				decision.observers = append(decision.observers, controller.Observe)
+			}
+		}
+	}
+
+	if decision.Allowed {
+		decisionsTotal.WithLabelValues(hierarchyId, allowedResult).Inc()
+	} else {
+		decisionsTotal.WithLabelValues(hierarchyId, rejectedResult).Inc()
+	}
+
+	return decision
+}
@@ -0,0 +1,75 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"testing"
+)
+
+func TestExpandKeyTemplate(t *testing.T) {
+	key, err := expandKeyTemplate("user:{subject}:{route}", map[string]string{"subject": "john", "route": "/data"})
+	require.NoError(t, err)
+	assert.Equal(t, "user:john:/data", key)
+
+	_, err = expandKeyTemplate("org:{org}", map[string]string{"subject": "john"})
+	require.ErrorIs(t, err, MissingHierarchyAttributeErr)
+}
+
+func TestClient_CheckHierarchy(t *testing.T) {
+	org := config.RateLimiterConfig{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 3, RefillRate: .01, Expiration: 60}
+	user := config.RateLimiterConfig{ID: "rpm", Algorithm: enum.TokenBucket, Capacity: 2, RefillRate: .01, Expiration: 60}
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		cfg: &config.Config{
+			Hierarchies: map[string][]config.HierarchyLevelConfig{
+				"api": {
+					{RateLimitersID: "org", KeyTemplate: "org:{org}"},
+					{RateLimitersID: "user", KeyTemplate: "user:{subject}"},
+				},
+			},
+		},
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"org":  {{id: org.ID, rl: c.newRateLimiter("org", org), cfg: org}},
+		"user": {{id: user.ID, rl: c.newRateLimiter("user", user), cfg: user}},
+	}
+
+	john := map[string]string{"org": "acme", "subject": "john"}
+	jane := map[string]string{"org": "acme", "subject": "jane"}
+
+	for i := 0; i < 2; i++ {
+		assert.True(t, c.CheckHierarchy(context.Background(), "api", john).Allowed)
+	}
+
+	rejected := c.CheckHierarchy(context.Background(), "api", john)
+	assert.False(t, rejected.Allowed)
+	assert.Equal(t, "user:john:user", rejected.Key)
+	assert.Equal(t, "user", rejected.RateLimitersID)
+	assert.Equal(t, "rpm", rejected.LimiterID)
+
+	// the rejected request was not charged to the org which still has one token
+	assert.True(t, c.CheckHierarchy(context.Background(), "api", jane).Allowed)
+
+	rejected = c.CheckHierarchy(context.Background(), "api", jane)
+	assert.False(t, rejected.Allowed)
+	assert.Equal(t, "org:acme:org", rejected.Key)
+	assert.Equal(t, 3, rejected.Capacity)
+
+	// the first level shares its buckets with Check
+	assert.False(t, c.Check(context.Background(), "org:acme", "org").Allowed)
+
+	t.Run("Missing attribute", func(t *testing.T) {
+		for _, attributes := range []map[string]string{{"subject": "john"}, {"subject": "john", "org": ""}} {
+			decision := c.CheckHierarchy(context.Background(), "api", attributes)
+			assert.False(t, decision.Allowed, "a request without the attributes of a level is not let through")
+			assert.ErrorIs(t, decision.Err, MissingHierarchyAttributeErr)
+		}
+	})
+
+	t.Run("Unknown hierarchy", func(t *testing.T) {
+		assert.True(t, c.CheckHierarchy(context.Background(), "unknown", john).Allowed)
+	})
+}
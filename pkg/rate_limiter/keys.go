@@ -0,0 +1,46 @@
+package rate_limiter
+
+import "strings"
+
+// limiterKey is the storage key of a limiter of keyPrefix (<key>:<rateLimitersId>),
+// the hash tag keeps every limiter of the key in the same redis cluster slot
+func limiterKey(keyPrefix string, limiterID string) string {
+	return "{" + keyPrefix + "}:" + limiterID
+}
+
+// hierarchyLevelKey is the storage key of a limiter of a hierarchy level,
+// under the hash tag of the first level of the hierarchy so that every level
+// lives in the same redis cluster slot. The first level keeps its limiterKey.
+func hierarchyLevelKey(rootKeyPrefix string, keyPrefix string, limiterID string) string {
+	if keyPrefix == rootKeyPrefix {
+		return limiterKey(keyPrefix, limiterID)
+	}
+	return "{" + rootKeyPrefix + "}:" + keyPrefix + ":" + limiterID
+}
+
+// keyPrefixOf returns the key prefix of a key built by limiterKey
+func keyPrefixOf(key string, limiterID string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}:"+limiterID)
+}
+
+// rateLimitersIdOf returns the group of a key built by limiterKey, whose key
+// prefix ends with the rate limiters id. It returns "" for the other keys.
+func rateLimitersIdOf(key string) string {
+	end := strings.LastIndex(key, "}:")
+	if !strings.HasPrefix(key, "{") || end < 0 {
+		return ""
+	}
+	keyPrefix := key[1:end]
+	return keyPrefix[strings.LastIndex(keyPrefix, ":")+1:]
+}
+
+// hashTag returns the part of the key hashed to place it, redis cluster
+// style: the content of the first {...} when not empty, the whole key otherwise
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
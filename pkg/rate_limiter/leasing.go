@@ -0,0 +1,267 @@
+package rate_limiter
+
+import (
+	"context"
+	"github/martinmaurice/rlim/pkg/config"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeasingCleanupInterval = time.Second
+	leasingReturnTimeout          = 5 * time.Second
+)
+
+type LeasingOptions struct {
+	Groups          map[string]config.LeasingConfig // indexed by rate limiters id, the other groups are not leased
+	CleanupInterval time.Duration                   // how often the expired leases are given back, default 1s
+}
+
+// tokenLease holds the tokens an instance took from a bucket and did not spend yet
+type tokenLease struct {
+	mu        sync.Mutex
+	tokens    int
+	capacity  int // capacity of the bucket the tokens are given back to
+	expiresAt time.Time
+	removed   bool // the lease was given back and left the map, it must not be used anymore
+}
+
+// LeasingStorage serves the token buckets of the leased groups from tokens
+// taken from the storage in batches: a request spends a token of the lease of
+// its key, the storage is only called once the lease is empty or expired. The
+// unspent tokens of an expired lease are given back.
+//
+// The limit is never exceeded as every token comes from the storage, but the
+// tokens held by an instance cannot be spent by the others: with a large
+// share, a key spread over several instances can be rejected by one of them
+// while another still holds tokens. Hierarchies and the other algorithms are
+// not leased.
+type LeasingStorage struct {
+	storage TokenLeaser
+	groups  map[string]config.LeasingConfig
+	now     func() time.Time
+
+	mu     sync.Mutex
+	leases map[string]*tokenLease
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewLeasingStorage(storage TokenLeaser, options LeasingOptions) *LeasingStorage {
+	cleanupInterval := options.CleanupInterval
+	if cleanupInterval <= 0 {
+		cleanupInterval = defaultLeasingCleanupInterval
+	}
+
+	l := &LeasingStorage{
+		storage: storage,
+		groups:  options.Groups,
+		now:     time.Now,
+		leases:  make(map[string]*tokenLease),
+		stop:    make(chan struct{}),
+	}
+	l.wg.Go(func() { l.returnExpiredLeases(cleanupInterval) })
+
+	return l
+}
+
+// lease returns the lease of the key, created empty when there is none
+func (l *LeasingStorage) lease(key string) *tokenLease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lease, ok := l.leases[key]
+	if !ok {
+		lease = &tokenLease{}
+		l.leases[key] = lease
+	}
+	return lease
+}
+
+// giveBack returns the unspent tokens of the lease to the storage, the lock of
+// the lease must be held. Tokens that cannot be given back are lost for the
+// current window, which only makes the limit stricter.
+func (l *LeasingStorage) giveBack(ctx context.Context, key string, lease *tokenLease) {
+	if lease.tokens <= 0 {
+		return
+	}
+
+	if err := l.storage.ReturnTokens(ctx, key, lease.capacity, lease.tokens); err != nil {
+		slog.Error("could not give back the leased tokens", "key", key, "tokens", lease.tokens, "error", err)
+	} else {
+		leasedTokensReturnedTotal.WithLabelValues(rateLimitersIdOf(key)).Add(float64(lease.tokens))
+	}
+	lease.tokens = 0
+}
+
+// spend takes a token of the lease, leasing a new batch from the storage when
+// it is empty or expired. The lock of the lease must be held.
+func (l *LeasingStorage) spend(
+	ctx context.Context,
+	key string,
+	lease *tokenLease,
+	cfg config.LeasingConfig,
+	capacity int,
+	refillRate float64,
+	expiresIn time.Duration,
+) (bool, time.Time, error) {
+	group := rateLimitersIdOf(key)
+	now := l.now()
+	if lease.tokens > 0 && now.Before(lease.expiresAt) {
+		lease.tokens--
+		leasedRequestsTotal.WithLabelValues(group).Inc()
+		return true, time.Time{}, nil
+	}
+
+	l.giveBack(ctx, key, lease)
+
+	count := max(int(math.Round(float64(capacity)*cfg.Share)), 1)
+	taken, retryAt, err := l.storage.LeaseTokens(ctx, key, capacity, refillRate, expiresIn, count)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if taken == 0 {
+		return false, retryAt, nil
+	}
+
+	tokenLeasesTotal.WithLabelValues(group).Inc()
+	lease.tokens = taken - 1 // the request spends the first one
+	lease.capacity = capacity
+	lease.expiresAt = now.Add(cfg.TTL)
+	return true, time.Time{}, nil
+}
+
+func (l *LeasingStorage) CheckAndUpdateTokenBucket(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, error) {
+	ok, _, err := l.CheckAndUpdateTokenBucketRetryAt(ctx, key, capacity, refillRate, expiresIn)
+	return ok, err
+}
+
+// CheckAndUpdateTokenBucketRetryAt spends a leased token when the key belongs
+// to a leased group, the requests of a key on the instance wait for each other
+// while a new batch is leased
+func (l *LeasingStorage) CheckAndUpdateTokenBucketRetryAt(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, time.Time, error) {
+	cfg, ok := l.groups[rateLimitersIdOf(key)]
+	if !ok {
+		return l.storage.CheckAndUpdateTokenBucketRetryAt(ctx, key, capacity, refillRate, expiresIn)
+	}
+
+	for {
+		lease := l.lease(key)
+		lease.mu.Lock()
+		if lease.removed {
+			// given back in between, the map already holds a new lease
+			lease.mu.Unlock()
+			continue
+		}
+
+		ok, retryAt, err := l.spend(ctx, key, lease, cfg, capacity, refillRate, expiresIn)
+		lease.mu.Unlock()
+		return ok, retryAt, err
+	}
+}
+
+// returnExpiredLeases gives back the tokens of the leases of the keys that
+// stopped receiving requests
+func (l *LeasingStorage) returnExpiredLeases(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.returnLeases(func(lease *tokenLease) bool {
+				return !l.now().Before(lease.expiresAt)
+			})
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// returnLeases gives back and forgets the leases matching expired
+func (l *LeasingStorage) returnLeases(expired func(lease *tokenLease) bool) {
+	l.mu.Lock()
+	leases := make(map[string]*tokenLease, len(l.leases))
+	for key, lease := range l.leases {
+		leases[key] = lease
+	}
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), leasingReturnTimeout)
+	defer cancel()
+	for key, lease := range leases {
+		lease.mu.Lock()
+		if expired(lease) {
+			l.giveBack(ctx, key, lease)
+			lease.removed = true
+			l.mu.Lock()
+			delete(l.leases, key)
+			l.mu.Unlock()
+		}
+		lease.mu.Unlock()
+	}
+}
+
+func (l *LeasingStorage) CheckAndUpdateLeakyBucket(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, error) {
+	return l.storage.CheckAndUpdateLeakyBucket(ctx, key, capacity, leakRate, expiresIn)
+}
+
+func (l *LeasingStorage) CheckAndUpdateLeakyBucketRetryAt(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, time.Time, error) {
+	return l.storage.CheckAndUpdateLeakyBucketRetryAt(ctx, key, capacity, leakRate, expiresIn)
+}
+
+func (l *LeasingStorage) AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error) {
+	return l.storage.AcquireConcurrencyLease(ctx, key, limit, leaseID, leaseTTL)
+}
+
+func (l *LeasingStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	return l.storage.ReleaseConcurrencyLease(ctx, key, leaseID)
+}
+
+func (l *LeasingStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	return l.storage.CheckAndUpdateBuckets(ctx, buckets)
+}
+
+func (l *LeasingStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	return l.storage.RecordRejection(ctx, key, penalty)
+}
+
+func (l *LeasingStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	return l.storage.BanRemaining(ctx, key)
+}
+
+func (l *LeasingStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	return l.storage.ListBans(ctx)
+}
+
+func (l *LeasingStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	return l.storage.CheckAndUpdateQuota(ctx, key, initialBalance)
+}
+
+func (l *LeasingStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	return l.storage.CreditQuota(ctx, key, initialBalance, amount)
+}
+
+func (l *LeasingStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	return l.storage.IncrementCounter(ctx, key, ttl)
+}
+
+func (l *LeasingStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return l.storage.MarkOnce(ctx, key, ttl)
+}
+
+// Close stops the background work and gives back every lease before closing
+// the storage
+func (l *LeasingStorage) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		l.wg.Wait()
+		l.returnLeases(func(*tokenLease) bool { return true })
+		err = l.storage.Close()
+	})
+	return err
+}
@@ -0,0 +1,141 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"testing"
+	"time"
+)
+
+func newTestLeasingStorage(t *testing.T, mr *miniredis.Miniredis, options LeasingOptions) *LeasingStorage {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	storage := NewLeasingStorage(NewRedisStorage(client), options)
+	t.Cleanup(func() {
+		assert.NoError(t, storage.Close())
+	})
+	return storage
+}
+
+func TestRateLimitersIdOf(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: limiterKey("k1:search", "rpm"), expected: "search"},
+		{key: limiterKey("auth:acme:premium", "rph"), expected: "premium"},
+		{key: limiterKey("10.0.0.1:default", "default"), expected: "default"},
+		{key: "k1:search", expected: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, rateLimitersIdOf(tt.key), tt.key)
+	}
+}
+
+func TestRedisStorage_LeaseTokens(t *testing.T) {
+	mr, storage := newTestRedisStorage(t, nil)
+	ctx := context.Background()
+
+	// the bucket barely refills, a second going by in the test does not count
+	taken, retryAt, err := storage.LeaseTokens(ctx, "k1", 10, 0.001, time.Minute, 4)
+	require.NoError(t, err)
+	assert.Equal(t, 4, taken)
+	assert.True(t, retryAt.IsZero())
+	assertBucketSize(t, mr, "k1", 6, "the lease is taken off a new bucket")
+
+	taken, _, err = storage.LeaseTokens(ctx, "k1", 10, 0.001, time.Minute, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 6, taken, "a bucket running low leases what it has left")
+
+	taken, retryAt, err = storage.LeaseTokens(ctx, "k1", 10, 0.001, time.Minute, 4)
+	require.NoError(t, err)
+	assert.Zero(t, taken)
+	assert.WithinDuration(t, time.Now().Add(1000*time.Second), retryAt, 2*time.Second)
+
+	require.NoError(t, storage.ReturnTokens(ctx, "k1", 10, 3))
+	assert.InDelta(t, 3, getBucketSize(t, mr, "k1"), 0.01, "the tokens are given back")
+	require.NoError(t, storage.ReturnTokens(ctx, "k1", 10, 30))
+	assertBucketSize(t, mr, "k1", 10, "the bucket never goes above its capacity")
+
+	require.NoError(t, storage.ReturnTokens(ctx, "expired", 10, 3))
+	assert.False(t, mr.Exists("expired"), "an expired bucket is not created again")
+}
+
+func TestLeasingStorage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	storage := newTestLeasingStorage(t, mr, LeasingOptions{
+		Groups: map[string]config.LeasingConfig{
+			"search": {Share: 0.2, TTL: time.Minute},
+		},
+	})
+	ctx := context.Background()
+	key := limiterKey("k1:search", "rpm")
+
+	ok, err := storage.CheckAndUpdateTokenBucket(ctx, key, 10, 0.001, time.Hour)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assertBucketSize(t, mr, key, 8, "a fifth of the capacity is leased at once")
+	assert.Equal(t, 1, storage.leases[key].tokens)
+
+	for i := 1; i < 10; i++ {
+		ok, err = storage.CheckAndUpdateTokenBucket(ctx, key, 10, 0.001, time.Hour)
+		require.NoError(t, err)
+		assert.True(t, ok, "request %d", i)
+	}
+	ok, retryAt, err := storage.CheckAndUpdateTokenBucketRetryAt(ctx, key, 10, 0.001, time.Hour)
+	require.NoError(t, err)
+	assert.False(t, ok, "the leases never exceed the capacity")
+	assert.False(t, retryAt.IsZero())
+
+	t.Run("Groups without leasing go to the storage", func(t *testing.T) {
+		key := limiterKey("k1:login", "rpm")
+		ok, err := storage.CheckAndUpdateTokenBucket(ctx, key, 10, 0.001, time.Hour)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assertBucketSize(t, mr, key, 9, "a single token is taken")
+		assert.NotContains(t, storage.leases, key)
+	})
+}
+
+func TestLeasingStorage_ReturnTokens(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	key := limiterKey("k1:search", "rpm")
+
+	t.Run("Expired leases are given back", func(t *testing.T) {
+		storage := newTestLeasingStorage(t, mr, LeasingOptions{
+			Groups:          map[string]config.LeasingConfig{"search": {Share: 0.5, TTL: 50 * time.Millisecond}},
+			CleanupInterval: 10 * time.Millisecond,
+		})
+
+		ok, err := storage.CheckAndUpdateTokenBucket(ctx, key, 10, 0.001, time.Hour)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assertBucketSize(t, mr, key, 5, "half of the capacity is leased")
+
+		assert.Eventually(t, func() bool {
+			storage.mu.Lock()
+			defer storage.mu.Unlock()
+			return len(storage.leases) == 0
+		}, time.Second, 10*time.Millisecond, "the expired lease is forgotten")
+		assertBucketSize(t, mr, key, 9, "the unspent tokens are given back")
+	})
+
+	t.Run("Leases are given back on close", func(t *testing.T) {
+		mr.Del(key)
+		storage := newTestLeasingStorage(t, mr, LeasingOptions{
+			Groups: map[string]config.LeasingConfig{"search": {Share: 0.5, TTL: time.Minute}},
+		})
+
+		ok, err := storage.CheckAndUpdateTokenBucket(ctx, key, 10, 0.001, time.Hour)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		require.NoError(t, storage.Close())
+		assertBucketSize(t, mr, key, 9, "only the spent token is gone")
+	})
+}
@@ -0,0 +1,159 @@
+package rate_limiter
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+)
+
+// memoryEntry is a key of a shard with its expiration and its position in the
+// indexes of the shard
+type memoryEntry struct {
+	key       string
+	value     any
+	expiresAt int64         // unix nano, 0 means the entry never expires
+	heapIndex int           // index in the expiration heap, -1 when the entry never expires
+	element   *list.Element // position in the LRU list, nil when the entry is never evicted
+}
+
+// expirationHeap is a min-heap of the entries ordered by expiration
+type expirationHeap []*memoryEntry
+
+func (h expirationHeap) Len() int           { return len(h) }
+func (h expirationHeap) Less(i, j int) bool { return h[i].expiresAt < h[j].expiresAt }
+
+func (h expirationHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expirationHeap) Push(x any) {
+	entry := x.(*memoryEntry)
+	entry.heapIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expirationHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.heapIndex = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// memoryShard holds the keys of a shard. The least recently used key is
+// evicted once the shard holds more than maxKeys evictable keys, the expired
+// keys are treated as missing on read and swept from the expiration heap.
+// Every method expects the lock of the shard to be held.
+type memoryShard struct {
+	mu          sync.Mutex
+	db          map[string]*memoryEntry
+	lru         *list.List // front is the most recently used entry
+	expirations expirationHeap
+	maxKeys     int // 0 means unbounded
+}
+
+func newMemoryShard(maxKeys int) *memoryShard {
+	return &memoryShard{
+		db:      make(map[string]*memoryEntry),
+		lru:     list.New(),
+		maxKeys: maxKeys,
+	}
+}
+
+// get returns the value of the key, nil when it is missing or expired
+func (s *memoryShard) get(key string, now int64) any {
+	entry, ok := s.db[key]
+	if !ok {
+		return nil
+	}
+	if entry.expiresAt != 0 && entry.expiresAt <= now {
+		s.remove(entry)
+		memoryStorageExpirationsTotal.Inc()
+		return nil
+	}
+
+	if entry.element != nil {
+		s.lru.MoveToFront(entry.element)
+	}
+	return entry.value
+}
+
+// set stores the value of the key until expiresAt, 0 meaning it never
+// expires, and evicts the least recently used keys if the shard is full
+func (s *memoryShard) set(key string, value any, expiresAt int64) {
+	entry := s.upsert(key, value, expiresAt)
+	if entry.element == nil {
+		entry.element = s.lru.PushFront(entry)
+	} else {
+		s.lru.MoveToFront(entry.element)
+	}
+
+	for s.maxKeys > 0 && s.lru.Len() > s.maxKeys {
+		s.remove(s.lru.Back().Value.(*memoryEntry))
+		memoryStorageEvictionsTotal.Inc()
+	}
+}
+
+// pin stores the value of the key until expiresAt, 0 meaning it never
+// expires: it is never evicted and does not count towards maxKeys
+func (s *memoryShard) pin(key string, value any, expiresAt int64) {
+	entry := s.upsert(key, value, expiresAt)
+	if entry.element != nil {
+		s.lru.Remove(entry.element)
+		entry.element = nil
+	}
+}
+
+func (s *memoryShard) upsert(key string, value any, expiresAt int64) *memoryEntry {
+	entry, ok := s.db[key]
+	if !ok {
+		entry = &memoryEntry{key: key, heapIndex: -1}
+		s.db[key] = entry
+	}
+	entry.value = value
+	entry.expiresAt = expiresAt
+
+	switch {
+	case expiresAt == 0 && entry.heapIndex >= 0:
+		heap.Remove(&s.expirations, entry.heapIndex)
+	case expiresAt != 0 && entry.heapIndex >= 0:
+		heap.Fix(&s.expirations, entry.heapIndex)
+	case expiresAt != 0:
+		heap.Push(&s.expirations, entry)
+	}
+
+	return entry
+}
+
+func (s *memoryShard) delete(key string) {
+	if entry, ok := s.db[key]; ok {
+		s.remove(entry)
+	}
+}
+
+func (s *memoryShard) remove(entry *memoryEntry) {
+	delete(s.db, entry.key)
+	if entry.heapIndex >= 0 {
+		heap.Remove(&s.expirations, entry.heapIndex)
+	}
+	if entry.element != nil {
+		s.lru.Remove(entry.element)
+		entry.element = nil
+	}
+}
+
+// removeExpired deletes the keys of the shard whose expiration is past
+func (s *memoryShard) removeExpired(now int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for len(s.expirations) > 0 && s.expirations[0].expiresAt <= now {
+		s.remove(s.expirations[0])
+		removed++
+	}
+	memoryStorageExpirationsTotal.Add(float64(removed))
+}
@@ -0,0 +1,408 @@
+package rate_limiter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The snapshot of a MemoryStorage is made of:
+//   - a header: the magic, the version (uint16) and the time it was taken (int64, unix nano)
+//   - the entries: the kind (byte), the key, the expiration and the fields of the value,
+//     integers being varints, floats 8 bytes and strings prefixed by their length
+//   - an end marker (kind 0) and the CRC32 (uint32) of everything before it
+//
+// Numbers of fixed size are big endian. The concurrency leases are not saved,
+// their holders did not survive the restart. The entries of the bolt storage
+// are encoded the same way, leases included.
+const (
+	memorySnapshotMagic   = "RLMS"
+	memorySnapshotVersion = 1
+)
+
+const (
+	snapshotEnd byte = iota
+	snapshotTokenBucket
+	snapshotLeakyBucket
+	snapshotPenalty
+	snapshotQuota
+	snapshotCounter
+	snapshotConcurrencyLeases
+	snapshotPinnedQuota
+)
+
+var (
+	InvalidSnapshotErr            = errors.New("invalid memory storage snapshot")
+	UnsupportedSnapshotVersionErr = errors.New("unsupported memory storage snapshot version")
+)
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (s *snapshotWriter) byte(v byte) {
+	s.w.WriteByte(v)
+}
+
+func (s *snapshotWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(s.buf[:], v)
+	s.w.Write(s.buf[:n])
+}
+
+func (s *snapshotWriter) varint(v int64) {
+	n := binary.PutVarint(s.buf[:], v)
+	s.w.Write(s.buf[:n])
+}
+
+func (s *snapshotWriter) float(v float64) {
+	binary.BigEndian.PutUint64(s.buf[:8], math.Float64bits(v))
+	s.w.Write(s.buf[:8])
+}
+
+func (s *snapshotWriter) string(v string) {
+	s.uvarint(uint64(len(v)))
+	s.w.WriteString(v)
+}
+
+func (s *snapshotWriter) entry(entry memoryEntry) {
+	switch value := entry.value.(type) {
+	case memoryTokenBucket:
+		s.byte(snapshotTokenBucket)
+		s.string(entry.key)
+		s.varint(entry.expiresAt)
+		s.varint(value.lastRefillUnixNano)
+		s.float(value.bucketSize)
+	case memoryLeakyBucket:
+		s.byte(snapshotLeakyBucket)
+		s.string(entry.key)
+		s.varint(entry.expiresAt)
+		s.varint(value.lastLeakUnixNano)
+		s.float(value.bucketSize)
+	case memoryPenalty:
+		s.byte(snapshotPenalty)
+		s.string(entry.key)
+		s.varint(entry.expiresAt)
+		s.varint(int64(value.rejections))
+		s.varint(value.windowEndUnixNano)
+		s.varint(int64(value.offences))
+		s.varint(value.offencesExpireAtUnixNano)
+		s.varint(value.bannedUntilUnixNano)
+	case memoryQuota:
+		if value.pinned {
+			s.byte(snapshotPinnedQuota)
+		} else {
+			s.byte(snapshotQuota)
+		}
+		s.string(entry.key)
+		s.varint(entry.expiresAt)
+		s.varint(int64(value.balance))
+	case memoryCounter:
+		s.byte(snapshotCounter)
+		s.string(entry.key)
+		s.varint(entry.expiresAt)
+		s.varint(int64(value.value))
+		s.varint(value.expiredAtInUnixNano)
+	case memoryConcurrencyLeases:
+		s.byte(snapshotConcurrencyLeases)
+		s.string(entry.key)
+		s.varint(entry.expiresAt)
+		s.uvarint(uint64(len(value.leases)))
+		for id, expiredAt := range value.leases {
+			s.string(id)
+			s.varint(expiredAt)
+		}
+	}
+}
+
+// snapshotReader decodes the snapshot, the first error is kept and every
+// later read returns the zero value
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (s *snapshotReader) byte() byte {
+	if s.err != nil {
+		return 0
+	}
+	v, err := s.r.ReadByte()
+	s.err = err
+	return v
+}
+
+func (s *snapshotReader) uvarint() uint64 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(s.r)
+	s.err = err
+	return v
+}
+
+func (s *snapshotReader) varint() int64 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(s.r)
+	s.err = err
+	return v
+}
+
+func (s *snapshotReader) float() float64 {
+	var buf [8]byte
+	if s.err == nil {
+		_, s.err = io.ReadFull(s.r, buf[:])
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(buf[:]))
+}
+
+func (s *snapshotReader) string() string {
+	n := s.uvarint()
+	if s.err == nil && n > uint64(s.r.Len()) {
+		s.err = io.ErrUnexpectedEOF
+	}
+	if s.err != nil {
+		return ""
+	}
+	buf := make([]byte, n)
+	_, s.err = io.ReadFull(s.r, buf)
+	return string(buf)
+}
+
+// entry reads the next entry, ok is false once the end marker is reached
+func (s *snapshotReader) entry() (entry memoryEntry, ok bool) {
+	kind := s.byte()
+	if kind == snapshotEnd || s.err != nil {
+		return entry, false
+	}
+
+	entry.key = s.string()
+	entry.expiresAt = s.varint()
+	switch kind {
+	case snapshotTokenBucket:
+		entry.value = memoryTokenBucket{lastRefillUnixNano: s.varint(), bucketSize: s.float()}
+	case snapshotLeakyBucket:
+		entry.value = memoryLeakyBucket{lastLeakUnixNano: s.varint(), bucketSize: s.float()}
+	case snapshotPenalty:
+		entry.value = memoryPenalty{
+			rejections:               int(s.varint()),
+			windowEndUnixNano:        s.varint(),
+			offences:                 int(s.varint()),
+			offencesExpireAtUnixNano: s.varint(),
+			bannedUntilUnixNano:      s.varint(),
+		}
+	case snapshotQuota:
+		entry.value = memoryQuota{balance: int(s.varint())}
+	case snapshotPinnedQuota:
+		entry.value = memoryQuota{balance: int(s.varint()), pinned: true}
+	case snapshotCounter:
+		entry.value = memoryCounter{value: int(s.varint()), expiredAtInUnixNano: s.varint()}
+	case snapshotConcurrencyLeases:
+		n := s.uvarint()
+		leases := make(map[string]int64, min(n, uint64(s.r.Len())))
+		for i := uint64(0); i < n && s.err == nil; i++ {
+			leases[s.string()] = s.varint()
+		}
+		entry.value = memoryConcurrencyLeases{leases: leases}
+	default:
+		s.err = fmt.Errorf("unknown entry kind %d", kind)
+	}
+
+	return entry, s.err == nil
+}
+
+// encodeEntry encodes the entry the same way as in a snapshot
+func encodeEntry(entry memoryEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	sw := snapshotWriter{w: bufio.NewWriter(&buf)}
+	sw.entry(entry)
+	if err := sw.w.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeEntry(data []byte) (memoryEntry, error) {
+	sr := snapshotReader{r: bytes.NewReader(data)}
+	entry, ok := sr.entry()
+	if !ok && sr.err == nil {
+		sr.err = io.ErrUnexpectedEOF
+	}
+	return entry, sr.err
+}
+
+// Snapshot writes the keys of the storage to w. The shards are copied one at
+// a time, so the snapshot of a shard is consistent but the shards are not
+// taken at the exact same time.
+func (m *MemoryStorage) Snapshot(w io.Writer) error {
+	var (
+		checksum = crc32.NewIEEE()
+		sw       = snapshotWriter{w: bufio.NewWriter(io.MultiWriter(w, checksum))}
+		now      = time.Now().UnixNano()
+	)
+
+	sw.w.WriteString(memorySnapshotMagic)
+	binary.BigEndian.PutUint16(sw.buf[:2], memorySnapshotVersion)
+	sw.w.Write(sw.buf[:2])
+	binary.BigEndian.PutUint64(sw.buf[:8], uint64(now))
+	sw.w.Write(sw.buf[:8])
+
+	for _, s := range m.shards {
+		for _, entry := range s.entries(now) {
+			if _, ok := entry.value.(memoryConcurrencyLeases); !ok {
+				sw.entry(entry)
+			}
+		}
+	}
+	sw.byte(snapshotEnd)
+
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, checksum.Sum32())
+}
+
+// entries copies the live entries of the shard from the least to the most
+// recently used one, followed by the entries never evicted
+func (s *memoryShard) entries(now int64) []memoryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]memoryEntry, 0, len(s.db))
+	for element := s.lru.Back(); element != nil; element = element.Prev() {
+		if entry := element.Value.(*memoryEntry); entry.expiresAt == 0 || entry.expiresAt > now {
+			entries = append(entries, *entry)
+		}
+	}
+	for _, entry := range s.db {
+		if entry.element == nil {
+			entries = append(entries, *entry)
+		}
+	}
+
+	return entries
+}
+
+// Restore loads the keys of a snapshot written by Snapshot, it returns the
+// number of keys restored. The keys expired since the snapshot are dropped
+// and the timestamps ahead of the clock, after a clock adjustment, are
+// brought back to now. Nothing is restored from an invalid snapshot.
+func (m *MemoryStorage) Restore(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	headerLen := len(memorySnapshotMagic) + 2 + 8
+	if len(data) < headerLen+4 || string(data[:len(memorySnapshotMagic)]) != memorySnapshotMagic {
+		return 0, InvalidSnapshotErr
+	}
+	if version := binary.BigEndian.Uint16(data[len(memorySnapshotMagic):]); version != memorySnapshotVersion {
+		return 0, fmt.Errorf("%w: %d", UnsupportedSnapshotVersionErr, version)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return 0, fmt.Errorf("%w: checksum mismatch", InvalidSnapshotErr)
+	}
+
+	sr := snapshotReader{r: bytes.NewReader(body[headerLen:])}
+	var entries []memoryEntry
+	for {
+		entry, ok := sr.entry()
+		if !ok {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	if sr.err != nil {
+		return 0, fmt.Errorf("%w: %w", InvalidSnapshotErr, sr.err)
+	}
+
+	now := time.Now().UnixNano()
+	restored := 0
+	for _, entry := range entries {
+		if entry.expiresAt != 0 && entry.expiresAt <= now {
+			continue
+		}
+		switch value := entry.value.(type) {
+		case memoryTokenBucket:
+			value.lastRefillUnixNano = min(value.lastRefillUnixNano, now)
+			entry.value = value
+		case memoryLeakyBucket:
+			value.lastLeakUnixNano = min(value.lastLeakUnixNano, now)
+			entry.value = value
+		}
+
+		s := m.shard(entry.key)
+		s.mu.Lock()
+		if pinnedEntry(entry.value) {
+			s.pin(entry.key, entry.value, entry.expiresAt)
+		} else {
+			s.set(entry.key, entry.value, entry.expiresAt)
+		}
+		s.mu.Unlock()
+		restored++
+	}
+
+	return restored, nil
+}
+
+// SaveSnapshot writes the snapshot to a temporary file renamed to path once
+// complete, so that a crash never leaves a truncated snapshot behind
+func (m *MemoryStorage) SaveSnapshot(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // no-op once renamed
+
+	if err := m.Snapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot saved at path by SaveSnapshot
+func (m *MemoryStorage) LoadSnapshot(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return m.Restore(file)
+}
+
+func (m *MemoryStorage) saveSnapshotPeriodically(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.SaveSnapshot(path); err != nil {
+				slog.Error("could not save the memory storage snapshot", "path", path, "error", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorage_SnapshotAndRestore(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		storage = newTestMemoryStorage()
+		penalty = config.PenaltyConfig{MaxRejections: 1, Window: time.Minute, BanDuration: time.Minute, MaxBanDuration: time.Hour, ForgetAfter: time.Hour}
+	)
+
+	_, err := storage.CheckAndUpdateTokenBucket(ctx, "john:search:rpm", 5, 1, time.Minute)
+	require.NoError(t, err)
+	_, err = storage.CheckAndUpdateLeakyBucket(ctx, "john:upload:rpm", 5, 1, time.Minute)
+	require.NoError(t, err)
+	_, err = storage.RecordRejection(ctx, "john:search", penalty)
+	require.NoError(t, err)
+	_, _, err = storage.CheckAndUpdateQuota(ctx, "john:calls:quota", 10)
+	require.NoError(t, err)
+	_, err = storage.CreditQuota(ctx, "john:credits:quota", 10, 5)
+	require.NoError(t, err)
+	_, err = storage.IncrementCounter(ctx, "john:search:usage:0", time.Hour)
+	require.NoError(t, err)
+	_, err = storage.AcquireConcurrencyLease(ctx, "john:export:concurrency", 1, "lease", time.Minute)
+	require.NoError(t, err)
+
+	var snapshot bytes.Buffer
+	require.NoError(t, storage.Snapshot(&snapshot))
+
+	restoredStorage := newTestMemoryStorage()
+	restored, err := restoredStorage.Restore(&snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, 6, restored)
+
+	for _, key := range []string{"john:search:rpm", "john:upload:rpm", "john:search:penalty", "john:calls:quota", "john:credits:quota", "john:search:usage:0"} {
+		assert.Equal(t, storage.load(key), restoredStorage.load(key), key)
+	}
+	assert.Nil(t, restoredStorage.load("john:export:concurrency"), "The leases of the previous process are not restored")
+
+	remaining, err := restoredStorage.BanRemaining(ctx, "john:search")
+	require.NoError(t, err)
+	assert.Greater(t, remaining, time.Duration(0), "The ban survives the restart")
+}
+
+func TestMemoryStorage_Restore_AdjustsEntries(t *testing.T) {
+	storage := newTestMemoryStorage()
+	_, err := storage.CheckAndUpdateTokenBucket(context.Background(), "john:search:rps", 5, 1, time.Millisecond*10)
+	require.NoError(t, err)
+	storage.store("john:search:rpm", memoryTokenBucket{lastRefillUnixNano: time.Now().Add(time.Hour).UnixNano(), bucketSize: 1})
+
+	var snapshot bytes.Buffer
+	require.NoError(t, storage.Snapshot(&snapshot))
+	time.Sleep(time.Millisecond * 20)
+
+	restoredStorage := newTestMemoryStorage()
+	restored, err := restoredStorage.Restore(&snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored, "The bucket expired since the snapshot is dropped")
+
+	bucket, ok := restoredStorage.load("john:search:rpm").(memoryTokenBucket)
+	require.True(t, ok)
+	assert.LessOrEqual(t, bucket.lastRefillUnixNano, time.Now().UnixNano(), "The refill ahead of the clock is brought back to now")
+}
+
+func TestMemoryStorage_Restore_InvalidSnapshot(t *testing.T) {
+	storage := newTestMemoryStorage()
+	_, err := storage.CheckAndUpdateTokenBucket(context.Background(), "john:search:rpm", 5, 1, time.Minute)
+	require.NoError(t, err)
+
+	var snapshot bytes.Buffer
+	require.NoError(t, storage.Snapshot(&snapshot))
+	valid := snapshot.Bytes()
+
+	corrupt := func(i int, b byte) []byte {
+		data := bytes.Clone(valid)
+		data[i] = b
+		return data
+	}
+
+	tests := []struct {
+		id       string
+		snapshot []byte
+		err      error
+	}{
+		{id: "Empty snapshot", snapshot: nil, err: InvalidSnapshotErr},
+		{id: "Wrong magic", snapshot: corrupt(0, 'X'), err: InvalidSnapshotErr},
+		{id: "Unsupported version", snapshot: corrupt(5, memorySnapshotVersion+1), err: UnsupportedSnapshotVersionErr},
+		{id: "Checksum mismatch", snapshot: corrupt(len(valid)-6, 0xff), err: InvalidSnapshotErr},
+		{id: "Truncated snapshot", snapshot: valid[:len(valid)-10], err: InvalidSnapshotErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			restoredStorage := newTestMemoryStorage()
+			restored, err := restoredStorage.Restore(bytes.NewReader(tt.snapshot))
+			require.ErrorIs(t, err, tt.err)
+			assert.Equal(t, 0, restored)
+			assert.Equal(t, 0, restoredStorage.len(), "Nothing is restored from an invalid snapshot")
+		})
+	}
+}
+
+func TestMemoryStorage_SnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rlim.snapshot")
+
+	storage := NewMemoryStorageWithOptions(MemoryStorageOptions{SnapshotFile: path})
+	assert.Equal(t, 0, storage.len(), "A missing snapshot starts an empty storage")
+	for range 2 {
+		_, err := storage.CheckAndUpdateTokenBucket(context.Background(), "john:search:rpm", 2, 0, time.Minute)
+		require.NoError(t, err)
+	}
+	require.NoError(t, storage.Close(), "The snapshot is saved on close")
+
+	restartedStorage := NewMemoryStorageWithOptions(MemoryStorageOptions{SnapshotFile: path})
+	defer restartedStorage.Close()
+	ok, err := restartedStorage.CheckAndUpdateTokenBucket(context.Background(), "john:search:rpm", 2, 0, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok, "The bucket emptied before the restart is still empty")
+}
+
+func TestMemoryStorage_SnapshotInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rlim.snapshot")
+	storage := NewMemoryStorageWithOptions(MemoryStorageOptions{SnapshotFile: path, SnapshotInterval: time.Millisecond * 10})
+	defer storage.Close()
+
+	_, err := storage.CheckAndUpdateTokenBucket(context.Background(), "john:search:rpm", 2, 0, time.Minute)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		restored, err := newTestMemoryStorage().LoadSnapshot(path)
+		return err == nil && restored == 1
+	}, time.Second, time.Millisecond*10, "The snapshot is saved periodically")
+}
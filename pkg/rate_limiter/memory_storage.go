@@ -2,61 +2,203 @@ package rate_limiter
 
 import (
 	"context"
+	"errors"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/env"
 	"log/slog"
-	"math"
+	"math/bits"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
+// defaultMemoryStorageShards spreads the keys over enough locks for the
+// goroutines of every core to rarely wait on each other
+const defaultMemoryStorageShards = 64
+
+const defaultMemoryStorageCleanupInterval = time.Second
+
+// MemoryStorage spreads the keys over shards by hash, each shard having its
+// own lock and expiration index, so that requests for different keys are
+// rarely serialized. Operations on several keys lock their shards in order.
+// The expired keys are swept in the background until Close is called, and
+// the least recently used keys are evicted once MaxKeys is reached.
 type MemoryStorage struct {
-	mu           *sync.Mutex
-	db           map[string]any
-	expirationDb map[int64][]string
+	shards       []*memoryShard
+	shardMask    uint64
 	requestCost  float64
+	snapshotFile string
+	stop         chan struct{}
+	wg           sync.WaitGroup
+	closeOnce    sync.Once
+}
+
+type MemoryStorageOptions struct {
+	Shards          int           // number of shards, rounded up to a power of two (default: 64)
+	MaxKeys         int           // max keys held, split evenly between the shards, 0 means unbounded
+	CleanupInterval time.Duration // interval between two sweeps of the expired keys (default: 1s)
+	// SnapshotFile is restored on creation and saved on Close, every
+	// SnapshotInterval as well when it is positive. No snapshot when empty.
+	SnapshotFile     string
+	SnapshotInterval time.Duration
 }
 
 type memoryTokenBucket struct {
-	lastRefillUnixNano  int64
-	bucketSize          float64
-	expiredAtInUnixNano int64
+	lastRefillUnixNano int64
+	bucketSize         float64
 }
 
 type memoryLeakyBucket struct {
-	lastLeakUnixNano    int64
-	bucketSize          float64
+	lastLeakUnixNano int64
+	bucketSize       float64
+}
+
+type memoryPenalty struct {
+	rejections               int   // rejections counted in the current window
+	windowEndUnixNano        int64 // end of the window counting the rejections
+	offences                 int   // number of bans not forgotten yet
+	offencesExpireAtUnixNano int64
+	bannedUntilUnixNano      int64
+}
+
+// memoryQuota is the prepaid balance of a key, it never expires
+type memoryQuota struct {
+	balance int
+	pinned  bool // the balance differs from the initial one
+}
+
+type memoryCounter struct {
+	value               int
 	expiredAtInUnixNano int64
 }
 
+type memoryConcurrencyLeases struct {
+	leases map[string]int64 // lease expiration indexed by lease id
+}
+
+// NewMemory creates the memory storage configured by the env
+func NewMemory() *MemoryStorage {
+	envObj := env.GetEnv()
+	return NewMemoryStorageWithOptions(MemoryStorageOptions{
+		Shards:           envObj.MemoryStorageShards,
+		MaxKeys:          envObj.MemoryStorageMaxKeys,
+		CleanupInterval:  envObj.MemoryStorageCleanupInterval,
+		SnapshotFile:     envObj.MemoryStorageSnapshotFile,
+		SnapshotInterval: envObj.MemoryStorageSnapshotInterval,
+	})
+}
+
 func NewMemoryStorage() Storer {
-	return &MemoryStorage{
-		db:           make(map[string]any),
-		expirationDb: make(map[int64][]string),
-		mu:           &sync.Mutex{},
+	return NewMemoryStorageWithOptions(MemoryStorageOptions{})
+}
+
+func NewMemoryStorageWithOptions(options MemoryStorageOptions) *MemoryStorage {
+	shards := defaultMemoryStorageShards
+	if options.Shards > 0 {
+		shards = 1 << bits.Len(uint(options.Shards-1))
+	}
+	maxKeysPerShard := 0
+	if options.MaxKeys > 0 {
+		maxKeysPerShard = max((options.MaxKeys+shards-1)/shards, 1)
+	}
+	cleanupInterval := defaultMemoryStorageCleanupInterval
+	if options.CleanupInterval > 0 {
+		cleanupInterval = options.CleanupInterval
+	}
+
+	m := &MemoryStorage{
+		shards:       make([]*memoryShard, shards),
+		shardMask:    uint64(shards - 1),
 		requestCost:  1.0,
+		snapshotFile: options.SnapshotFile,
+		stop:         make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = newMemoryShard(maxKeysPerShard)
+	}
+
+	if m.snapshotFile != "" {
+		restored, err := m.LoadSnapshot(m.snapshotFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			slog.Info("no memory storage snapshot to restore", "path", m.snapshotFile)
+		case err != nil:
+			slog.Error("could not restore the memory storage snapshot, starting empty", "path", m.snapshotFile, "error", err)
+		default:
+			slog.Info("memory storage snapshot restored", "path", m.snapshotFile, "keys", restored)
+		}
+		if options.SnapshotInterval > 0 {
+			m.wg.Go(func() { m.saveSnapshotPeriodically(m.snapshotFile, options.SnapshotInterval) })
+		}
+	}
+	m.wg.Go(func() { m.removeExpiredKeys(cleanupInterval) })
+
+	return m
+}
+
+// shardIndex hashes the key with FNV-1a, inlined to avoid allocating
+func (m *MemoryStorage) shardIndex(key string) int {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return int(hash & m.shardMask)
+}
+
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	return m.shards[m.shardIndex(key)]
+}
+
+// lockShards locks, in order, the shards of the keys and returns the function unlocking them
+func (m *MemoryStorage) lockShards(keys []string) func() {
+	indexes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		indexes = append(indexes, m.shardIndex(key))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+
+	for _, i := range indexes {
+		m.shards[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			m.shards[i].mu.Unlock()
+		}
 	}
 }
-func (m *MemoryStorage) removeExpiredBucket(tickerDuration time.Duration, stop <-chan bool) {
-	go func() {
-		ticker := time.NewTicker(tickerDuration)
-		for {
-			select {
-			case <-ticker.C:
-				m.mu.Lock()
-				for expiredAt, expiredKeys := range m.expirationDb {
-					if time.Now().UnixNano() < expiredAt {
-						continue
-					}
-					for _, key := range expiredKeys {
-						delete(m.db, key)
-					}
-				}
-				m.mu.Unlock()
-			case <-stop:
-				ticker.Stop()
-				return
+
+func (m *MemoryStorage) removeExpiredKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// the shards are swept one at a time, the others keep serving requests
+			for _, shard := range m.shards {
+				shard.removeExpired(time.Now().UnixNano())
 			}
+		case <-m.stop:
+			return
 		}
-	}()
+	}
+}
+
+// Close stops the background work and saves the last snapshot, the storage
+// keeps serving requests but they are not saved anymore
+func (m *MemoryStorage) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		m.wg.Wait()
+		if m.snapshotFile != "" {
+			err = m.SaveSnapshot(m.snapshotFile)
+		}
+	})
+	return err
 }
 
 func (m *MemoryStorage) CheckAndUpdateTokenBucket(
@@ -66,43 +208,11 @@ func (m *MemoryStorage) CheckAndUpdateTokenBucket(
 	refillRate float64,
 	expiresIn time.Duration,
 ) (bool, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	var (
-		now               = time.Now().UnixNano()
-		updateTokenBucket = func(bucketSize float64, setExpiration bool) {
-			bucket := memoryTokenBucket{
-				lastRefillUnixNano: now,
-				bucketSize:         bucketSize,
-			}
-			if setExpiration {
-				bucket.expiredAtInUnixNano = time.Now().Add(expiresIn).UnixNano()
-			}
-			m.db[key] = bucket
-			m.expirationDb[bucket.expiredAtInUnixNano] = append(m.expirationDb[bucket.expiredAtInUnixNano], key)
-		}
-	)
-
-	slog.Debug("looking for bucket with", "key", key)
-	match, ok := m.db[key].(memoryTokenBucket)
-	if !ok { // if no token_bucket match the key create one
-		bucketSize := float64(capacity) - m.requestCost
-		slog.Debug("creating new token bucket", "key", key, "bucketSize", bucketSize)
-		updateTokenBucket(bucketSize, true) // remove the cost of the ongoing request
-		return true, nil
-	}
-
-	elapsedSecondsSinceLastRefill := math.Round(time.Now().Sub(time.Unix(0, match.lastRefillUnixNano)).Seconds())
-	tokensToRefill := elapsedSecondsSinceLastRefill * refillRate
-	bucketSize := math.Min(float64(capacity), tokensToRefill+match.bucketSize)
-
-	if bucketSize >= m.requestCost {
-		slog.Debug("refilling token bucket", "key", key, "bucketSize", bucketSize)
-		updateTokenBucket(bucketSize-m.requestCost, false)
-		return true, nil
-	}
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return false, nil
+	return checkAndUpdateTokenBucket(s, key, capacity, refillRate, expiresIn, m.requestCost, time.Now()), nil
 }
 
 func (m *MemoryStorage) CheckAndUpdateLeakyBucket(
@@ -112,41 +222,128 @@ func (m *MemoryStorage) CheckAndUpdateLeakyBucket(
 	leakRate float64,
 	expiresIn time.Duration,
 ) (bool, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	var (
-		now               = time.Now().UnixNano()
-		updateLeakyBucket = func(bucketSize float64, setExpiration bool) {
-			bucket := memoryLeakyBucket{
-				lastLeakUnixNano: now,
-				bucketSize:       bucketSize,
-			}
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return checkAndUpdateLeakyBucket(s, key, maxTokens, leakRate, expiresIn, m.requestCost, time.Now()), nil
+}
+
+func (m *MemoryStorage) AcquireConcurrencyLease(
+	ctx context.Context,
+	key string,
+	limit int,
+	leaseID string,
+	leaseTTL time.Duration,
+) (bool, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return acquireConcurrencyLease(s, key, limit, leaseID, leaseTTL, time.Now()), nil
+}
+
+func (m *MemoryStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	releaseConcurrencyLease(s, key, leaseID, time.Now())
+	return nil
+}
+
+func (m *MemoryStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	keys := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		keys = append(keys, bucket.Key)
+	}
+	unlock := m.lockShards(keys)
+	defer unlock()
+
+	storeOf := func(key string) entryStore { return m.shard(key) }
+	return checkAndUpdateBuckets(storeOf, buckets, m.requestCost, time.Now()), nil
+}
 
-			if setExpiration {
-				bucket.expiredAtInUnixNano = time.Now().Add(expiresIn).UnixNano()
+// checkBuckets tells which bucket would reject the request without charging
+// any, it returns -1 when every bucket would accept it
+func (m *MemoryStorage) checkBuckets(buckets []Bucket) int {
+	keys := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		keys = append(keys, bucket.Key)
+	}
+	unlock := m.lockShards(keys)
+	defer unlock()
+
+	storeOf := func(key string) entryStore { return m.shard(key) }
+	return checkBuckets(storeOf, buckets, m.requestCost, time.Now())
+}
+
+func (m *MemoryStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	s := m.shard(penaltyKey(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return recordRejection(s, key, penalty, time.Now()), nil
+}
+
+func (m *MemoryStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	s := m.shard(penaltyKey(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return banRemaining(s, key, time.Now()), nil
+}
+
+func (m *MemoryStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	now := time.Now().UnixNano()
+
+	var bans []Ban
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for k, entry := range s.db {
+			if match, ok := entry.value.(memoryPenalty); ok && match.bannedUntilUnixNano > now {
+				bans = append(bans, Ban{
+					Key:   strings.TrimSuffix(k, ":penalty"),
+					Until: time.Unix(0, match.bannedUntilUnixNano),
+				})
 			}
-			m.db[key] = bucket
 		}
-	)
-
-	slog.Debug("looking for bucket with", "key", key)
-	match, ok := m.db[key].(memoryLeakyBucket)
-	if !ok { // if no leaky_bucket match the key create one
-		bucketSize := m.requestCost
-		slog.Debug("creating new leaky bucket", "key", key, "bucketSize", bucketSize)
-		updateLeakyBucket(bucketSize, true)
-		return true, nil
+		s.mu.Unlock()
 	}
+	slices.SortFunc(bans, func(a, b Ban) int { return a.Until.Compare(b.Until) })
 
-	elapsedSecondsSinceLastLeak := math.Round(time.Now().Sub(time.Unix(0, match.lastLeakUnixNano)).Seconds())
-	nbTokensToLeak := elapsedSecondsSinceLastLeak * leakRate
-	bucketSize := math.Max(0, match.bucketSize-nbTokensToLeak)
+	return bans, nil
+}
 
-	if n := bucketSize + m.requestCost; n <= float64(maxTokens) {
-		slog.Debug("leaking tokens", "key", key, "bucketSize", bucketSize)
-		updateLeakyBucket(n, false)
-		return true, nil
-	}
+func (m *MemoryStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, balance := checkAndUpdateQuota(s, key, initialBalance, time.Now())
+	return ok, balance, nil
+}
+
+func (m *MemoryStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return creditQuota(s, key, initialBalance, amount, time.Now()), nil
+}
+
+func (m *MemoryStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return incrementCounter(s, key, ttl, time.Now()), nil
+}
+
+func (m *MemoryStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return false, nil
+	return markOnce(s, key, ttl, time.Now()), nil
 }
@@ -2,20 +2,48 @@ package rate_limiter
 
 import (
 	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func newTestMemoryStorage() MemoryStorage {
-	return MemoryStorage{
-		mu:           &sync.Mutex{},
-		db:           make(map[string]any),
-		expirationDb: make(map[int64][]string),
-		requestCost:  1.0,
+func newTestMemoryStorage() *MemoryStorage {
+	storage := NewMemoryStorageWithOptions(MemoryStorageOptions{})
+	storage.Close()
+	return storage
+}
+
+// load returns the value stored under the key, locking its shard
+func (m *MemoryStorage) load(key string) any {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key, time.Now().UnixNano())
+}
+
+// len returns the number of keys held, expired or not
+func (m *MemoryStorage) len() int {
+	n := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		n += len(s.db)
+		s.mu.Unlock()
 	}
+	return n
+}
+
+// store sets the value of the key without expiration, locking its shard
+func (m *MemoryStorage) store(key string, value any) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value, 0)
 }
 
 func TestMemoryStorage_CheckAndUpdateLeakyBucket(t *testing.T) {
@@ -74,7 +102,9 @@ func TestMemoryStorage_CheckAndUpdateLeakyBucket(t *testing.T) {
 
 	for _, tt := range tests {
 		storage := newTestMemoryStorage()
-		storage.db = tt.db
+		for k, v := range tt.db {
+			storage.store(k, v)
+		}
 
 		t.Run(tt.id, func(t *testing.T) {
 			ok, err := storage.CheckAndUpdateLeakyBucket(context.Background(),
@@ -145,7 +175,9 @@ func TestMemoryStorage_CheckAndUpdateTokenBucket(t *testing.T) {
 
 	for _, tt := range tests {
 		storage := newTestMemoryStorage()
-		storage.db = tt.db
+		for k, v := range tt.db {
+			storage.store(k, v)
+		}
 
 		t.Run(tt.id, func(t *testing.T) {
 			ok, err := storage.CheckAndUpdateTokenBucket(context.Background(),
@@ -166,10 +198,10 @@ func TestMemoryStorage_TokenBucket_EdgeCases(t *testing.T) {
 
 		// Set up bucket with exactly 1.0 bucketSize
 		key := "token:boundary"
-		storage.db[key] = memoryTokenBucket{
+		storage.store(key, memoryTokenBucket{
 			lastRefillUnixNano: time.Now().UnixNano(),
 			bucketSize:         1.0,
-		}
+		})
 
 		// Should allow request when bucketSize exactly equals requestCost
 		ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), key, 10, 1.0, 0)
@@ -177,7 +209,7 @@ func TestMemoryStorage_TokenBucket_EdgeCases(t *testing.T) {
 		assert.True(t, ok, "Should allow request when bucketSize exactly equals requestCost")
 
 		// Verify bucketSize were consumed
-		bucket := storage.db[key].(memoryTokenBucket)
+		bucket := storage.load(key).(memoryTokenBucket)
 		assert.Equal(t, 0.0, bucket.bucketSize, "bucketSize should be 0 after consuming exactly 1.0")
 	})
 
@@ -216,10 +248,10 @@ func TestMemoryStorage_TokenBucket_EdgeCases(t *testing.T) {
 		refillRate := 100.0 // Very high refill rate
 
 		// Set up bucket with some bucketSize, long time ago
-		storage.db[key] = memoryTokenBucket{
+		storage.store(key, memoryTokenBucket{
 			lastRefillUnixNano: time.Now().Add(-10 * time.Second).UnixNano(),
 			bucketSize:         5.0,
-		}
+		})
 
 		// Request should succeed
 		ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), key, capacity, refillRate, 0)
@@ -227,7 +259,7 @@ func TestMemoryStorage_TokenBucket_EdgeCases(t *testing.T) {
 		assert.True(t, ok)
 
 		// bucketSize should be capped at capacity-1 (after consuming 1)
-		bucket := storage.db[key].(memoryTokenBucket)
+		bucket := storage.load(key).(memoryTokenBucket)
 		assert.LessOrEqual(t, bucket.bucketSize, float64(capacity), "bucketSize should not exceed capacity")
 	})
 
@@ -299,14 +331,8 @@ func TestMemoryStorage_TokenBucket_EdgeCases(t *testing.T) {
 	})
 
 	t.Run("Buckets are removed when they expires", func(t *testing.T) {
-		storage := newTestMemoryStorage()
-
-		stop := make(chan bool)
-		defer func() {
-			stop <- true
-		}()
-
-		storage.removeExpiredBucket(time.Millisecond*10, stop)
+		storage := NewMemoryStorageWithOptions(MemoryStorageOptions{CleanupInterval: time.Millisecond * 10})
+		defer storage.Close()
 
 		key := "token:expired"
 		capacity := 1
@@ -317,21 +343,31 @@ func TestMemoryStorage_TokenBucket_EdgeCases(t *testing.T) {
 		require.NoError(t, err)
 		assert.True(t, ok, "Request should success")
 
-		storage.mu.Lock()
-		bucket, _ := storage.db[key].(memoryTokenBucket)
-		storage.mu.Unlock()
+		bucket, _ := storage.load(key).(memoryTokenBucket)
 		assert.Equal(t, 0.0, bucket.bucketSize, "Bucket size should be decremented")
 
-		time.Sleep(time.Millisecond * 10)
-
-		storage.mu.Lock()
-		assert.Nil(t, storage.db[key], "Bucket was removed because it expired")
-		storage.mu.Unlock()
+		assert.Eventually(t, func() bool { return storage.len() == 0 }, time.Second, time.Millisecond*5,
+			"Bucket was removed because it expired")
 
 		ok, err = storage.CheckAndUpdateTokenBucket(context.Background(), key, capacity, refillRate, expiresIn)
 		require.NoError(t, err)
 		assert.True(t, ok, "Request should success because previous bucket was removed")
+	})
+
+	t.Run("Refreshed buckets keep expiring", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "token:refreshed"
+
+		for range 2 {
+			ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), key, 2, 0, time.Millisecond*10)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		}
+		time.Sleep(time.Millisecond * 20)
 
+		ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), key, 2, 0, time.Millisecond*10)
+		require.NoError(t, err)
+		assert.True(t, ok, "The refreshed bucket expired and was created again")
 	})
 }
 
@@ -343,10 +379,10 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		maxTokens := 2
 
 		// Set up bucket with maxTokens-1 tokens
-		storage.db[key] = memoryLeakyBucket{
+		storage.store(key, memoryLeakyBucket{
 			lastLeakUnixNano: time.Now().UnixNano(),
 			bucketSize:       1.0,
-		}
+		})
 
 		// Should allow request that brings us exactly to capacity
 		ok, err := storage.CheckAndUpdateLeakyBucket(context.Background(), key, maxTokens, 1.0, 0)
@@ -354,7 +390,7 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		assert.True(t, ok, "Should allow request when result equals capacity")
 
 		// Verify bucket is now at capacity
-		bucket := storage.db[key].(memoryLeakyBucket)
+		bucket := storage.load(key).(memoryLeakyBucket)
 		assert.Equal(t, 2.0, bucket.bucketSize, "Bucket should be at capacity (2.0)")
 	})
 
@@ -370,7 +406,7 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		require.NoError(t, err)
 		assert.True(t, ok)
 
-		bucket := storage.db[key].(memoryLeakyBucket)
+		bucket := storage.load(key).(memoryLeakyBucket)
 		assert.Equal(t, 1.0, bucket.bucketSize, "First request should add 1 token")
 
 		// Second request immediately
@@ -378,7 +414,7 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		require.NoError(t, err)
 		assert.True(t, ok)
 
-		bucket = storage.db[key].(memoryLeakyBucket)
+		bucket = storage.load(key).(memoryLeakyBucket)
 		assert.Equal(t, 2.0, bucket.bucketSize, "Second request should increase to 2 bucketSize")
 
 		// Third request
@@ -386,7 +422,7 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		require.NoError(t, err)
 		assert.True(t, ok)
 
-		bucket = storage.db[key].(memoryLeakyBucket)
+		bucket = storage.load(key).(memoryLeakyBucket)
 		assert.Equal(t, 3.0, bucket.bucketSize, "Third request should increase to 3 bucketSize")
 	})
 
@@ -398,10 +434,10 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		leakRate := 2.0 // 2 bucketSize per second
 
 		// Fill bucket to capacity
-		storage.db[key] = memoryLeakyBucket{
+		storage.store(key, memoryLeakyBucket{
 			lastLeakUnixNano: time.Now().Add(-1 * time.Second).UnixNano(),
 			bucketSize:       5.0,
-		}
+		})
 
 		// After 1 second, 2 bucketSize should have leaked
 		// So bucket should have 3 bucketSize, allowing a request
@@ -409,7 +445,7 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		require.NoError(t, err)
 		assert.True(t, ok, "Request should succeed after leak drains bucket")
 
-		bucket := storage.db[key].(memoryLeakyBucket)
+		bucket := storage.load(key).(memoryLeakyBucket)
 		// After leak (5 - 2 = 3) and adding request (3 + 1 = 4)
 		assert.InDelta(t, 4.0, bucket.bucketSize, 0.1, "Bucket should have ~4 bucketSize after leak and request")
 	})
@@ -421,17 +457,17 @@ func TestMemoryStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		leakRate := 10.0 // Very high leak rate
 
 		// Set up bucket with 1 token, long time ago
-		storage.db[key] = memoryLeakyBucket{
+		storage.store(key, memoryLeakyBucket{
 			lastLeakUnixNano: time.Now().Add(-10 * time.Second).UnixNano(),
 			bucketSize:       1.0,
-		}
+		})
 
 		// After 10 seconds with leak rate 10, all bucketSize should have leaked
 		ok, err := storage.CheckAndUpdateLeakyBucket(context.Background(), key, maxTokens, leakRate, 0)
 		require.NoError(t, err)
 		assert.True(t, ok)
 
-		bucket := storage.db[key].(memoryLeakyBucket)
+		bucket := storage.load(key).(memoryLeakyBucket)
 		assert.GreaterOrEqual(t, bucket.bucketSize, 0.0, "bucketSize should never be negative")
 	})
 
@@ -549,3 +585,396 @@ func TestMemoryStorage_AlgorithmBehaviorComparison(t *testing.T) {
 		assert.False(t, okLeaky, "Leaky bucket should deny when full")
 	})
 }
+
+func TestMemoryStorage_ConcurrencyLease(t *testing.T) {
+	t.Run("Leases are limited and released", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "concurrency:john"
+
+		for i := 0; i < 2; i++ {
+			ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 2, fmt.Sprintf("lease-%d", i), time.Minute)
+			require.NoError(t, err)
+			assert.True(t, ok, "Lease %d should be acquired", i)
+		}
+
+		ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 2, "lease-2", time.Minute)
+		require.NoError(t, err)
+		assert.False(t, ok, "Limit is reached")
+
+		require.NoError(t, storage.ReleaseConcurrencyLease(context.Background(), key, "lease-0"))
+
+		ok, err = storage.AcquireConcurrencyLease(context.Background(), key, 2, "lease-2", time.Minute)
+		require.NoError(t, err)
+		assert.True(t, ok, "Lease should be acquired once another one is released")
+	})
+
+	t.Run("Expired leases are reclaimed", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "concurrency:crashed"
+		storage.store(key, memoryConcurrencyLeases{
+			leases: map[string]int64{
+				"crashed-holder": time.Now().Add(-time.Second).UnixNano(),
+			},
+		})
+
+		ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 1, "lease-1", time.Minute)
+		require.NoError(t, err)
+		assert.True(t, ok, "The lease of the crashed holder should be reclaimed")
+	})
+
+	t.Run("Releasing an unknown lease is a no-op", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		require.NoError(t, storage.ReleaseConcurrencyLease(context.Background(), "concurrency:unknown", "lease"))
+	})
+
+	t.Run("Concurrent acquisitions - race condition test", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "concurrency:concurrent"
+		limit := 5
+
+		var (
+			wg           sync.WaitGroup
+			countMutex   sync.Mutex
+			successCount int
+		)
+		for i := 0; i < 20; i++ {
+			wg.Go(func() {
+				ok, err := storage.AcquireConcurrencyLease(context.Background(), key, limit, fmt.Sprintf("lease-%d", i), time.Minute)
+				require.NoError(t, err)
+				if ok {
+					countMutex.Lock()
+					successCount++
+					countMutex.Unlock()
+				}
+			})
+		}
+		wg.Wait()
+
+		assert.Equal(t, limit, successCount, "Concurrent acquisitions should not exceed the limit")
+	})
+}
+
+func TestMemoryStorage_CheckAndUpdateBuckets(t *testing.T) {
+	storage := newTestMemoryStorage()
+	buckets := []Bucket{
+		{Key: "org:acme", Algorithm: enum.TokenBucket, Capacity: 3, Rate: .01, ExpiresIn: time.Minute},
+		{Key: "user:john", Algorithm: enum.LeakyBucket, Capacity: 2, Rate: .01, ExpiresIn: time.Minute},
+	}
+
+	for i := 0; i < 2; i++ {
+		rejected, err := storage.CheckAndUpdateBuckets(context.Background(), buckets)
+		require.NoError(t, err)
+		assert.Equal(t, -1, rejected, "Request %d should be charged against both buckets", i)
+	}
+
+	rejected, err := storage.CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rejected, "The user bucket is full")
+	assert.Equal(t, 1.0, storage.load("org:acme").(memoryTokenBucket).bucketSize, "The org bucket must not be charged")
+
+	// another user of the same org drains the org bucket
+	rejected, err = storage.CheckAndUpdateBuckets(context.Background(), []Bucket{
+		buckets[0],
+		{Key: "user:jane", Algorithm: enum.LeakyBucket, Capacity: 2, Rate: .01, ExpiresIn: time.Minute},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected)
+
+	rejected, err = storage.CheckAndUpdateBuckets(context.Background(), []Bucket{
+		buckets[0],
+		{Key: "user:jane", Algorithm: enum.LeakyBucket, Capacity: 2, Rate: .01, ExpiresIn: time.Minute},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, rejected, "The org bucket is empty")
+	assert.Equal(t, 1.0, storage.load("user:jane").(memoryLeakyBucket).bucketSize, "The user bucket must not be charged")
+}
+
+func TestMemoryStorage_Penalty(t *testing.T) {
+	penalty := config.PenaltyConfig{
+		MaxRejections:  2,
+		Window:         time.Minute,
+		BanDuration:    time.Hour,
+		MaxBanDuration: 3 * time.Hour,
+		ForgetAfter:    time.Hour,
+	}
+
+	t.Run("Ban after repeated rejections, doubling on each offence", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "auth:john:login"
+
+		for _, expected := range []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour} {
+			duration, err := storage.RecordRejection(context.Background(), key, penalty)
+			require.NoError(t, err)
+			assert.Zero(t, duration, "The first rejection does not ban the key")
+
+			duration, err = storage.RecordRejection(context.Background(), key, penalty)
+			require.NoError(t, err)
+			assert.Equal(t, expected, duration)
+
+			remaining, err := storage.BanRemaining(context.Background(), key)
+			require.NoError(t, err)
+			assert.InDelta(t, expected.Seconds(), remaining.Seconds(), 1)
+		}
+
+		bans, err := storage.ListBans(context.Background())
+		require.NoError(t, err)
+		require.Len(t, bans, 1)
+		assert.Equal(t, key, bans[0].Key)
+	})
+
+	t.Run("Rejections outside the window are not counted", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "auth:jane:login"
+		storage.store(penaltyKey(key), memoryPenalty{
+			rejections:        1,
+			windowEndUnixNano: time.Now().Add(-time.Second).UnixNano(),
+		})
+
+		duration, err := storage.RecordRejection(context.Background(), key, penalty)
+		require.NoError(t, err)
+		assert.Zero(t, duration)
+
+		remaining, err := storage.BanRemaining(context.Background(), key)
+		require.NoError(t, err)
+		assert.Zero(t, remaining)
+	})
+
+	t.Run("Forgotten offences start over", func(t *testing.T) {
+		storage := newTestMemoryStorage()
+		key := "auth:joe:login"
+		storage.store(penaltyKey(key), memoryPenalty{
+			offences:                 2,
+			offencesExpireAtUnixNano: time.Now().Add(-time.Second).UnixNano(),
+		})
+
+		_, err := storage.RecordRejection(context.Background(), key, penalty)
+		require.NoError(t, err)
+		duration, err := storage.RecordRejection(context.Background(), key, penalty)
+		require.NoError(t, err)
+		assert.Equal(t, time.Hour, duration)
+	})
+}
+
+func TestMemoryStorage_Quota(t *testing.T) {
+	storage := newTestMemoryStorage()
+	key := "auth:acme:calls:quota"
+
+	for _, expected := range []int{1, 0} {
+		ok, balance, err := storage.CheckAndUpdateQuota(context.Background(), key, 2)
+		assertAllowed(t, ok, err, "The initial balance is charged")
+		assert.Equal(t, expected, balance)
+	}
+
+	ok, balance, err := storage.CheckAndUpdateQuota(context.Background(), key, 2)
+	assertNotAllowed(t, ok, err, "An exhausted quota does not refill")
+	assert.Zero(t, balance)
+
+	balance, err = storage.CreditQuota(context.Background(), key, 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 5, balance)
+
+	ok, balance, err = storage.CheckAndUpdateQuota(context.Background(), key, 2)
+	assertAllowed(t, ok, err, "A credited quota accepts requests again")
+	assert.Equal(t, 4, balance)
+
+	balance, err = storage.CreditQuota(context.Background(), "auth:new:calls:quota", 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 7, balance, "A key never seen is credited on top of the initial balance")
+}
+
+func TestMemoryStorage_CounterAndMark(t *testing.T) {
+	storage := newTestMemoryStorage()
+
+	for _, expected := range []int{1, 2, 3} {
+		value, err := storage.IncrementCounter(context.Background(), "acme:premium:usage", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+
+	storage.store("acme:premium:usage", memoryCounter{value: 3, expiredAtInUnixNano: time.Now().Add(-time.Second).UnixNano()})
+	value, err := storage.IncrementCounter(context.Background(), "acme:premium:usage", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, value, "An expired counter starts over")
+
+	first, err := storage.MarkOnce(context.Background(), "acme:premium:usage:80", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, first)
+	first, err = storage.MarkOnce(context.Background(), "acme:premium:usage:80", time.Hour)
+	require.NoError(t, err)
+	assert.False(t, first, "The key is already marked")
+
+	storage.store("acme:premium:usage:80", memoryCounter{value: 1, expiredAtInUnixNano: time.Now().Add(-time.Second).UnixNano()})
+	first, err = storage.MarkOnce(context.Background(), "acme:premium:usage:80", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, first, "An expired mark can be set again")
+}
+
+func TestNewMemoryStorageWithOptions(t *testing.T) {
+	tests := []struct {
+		shards   int
+		expected int
+	}{
+		{0, defaultMemoryStorageShards},
+		{1, 1},
+		{3, 4},
+		{64, 64},
+		{100, 128},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d shards", tt.shards), func(t *testing.T) {
+			storage := NewMemoryStorageWithOptions(MemoryStorageOptions{Shards: tt.shards})
+			assert.Len(t, storage.shards, tt.expected)
+		})
+	}
+
+	t.Run("Keys are spread over the shards", func(t *testing.T) {
+		storage := NewMemoryStorageWithOptions(MemoryStorageOptions{Shards: 8})
+		used := make(map[int]bool)
+		for i := 0; i < 1000; i++ {
+			used[storage.shardIndex(fmt.Sprintf("ip:10.0.%d.%d:default:default", i/256, i%256))] = true
+		}
+		assert.Len(t, used, 8)
+	})
+}
+
+func TestMemoryStorage_CheckAndUpdateBuckets_Concurrent(t *testing.T) {
+	storage := newTestMemoryStorage()
+	org := Bucket{Key: "org:acme", Algorithm: enum.TokenBucket, Capacity: 50, ExpiresIn: time.Minute}
+
+	// the users of the org lock the shard of the org along with their own
+	var (
+		wg      sync.WaitGroup
+		allowed atomic.Int64
+	)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := Bucket{Key: fmt.Sprintf("user:%d", i), Algorithm: enum.TokenBucket, Capacity: 1, ExpiresIn: time.Minute}
+			rejected, err := storage.CheckAndUpdateBuckets(context.Background(), []Bucket{org, user})
+			assert.NoError(t, err)
+			if rejected < 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(50), allowed.Load(), "The org bucket is charged exactly once per allowed request")
+}
+
+// BenchmarkMemoryStorage_CheckAndUpdateTokenBucket compares a single lock
+// with the sharded storage, run it with -cpu 1,2,4,8 to see the throughput
+// of the sharded storage scale with GOMAXPROCS
+func BenchmarkMemoryStorage_CheckAndUpdateTokenBucket(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("auth:user-%d:premium:rpm", i)
+	}
+
+	for _, shards := range []int{1, defaultMemoryStorageShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			storage := NewMemoryStorageWithOptions(MemoryStorageOptions{Shards: shards})
+			var worker atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// each goroutine walks the keys from its own offset
+				i := int(worker.Add(1)) * 997
+				for pb.Next() {
+					_, _ = storage.CheckAndUpdateTokenBucket(context.Background(), keys[i%len(keys)], 100, 100, time.Minute)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryStorage_MaxKeys(t *testing.T) {
+	storage := NewMemoryStorageWithOptions(MemoryStorageOptions{Shards: 1, MaxKeys: 2})
+	defer storage.Close()
+	check := func(key string) {
+		ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), key, 5, 1, time.Minute)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	_, err := storage.CreditQuota(context.Background(), "auth:acme:calls:quota", 10, 5)
+	require.NoError(t, err)
+	_, _, err = storage.CheckAndUpdateQuota(context.Background(), "auth:acme:calls:quota", 10)
+	require.NoError(t, err)
+	_, _, err = storage.CheckAndUpdateQuota(context.Background(), "auth:globex:calls:quota", 10)
+	require.NoError(t, err)
+	_, err = storage.CreditQuota(context.Background(), "auth:initech:calls:quota", 10, 1)
+	require.NoError(t, err)
+	_, _, err = storage.CheckAndUpdateQuota(context.Background(), "auth:initech:calls:quota", 10)
+	require.NoError(t, err)
+
+	check("ip:1")
+	check("ip:2")
+	check("ip:1") // ip:2 becomes the least recently used key
+	check("ip:3")
+
+	assert.NotNil(t, storage.load("ip:1"))
+	assert.Nil(t, storage.load("ip:2"), "The least recently used key is evicted")
+	assert.NotNil(t, storage.load("ip:3"))
+	assert.Equal(t, memoryQuota{balance: 14, pinned: true}, storage.load("auth:acme:calls:quota"),
+		"Credited quotas are never evicted and do not count towards max keys")
+	assert.Equal(t, memoryQuota{balance: 9, pinned: true}, storage.load("auth:globex:calls:quota"),
+		"Spent quotas are never evicted and do not count towards max keys")
+	assert.Nil(t, storage.load("auth:initech:calls:quota"), "Quotas back to their initial balance are evicted like any other key")
+	assert.Equal(t, 4, storage.len())
+}
+
+func TestMemoryStorage_MaxKeys_EvictionFlood(t *testing.T) {
+	storage := NewMemoryStorageWithOptions(MemoryStorageOptions{Shards: 1, MaxKeys: 10})
+	defer storage.Close()
+	ctx := context.Background()
+	penalty := config.PenaltyConfig{
+		MaxRejections:  1,
+		Window:         time.Minute,
+		BanDuration:    time.Hour,
+		MaxBanDuration: time.Hour,
+		ForgetAfter:    time.Hour,
+	}
+
+	duration, err := storage.RecordRejection(ctx, "auth:john:login", penalty)
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, duration)
+	ok, err := storage.AcquireConcurrencyLease(ctx, "concurrency:john", 1, "lease-1", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, _, err = storage.CheckAndUpdateQuota(ctx, "auth:john:calls:quota", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	for i := range 1000 {
+		ok, err := storage.CheckAndUpdateTokenBucket(ctx, fmt.Sprintf("ip:%d", i), 5, 1, time.Minute)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	remaining, err := storage.BanRemaining(ctx, "auth:john:login")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), remaining.Seconds(), 1, "The ban survives the eviction flood")
+
+	ok, err = storage.AcquireConcurrencyLease(ctx, "concurrency:john", 1, "lease-2", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok, "The lease survives the eviction flood")
+
+	ok, balance, err := storage.CheckAndUpdateQuota(ctx, "auth:john:calls:quota", 1)
+	require.NoError(t, err)
+	assert.False(t, ok, "The exhausted quota survives the eviction flood")
+	assert.Equal(t, 0, balance)
+	assert.Equal(t, 13, storage.len(), "Bans, leases and spent quotas do not count towards max keys")
+}
+
+func TestMemoryStorage_Close(t *testing.T) {
+	storage := NewMemoryStorageWithOptions(MemoryStorageOptions{})
+	require.NoError(t, storage.Close())
+	require.NoError(t, storage.Close(), "Closing twice is a no-op")
+
+	ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), "token:closed", 1, 1, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok, "A closed storage keeps serving requests")
+}
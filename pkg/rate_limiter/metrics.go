@@ -0,0 +1,157 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"time"
+)
+
+const activeBansScrapeTimeout = 5 * time.Second
+
+const (
+	allowedResult        = "allowed"
+	rejectedResult       = "rejected"
+	shadowRejectedResult = "shadow_rejected"
+	bannedResult         = "banned"
+)
+
+var (
+	decisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_decisions_total",
+		Help: "Number of rate limit decisions by group of rate limiters and result (allowed, rejected, shadow_rejected, banned).",
+	}, []string{"rate_limiters_id", "result"})
+
+	shadowRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_shadow_rejections_total",
+		Help: "Number of requests a rate limiter in shadow mode would have rejected.",
+	}, []string{"rate_limiters_id", "limiter_id"})
+
+	shapingWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rlim_shaping_wait_seconds",
+		Help:    "Time requests of a shaped group waited for their bucket to free capacity.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"rate_limiters_id"})
+
+	shapingQueueFullTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_shaping_queue_full_total",
+		Help: "Number of requests rejected because the shaping queue of their group was full.",
+	}, []string{"rate_limiters_id"})
+
+	bansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_bans_total",
+		Help: "Number of keys banned after repeated rejections.",
+	}, []string{"rate_limiters_id"})
+
+	quotaLowBalanceTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_quota_low_balance_total",
+		Help: "Number of quota balances that went down to the low balance threshold.",
+	}, []string{"rate_limiters_id"})
+
+	memoryStorageEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_memory_storage_evictions_total",
+		Help: "Number of keys evicted from the memory storage because it held max keys.",
+	})
+
+	memoryStorageExpirationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_memory_storage_expirations_total",
+		Help: "Number of expired keys removed from the memory storage.",
+	})
+
+	boltStorageExpirationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_bolt_storage_expirations_total",
+		Help: "Number of expired keys removed from the bolt storage.",
+	})
+
+	nearCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_near_cache_hits_total",
+		Help: "Number of checks answered by the near cache without calling the storage.",
+	})
+
+	nearCacheEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_near_cache_evictions_total",
+		Help: "Number of rejected keys evicted from the near cache because it held max keys.",
+	})
+
+	nearCacheInvalidationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_near_cache_invalidations_total",
+		Help: "Number of key prefixes whose rejections were dropped from the near cache.",
+	})
+
+	tokenLeasesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_token_leases_total",
+		Help: "Number of batches of tokens leased from the storage by group of rate limiters.",
+	}, []string{"rate_limiters_id"})
+
+	leasedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_leased_requests_total",
+		Help: "Number of requests allowed with a leased token without calling the storage.",
+	}, []string{"rate_limiters_id"})
+
+	leasedTokensReturnedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_leased_tokens_returned_total",
+		Help: "Number of leased tokens given back to the storage unspent.",
+	}, []string{"rate_limiters_id"})
+
+	peerCallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rlim_peer_calls_total",
+		Help: "Number of peer storage calls by result: served as owner (local), forwarded to the owner or served locally as the owner was unreachable (fallback).",
+	}, []string{"result"})
+
+	gossipDeltasSentTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_gossip_deltas_sent_total",
+		Help: "Number of counts of a node in a window delivered to the peers.",
+	})
+
+	gossipDeltasMergedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_gossip_deltas_merged_total",
+		Help: "Number of counts received from the peers that raised a local count.",
+	})
+
+	gossipEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_gossip_evictions_total",
+		Help: "Number of gossip counters evicted as the max number of keys was reached.",
+	})
+
+	gossipSendFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rlim_gossip_send_failures_total",
+		Help: "Number of gossip rounds that could not reach a peer, the counts are sent again on the next round.",
+	})
+
+	activeBansDesc = prometheus.NewDesc(
+		"rlim_active_bans",
+		"Number of keys currently banned, read from the storage.",
+		nil, nil,
+	)
+)
+
+// activeBansCollector reads the active bans from the storage on each scrape
+// so that the value is shared by every instance using the same storage
+type activeBansCollector struct {
+	client *Client
+}
+
+// NewActiveBansCollector exposes the number of active bans of the client,
+// it must be registered once
+func NewActiveBansCollector(client *Client) prometheus.Collector {
+	return activeBansCollector{client: client}
+}
+
+func (a activeBansCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeBansDesc
+}
+
+func (a activeBansCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), activeBansScrapeTimeout)
+	defer cancel()
+
+	bans, err := a.client.ListBans(ctx)
+	if err != nil {
+		slog.Error("could not list the active bans", "error", err)
+		ch <- prometheus.NewInvalidMetric(activeBansDesc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(activeBansDesc, prometheus.GaugeValue, float64(len(bans)))
+}
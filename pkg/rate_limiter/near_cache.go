@@ -0,0 +1,276 @@
+package rate_limiter
+
+import (
+	"container/list"
+	"context"
+	"github.com/redis/go-redis/v9"
+	"github/martinmaurice/rlim/pkg/config"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultNearCacheMaxKeys              = 100000
+	DefaultNearCacheInvalidationsChannel = "rlim:near_cache:invalidations"
+
+	nearCacheSubscribeTimeout = 5 * time.Second
+)
+
+type NearCacheOptions struct {
+	MaxKeys int // max rejected keys kept in the process, default DefaultNearCacheMaxKeys
+	// Invalidations is subscribed to the InvalidationsChannel, every
+	// instance then drops the rejections of a key prefix invalidated by any
+	// of them. Nil keeps the invalidations local to the process.
+	Invalidations        redis.UniversalClient
+	InvalidationsChannel string // default DefaultNearCacheInvalidationsChannel
+}
+
+// nearCacheEntry is a key rejected until a known time
+type nearCacheEntry struct {
+	key   string
+	until time.Time
+}
+
+// NearCacheStorage answers in the process the checks of the buckets and the
+// bans known to reject until a given time, the other checks and every other
+// call go to the storage. A bucket stays rejected until the retry time the
+// storage computed, a limit raised in between (override) is only seen once
+// its key prefix is invalidated or the retry time is reached.
+type NearCacheStorage struct {
+	storage RetryAtStorer
+	now     func() time.Time
+
+	mu       sync.Mutex
+	rejected map[string]*list.Element // of *nearCacheEntry
+	lru      *list.List               // front is the most recently rejected key
+	maxKeys  int
+
+	invalidations        redis.UniversalClient
+	invalidationsChannel string
+	pubSub               *redis.PubSub
+	wg                   sync.WaitGroup
+	listeners            []func(keyPrefix string) // also told about the invalidated key prefixes
+}
+
+func NewNearCacheStorage(storage RetryAtStorer, options NearCacheOptions) *NearCacheStorage {
+	if options.MaxKeys <= 0 {
+		options.MaxKeys = DefaultNearCacheMaxKeys
+	}
+	if options.InvalidationsChannel == "" {
+		options.InvalidationsChannel = DefaultNearCacheInvalidationsChannel
+	}
+
+	n := &NearCacheStorage{
+		storage:              storage,
+		now:                  time.Now,
+		rejected:             make(map[string]*list.Element),
+		lru:                  list.New(),
+		maxKeys:              options.MaxKeys,
+		invalidations:        options.Invalidations,
+		invalidationsChannel: options.InvalidationsChannel,
+	}
+
+	if n.invalidations != nil {
+		// wait for the subscription so that no invalidation published once
+		// the storage is created is missed
+		ctx, cancel := context.WithTimeout(context.Background(), nearCacheSubscribeTimeout)
+		defer cancel()
+		n.pubSub = n.invalidations.Subscribe(ctx, n.invalidationsChannel)
+		if _, err := n.pubSub.Receive(ctx); err != nil {
+			slog.Error("could not subscribe to the near cache invalidations, retrying in the background", "error", err)
+		}
+		n.wg.Go(n.receiveInvalidations)
+	}
+
+	return n
+}
+
+// receiveInvalidations drops the key prefixes published on the channel until
+// the subscription is closed, the subscription reconnects by itself
+func (n *NearCacheStorage) receiveInvalidations() {
+	for message := range n.pubSub.Channel() {
+		n.drop(message.Payload)
+	}
+}
+
+// rejectedUntil returns whether the key is known to be rejected and until when
+func (n *NearCacheStorage) rejectedUntil(key string) (time.Time, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	element, ok := n.rejected[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	entry := element.Value.(*nearCacheEntry)
+	if !n.now().Before(entry.until) {
+		n.lru.Remove(element)
+		delete(n.rejected, key)
+		return time.Time{}, false
+	}
+
+	return entry.until, true
+}
+
+// reject keeps the key rejected until the given time, a zero time (the
+// storage cannot tell) is not cached
+func (n *NearCacheStorage) reject(key string, until time.Time) {
+	if until.IsZero() || !n.now().Before(until) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if element, ok := n.rejected[key]; ok {
+		element.Value.(*nearCacheEntry).until = until
+		n.lru.MoveToFront(element)
+		return
+	}
+
+	n.rejected[key] = n.lru.PushFront(&nearCacheEntry{key: key, until: until})
+	if n.lru.Len() > n.maxKeys {
+		oldest := n.lru.Back()
+		n.lru.Remove(oldest)
+		delete(n.rejected, oldest.Value.(*nearCacheEntry).key)
+		nearCacheEvictionsTotal.Inc()
+	}
+}
+
+// onInvalidate calls the listener with every key prefix invalidated by any
+// instance, e.g. to drop the overrides cached by the client
+func (n *NearCacheStorage) onInvalidate(listener func(keyPrefix string)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.listeners = append(n.listeners, listener)
+}
+
+// drop forgets the rejections of the key prefix: its ban and its buckets
+func (n *NearCacheStorage) drop(keyPrefix string) {
+	n.mu.Lock()
+	bucketsPrefix := limiterKey(keyPrefix, "")
+	for key, element := range n.rejected {
+		if key == keyPrefix || strings.HasPrefix(key, bucketsPrefix) {
+			n.lru.Remove(element)
+			delete(n.rejected, key)
+		}
+	}
+	listeners := n.listeners
+	n.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(keyPrefix)
+	}
+	nearCacheInvalidationsTotal.Inc()
+}
+
+// Invalidate drops the cached rejections of the rate-limit key
+// (<key>:<rateLimitersId>) whose limits changed, in every instance
+// subscribed to the invalidations
+func (n *NearCacheStorage) Invalidate(ctx context.Context, keyPrefix string) error {
+	if n.invalidations == nil {
+		n.drop(keyPrefix)
+		return nil
+	}
+
+	// the instance receives its own invalidation, unless redis is unreachable
+	if err := n.invalidations.Publish(ctx, n.invalidationsChannel, keyPrefix).Err(); err != nil {
+		n.drop(keyPrefix)
+		return err
+	}
+	return nil
+}
+
+func (n *NearCacheStorage) CheckAndUpdateTokenBucket(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, error) {
+	if _, ok := n.rejectedUntil(key); ok {
+		nearCacheHitsTotal.Inc()
+		return false, nil
+	}
+
+	ok, retryAt, err := n.storage.CheckAndUpdateTokenBucketRetryAt(ctx, key, capacity, refillRate, expiresIn)
+	if err == nil && !ok {
+		n.reject(key, retryAt)
+	}
+	return ok, err
+}
+
+func (n *NearCacheStorage) CheckAndUpdateLeakyBucket(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, error) {
+	if _, ok := n.rejectedUntil(key); ok {
+		nearCacheHitsTotal.Inc()
+		return false, nil
+	}
+
+	ok, retryAt, err := n.storage.CheckAndUpdateLeakyBucketRetryAt(ctx, key, capacity, leakRate, expiresIn)
+	if err == nil && !ok {
+		n.reject(key, retryAt)
+	}
+	return ok, err
+}
+
+func (n *NearCacheStorage) AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error) {
+	return n.storage.AcquireConcurrencyLease(ctx, key, limit, leaseID, leaseTTL)
+}
+
+func (n *NearCacheStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	return n.storage.ReleaseConcurrencyLease(ctx, key, leaseID)
+}
+
+func (n *NearCacheStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	return n.storage.CheckAndUpdateBuckets(ctx, buckets)
+}
+
+func (n *NearCacheStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	ban, err := n.storage.RecordRejection(ctx, key, penalty)
+	if err == nil && ban > 0 {
+		n.reject(key, n.now().Add(ban))
+	}
+	return ban, err
+}
+
+// BanRemaining answers the banned keys in the process until their ban ends
+func (n *NearCacheStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	if until, ok := n.rejectedUntil(key); ok {
+		nearCacheHitsTotal.Inc()
+		return until.Sub(n.now()), nil
+	}
+
+	remaining, err := n.storage.BanRemaining(ctx, key)
+	if err == nil && remaining > 0 {
+		n.reject(key, n.now().Add(remaining))
+	}
+	return remaining, err
+}
+
+func (n *NearCacheStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	return n.storage.ListBans(ctx)
+}
+
+func (n *NearCacheStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	return n.storage.CheckAndUpdateQuota(ctx, key, initialBalance)
+}
+
+func (n *NearCacheStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	return n.storage.CreditQuota(ctx, key, initialBalance, amount)
+}
+
+func (n *NearCacheStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	return n.storage.IncrementCounter(ctx, key, ttl)
+}
+
+func (n *NearCacheStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return n.storage.MarkOnce(ctx, key, ttl)
+}
+
+// Close stops listening to the invalidations then closes the storage
+func (n *NearCacheStorage) Close() error {
+	if n.pubSub != nil {
+		if err := n.pubSub.Close(); err != nil {
+			slog.Error("could not close the near cache invalidations subscription", "error", err)
+		}
+		n.wg.Wait()
+	}
+	return n.storage.Close()
+}
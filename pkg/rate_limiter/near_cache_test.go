@@ -0,0 +1,204 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestNearCacheStorage returns a near cache in front of its own client to
+// the fake redis, invalidated through the fake redis when subscribed is true
+func newTestNearCacheStorage(t *testing.T, mr *miniredis.Miniredis, options NearCacheOptions, subscribed bool) *NearCacheStorage {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	if subscribed {
+		options.Invalidations = client
+	}
+	nearCache := NewNearCacheStorage(NewRedisStorage(client), options)
+	t.Cleanup(func() {
+		assert.NoError(t, nearCache.Close())
+	})
+	return nearCache
+}
+
+func TestRedisStorage_RetryAt(t *testing.T) {
+	now := time.Now().Unix()
+	_, storage := newTestRedisStorage(t, map[string]any{
+		"token":  redisTokenBucket{lastRefillUnix: now, bucketSize: 0.25},
+		"leaky":  redisLeakyBucket{lastLeakUnix: now, bucketSize: 10},
+		"frozen": redisTokenBucket{lastRefillUnix: now, bucketSize: 0},
+	})
+
+	// the retry time does not depend on the second the script runs in
+	ok, retryAt, err := storage.CheckAndUpdateTokenBucketRetryAt(context.Background(), "token", 10, 0.5, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Unix(now+2, 0), retryAt)
+
+	ok, retryAt, err = storage.CheckAndUpdateLeakyBucketRetryAt(context.Background(), "leaky", 10, 0.5, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Unix(now+2, 0), retryAt)
+
+	ok, retryAt, err = storage.CheckAndUpdateTokenBucketRetryAt(context.Background(), "frozen", 10, 0, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, retryAt.IsZero(), "a bucket that never refills has no retry time")
+
+	ok, retryAt, err = storage.CheckAndUpdateTokenBucketRetryAt(context.Background(), "new", 10, 0.5, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, retryAt.IsZero())
+}
+
+func TestNearCacheStorage_Buckets(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(n *NearCacheStorage) (bool, error)
+	}{
+		{
+			name: "Token bucket",
+			check: func(n *NearCacheStorage) (bool, error) {
+				return n.CheckAndUpdateTokenBucket(context.Background(), "{k1:search}:rpm", 1, 0.5, time.Minute)
+			},
+		},
+		{
+			name: "Leaky bucket",
+			check: func(n *NearCacheStorage) (bool, error) {
+				return n.CheckAndUpdateLeakyBucket(context.Background(), "{k1:search}:rpm", 1, 0.5, time.Minute)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			nearCache := newTestNearCacheStorage(t, mr, NearCacheOptions{}, false)
+
+			ok, err := tt.check(nearCache)
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, err = tt.check(nearCache)
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			until, cached := nearCache.rejectedUntil("{k1:search}:rpm")
+			require.True(t, cached)
+			assert.WithinDuration(t, time.Now().Add(2*time.Second), until, 2*time.Second)
+
+			commands := mr.CommandCount()
+			ok, err = tt.check(nearCache)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			assert.Equal(t, commands, mr.CommandCount(), "the rejection is answered without calling redis")
+
+			nearCache.now = func() time.Time { return until }
+			_, err = tt.check(nearCache)
+			require.NoError(t, err)
+			assert.Greater(t, mr.CommandCount(), commands, "redis is called again once the retry time is reached")
+		})
+	}
+}
+
+func TestNearCacheStorage_Bans(t *testing.T) {
+	penalty := config.PenaltyConfig{
+		MaxRejections:  1,
+		Window:         time.Minute,
+		BanDuration:    time.Hour,
+		MaxBanDuration: time.Hour,
+		ForgetAfter:    time.Hour,
+	}
+	mr := miniredis.RunT(t)
+	nearCache := newTestNearCacheStorage(t, mr, NearCacheOptions{}, false)
+	key := "auth:john:login"
+
+	remaining, err := nearCache.BanRemaining(context.Background(), key)
+	require.NoError(t, err)
+	assert.Zero(t, remaining)
+
+	ban, err := nearCache.RecordRejection(context.Background(), key, penalty)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, ban)
+
+	commands := mr.CommandCount()
+	remaining, err = nearCache.BanRemaining(context.Background(), key)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour, remaining, float64(time.Second))
+	assert.Equal(t, commands, mr.CommandCount(), "the ban is answered without calling redis")
+}
+
+func TestNearCacheStorage_Invalidate(t *testing.T) {
+	mr := miniredis.RunT(t)
+	instances := []*NearCacheStorage{
+		newTestNearCacheStorage(t, mr, NearCacheOptions{}, true),
+		newTestNearCacheStorage(t, mr, NearCacheOptions{}, true),
+	}
+
+	until := time.Now().Add(time.Minute)
+	for _, instance := range instances {
+		instance.reject("{k1:search}:rpm", until)
+		instance.reject("{k1:search}:rph", until)
+		instance.reject("k1:search", until)
+		instance.reject("{k10:search}:rpm", until)
+	}
+
+	var dropped atomic.Value
+	instances[1].onInvalidate(func(keyPrefix string) {
+		dropped.Store(keyPrefix)
+	})
+
+	require.NoError(t, instances[0].Invalidate(context.Background(), "k1:search"))
+
+	assert.Eventually(t, func() bool {
+		return dropped.Load() == "k1:search"
+	}, time.Second, 10*time.Millisecond, "the listeners hear about the invalidations of the other instances")
+
+	for i, instance := range instances {
+		assert.Eventually(t, func() bool {
+			_, cached := instance.rejectedUntil("{k1:search}:rpm")
+			return !cached
+		}, time.Second, 10*time.Millisecond, "instance %d", i)
+
+		_, cached := instance.rejectedUntil("{k1:search}:rph")
+		assert.False(t, cached, "instance %d", i)
+		_, cached = instance.rejectedUntil("k1:search")
+		assert.False(t, cached, "the ban is read again from redis")
+		_, cached = instance.rejectedUntil("{k10:search}:rpm")
+		assert.True(t, cached, "the other key prefixes are kept")
+	}
+
+	t.Run("Without subscription the invalidation is local", func(t *testing.T) {
+		nearCache := newTestNearCacheStorage(t, mr, NearCacheOptions{}, false)
+		nearCache.reject("{k1:search}:rpm", until)
+		require.NoError(t, nearCache.Invalidate(context.Background(), "k1:search"))
+		_, cached := nearCache.rejectedUntil("{k1:search}:rpm")
+		assert.False(t, cached)
+	})
+}
+
+func TestNearCacheStorage_MaxKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	nearCache := newTestNearCacheStorage(t, mr, NearCacheOptions{MaxKeys: 2}, false)
+
+	until := time.Now().Add(time.Minute)
+	nearCache.reject("k1", until)
+	nearCache.reject("k2", until)
+	nearCache.reject("k1", until) // k2 is now the least recently rejected
+	nearCache.reject("k3", until)
+
+	assert.Len(t, nearCache.rejected, 2)
+	_, cached := nearCache.rejectedUntil("k2")
+	assert.False(t, cached)
+	_, cached = nearCache.rejectedUntil("k1")
+	assert.True(t, cached)
+
+	nearCache.reject("k4", time.Time{})
+	_, cached = nearCache.rejectedUntil("k4")
+	assert.False(t, cached, "a rejection without retry time is not cached")
+}
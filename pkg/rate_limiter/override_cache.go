@@ -0,0 +1,109 @@
+package rate_limiter
+
+import (
+	"container/list"
+	"github/martinmaurice/rlim/pkg/override_store"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOverridesCacheTTL     = 5 * time.Second
+	DefaultOverridesCacheMaxKeys = 100000
+)
+
+// overrideCacheEntry is the override of a key prefix as read from the store,
+// nil when the key prefix has none
+type overrideCacheEntry struct {
+	keyPrefix string
+	override  *override_store.Override
+	until     time.Time
+}
+
+// overrideCache keeps the overrides read from the store for a while so that
+// the checks do not read the store on every request. Setting or deleting an
+// override invalidates its key prefix, the ttl bounds how long an instance
+// missing the invalidation keeps the previous limits.
+type overrideCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu            sync.Mutex
+	entries       map[string]*list.Element // of *overrideCacheEntry
+	lru           *list.List               // front is the most recently read key prefix
+	maxKeys       int
+	invalidations uint64 // drops so far, a read started before a drop is not cached
+}
+
+func newOverrideCache(ttl time.Duration, maxKeys int) *overrideCache {
+	return &overrideCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		maxKeys: maxKeys,
+	}
+}
+
+// get returns the cached override of the key prefix, ok is false when the
+// store has to be read, along with the version to cache the read with
+func (o *overrideCache) get(keyPrefix string) (override *override_store.Override, ok bool, version uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	element, found := o.entries[keyPrefix]
+	if !found {
+		return nil, false, o.invalidations
+	}
+	entry := element.Value.(*overrideCacheEntry)
+	if !o.now().Before(entry.until) {
+		o.lru.Remove(element)
+		delete(o.entries, keyPrefix)
+		return nil, false, o.invalidations
+	}
+
+	o.lru.MoveToFront(element)
+	return entry.override, true, o.invalidations
+}
+
+// set caches the override read from the store unless a key prefix was
+// invalidated since version, the read may predate the new override
+func (o *overrideCache) set(keyPrefix string, override *override_store.Override, version uint64) {
+	until := o.now().Add(o.ttl)
+	if override != nil && !override.ExpiresAt.IsZero() && override.ExpiresAt.Before(until) {
+		until = override.ExpiresAt
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if version != o.invalidations {
+		return
+	}
+
+	if element, found := o.entries[keyPrefix]; found {
+		entry := element.Value.(*overrideCacheEntry)
+		entry.override, entry.until = override, until
+		o.lru.MoveToFront(element)
+		return
+	}
+
+	o.entries[keyPrefix] = o.lru.PushFront(&overrideCacheEntry{keyPrefix: keyPrefix, override: override, until: until})
+	if o.lru.Len() > o.maxKeys {
+		oldest := o.lru.Back()
+		o.lru.Remove(oldest)
+		delete(o.entries, oldest.Value.(*overrideCacheEntry).keyPrefix)
+	}
+}
+
+// drop forgets the override of the key prefix
+func (o *overrideCache) drop(keyPrefix string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.invalidations++
+	if element, found := o.entries[keyPrefix]; found {
+		o.lru.Remove(element)
+		delete(o.entries, keyPrefix)
+	}
+}
@@ -0,0 +1,131 @@
+package rate_limiter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the calls between the instances of a peer or gossip storage are signed like
+// the webhooks: the hex encoded HMAC-SHA256, keyed by the shared secret, of
+// "<timestamp>.<nonce>.<body>". The nonce is unique to each call so that a
+// captured call cannot be replayed while its timestamp is within tolerance.
+const (
+	PeerSignatureHeader = "X-Rlim-Signature"
+	PeerTimestampHeader = "X-Rlim-Timestamp"
+	PeerNonceHeader     = "X-Rlim-Nonce"
+
+	peerSignaturePrefix = "sha256="
+	peerSignatureMaxAge = time.Minute
+	maxPeerBodyBytes    = 1 << 20
+)
+
+var (
+	MissingPeerSecretErr    = errors.New("a shared secret is required between the peers")
+	InvalidPeerSignatureErr = errors.New("invalid peer signature")
+	ReplayedPeerCallErr     = errors.New("the peer call was already received")
+)
+
+func signPeerBody(secret string, timestamp int64, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.%s.", timestamp, nonce)
+	_, _ = mac.Write(body)
+	return peerSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signPeerRequest sets the signature headers of a request to a peer
+func signPeerRequest(req *http.Request, secret string, body []byte) {
+	timestamp := time.Now().Unix()
+	nonce := newRandomID()
+	req.Header.Set(PeerTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(PeerNonceHeader, nonce)
+	req.Header.Set(PeerSignatureHeader, signPeerBody(secret, timestamp, nonce, body))
+}
+
+// peerNonces remembers the nonces of the calls received while their timestamp
+// is within tolerance, a call carrying one of them is a replay
+type peerNonces struct {
+	mu        sync.Mutex
+	seen      map[string]int64 // nonce to the unix time its call expires at
+	nextSweep int64
+}
+
+func newPeerNonces() *peerNonces {
+	return &peerNonces{seen: make(map[string]int64)}
+}
+
+// add records the nonce of a call, it returns false when it was already seen
+func (n *peerNonces) add(nonce string, timestamp int64, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	unixNow := now.Unix()
+	if unixNow >= n.nextSweep {
+		for seen, expiresAt := range n.seen {
+			if expiresAt < unixNow {
+				delete(n.seen, seen)
+			}
+		}
+		n.nextSweep = unixNow + int64(peerSignatureMaxAge.Seconds())
+	}
+
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = timestamp + int64(peerSignatureMaxAge.Seconds())
+	return true
+}
+
+func verifyPeerBody(secret, timestamp, nonce, signature string, body []byte, nonces *peerNonces) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", InvalidPeerSignatureErr)
+	}
+	now := time.Now()
+	if age := now.Sub(time.Unix(ts, 0)); age > peerSignatureMaxAge || age < -peerSignatureMaxAge {
+		return fmt.Errorf("%w: timestamp out of tolerance", InvalidPeerSignatureErr)
+	}
+	if nonce == "" {
+		return fmt.Errorf("%w: missing nonce", InvalidPeerSignatureErr)
+	}
+	if !strings.HasPrefix(signature, peerSignaturePrefix) {
+		return fmt.Errorf("%w: unsupported scheme", InvalidPeerSignatureErr)
+	}
+	if !hmac.Equal([]byte(signPeerBody(secret, ts, nonce, body)), []byte(signature)) {
+		return InvalidPeerSignatureErr
+	}
+	// only the nonces of valid signatures are kept, they cannot be forged
+	if !nonces.add(nonce, ts, now) {
+		return ReplayedPeerCallErr
+	}
+	return nil
+}
+
+// readSignedPeerBody reads the bounded body of a call from a peer, it replies
+// and returns false when the body is too large, not signed with the secret or
+// replayed
+func readSignedPeerBody(w http.ResponseWriter, r *http.Request, secret string, nonces *peerNonces) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPeerBodyBytes))
+	if err != nil {
+		http.Error(w, "invalid peer call", http.StatusBadRequest)
+		return nil, false
+	}
+
+	err = verifyPeerBody(secret, r.Header.Get(PeerTimestampHeader), r.Header.Get(PeerNonceHeader), r.Header.Get(PeerSignatureHeader), body, nonces)
+	if err != nil {
+		slog.Warn("rejecting peer call", "remoteAddr", r.RemoteAddr, "error", err)
+		http.Error(w, "invalid peer signature", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return body, true
+}
@@ -0,0 +1,70 @@
+package rate_limiter
+
+import (
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+const defaultPeerVirtualNodes = 128
+
+// peerRing places the peers on a consistent hash ring, each one at several
+// points so that the keys are evenly spread. Adding or removing a peer only
+// moves the keys it owns.
+type peerRing struct {
+	points []uint64          // sorted
+	owners map[uint64]string // peer of each point
+}
+
+func newPeerRing(peers []string, virtualNodes int) *peerRing {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultPeerVirtualNodes
+	}
+
+	// sorted so that a collision is settled the same way whatever the order
+	// of the peers in the list of each instance
+	r := &peerRing{owners: make(map[uint64]string, len(peers)*virtualNodes)}
+	for _, peer := range slices.Sorted(slices.Values(peers)) {
+		for i := range virtualNodes {
+			point := peerRingHash(peer + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[point]; ok {
+				continue // a collision keeps the first peer
+			}
+			r.owners[point] = peer
+			r.points = append(r.points, point)
+		}
+	}
+	slices.Sort(r.points)
+
+	return r
+}
+
+// peerRingHash is FNV-1a followed by the finalizer of murmur3: FNV alone
+// barely changes the high bits for strings differing by their last bytes,
+// such as the points of a peer, which would gather them on the ring
+func peerRingHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// owner returns the peer owning the key: the first point after the hash of
+// its hash tag, so that every limiter of a key has the same owner
+func (r *peerRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := peerRingHash(hashTag(key))
+	i, _ := slices.BinarySearch(r.points, hash)
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
@@ -0,0 +1,426 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/martinmaurice/rlim/pkg/config"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	PeerCallPath = "/peer/v1/call"
+
+	defaultPeerTimeout       = 500 * time.Millisecond
+	defaultPeerRetryInterval = 5 * time.Second
+)
+
+const (
+	localPeerResult     = "local"
+	forwardedPeerResult = "forwarded"
+	fallbackPeerResult  = "fallback"
+)
+
+var (
+	UnknownPeerMethodErr = errors.New("unknown peer storage method")
+	PeerUnavailableErr   = errors.New("the peer could not serve the call")
+)
+
+// the methods of the storage a peer serves for the keys it owns
+const (
+	peerTokenBucketMethod      = "token_bucket"
+	peerLeakyBucketMethod      = "leaky_bucket"
+	peerAcquireLeaseMethod     = "acquire_lease"
+	peerReleaseLeaseMethod     = "release_lease"
+	peerCheckBucketsMethod     = "check_buckets"
+	peerChargeBucketsMethod    = "charge_buckets"
+	peerRecordRejectionMethod  = "record_rejection"
+	peerBanRemainingMethod     = "ban_remaining"
+	peerListBansMethod         = "list_bans"
+	peerQuotaMethod            = "quota"
+	peerCreditQuotaMethod      = "credit_quota"
+	peerIncrementCounterMethod = "increment_counter"
+	peerMarkOnceMethod         = "mark_once"
+)
+
+// peerCall is the body of a call to a peer, only the fields of the method are set
+type peerCall struct {
+	Method   string                `json:"method"`
+	Key      string                `json:"key,omitempty"`
+	Capacity int                   `json:"capacity,omitempty"` // capacity, limit or initial balance
+	Rate     float64               `json:"rate,omitempty"`
+	TTL      time.Duration         `json:"ttl,omitempty"` // bucket expiration, lease or counter ttl
+	LeaseID  string                `json:"lease_id,omitempty"`
+	Amount   int                   `json:"amount,omitempty"`
+	Buckets  []Bucket              `json:"buckets,omitempty"`
+	Penalty  *config.PenaltyConfig `json:"penalty,omitempty"`
+}
+
+// peerReply is the result of a call, only the fields of the method are set
+type peerReply struct {
+	Ok       bool          `json:"ok,omitempty"`
+	Value    int           `json:"value,omitempty"` // rejected bucket, balance or counter
+	Duration time.Duration `json:"duration,omitempty"`
+	Bans     []Ban         `json:"bans,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type PeerStorageOptions struct {
+	Secret        string         // shared by the peers to sign their calls, required
+	Self          string         // host:port the other peers reach this instance on, one of Peers
+	Peers         []string       // host:port of every instance, the same list on each of them
+	VirtualNodes  int            // points of each peer on the hash ring, default 128
+	Timeout       time.Duration  // max duration of a call to a peer, default 500ms
+	RetryInterval time.Duration  // an unreachable peer is not called again before, default 5s
+	Local         *MemoryStorage // keys owned by the instance and fallback, default an unbounded memory storage
+}
+
+// PeerStorage spreads the keys over a static list of instances without any
+// shared storage: each key is owned by one peer, picked by consistent hashing
+// of its hash tag, which keeps it in memory. The calls for a key owned by
+// another peer are forwarded to it over HTTP (see Handler), they are served
+// from the local memory when the owner cannot be reached, the limits of its
+// keys are then enforced per instance until it is back.
+//
+// The calls between the peers are signed with the shared secret, a call
+// without a valid signature or already received is rejected.
+//
+// The levels of a hierarchy share the hash tag of the first one, hence its
+// owner. Buckets of different owners are checked on every owner first then
+// charged owner by owner: a concurrent request taking the last capacity in
+// between can leave the first buckets charged for a rejected request.
+type PeerStorage struct {
+	secret        string
+	nonces        *peerNonces
+	self          string
+	peers         []string
+	ring          *peerRing
+	local         *MemoryStorage
+	client        *http.Client
+	retryInterval time.Duration
+	now           func() time.Time
+
+	mu        sync.Mutex
+	downUntil map[string]time.Time // peers not called until then
+}
+
+func NewPeerStorage(options PeerStorageOptions) (*PeerStorage, error) {
+	if options.Secret == "" {
+		return nil, MissingPeerSecretErr
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultPeerTimeout
+	}
+	retryInterval := options.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = defaultPeerRetryInterval
+	}
+	local := options.Local
+	if local == nil {
+		local = NewMemoryStorageWithOptions(MemoryStorageOptions{})
+	}
+
+	return &PeerStorage{
+		secret:        options.Secret,
+		nonces:        newPeerNonces(),
+		self:          options.Self,
+		peers:         options.Peers,
+		ring:          newPeerRing(options.Peers, options.VirtualNodes),
+		local:         local,
+		client:        &http.Client{Timeout: timeout},
+		retryInterval: retryInterval,
+		now:           time.Now,
+		downUntil:     make(map[string]time.Time),
+	}, nil
+}
+
+// Handler serves the calls signed by the other peers, they are always run on
+// the local storage so that peers disagreeing on the owner never loop
+func (p *PeerStorage) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+PeerCallPath, func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readSignedPeerBody(w, r, p.secret, p.nonces)
+		if !ok {
+			return
+		}
+
+		var call peerCall
+		if err := json.Unmarshal(body, &call); err != nil {
+			http.Error(w, "invalid peer call", http.StatusBadRequest)
+			return
+		}
+
+		reply, err := p.serve(r.Context(), call)
+		if errors.Is(err, UnknownPeerMethodErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(reply); err != nil {
+			slog.Error("could not write the peer reply", "method", call.Method, "error", err)
+		}
+	})
+	return mux
+}
+
+// serve runs the call on the local storage
+func (p *PeerStorage) serve(ctx context.Context, call peerCall) (peerReply, error) {
+	var (
+		reply peerReply
+		err   error
+	)
+	switch call.Method {
+	case peerTokenBucketMethod:
+		reply.Ok, err = p.local.CheckAndUpdateTokenBucket(ctx, call.Key, call.Capacity, call.Rate, call.TTL)
+	case peerLeakyBucketMethod:
+		reply.Ok, err = p.local.CheckAndUpdateLeakyBucket(ctx, call.Key, call.Capacity, call.Rate, call.TTL)
+	case peerAcquireLeaseMethod:
+		reply.Ok, err = p.local.AcquireConcurrencyLease(ctx, call.Key, call.Capacity, call.LeaseID, call.TTL)
+	case peerReleaseLeaseMethod:
+		err = p.local.ReleaseConcurrencyLease(ctx, call.Key, call.LeaseID)
+	case peerCheckBucketsMethod:
+		reply.Value = p.local.checkBuckets(call.Buckets)
+	case peerChargeBucketsMethod:
+		reply.Value, err = p.local.CheckAndUpdateBuckets(ctx, call.Buckets)
+	case peerRecordRejectionMethod:
+		if call.Penalty == nil {
+			return reply, fmt.Errorf("%w: %s without penalty", UnknownPeerMethodErr, call.Method)
+		}
+		reply.Duration, err = p.local.RecordRejection(ctx, call.Key, *call.Penalty)
+	case peerBanRemainingMethod:
+		reply.Duration, err = p.local.BanRemaining(ctx, call.Key)
+	case peerListBansMethod:
+		reply.Bans, err = p.local.ListBans(ctx)
+	case peerQuotaMethod:
+		reply.Ok, reply.Value, err = p.local.CheckAndUpdateQuota(ctx, call.Key, call.Capacity)
+	case peerCreditQuotaMethod:
+		reply.Value, err = p.local.CreditQuota(ctx, call.Key, call.Capacity, call.Amount)
+	case peerIncrementCounterMethod:
+		reply.Value, err = p.local.IncrementCounter(ctx, call.Key, call.TTL)
+	case peerMarkOnceMethod:
+		reply.Ok, err = p.local.MarkOnce(ctx, call.Key, call.TTL)
+	default:
+		return reply, fmt.Errorf("%w: %q", UnknownPeerMethodErr, call.Method)
+	}
+
+	return reply, err
+}
+
+// reachable tells whether the peer may be called, a peer that failed is left
+// alone for the retry interval
+func (p *PeerStorage) reachable(peer string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.now().Before(p.downUntil[peer])
+}
+
+func (p *PeerStorage) markDown(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downUntil[peer] = p.now().Add(p.retryInterval)
+}
+
+// forward sends the call to the peer, PeerUnavailableErr means the peer did
+// not run it and the call can be served elsewhere
+func (p *PeerStorage) forward(ctx context.Context, peer string, call peerCall) (peerReply, error) {
+	body, err := json.Marshal(call)
+	if err != nil {
+		return peerReply{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+PeerCallPath, bytes.NewReader(body))
+	if err != nil {
+		return peerReply{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signPeerRequest(req, p.secret, body)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return peerReply{}, errors.Join(PeerUnavailableErr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return peerReply{}, fmt.Errorf("%w: %s replied %s", PeerUnavailableErr, peer, resp.Status)
+	}
+
+	var reply peerReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return peerReply{}, errors.Join(PeerUnavailableErr, err)
+	}
+	if reply.Error != "" {
+		return reply, errors.New(reply.Error)
+	}
+
+	return reply, nil
+}
+
+// call runs the call on the owner of the key, locally when the instance owns
+// it or when the owner cannot be reached
+func (p *PeerStorage) call(ctx context.Context, key string, call peerCall) (peerReply, error) {
+	owner := p.ring.owner(key)
+	if owner == p.self || owner == "" {
+		peerCallsTotal.WithLabelValues(localPeerResult).Inc()
+		return p.serve(ctx, call)
+	}
+
+	if p.reachable(owner) {
+		reply, err := p.forward(ctx, owner, call)
+		if !errors.Is(err, PeerUnavailableErr) || ctx.Err() != nil {
+			peerCallsTotal.WithLabelValues(forwardedPeerResult).Inc()
+			return reply, err
+		}
+
+		slog.Warn("the owner of the key is unreachable, serving it locally", "peer", owner, "key", key, "error", err)
+		p.markDown(owner)
+	}
+
+	peerCallsTotal.WithLabelValues(fallbackPeerResult).Inc()
+	return p.serve(ctx, call)
+}
+
+func (p *PeerStorage) CheckAndUpdateTokenBucket(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerTokenBucketMethod, Key: key, Capacity: capacity, Rate: refillRate, TTL: expiresIn})
+	return reply.Ok, err
+}
+
+func (p *PeerStorage) CheckAndUpdateLeakyBucket(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerLeakyBucketMethod, Key: key, Capacity: capacity, Rate: leakRate, TTL: expiresIn})
+	return reply.Ok, err
+}
+
+func (p *PeerStorage) AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerAcquireLeaseMethod, Key: key, Capacity: limit, LeaseID: leaseID, TTL: leaseTTL})
+	return reply.Ok, err
+}
+
+func (p *PeerStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	_, err := p.call(ctx, key, peerCall{Method: peerReleaseLeaseMethod, Key: key, LeaseID: leaseID})
+	return err
+}
+
+// CheckAndUpdateBuckets charges the buckets on their owner in a single call
+// when they have the same one, otherwise every owner checks its buckets before
+// any of them is charged
+func (p *PeerStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	var (
+		owners  []string
+		indexes = make(map[string][]int)
+	)
+	for i, bucket := range buckets {
+		owner := p.ring.owner(bucket.Key)
+		if _, ok := indexes[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		indexes[owner] = append(indexes[owner], i)
+	}
+
+	if len(owners) == 1 {
+		reply, err := p.call(ctx, buckets[0].Key, peerCall{Method: peerChargeBucketsMethod, Buckets: buckets})
+		return reply.Value, err
+	}
+
+	for _, method := range []string{peerCheckBucketsMethod, peerChargeBucketsMethod} {
+		for _, owner := range owners {
+			ownerBuckets := make([]Bucket, 0, len(indexes[owner]))
+			for _, i := range indexes[owner] {
+				ownerBuckets = append(ownerBuckets, buckets[i])
+			}
+
+			reply, err := p.call(ctx, ownerBuckets[0].Key, peerCall{Method: method, Buckets: ownerBuckets})
+			if err != nil {
+				return 0, err
+			}
+			if reply.Value >= 0 {
+				return indexes[owner][reply.Value], nil
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+func (p *PeerStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerRecordRejectionMethod, Key: key, Penalty: &penalty})
+	return reply.Duration, err
+}
+
+func (p *PeerStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerBanRemainingMethod, Key: key})
+	return reply.Duration, err
+}
+
+// ListBans gathers the bans of every reachable peer, a key banned on several
+// of them (served locally while its owner was unreachable) is listed once
+// with the latest end
+func (p *PeerStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	bans, err := p.local.ListBans(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range p.peers {
+		if peer == p.self || !p.reachable(peer) {
+			continue
+		}
+		reply, err := p.forward(ctx, peer, peerCall{Method: peerListBansMethod})
+		if err != nil {
+			slog.Error("could not list the bans of the peer", "peer", peer, "error", err)
+			continue
+		}
+		bans = append(bans, reply.Bans...)
+	}
+
+	until := make(map[string]time.Time, len(bans))
+	merged := make([]Ban, 0, len(bans))
+	for _, ban := range bans {
+		current, ok := until[ban.Key]
+		if !ok {
+			merged = append(merged, ban)
+		}
+		if ban.Until.After(current) {
+			until[ban.Key] = ban.Until
+		}
+	}
+	for i := range merged {
+		merged[i].Until = until[merged[i].Key]
+	}
+
+	return merged, nil
+}
+
+func (p *PeerStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerQuotaMethod, Key: key, Capacity: initialBalance})
+	return reply.Ok, reply.Value, err
+}
+
+func (p *PeerStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerCreditQuotaMethod, Key: key, Capacity: initialBalance, Amount: amount})
+	return reply.Value, err
+}
+
+func (p *PeerStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerIncrementCounterMethod, Key: key, TTL: ttl})
+	return reply.Value, err
+}
+
+func (p *PeerStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	reply, err := p.call(ctx, key, peerCall{Method: peerMarkOnceMethod, Key: key, TTL: ttl})
+	return reply.Ok, err
+}
+
+// Close closes the local storage, the peer server is stopped by its owner
+func (p *PeerStorage) Close() error {
+	return p.local.Close()
+}
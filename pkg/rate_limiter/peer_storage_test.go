@@ -0,0 +1,247 @@
+package rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPeerSecret = "peer-secret"
+
+// newTestPeers starts n peer storages listening on loopback, each one knowing
+// the address of every other
+func newTestPeers(t *testing.T, n int) ([]*PeerStorage, []*httptest.Server) {
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	peers := make([]*PeerStorage, n)
+	servers := make([]*httptest.Server, n)
+	for i := range n {
+		var err error
+		peers[i], err = NewPeerStorage(PeerStorageOptions{Secret: testPeerSecret, Self: addrs[i], Peers: addrs})
+		require.NoError(t, err)
+		servers[i] = httptest.NewUnstartedServer(peers[i].Handler())
+		servers[i].Listener.Close()
+		servers[i].Listener = listeners[i]
+		servers[i].Start()
+
+		t.Cleanup(servers[i].Close)
+		t.Cleanup(func() {
+			assert.NoError(t, peers[i].Close())
+		})
+	}
+
+	return peers, servers
+}
+
+// ownedKey returns a limiter key owned by the peer
+func ownedKey(t *testing.T, ring *peerRing, peer string) string {
+	for i := range 1000 {
+		key := limiterKey(fmt.Sprintf("k%d:search", i), "rpm")
+		if ring.owner(key) == peer {
+			return key
+		}
+	}
+	require.FailNow(t, "no key owned by the peer", peer)
+	return ""
+}
+
+func TestPeerRing(t *testing.T) {
+	peers := []string{"10.0.0.1:7946", "10.0.0.2:7946", "10.0.0.3:7946"}
+	ring := newPeerRing(peers, 0)
+	reversed := newPeerRing([]string{peers[2], peers[1], peers[0]}, 0)
+	withoutLast := newPeerRing(peers[:2], 0)
+
+	owned := make(map[string]int)
+	for i := range 1000 {
+		key := limiterKey(fmt.Sprintf("k%d:search", i), "rpm")
+		owner := ring.owner(key)
+		owned[owner]++
+
+		assert.Equal(t, owner, reversed.owner(key), "the order of the peers does not matter")
+		assert.Equal(t, owner, ring.owner(limiterKey(fmt.Sprintf("k%d:search", i), "rph")), "the limiters of a key have the same owner")
+		if owner != peers[2] {
+			assert.Equal(t, owner, withoutLast.owner(key), "only the keys of the removed peer move")
+		}
+	}
+
+	for _, peer := range peers {
+		assert.Greater(t, owned[peer], 200, "the keys are spread over the peers")
+	}
+	assert.Empty(t, newPeerRing(nil, 0).owner("k1"))
+}
+
+func TestPeerStorage_TokenBucket(t *testing.T) {
+	peers, _ := newTestPeers(t, 3)
+	ctx := context.Background()
+	key := limiterKey("k1:search", "rpm")
+
+	for i := range 5 {
+		ok, err := peers[i%3].CheckAndUpdateTokenBucket(ctx, key, 5, 0.001, time.Minute)
+		require.NoError(t, err)
+		assert.True(t, ok, "request %d", i)
+	}
+
+	for i, peer := range peers {
+		ok, err := peer.CheckAndUpdateTokenBucket(ctx, key, 5, 0.001, time.Minute)
+		require.NoError(t, err)
+		assert.False(t, ok, "the bucket is shared by every peer, peer %d", i)
+	}
+}
+
+func TestPeerStorage_Fallback(t *testing.T) {
+	peers, servers := newTestPeers(t, 2)
+	ctx := context.Background()
+	key := ownedKey(t, peers[1].ring, peers[0].self)
+
+	ok, err := peers[1].CheckAndUpdateTokenBucket(ctx, key, 1, 0.001, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	servers[0].Close()
+
+	ok, err = peers[1].CheckAndUpdateTokenBucket(ctx, key, 1, 0.001, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, ok, "the key is served from the local memory while its owner is down")
+	assert.False(t, peers[1].reachable(peers[0].self), "the owner is not called until the retry interval is over")
+
+	ok, err = peers[1].CheckAndUpdateTokenBucket(ctx, key, 1, 0.001, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, ok, "the local bucket enforces the limit")
+
+	peers[1].now = func() time.Time { return time.Now().Add(defaultPeerRetryInterval) }
+	assert.True(t, peers[1].reachable(peers[0].self))
+}
+
+func TestPeerStorage_CheckAndUpdateBuckets(t *testing.T) {
+	peers, _ := newTestPeers(t, 3)
+	ctx := context.Background()
+	parent := ownedKey(t, peers[0].ring, peers[0].self)
+	child := ownedKey(t, peers[0].ring, peers[1].self)
+
+	buckets := []Bucket{
+		{Key: parent, Algorithm: enum.TokenBucket, Capacity: 1, Rate: 0.001, ExpiresIn: time.Minute},
+		{Key: child, Algorithm: enum.TokenBucket, Capacity: 2, Rate: 0.001, ExpiresIn: time.Minute},
+	}
+
+	rejected, err := peers[2].CheckAndUpdateBuckets(ctx, buckets)
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected)
+
+	rejected, err = peers[2].CheckAndUpdateBuckets(ctx, buckets)
+	require.NoError(t, err)
+	assert.Equal(t, 0, rejected, "the parent bucket owned by another peer is empty")
+
+	rejected, err = peers[2].CheckAndUpdateBuckets(ctx, buckets[1:])
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected, "the child bucket was not charged by the rejected request")
+}
+
+func TestPeerStorage_ListBans(t *testing.T) {
+	peers, _ := newTestPeers(t, 2)
+	ctx := context.Background()
+	penalty := config.PenaltyConfig{
+		MaxRejections:  1,
+		Window:         time.Minute,
+		BanDuration:    time.Hour,
+		MaxBanDuration: time.Hour,
+		ForgetAfter:    time.Hour,
+	}
+
+	var keys []string
+	for _, peer := range peers {
+		key := strings.TrimSuffix(strings.TrimPrefix(ownedKey(t, peers[0].ring, peer.self), "{"), "}:rpm")
+		keys = append(keys, key)
+		ban, err := peers[0].RecordRejection(ctx, key, penalty)
+		require.NoError(t, err)
+		assert.Equal(t, time.Hour, ban)
+	}
+
+	for i, peer := range peers {
+		bans, err := peer.ListBans(ctx)
+		require.NoError(t, err)
+		require.Len(t, bans, 2, "peer %d", i)
+		assert.ElementsMatch(t, keys, []string{bans[0].Key, bans[1].Key})
+
+		remaining, err := peer.BanRemaining(ctx, keys[0])
+		require.NoError(t, err)
+		assert.InDelta(t, time.Hour, remaining, float64(time.Second))
+	}
+}
+
+// postPeerCall posts the body to the peer server, signed with the secret when it is not empty
+func postPeerCall(t *testing.T, url, secret, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url+PeerCallPath, strings.NewReader(body))
+	require.NoError(t, err)
+	if secret != "" {
+		signPeerRequest(req, secret, []byte(body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestNewPeerStorage_RequiresSecret(t *testing.T) {
+	_, err := NewPeerStorage(PeerStorageOptions{Self: "127.0.0.1:7946", Peers: []string{"127.0.0.1:7946"}})
+	assert.ErrorIs(t, err, MissingPeerSecretErr)
+}
+
+func TestPeerStorage_Handler(t *testing.T) {
+	peers, servers := newTestPeers(t, 1)
+	credit := `{"method":"credit_quota","key":"k1:credits","capacity":10,"amount":1000}`
+
+	tests := []struct {
+		name     string
+		secret   string
+		body     string
+		expected int
+	}{
+		{name: "Unsigned call", body: credit, expected: http.StatusUnauthorized},
+		{name: "Call signed with another secret", secret: "forged", body: credit, expected: http.StatusUnauthorized},
+		{name: "Body too large", secret: testPeerSecret, body: strings.Repeat(" ", maxPeerBodyBytes+1), expected: http.StatusBadRequest},
+		{name: "Unknown method", secret: testPeerSecret, body: `{"method":"unknown"}`, expected: http.StatusBadRequest},
+		{name: "Invalid call", secret: testPeerSecret, body: `{`, expected: http.StatusBadRequest},
+		{name: "Signed call", secret: testPeerSecret, body: credit, expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postPeerCall(t, servers[0].URL, tt.secret, tt.body)
+			assert.Equal(t, tt.expected, resp.StatusCode)
+		})
+	}
+
+	t.Run("Replayed call", func(t *testing.T) {
+		signed := postPeerCall(t, servers[0].URL, testPeerSecret, credit)
+		require.Equal(t, http.StatusOK, signed.StatusCode)
+
+		// a captured call is sent again as is, within the timestamp tolerance
+		req, err := http.NewRequest(http.MethodPost, servers[0].URL+PeerCallPath, strings.NewReader(credit))
+		require.NoError(t, err)
+		req.Header = signed.Request.Header.Clone()
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	_, balance, err := peers[0].local.CheckAndUpdateQuota(context.Background(), "k1:credits", 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2009, balance, "only the signed credits received once were applied")
+}
@@ -2,6 +2,8 @@ package rate_limiter
 
 import (
 	"context"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
 	"time"
 )
 
@@ -9,7 +11,74 @@ type RateLimiter interface {
 	Allow(ctx context.Context, key string) (bool, error)
 }
 
+// Bucket describes one of the buckets charged together by CheckAndUpdateBuckets
+type Bucket struct {
+	Key       string
+	Algorithm enum.Algorithm // TokenBucket or LeakyBucket
+	Capacity  int
+	Rate      float64 // refill rate of a token bucket, leak rate of a leaky bucket
+	ExpiresIn time.Duration
+}
+
+// Ban describes a key banned by the penalty policy of its group
+type Ban struct {
+	Key   string    `json:"key"` // key prefix of the banned buckets, e.g. auth:john:login
+	Until time.Time `json:"until"`
+}
+
 type Storer interface {
 	CheckAndUpdateTokenBucket(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, error)
 	CheckAndUpdateLeakyBucket(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, error)
+	AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error)
+	ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error
+	// CheckAndUpdateBuckets charges the request against every bucket or
+	// against none of them. It returns the index of the first bucket without
+	// enough capacity, -1 when the request was charged.
+	CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error)
+	// RecordRejection counts a rejection of the key and bans it once the
+	// penalty threshold is reached. It returns the duration of the ban the
+	// rejection triggered, 0 when it did not trigger any.
+	RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error)
+	// BanRemaining returns how long the key is still banned, 0 when it is not
+	BanRemaining(ctx context.Context, key string) (time.Duration, error)
+	ListBans(ctx context.Context) ([]Ban, error)
+	// CheckAndUpdateQuota takes one request off the balance of the key, a key
+	// never seen starts with initialBalance and the balance never expires. It
+	// returns whether the request was charged and the balance left.
+	CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error)
+	// CreditQuota adds amount to the balance of the key and returns the new balance
+	CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error)
+	// IncrementCounter adds one to the counter of the key, created with the
+	// ttl, and returns its new value
+	IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error)
+	// MarkOnce marks the key for ttl, it returns false when the key was already marked
+	MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Close releases the resources of the storage once the client is done with it
+	Close() error
+}
+
+// RetryAtStorer is a storage telling when a bucket that rejected a request
+// accepts requests again, so that the rejection can be cached until then
+type RetryAtStorer interface {
+	Storer
+	// CheckAndUpdateTokenBucketRetryAt is CheckAndUpdateTokenBucket also
+	// returning, on rejection, when the bucket has a token again. The time
+	// is zero when the request was allowed or the bucket never refills.
+	CheckAndUpdateTokenBucketRetryAt(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, time.Time, error)
+	// CheckAndUpdateLeakyBucketRetryAt is CheckAndUpdateLeakyBucket also
+	// returning, on rejection, when the bucket leaked enough for a request
+	CheckAndUpdateLeakyBucketRetryAt(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, time.Time, error)
+}
+
+// TokenLeaser is a storage whose token buckets can hand out several tokens at
+// once, to be spent by the instance without calling the storage
+type TokenLeaser interface {
+	RetryAtStorer
+	// LeaseTokens takes up to count tokens off the token bucket of the key,
+	// fewer when the bucket runs low. When it takes none it also returns when
+	// the bucket has a token again, zero when it never refills.
+	LeaseTokens(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration, count int) (int, time.Time, error)
+	// ReturnTokens gives back leased tokens that were not spent, the bucket
+	// never goes above its capacity
+	ReturnTokens(ctx context.Context, key string, capacity int, count int) error
 }
@@ -0,0 +1,44 @@
+package rate_limiter
+
+import (
+	"context"
+)
+
+type QuotaHandler interface {
+	CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error)
+	CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error)
+}
+
+// QuotaLimiter charges each request against a prepaid balance which never
+// refills nor expires, the balance only grows when it is credited
+type QuotaLimiter struct {
+	InitialBalance      int // balance of a key never seen before
+	LowBalanceThreshold int
+	// OnLowBalance is called, synchronously, by the request bringing the
+	// balance of the key down to LowBalanceThreshold
+	OnLowBalance     func(ctx context.Context, key string, balance int)
+	rateLimitHandler QuotaHandler
+}
+
+func NewQuotaLimiter(handler QuotaHandler, options *QuotaLimiter) *QuotaLimiter {
+	options.rateLimitHandler = handler
+	return options
+}
+
+func (ql *QuotaLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	ok, balance, err := ql.rateLimitHandler.CheckAndUpdateQuota(ctx, key, ql.InitialBalance)
+	if err != nil {
+		return false, err
+	}
+
+	if ok && balance == ql.LowBalanceThreshold && ql.OnLowBalance != nil {
+		ql.OnLowBalance(ctx, key, balance)
+	}
+
+	return ok, nil
+}
+
+// Credit adds amount to the balance of the key and returns the new balance
+func (ql *QuotaLimiter) Credit(ctx context.Context, key string, amount int) (int, error) {
+	return ql.rateLimitHandler.CreditQuota(ctx, key, ql.InitialBalance, amount)
+}
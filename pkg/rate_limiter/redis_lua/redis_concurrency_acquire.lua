@@ -0,0 +1,17 @@
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local lease_id = ARGV[2]
+local lease_ttl_ms = tonumber(ARGV[3])
+local now_ms = tonumber(ARGV[4])
+
+-- reclaim the leases whose holder did not release them in time
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now_ms)
+
+local in_flight = redis.call('ZCARD', key)
+if in_flight < limit then
+    redis.call('ZADD', key, now_ms + lease_ttl_ms, lease_id)
+    redis.call('PEXPIRE', key, lease_ttl_ms)
+    return {1, in_flight + 1}
+else
+    return {0, in_flight}
+end
@@ -0,0 +1,9 @@
+local key = KEYS[1]
+local ttl_ms = tonumber(ARGV[1])
+
+-- the ttl is only set by the first increment so that the counter covers a fixed window
+local value = redis.call('INCR', key)
+if value == 1 then
+    redis.call('PEXPIRE', key, ttl_ms)
+end
+return value
@@ -26,6 +26,11 @@ if current_bucket_size_plus_request_cost <= capacity then
     redis.call('EXPIRE', key, expires_at)
     return {1, bucket_size}
 else
-    return {0, bucket_size}
+    -- seconds until the bucket leaks enough for one request, -1 when it never accepts a request
+    local retry_after = -1
+    if leak_rate > 0 and capacity >= 1 then
+        retry_after = math.ceil((current_bucket_size_plus_request_cost - capacity) / leak_rate)
+    end
+    return {0, bucket_size, retry_after}
 end
 
@@ -0,0 +1,45 @@
+-- charges the request against every bucket of KEYS or against none of them
+-- ARGV[1] is the current unix time, then each bucket takes 4 arguments:
+-- algorithm (token_bucket or leaky_bucket), capacity, rate and expiration in seconds
+local now_unix = tonumber(ARGV[1])
+local updates = {}
+
+for i, key in ipairs(KEYS) do
+    local offset = 1 + (i - 1) * 4
+    local algorithm = ARGV[offset + 1]
+    local capacity = tonumber(ARGV[offset + 2])
+    local rate = tonumber(ARGV[offset + 3])
+
+    if algorithm == 'leaky_bucket' then
+        local last_leak_unix = redis.call('HGET', key, 'last_leak_unix')
+        local bucket_size = 0
+        if last_leak_unix ~= false then
+            local time_elapsed = now_unix - tonumber(last_leak_unix)
+            bucket_size = math.max(0, tonumber(redis.call('HGET', key, 'bucket_size')) - time_elapsed * rate)
+        end
+
+        if bucket_size + 1 > capacity then
+            return {0, i}
+        end
+        updates[i] = {'bucket_size', bucket_size + 1, 'last_leak_unix', now_unix}
+    else
+        local last_refill_unix = redis.call('HGET', key, 'last_refill_unix')
+        local bucket_size = capacity
+        if last_refill_unix ~= false then
+            local time_elapsed = now_unix - tonumber(last_refill_unix)
+            bucket_size = math.min(capacity, tonumber(redis.call('HGET', key, 'bucket_size')) + time_elapsed * rate)
+        end
+
+        if bucket_size < 1 then
+            return {0, i}
+        end
+        updates[i] = {'bucket_size', bucket_size - 1, 'last_refill_unix', now_unix}
+    end
+end
+
+for i, key in ipairs(KEYS) do
+    redis.call('HSET', key, unpack(updates[i]))
+    redis.call('EXPIRE', key, ARGV[1 + (i - 1) * 4 + 4])
+end
+
+return {1, 0}
@@ -0,0 +1,13 @@
+local key = KEYS[1]
+local initial_balance = tonumber(ARGV[1])
+
+-- the balance never expires, a key never seen starts with the initial balance
+local balance = tonumber(redis.call('GET', key) or initial_balance)
+
+if balance > 0 then
+    balance = balance - 1
+    redis.call('SET', key, balance)
+    return {1, balance}
+else
+    return {0, balance}
+end
@@ -0,0 +1,7 @@
+local key = KEYS[1]
+local initial_balance = tonumber(ARGV[1])
+local amount = tonumber(ARGV[2])
+
+local balance = tonumber(redis.call('GET', key) or initial_balance) + amount
+redis.call('SET', key, balance)
+return balance
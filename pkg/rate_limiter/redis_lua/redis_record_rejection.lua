@@ -0,0 +1,37 @@
+-- counts a rejection and bans the key once max_rejections is reached within the window,
+-- the ban duration doubles on each offence not forgotten yet up to max_ban_ms
+local rejections_key = KEYS[1]
+local offences_key = KEYS[2]
+local ban_key = KEYS[3]
+local now_ms = tonumber(ARGV[1])
+local max_rejections = tonumber(ARGV[2])
+local window_ms = tonumber(ARGV[3])
+local ban_ms = tonumber(ARGV[4])
+local max_ban_ms = tonumber(ARGV[5])
+local forget_after_ms = tonumber(ARGV[6])
+
+local rejections = redis.call('INCR', rejections_key)
+if rejections == 1 then
+    redis.call('PEXPIRE', rejections_key, window_ms)
+end
+
+if rejections < max_rejections then
+    return 0
+end
+
+redis.call('DEL', rejections_key)
+local offences = redis.call('INCR', offences_key)
+
+local duration = ban_ms
+for _ = 2, offences do
+    if duration >= max_ban_ms then
+        break
+    end
+    duration = duration * 2
+end
+duration = math.min(duration, max_ban_ms)
+
+redis.call('PEXPIRE', offences_key, duration + forget_after_ms)
+redis.call('SET', ban_key, now_ms + duration, 'PX', duration)
+
+return duration
@@ -25,6 +25,11 @@ if bucket_size >= 1 then
     redis.call('EXPIRE', key, expires_at)
     return {1, bucket_size}
 else
-    return {0, bucket_size}
+    -- seconds until the bucket refills one token, -1 when it never accepts a request
+    local retry_after = -1
+    if refill_rate > 0 and capacity >= 1 then
+        retry_after = math.ceil((1 - bucket_size) / refill_rate)
+    end
+    return {0, bucket_size, retry_after}
 end
 
@@ -0,0 +1,37 @@
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local refill_rate = tonumber(ARGV[2])
+local expires_in = tonumber(ARGV[3])
+local now_unix = tonumber(ARGV[4])
+local count = tonumber(ARGV[5])
+
+local last_refill_unix = redis.call('HGET', key, 'last_refill_unix')
+local bucket_size = redis.call('HGET', key, 'bucket_size')
+
+if last_refill_unix == false then
+    last_refill_unix = now_unix
+    bucket_size = capacity
+else
+    last_refill_unix = tonumber(last_refill_unix)
+    bucket_size = tonumber(bucket_size)
+
+    local time_elapsed = now_unix - last_refill_unix
+    local tokens_to_refill = time_elapsed * refill_rate
+    bucket_size = math.min(capacity, bucket_size + tokens_to_refill)
+    last_refill_unix = now_unix
+end
+
+-- take up to count whole tokens, fewer when the bucket runs low
+local taken = math.min(count, math.floor(bucket_size))
+if taken >= 1 then
+    redis.call('HSET', key, 'bucket_size', bucket_size - taken, 'last_refill_unix', last_refill_unix)
+    redis.call('EXPIRE', key, expires_in)
+    return {taken, 0}
+else
+    -- seconds until the bucket refills one token, -1 when it never accepts a request
+    local retry_after = -1
+    if refill_rate > 0 and capacity >= 1 then
+        retry_after = math.ceil((1 - bucket_size) / refill_rate)
+    end
+    return {0, retry_after}
+end
@@ -0,0 +1,13 @@
+local key = KEYS[1]
+local capacity = tonumber(ARGV[1])
+local count = tonumber(ARGV[2])
+
+-- an expired bucket starts full again, there is nothing to give back
+local bucket_size = redis.call('HGET', key, 'bucket_size')
+if bucket_size == false then
+    return 0
+end
+
+bucket_size = math.min(capacity, tonumber(bucket_size) + count)
+redis.call('HSET', key, 'bucket_size', bucket_size)
+return bucket_size
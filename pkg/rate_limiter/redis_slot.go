@@ -0,0 +1,25 @@
+package rate_limiter
+
+const redisClusterSlots = 16384
+
+// redisKeySlot returns the redis cluster slot of the key, only the hash tag
+// is hashed when the key has a non-empty one
+func redisKeySlot(key string) int {
+	return int(crc16(hashTag(key)) % redisClusterSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
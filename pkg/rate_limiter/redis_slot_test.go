@@ -0,0 +1,28 @@
+package rate_limiter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRedisKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{key: "foo", slot: 12182},
+		{key: "{foo}:rpm", slot: 12182},
+		{key: "bar{foo}", slot: 12182},
+		{key: "{foo}{bar}", slot: 12182},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.slot, redisKeySlot(tt.key), tt.key)
+	}
+
+	assert.NotEqual(t, redisKeySlot("bar"), redisKeySlot("foo{}{bar}"), "An empty hash tag hashes the whole key")
+	assert.Equal(t, redisKeySlot(limiterKey("john:login", "rpm")), redisKeySlot(limiterKey("john:login", "rph")),
+		"The limiters of a key share a slot")
+}
@@ -3,9 +3,14 @@ package rate_limiter
 import (
 	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"github.com/redis/go-redis/v9"
-	"github/martinmaurice/rlim/pkg/env"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/redis_client"
 	"log/slog"
+	"math"
+	"strconv"
 	"time"
 )
 
@@ -15,8 +20,66 @@ var (
 
 	//go:embed redis_lua/redis_leaky_bucket.lua
 	redisLeakyBucketLua string
+
+	//go:embed redis_lua/redis_concurrency_acquire.lua
+	redisConcurrencyAcquireLua string
+
+	//go:embed redis_lua/redis_multi_bucket.lua
+	redisMultiBucketLua string
+
+	//go:embed redis_lua/redis_record_rejection.lua
+	redisRecordRejectionLua string
+
+	//go:embed redis_lua/redis_quota.lua
+	redisQuotaLua string
+
+	//go:embed redis_lua/redis_quota_credit.lua
+	redisQuotaCreditLua string
+
+	//go:embed redis_lua/redis_increment_counter.lua
+	redisIncrementCounterLua string
+
+	//go:embed redis_lua/redis_token_lease.lua
+	redisTokenLeaseLua string
+
+	//go:embed redis_lua/redis_token_return.lua
+	redisTokenReturnLua string
 )
 
+var CrossSlotBucketsErr = errors.New("the buckets cannot be charged at once across redis cluster slots")
+
+// the scripts are built once, their sha is computed at init
+var (
+	redisTokenBucketScript        = redis.NewScript(redisTokenBucketLua)
+	redisLeakyBucketScript        = redis.NewScript(redisLeakyBucketLua)
+	redisConcurrencyAcquireScript = redis.NewScript(redisConcurrencyAcquireLua)
+	redisMultiBucketScript        = redis.NewScript(redisMultiBucketLua)
+	redisRecordRejectionScript    = redis.NewScript(redisRecordRejectionLua)
+	redisQuotaScript              = redis.NewScript(redisQuotaLua)
+	redisQuotaCreditScript        = redis.NewScript(redisQuotaCreditLua)
+	redisIncrementCounterScript   = redis.NewScript(redisIncrementCounterLua)
+	redisTokenLeaseScript         = redis.NewScript(redisTokenLeaseLua)
+	redisTokenReturnScript        = redis.NewScript(redisTokenReturnLua)
+
+	redisScripts = []*redis.Script{
+		redisTokenBucketScript,
+		redisLeakyBucketScript,
+		redisConcurrencyAcquireScript,
+		redisMultiBucketScript,
+		redisRecordRejectionScript,
+		redisQuotaScript,
+		redisQuotaCreditScript,
+		redisIncrementCounterScript,
+		redisTokenLeaseScript,
+		redisTokenReturnScript,
+	}
+)
+
+const redisLoadScriptsTimeout = 5 * time.Second
+
+// redisBansIndexKey is a sorted set of the banned keys scored by the end of their ban
+const redisBansIndexKey = "rlim:bans"
+
 type redisTokenBucket struct {
 	lastRefillUnix int64
 	bucketSize     float64
@@ -28,65 +91,354 @@ type redisLeakyBucket struct {
 }
 
 type RedisStorage struct {
-	dB *redis.Client
+	dB      redis.UniversalClient
+	cluster bool // the keys of a script must then share a slot
 }
 
+// NewRedis creates the storage on the redis of the env: single node, sentinel or cluster
 func NewRedis() Storer {
-	envObj := env.GetEnv()
-	return &RedisStorage{
-		dB: redis.NewClient(&redis.Options{
-			Addr:     envObj.RedisAddr,
-			Password: envObj.RedisPassword,
-			DB:       envObj.RedisDb,
-			PoolSize: envObj.RedisPoolSize,
-		}),
+	return NewRedisStorage(redis_client.New())
+}
+
+// NewRedisStorage loads the scripts into redis, a redis not reachable yet
+// gets them on the first call
+func NewRedisStorage(client redis.UniversalClient) *RedisStorage {
+	_, cluster := client.(*redis.ClusterClient)
+	r := &RedisStorage{
+		dB:      client,
+		cluster: cluster,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisLoadScriptsTimeout)
+	defer cancel()
+	if err := r.LoadScripts(ctx); err != nil {
+		slog.Error("could not load the scripts into redis, they will be loaded on first use", "error", err)
 	}
+
+	return r
+}
+
+// LoadScripts loads every script into redis (every master of a cluster) so
+// that they can be called by their sha
+func (r *RedisStorage) LoadScripts(ctx context.Context) error {
+	for _, script := range redisScripts {
+		if err := script.Load(ctx, r.dB).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run calls the script by its sha, loading it again when redis lost it
+// (restart, failover, SCRIPT FLUSH)
+func (r *RedisStorage) run(ctx context.Context, script *redis.Script, keys []string, args ...any) *redis.Cmd {
+	cmd := script.EvalSha(ctx, r.dB, keys, args...)
+	if !redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+		return cmd
+	}
+
+	slog.Warn("the script is missing from redis, loading it again", "sha", script.Hash())
+	if err := script.Load(ctx, r.dB).Err(); err != nil {
+		slog.Error("could not load the script into redis", "sha", script.Hash(), "error", err)
+		return cmd
+	}
+	return script.EvalSha(ctx, r.dB, keys, args...)
 }
 
 func (r *RedisStorage) CheckAndUpdateTokenBucket(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, error) {
-	script := redis.NewScript(redisTokenBucketLua)
+	ok, _, err := r.CheckAndUpdateTokenBucketRetryAt(ctx, key, capacity, refillRate, expiresIn)
+	return ok, err
+}
+
+func (r *RedisStorage) CheckAndUpdateTokenBucketRetryAt(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration) (bool, time.Time, error) {
 	keys := []string{key}
 
-	result, err := script.Run(
-		context.Background(),
-		r.dB,
+	now := time.Now().Unix()
+	result, err := r.run(
+		ctx,
+		redisTokenBucketScript,
 		keys,
 		capacity,
 		refillRate,
 		expiresIn,
-		time.Now().Unix(),
+		now,
 	).Int64Slice()
 	if err != nil {
-		return false, err
+		return false, time.Time{}, err
 	}
 
 	ok := result[0]
 	bucketSize := result[1]
 
 	slog.Debug("token bucket", "ok", ok, "bucket_size", bucketSize)
-	return ok > 0, nil
+	if ok > 0 {
+		return true, time.Time{}, nil
+	}
+	// a rejection also returns the seconds before the next token
+	return false, retryAt(now, result[2]), nil
 }
 
 func (r *RedisStorage) CheckAndUpdateLeakyBucket(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, error) {
-	script := redis.NewScript(redisLeakyBucketLua)
+	ok, _, err := r.CheckAndUpdateLeakyBucketRetryAt(ctx, key, capacity, leakRate, expiresIn)
+	return ok, err
+}
+
+func (r *RedisStorage) CheckAndUpdateLeakyBucketRetryAt(ctx context.Context, key string, capacity int, leakRate float64, expiresIn time.Duration) (bool, time.Time, error) {
 	keys := []string{key}
 
-	result, err := script.Run(
-		context.Background(),
-		r.dB,
+	now := time.Now().Unix()
+	result, err := r.run(
+		ctx,
+		redisLeakyBucketScript,
 		keys,
 		capacity,
 		leakRate,
 		expiresIn,
-		time.Now().Unix(),
+		now,
 	).Int64Slice()
 	if err != nil {
-		return false, err
+		return false, time.Time{}, err
 	}
 
 	ok := result[0]
 	bucketSize := result[1]
 
-	slog.Debug("token bucket", "ok", ok, "bucket_size", bucketSize)
+	slog.Debug("leaky bucket", "ok", ok, "bucket_size", bucketSize)
+	if ok > 0 {
+		return true, time.Time{}, nil
+	}
+	// a rejection also returns the seconds before the bucket leaked enough
+	return false, retryAt(now, result[2]), nil
+}
+
+// retryAt converts the seconds before a rejecting bucket accepts a request
+// again, counted by the scripts in whole seconds from now, to a time. A
+// negative count means never, the time is then zero.
+func retryAt(now int64, retryAfter int64) time.Time {
+	if retryAfter < 0 {
+		return time.Time{}
+	}
+	return time.Unix(now+retryAfter, 0)
+}
+
+func (r *RedisStorage) LeaseTokens(ctx context.Context, key string, capacity int, refillRate float64, expiresIn time.Duration, count int) (int, time.Time, error) {
+	keys := []string{key}
+
+	now := time.Now().Unix()
+	result, err := r.run(
+		ctx,
+		redisTokenLeaseScript,
+		keys,
+		capacity,
+		refillRate,
+		int64(math.Ceil(expiresIn.Seconds())),
+		now,
+		count,
+	).Int64Slice()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	taken := int(result[0])
+	slog.Debug("token lease", "taken", taken, "count", count)
+	if taken > 0 {
+		return taken, time.Time{}, nil
+	}
+	return 0, retryAt(now, result[1]), nil
+}
+
+func (r *RedisStorage) ReturnTokens(ctx context.Context, key string, capacity int, count int) error {
+	return r.run(ctx, redisTokenReturnScript, []string{key}, capacity, count).Err()
+}
+
+func (r *RedisStorage) AcquireConcurrencyLease(ctx context.Context, key string, limit int, leaseID string, leaseTTL time.Duration) (bool, error) {
+	keys := []string{key}
+
+	result, err := r.run(
+		ctx,
+		redisConcurrencyAcquireScript,
+		keys,
+		limit,
+		leaseID,
+		leaseTTL.Milliseconds(),
+		time.Now().UnixMilli(),
+	).Int64Slice()
+	if err != nil {
+		return false, err
+	}
+
+	ok := result[0]
+	inFlight := result[1]
+
+	slog.Debug("concurrency", "ok", ok, "in_flight", inFlight)
 	return ok > 0, nil
 }
+
+func (r *RedisStorage) ReleaseConcurrencyLease(ctx context.Context, key string, leaseID string) error {
+	return r.dB.ZRem(ctx, key, leaseID).Err()
+}
+
+// CheckAndUpdateBuckets charges the request against every bucket or none of
+// them in a single script. On a cluster the buckets must share a slot, as the
+// levels of a hierarchy do: buckets spread over several slots cannot be
+// charged atomically and are refused with CrossSlotBucketsErr.
+func (r *RedisStorage) CheckAndUpdateBuckets(ctx context.Context, buckets []Bucket) (int, error) {
+	keys := make([]string, 0, len(buckets))
+	args := []any{time.Now().Unix()}
+	for _, bucket := range buckets {
+		if r.cluster && redisKeySlot(bucket.Key) != redisKeySlot(buckets[0].Key) {
+			return 0, fmt.Errorf("%w: %q and %q", CrossSlotBucketsErr, buckets[0].Key, bucket.Key)
+		}
+		keys = append(keys, bucket.Key)
+		args = append(args,
+			bucket.Algorithm.String(),
+			bucket.Capacity,
+			bucket.Rate,
+			int64(math.Ceil(bucket.ExpiresIn.Seconds())),
+		)
+	}
+
+	result, err := r.run(ctx, redisMultiBucketScript, keys, args...).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+
+	ok := result[0]
+	rejectedIndex := int(result[1]) - 1 // lua indexes start at 1
+
+	slog.Debug("multi bucket", "ok", ok, "rejected_index", rejectedIndex)
+	if ok > 0 {
+		return -1, nil
+	}
+	return rejectedIndex, nil
+}
+
+// RecordRejection keeps the penalty state of the key in the slot of its
+// limiters, the bans index is updated apart as it lives in its own slot
+func (r *RedisStorage) RecordRejection(ctx context.Context, key string, penalty config.PenaltyConfig) (time.Duration, error) {
+	keys := []string{
+		limiterKey(key, "penalty:rejections"),
+		limiterKey(key, "penalty:offences"),
+		limiterKey(key, "penalty:ban"),
+	}
+
+	now := time.Now()
+	duration, err := r.run(
+		ctx,
+		redisRecordRejectionScript,
+		keys,
+		now.UnixMilli(),
+		penalty.MaxRejections,
+		penalty.Window.Milliseconds(),
+		penalty.BanDuration.Milliseconds(),
+		penalty.MaxBanDuration.Milliseconds(),
+		penalty.ForgetAfter.Milliseconds(),
+	).Int64()
+	if err != nil || duration == 0 {
+		return 0, err
+	}
+
+	ban := time.Duration(duration) * time.Millisecond
+	_, err = r.dB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, redisBansIndexKey, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+		pipe.ZAdd(ctx, redisBansIndexKey, redis.Z{Score: float64(now.Add(ban).UnixMilli()), Member: key})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return ban, nil
+}
+
+func (r *RedisStorage) BanRemaining(ctx context.Context, key string) (time.Duration, error) {
+	remaining, err := r.dB.PTTL(ctx, limiterKey(key, "penalty:ban")).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// negative values mean the key does not exist or has no ttl
+	return max(remaining, 0), nil
+}
+
+func (r *RedisStorage) ListBans(ctx context.Context) ([]Ban, error) {
+	now := time.Now().UnixMilli()
+	members, err := r.dB.ZRangeByScoreWithScores(ctx, redisBansIndexKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(now+1, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	bans := make([]Ban, 0, len(members))
+	for _, member := range members {
+		bans = append(bans, Ban{
+			Key:   member.Member.(string),
+			Until: time.UnixMilli(int64(member.Score)),
+		})
+	}
+
+	return bans, nil
+}
+
+func (r *RedisStorage) CheckAndUpdateQuota(ctx context.Context, key string, initialBalance int) (bool, int, error) {
+	keys := []string{key}
+
+	result, err := r.run(
+		ctx,
+		redisQuotaScript,
+		keys,
+		initialBalance,
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	ok := result[0]
+	balance := result[1]
+
+	slog.Debug("quota", "ok", ok, "balance", balance)
+	return ok > 0, int(balance), nil
+}
+
+func (r *RedisStorage) CreditQuota(ctx context.Context, key string, initialBalance int, amount int) (int, error) {
+	keys := []string{key}
+
+	balance, err := r.run(
+		ctx,
+		redisQuotaCreditScript,
+		keys,
+		initialBalance,
+		amount,
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(balance), nil
+}
+
+func (r *RedisStorage) IncrementCounter(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	keys := []string{key}
+
+	value, err := r.run(
+		ctx,
+		redisIncrementCounterScript,
+		keys,
+		ttl.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(value), nil
+}
+
+func (r *RedisStorage) MarkOnce(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return r.dB.SetNX(ctx, key, 1, ttl).Result()
+}
+
+func (r *RedisStorage) Close() error {
+	return r.dB.Close()
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
 	"strconv"
 	"sync"
 	"testing"
@@ -556,3 +558,277 @@ func TestRedisStorage_LeakyBucket_EdgeCases(t *testing.T) {
 		assertNotAllowed(t, ok, err, "Bucket should still be full with slow leak rate")
 	})
 }
+
+func TestRedisStorage_ConcurrencyLease(t *testing.T) {
+	t.Run("Leases are limited and released", func(t *testing.T) {
+		mr, storage := newTestRedisStorage(t, nil)
+		key := "concurrency:john"
+
+		for i := 0; i < 2; i++ {
+			ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 2, fmt.Sprintf("lease-%d", i), time.Minute)
+			assertAllowed(t, ok, err, fmt.Sprintf("Lease %d should be acquired", i))
+		}
+
+		ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 2, "lease-2", time.Minute)
+		assertNotAllowed(t, ok, err, "Limit is reached")
+
+		require.NoError(t, storage.ReleaseConcurrencyLease(context.Background(), key, "lease-0"))
+		members, err := mr.ZMembers(key)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"lease-1"}, members)
+
+		ok, err = storage.AcquireConcurrencyLease(context.Background(), key, 2, "lease-2", time.Minute)
+		assertAllowed(t, ok, err, "Lease should be acquired once another one is released")
+	})
+
+	t.Run("Expired leases are reclaimed", func(t *testing.T) {
+		mr, storage := newTestRedisStorage(t, nil)
+		key := "concurrency:crashed"
+		_, err := mr.ZAdd(key, float64(time.Now().Add(-time.Second).UnixMilli()), "crashed-holder")
+		require.NoError(t, err)
+
+		ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 1, "lease-1", time.Minute)
+		assertAllowed(t, ok, err, "The lease of the crashed holder should be reclaimed")
+	})
+
+	t.Run("Leases set expire with their ttl", func(t *testing.T) {
+		mr, storage := newTestRedisStorage(t, nil)
+		key := "concurrency:ttl"
+
+		ok, err := storage.AcquireConcurrencyLease(context.Background(), key, 1, "lease-1", time.Second)
+		assertAllowed(t, ok, err, "Lease should be acquired")
+
+		mr.FastForward(time.Second)
+		assert.False(t, mr.Exists(key), "The key should expire with the last lease")
+	})
+}
+
+func TestRedisStorage_CheckAndUpdateBuckets(t *testing.T) {
+	mr, storage := newTestRedisStorage(t, map[string]any{
+		"user:john": redisLeakyBucket{lastLeakUnix: time.Now().Unix(), bucketSize: 1},
+	})
+	buckets := []Bucket{
+		{Key: "org:acme", Algorithm: enum.TokenBucket, Capacity: 3, Rate: .01, ExpiresIn: time.Minute},
+		{Key: "user:john", Algorithm: enum.LeakyBucket, Capacity: 2, Rate: .01, ExpiresIn: time.Minute},
+	}
+
+	rejected, err := storage.CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected, "The request should be charged against both buckets")
+	assertBucketSize(t, mr, "org:acme", 2, "The org bucket should be charged")
+	assertBucketSize(t, mr, "user:john", 2, "The user bucket should be charged")
+	assert.Equal(t, time.Minute, mr.TTL("org:acme"))
+
+	rejected, err = storage.CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rejected, "The user bucket is full")
+	assertBucketSize(t, mr, "org:acme", 2, "The org bucket must not be charged")
+
+	rejected, err = storage.CheckAndUpdateBuckets(context.Background(), []Bucket{
+		{Key: "org:acme", Algorithm: enum.TokenBucket, Capacity: 3, Rate: .01, ExpiresIn: time.Minute},
+		{Key: "user:jane", Algorithm: enum.LeakyBucket, Capacity: 0, Rate: .01, ExpiresIn: time.Minute},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, rejected)
+	assert.False(t, mr.Exists("user:jane"), "Nothing is written when a bucket rejects the request")
+	assertBucketSize(t, mr, "org:acme", 2, "The org bucket must not be charged")
+}
+
+func TestRedisStorage_CheckAndUpdateBuckets_Cluster(t *testing.T) {
+	mr, storage := newTestRedisStorage(t, nil)
+	storage.cluster = true
+	buckets := []Bucket{
+		{Key: hierarchyLevelKey("org:acme:org", "org:acme:org", "rpm"), Algorithm: enum.TokenBucket, Capacity: 3, Rate: .01, ExpiresIn: time.Minute},
+		{Key: hierarchyLevelKey("org:acme:org", "user:jane:user", "rpm"), Algorithm: enum.LeakyBucket, Capacity: 1, Rate: .01, ExpiresIn: time.Minute},
+	}
+	require.Equal(t, redisKeySlot(buckets[0].Key), redisKeySlot(buckets[1].Key), "The levels must live in the same slot")
+
+	rejected, err := storage.CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, -1, rejected)
+	assertBucketSize(t, mr, buckets[0].Key, 2, "The org bucket is charged")
+	assertBucketSize(t, mr, buckets[1].Key, 1, "The user bucket is charged")
+
+	rejected, err = storage.CheckAndUpdateBuckets(context.Background(), buckets)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rejected, "The user bucket is full")
+	assertBucketSize(t, mr, buckets[0].Key, 2, "The org bucket must not be charged")
+
+	t.Run("Buckets of different slots", func(t *testing.T) {
+		crossSlot := []Bucket{
+			{Key: limiterKey("org:globex:org", "rpm"), Algorithm: enum.TokenBucket, Capacity: 3, Rate: .01, ExpiresIn: time.Minute},
+			{Key: limiterKey("user:john:user", "rpm"), Algorithm: enum.TokenBucket, Capacity: 3, Rate: .01, ExpiresIn: time.Minute},
+		}
+		require.NotEqual(t, redisKeySlot(crossSlot[0].Key), redisKeySlot(crossSlot[1].Key))
+
+		_, err := storage.CheckAndUpdateBuckets(context.Background(), crossSlot)
+		require.ErrorIs(t, err, CrossSlotBucketsErr, "The buckets cannot be charged atomically")
+		assert.False(t, mr.Exists(crossSlot[0].Key), "Nothing is charged")
+	})
+}
+
+func TestNewRedisStorage_Cluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { client.Close() })
+
+	storage := NewRedisStorage(client)
+	assert.True(t, storage.cluster)
+
+	ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), limiterKey("john:login", "rpm"), 1, 1, time.Minute)
+	assertAllowed(t, ok, err, "The cluster client runs the scripts")
+	duration, err := storage.RecordRejection(context.Background(), "john:login", config.PenaltyConfig{
+		MaxRejections:  1,
+		Window:         time.Minute,
+		BanDuration:    time.Minute,
+		MaxBanDuration: time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, duration)
+
+	bans, err := storage.ListBans(context.Background())
+	require.NoError(t, err)
+	require.Len(t, bans, 1, "The bans index is updated apart from the penalty script")
+	assert.Equal(t, "john:login", bans[0].Key)
+
+	assert.False(t, NewRedisStorage(redis.NewClient(&redis.Options{Addr: mr.Addr()})).cluster)
+}
+
+func TestRedisStorage_Penalty(t *testing.T) {
+	penalty := config.PenaltyConfig{
+		MaxRejections:  2,
+		Window:         time.Minute,
+		BanDuration:    time.Hour,
+		MaxBanDuration: 3 * time.Hour,
+		ForgetAfter:    time.Hour,
+	}
+	mr, storage := newTestRedisStorage(t, nil)
+	key := "auth:john:login"
+
+	for _, expected := range []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour} {
+		duration, err := storage.RecordRejection(context.Background(), key, penalty)
+		require.NoError(t, err)
+		assert.Zero(t, duration, "The first rejection does not ban the key")
+
+		duration, err = storage.RecordRejection(context.Background(), key, penalty)
+		require.NoError(t, err)
+		assert.Equal(t, expected, duration)
+
+		remaining, err := storage.BanRemaining(context.Background(), key)
+		require.NoError(t, err)
+		assert.Equal(t, expected, remaining)
+	}
+
+	bans, err := storage.ListBans(context.Background())
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, key, bans[0].Key)
+
+	// the ban and the offences expire with their ttl
+	mr.FastForward(3 * time.Hour)
+	remaining, err := storage.BanRemaining(context.Background(), key)
+	require.NoError(t, err)
+	assert.Zero(t, remaining)
+	assert.True(t, mr.Exists(limiterKey(key, "penalty:offences")), "offences are remembered after the ban")
+
+	mr.FastForward(time.Hour)
+	assert.False(t, mr.Exists(limiterKey(key, "penalty:offences")))
+
+	t.Run("Rejections outside the window are not counted", func(t *testing.T) {
+		_, err := storage.RecordRejection(context.Background(), "auth:jane:login", penalty)
+		require.NoError(t, err)
+		mr.FastForward(time.Minute)
+
+		duration, err := storage.RecordRejection(context.Background(), "auth:jane:login", penalty)
+		require.NoError(t, err)
+		assert.Zero(t, duration)
+	})
+}
+
+func TestRedisStorage_Quota(t *testing.T) {
+	mr, storage := newTestRedisStorage(t, nil)
+	key := "auth:acme:calls:quota"
+
+	for _, expected := range []int{1, 0} {
+		ok, balance, err := storage.CheckAndUpdateQuota(context.Background(), key, 2)
+		assertAllowed(t, ok, err, "The initial balance is charged")
+		assert.Equal(t, expected, balance)
+	}
+
+	ok, balance, err := storage.CheckAndUpdateQuota(context.Background(), key, 2)
+	assertNotAllowed(t, ok, err, "An exhausted quota does not refill")
+	assert.Zero(t, balance)
+
+	balance, err = storage.CreditQuota(context.Background(), key, 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 5, balance)
+
+	mr.FastForward(365 * 24 * time.Hour)
+	assert.Zero(t, mr.TTL(key), "The balance never expires")
+
+	ok, balance, err = storage.CheckAndUpdateQuota(context.Background(), key, 2)
+	assertAllowed(t, ok, err, "A credited quota accepts requests again")
+	assert.Equal(t, 4, balance)
+
+	balance, err = storage.CreditQuota(context.Background(), "auth:new:calls:quota", 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 7, balance, "A key never seen is credited on top of the initial balance")
+}
+
+func TestRedisStorage_CounterAndMark(t *testing.T) {
+	mr, storage := newTestRedisStorage(t, nil)
+
+	for _, expected := range []int{1, 2, 3} {
+		value, err := storage.IncrementCounter(context.Background(), "acme:premium:usage", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+		mr.FastForward(time.Minute)
+	}
+	assert.Equal(t, 57*time.Minute, mr.TTL("acme:premium:usage"), "The ttl is set by the first increment only")
+
+	mr.FastForward(time.Hour)
+	value, err := storage.IncrementCounter(context.Background(), "acme:premium:usage", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, value, "An expired counter starts over")
+
+	first, err := storage.MarkOnce(context.Background(), "acme:premium:usage:80", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, first)
+	first, err = storage.MarkOnce(context.Background(), "acme:premium:usage:80", time.Hour)
+	require.NoError(t, err)
+	assert.False(t, first, "The key is already marked")
+
+	mr.FastForward(time.Hour)
+	first, err = storage.MarkOnce(context.Background(), "acme:premium:usage:80", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, first, "An expired mark can be set again")
+}
+
+func TestRedisStorage_Scripts(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	storage := NewRedisStorage(client)
+
+	hashes := make([]string, 0, len(redisScripts))
+	for _, script := range redisScripts {
+		hashes = append(hashes, script.Hash())
+	}
+	exists, err := client.ScriptExists(context.Background(), hashes...).Result()
+	require.NoError(t, err)
+	assert.NotContains(t, exists, false, "Every script is loaded on creation")
+
+	require.NoError(t, client.ScriptFlush(context.Background()).Err())
+	ok, err := storage.CheckAndUpdateTokenBucket(context.Background(), "token:flushed", 1, 1, time.Minute)
+	assertAllowed(t, ok, err, "The flushed script is loaded again")
+	exists, err = client.ScriptExists(context.Background(), redisTokenBucketScript.Hash()).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true}, exists)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = storage.CheckAndUpdateTokenBucket(ctx, "token:canceled", 1, 1, time.Minute)
+	assert.ErrorIs(t, err, context.Canceled, "The context of the caller is propagated")
+	_, err = storage.CheckAndUpdateLeakyBucket(ctx, "leaky:canceled", 1, 1, time.Minute)
+	assert.ErrorIs(t, err, context.Canceled, "The context of the caller is propagated")
+}
@@ -0,0 +1,62 @@
+package rate_limiter
+
+import (
+	"github/martinmaurice/rlim/pkg/config"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+type scheduledRateLimiters struct {
+	schedule     config.ScheduleConfig
+	rateLimiters []rateLimiterWithID
+}
+
+type groupSchedules struct {
+	location  *time.Location
+	schedules []scheduledRateLimiters
+}
+
+// scheduleActiveAt reports whether the window of the schedule contains t,
+// given in the location of the schedules
+func scheduleActiveAt(schedule config.ScheduleConfig, t time.Time) bool {
+	var (
+		offset = time.Duration(t.Hour())*time.Hour +
+			time.Duration(t.Minute())*time.Minute +
+			time.Duration(t.Second())*time.Second
+		onDay = func(day time.Weekday) bool {
+			return len(schedule.Days) == 0 || slices.Contains(schedule.Days, day)
+		}
+	)
+
+	if schedule.End > schedule.Start {
+		return offset >= schedule.Start && offset < schedule.End && onDay(t.Weekday())
+	}
+
+	// the window wraps past midnight, its end belongs to the previous day
+	switch {
+	case offset >= schedule.Start:
+		return onDay(t.Weekday())
+	case offset < schedule.End:
+		return onDay((t.Weekday() + 6) % 7)
+	default:
+		return false
+	}
+}
+
+// activeRateLimiters returns the rate limiters of the first schedule of the
+// group active at now, the ones of the group when no schedule is active.
+// The rate limiters of the schedules share the bucket keys of the group ones.
+func (c *Client) activeRateLimiters(rateLimitersId string, now time.Time) []rateLimiterWithID {
+	if gs, ok := c.schedules[rateLimitersId]; ok {
+		local := now.In(gs.location)
+		for _, s := range gs.schedules {
+			if scheduleActiveAt(s.schedule, local) {
+				slog.Debug("using the rate limiters of the active schedule", "rateLimitersId", rateLimitersId, "schedule", s.schedule.Name)
+				return s.rateLimiters
+			}
+		}
+	}
+
+	return c.rateLimiters[rateLimitersId]
+}
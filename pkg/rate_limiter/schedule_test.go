@@ -0,0 +1,106 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"testing"
+	"time"
+)
+
+func TestScheduleActiveAt(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	businessHours := config.ScheduleConfig{
+		Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start: 9 * time.Hour,
+		End:   18 * time.Hour,
+	}
+	nightly := config.ScheduleConfig{
+		Days:  []time.Weekday{time.Friday},
+		Start: 22 * time.Hour,
+		End:   6 * time.Hour,
+	}
+	everyDay := config.ScheduleConfig{Start: 12 * time.Hour, End: 14 * time.Hour}
+
+	tests := []struct {
+		name     string
+		schedule config.ScheduleConfig
+		t        time.Time
+		expected bool
+	}{
+		{"Within the window", businessHours, time.Date(2026, 10, 14, 10, 0, 0, 0, paris), true},
+		{"Start is inclusive", businessHours, time.Date(2026, 10, 14, 9, 0, 0, 0, paris), true},
+		{"End is exclusive", businessHours, time.Date(2026, 10, 14, 18, 0, 0, 0, paris), false},
+		{"Outside of the days", businessHours, time.Date(2026, 10, 17, 10, 0, 0, 0, paris), false},
+		{"Wrapping window before midnight", nightly, time.Date(2026, 10, 16, 23, 0, 0, 0, paris), true},
+		{"Wrapping window after midnight of the start day", nightly, time.Date(2026, 10, 17, 5, 59, 0, 0, paris), true},
+		{"Wrapping window after midnight of another day", nightly, time.Date(2026, 10, 16, 5, 0, 0, 0, paris), false},
+		{"Wrapping window outside of the hours", nightly, time.Date(2026, 10, 16, 12, 0, 0, 0, paris), false},
+		{"No days means every day", everyDay, time.Date(2026, 10, 18, 13, 0, 0, 0, paris), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, scheduleActiveAt(tt.schedule, tt.t))
+		})
+	}
+}
+
+func TestClient_activeRateLimiters(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+	}
+
+	rpm := config.RateLimiterConfig{
+		ID:         "rpm",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   1,
+		RefillRate: .5,
+		Expiration: 60,
+	}
+	peakRpm := rpm
+	peakRpm.Capacity = 3
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"free": {{id: rpm.ID, rl: c.newRateLimiter("free", rpm), cfg: rpm}},
+	}
+	c.schedules = map[string]*groupSchedules{
+		"free": {
+			location: paris,
+			schedules: []scheduledRateLimiters{{
+				schedule: config.ScheduleConfig{Name: "business-hours", Start: 9 * time.Hour, End: 18 * time.Hour},
+				rateLimiters: []rateLimiterWithID{
+					{id: peakRpm.ID, rl: c.newRateLimiter("free", peakRpm), cfg: peakRpm},
+				},
+			}},
+		},
+	}
+
+	// 10:00 in Paris, 08:00 UTC
+	active := c.activeRateLimiters("free", time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC))
+	require.Len(t, active, 1)
+	assert.Equal(t, 3, active[0].cfg.Capacity)
+
+	// 20:00 in Paris
+	active = c.activeRateLimiters("free", time.Date(2026, 10, 14, 18, 0, 0, 0, time.UTC))
+	require.Len(t, active, 1)
+	assert.Equal(t, 1, active[0].cfg.Capacity)
+
+	assert.Empty(t, c.activeRateLimiters("unknown", time.Now()))
+
+	// switching schedules keeps the bucket of the key
+	peak := c.schedules["free"].schedules[0].rateLimiters[0].rl
+	for i := 0; i < 3; i++ {
+		allowed, err := peak.Allow(context.Background(), "k1:free:rpm")
+		require.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, err := c.rateLimiters["free"][0].rl.Allow(context.Background(), "k1:free:rpm")
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
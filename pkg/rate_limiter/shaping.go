@@ -0,0 +1,172 @@
+package rate_limiter
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// minShapingRetryInterval prevents busy looping on buckets whose retry after is unknown
+const minShapingRetryInterval = 10 * time.Millisecond
+
+// shapingQueue holds the requests of a key in their order of arrival, only
+// the front one checks its buckets
+type shapingQueue struct {
+	waiters *list.List // of chan struct{}, closed once the waiter reaches the front
+	last    Decision   // last rejection of the front waiter, returned to the waiters giving up
+}
+
+// shaper bounds the requests of a group waiting for their bucket to free
+// capacity and lets them through first come, first served for each key
+type shaper struct {
+	rateLimitersId string
+	maxQueue       int
+	maxWait        time.Duration
+
+	mu     sync.Mutex
+	queued int // requests waiting over every key of the group
+	queues map[string]*shapingQueue
+}
+
+func newShaper(rateLimitersId string, maxQueue int, maxWait time.Duration) *shaper {
+	return &shaper{
+		rateLimitersId: rateLimitersId,
+		maxQueue:       maxQueue,
+		maxWait:        maxWait,
+		queues:         make(map[string]*shapingQueue),
+	}
+}
+
+// shape runs the check of the request identified by key once the requests of
+// the same key that arrived before are done, then retries it until it is
+// allowed, the max wait elapses or the context is done, sleeping the
+// estimated retry after between attempts. A request arriving while the key
+// has no waiter is checked right away; a request that has to wait while the
+// queue is full is rejected right away.
+func (s *shaper) shape(ctx context.Context, key string, check func() Decision) Decision {
+	var (
+		start    = time.Now()
+		deadline = start.Add(s.maxWait)
+		turn     = make(chan struct{})
+	)
+
+	s.mu.Lock()
+	q, ok := s.queues[key]
+	if !ok {
+		q = &shapingQueue{waiters: list.New()}
+		s.queues[key] = q
+		close(turn)
+	}
+	waiter := q.waiters.PushBack(turn)
+	s.mu.Unlock()
+
+	// the first request of the key is not queued unless it is rejected
+	waiting := false
+	defer func() { s.leave(key, q, waiter, waiting) }()
+	if ok {
+		if !s.wait() {
+			return s.giveUp(key, q)
+		}
+		waiting = true
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-turn:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return s.giveUp(key, q)
+		case <-timer.C:
+			return s.giveUp(key, q)
+		}
+	}
+
+	var decision Decision
+	for {
+		decision = check()
+		if decision.Allowed {
+			break
+		}
+
+		s.mu.Lock()
+		q.last = decision
+		s.mu.Unlock()
+
+		if !waiting {
+			if !s.wait() {
+				return decision
+			}
+			waiting = true
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		timer := time.NewTimer(min(max(decision.RetryAfter, minShapingRetryInterval), remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return decision
+		case <-timer.C:
+		}
+	}
+
+	if waiting {
+		decision.Waited = time.Since(start)
+		shapingWaitSeconds.WithLabelValues(decision.RateLimitersID).Observe(decision.Waited.Seconds())
+	}
+
+	return decision
+}
+
+// wait counts the request among the waiting ones, it returns false when the
+// queue is full
+func (s *shaper) wait() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queued >= s.maxQueue {
+		slog.Debug("shaping queue is full", "rateLimitersId", s.rateLimitersId)
+		shapingQueueFullTotal.WithLabelValues(s.rateLimitersId).Inc()
+		return false
+	}
+	s.queued++
+	return true
+}
+
+// giveUp returns the last rejection of the key to a waiter leaving the queue
+// before its turn
+func (s *shaper) giveUp(key string, q *shapingQueue) Decision {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decision := q.last
+	if decision.Key == "" {
+		decision = Decision{Key: key, RateLimitersID: s.rateLimitersId}
+	}
+	return decision
+}
+
+// leave removes the waiter from the queue of the key and gives the turn to
+// the next one
+func (s *shaper) leave(key string, q *shapingQueue, waiter *list.Element, waiting bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if waiting {
+		s.queued--
+	}
+
+	front := q.waiters.Front() == waiter
+	q.waiters.Remove(waiter)
+	switch {
+	case q.waiters.Len() == 0:
+		delete(s.queues, key)
+	case front:
+		close(q.waiters.Front().Value.(chan struct{}))
+	}
+}
@@ -0,0 +1,137 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newShapedTestClient(maxQueue int, maxWait time.Duration, cfgs ...config.RateLimiterConfig) *Client {
+	c := &Client{
+		rateStorage:  NewMemoryStorage(),
+		rateLimiters: make(map[string][]rateLimiterWithID),
+		shapers: map[string]*shaper{
+			"batch": newShaper("batch", maxQueue, maxWait),
+		},
+	}
+	for _, cfg := range cfgs {
+		c.rateLimiters["batch"] = append(c.rateLimiters["batch"], rateLimiterWithID{id: cfg.ID, rl: c.newRateLimiter("batch", cfg), cfg: cfg})
+	}
+
+	return c
+}
+
+// tokenBucketConfig allows a burst of capacity requests then one every 1/refillRate seconds
+func tokenBucketConfig(id string, capacity int, refillRate float64) config.RateLimiterConfig {
+	return config.RateLimiterConfig{ID: id, Algorithm: enum.TokenBucket, Capacity: capacity, RefillRate: refillRate, Expiration: 60}
+}
+
+func TestClient_Check_Shaping(t *testing.T) {
+	t.Run("Request is delayed until the bucket frees capacity", func(t *testing.T) {
+		c := newShapedTestClient(10, time.Second, tokenBucketConfig("rps", 1, 20))
+		assert.True(t, c.Check(context.Background(), "k1", "batch").Allowed)
+
+		decision := c.Check(context.Background(), "k1", "batch")
+		assert.True(t, decision.Allowed)
+		assert.GreaterOrEqual(t, decision.Waited, 30*time.Millisecond)
+	})
+
+	t.Run("Request is rejected once the max wait elapses", func(t *testing.T) {
+		c := newShapedTestClient(10, 50*time.Millisecond, tokenBucketConfig("rpm", 1, 0.001))
+		assert.True(t, c.Check(context.Background(), "k1", "batch").Allowed)
+
+		start := time.Now()
+		decision := c.Check(context.Background(), "k1", "batch")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, "rpm", decision.LimiterID)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("Request is rejected right away when the queue is full", func(t *testing.T) {
+		c := newShapedTestClient(2, 200*time.Millisecond, tokenBucketConfig("rpm", 1, 0.001))
+		assert.True(t, c.Check(context.Background(), "k1", "batch").Allowed)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Go(func() {
+				c.Check(context.Background(), "k1", "batch")
+			})
+		}
+		time.Sleep(20 * time.Millisecond) // let the first requests enter the queue
+
+		start := time.Now()
+		decision := c.Check(context.Background(), "k1", "batch")
+		assert.False(t, decision.Allowed)
+		assert.Equal(t, "batch", decision.RateLimitersID)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+		wg.Wait()
+		s := c.shapers["batch"]
+		assert.Zero(t, s.queued)
+		assert.Empty(t, s.queues)
+	})
+
+	t.Run("Waiting stops when the context is done", func(t *testing.T) {
+		c := newShapedTestClient(10, 10*time.Second, tokenBucketConfig("rpm", 1, 0.001))
+		assert.True(t, c.Check(context.Background(), "k1", "batch").Allowed)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		decision := c.Check(ctx, "k1", "batch")
+		assert.False(t, decision.Allowed)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Requests of a key are admitted in their order of arrival", func(t *testing.T) {
+		c := newShapedTestClient(10, 2*time.Second, tokenBucketConfig("rps", 1, 10))
+		assert.True(t, c.Check(context.Background(), "k1", "batch").Allowed)
+
+		var (
+			mu       sync.Mutex
+			admitted []int
+			wg       sync.WaitGroup
+		)
+		for i := range 3 {
+			wg.Go(func() {
+				decision := c.Check(context.Background(), "k1", "batch")
+				assert.True(t, decision.Allowed)
+				mu.Lock()
+				admitted = append(admitted, i)
+				mu.Unlock()
+			})
+			time.Sleep(20 * time.Millisecond) // let the request enter the queue
+		}
+
+		wg.Wait()
+		assert.Equal(t, []int{0, 1, 2}, admitted, "a new arrival never overtakes the waiting requests")
+	})
+
+	t.Run("Retries do not charge the buckets that accepted the request", func(t *testing.T) {
+		c := newShapedTestClient(10, time.Second, tokenBucketConfig("rpm", 5, 0.001), tokenBucketConfig("rps", 1, 20))
+
+		for range 5 {
+			assert.True(t, c.Check(context.Background(), "k1", "batch").Allowed)
+		}
+		decision := c.Check(context.Background(), "k1", "batch")
+		assert.False(t, decision.Allowed, "the 5 requests admitted were charged once by the rpm bucket")
+		assert.Equal(t, "rpm", decision.LimiterID)
+	})
+
+	t.Run("Groups without shaping reject immediately", func(t *testing.T) {
+		c := newShapedTestClient(10, time.Second, tokenBucketConfig("rpm", 1, 0.001))
+		c.rateLimiters["unshaped"] = c.rateLimiters["batch"]
+		assert.True(t, c.Check(context.Background(), "k1", "unshaped").Allowed)
+
+		start := time.Now()
+		decision := c.Check(context.Background(), "k1", "unshaped")
+		assert.False(t, decision.Allowed)
+		assert.Zero(t, decision.Waited)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+	})
+}
@@ -0,0 +1,104 @@
+package rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+// hourlyRateLimiterID is the id the config gives to the requests_per_hour rate limiter
+const hourlyRateLimiterID = "rph"
+
+// UsageEvent tells that a key used the Threshold share of the hourly quota
+// of its group during the window
+type UsageEvent struct {
+	Key            string    `json:"key"` // rate-limit key, e.g. auth:acme:premium
+	RateLimitersID string    `json:"rate_limiters_id"`
+	Threshold      float64   `json:"threshold"`
+	Used           int       `json:"used"`
+	Limit          int       `json:"limit"`
+	WindowStart    time.Time `json:"window_start"`
+	WindowEnd      time.Time `json:"window_end"`
+}
+
+type UsageNotifier interface {
+	Notify(ctx context.Context, event UsageEvent)
+}
+
+// hourlyLimit returns the requests allowed per hour by the rate limiter
+func hourlyLimit(cfg config.RateLimiterConfig) int {
+	rate := cfg.RefillRate
+	if cfg.Algorithm == enum.LeakyBucket {
+		rate = cfg.LeakRate
+	}
+	return int(math.Round(rate * time.Hour.Seconds()))
+}
+
+// trackUsage counts the allowed requests of the key in the current hour and
+// notifies the thresholds of the hourly quota crossed by the request. A
+// rejection by the hourly rate limiter means the whole quota is used. Each
+// threshold is notified once per window and key, across every instance
+// sharing the storage.
+func (c *Client) trackUsage(ctx context.Context, decision Decision) {
+	if c.notifier == nil || decision.hourlyLimit <= 0 || decision.Banned {
+		return
+	}
+
+	var (
+		limit       = decision.hourlyLimit
+		windowStart = time.Now().Truncate(time.Hour)
+		windowEnd   = windowStart.Add(time.Hour)
+		usageKey    = limiterKey(decision.Key, fmt.Sprintf("usage:%d", windowStart.Unix()))
+		used        int
+		err         error
+	)
+
+	switch {
+	case decision.Allowed:
+		used, err = c.rateStorage.IncrementCounter(ctx, usageKey, time.Until(windowEnd))
+		if err != nil {
+			slog.Error("unexpected error while counting the usage", "key", decision.Key, "error", err)
+			return
+		}
+	case decision.LimiterID == hourlyRateLimiterID:
+		used = limit
+	default:
+		return
+	}
+
+	for _, threshold := range c.cfg.Notifications.Thresholds {
+		target := int(math.Ceil(threshold * float64(limit)))
+		// the counter goes up one request at a time, only the request
+		// reaching the target of an allowed threshold has to notify it
+		if used < target || (decision.Allowed && used != target) {
+			continue
+		}
+
+		// the threshold is formatted exactly, 0.29*100 truncates to 28
+		markKey := usageKey + ":" + strconv.FormatFloat(threshold, 'f', -1, 64)
+		first, err := c.rateStorage.MarkOnce(ctx, markKey, time.Until(windowEnd))
+		if err != nil {
+			slog.Error("unexpected error while deduplicating the usage notification", "key", decision.Key, "error", err)
+			continue
+		}
+		if !first {
+			continue
+		}
+
+		slog.Info("usage threshold reached", "key", decision.Key, "threshold", threshold, "used", used, "limit", limit)
+		c.notifier.Notify(ctx, UsageEvent{
+			Key:            decision.Key,
+			RateLimitersID: decision.RateLimitersID,
+			Threshold:      threshold,
+			Used:           used,
+			Limit:          limit,
+			WindowStart:    windowStart,
+			WindowEnd:      windowEnd,
+		})
+	}
+}
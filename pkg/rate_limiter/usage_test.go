@@ -0,0 +1,135 @@
+package rate_limiter
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/config"
+	"github/martinmaurice/rlim/pkg/enum"
+	"testing"
+	"time"
+)
+
+type fakeUsageNotifier struct {
+	events []UsageEvent
+}
+
+func (f *fakeUsageNotifier) Notify(ctx context.Context, event UsageEvent) {
+	f.events = append(f.events, event)
+}
+
+func TestClient_Check_UsageNotifications(t *testing.T) {
+	notifier := &fakeUsageNotifier{}
+	storage := NewMemoryStorage()
+	newClient := func() *Client {
+		c := &Client{
+			rateStorage: storage,
+			cfg: &config.Config{
+				Notifications: config.NotificationsConfig{Enabled: true, Thresholds: []float64{0.8, 1}},
+			},
+			notifier: notifier,
+		}
+		rph := config.RateLimiterConfig{
+			ID:         "rph",
+			Algorithm:  enum.TokenBucket,
+			Capacity:   10,
+			RefillRate: 10.0 / 3600,
+			Expiration: 3600,
+		}
+		c.rateLimiters = map[string][]rateLimiterWithID{
+			"premium": {{id: rph.ID, rl: c.newRateLimiter("premium", rph), cfg: rph}},
+		}
+		return c
+	}
+	c := newClient()
+
+	for i := 0; i < 7; i++ {
+		assert.True(t, c.Check(context.Background(), "acme", "premium").Allowed)
+	}
+	assert.Empty(t, notifier.events)
+
+	assert.True(t, c.Check(context.Background(), "acme", "premium").Allowed)
+	require.Len(t, notifier.events, 1)
+	event := notifier.events[0]
+	assert.Equal(t, "acme:premium", event.Key)
+	assert.Equal(t, "premium", event.RateLimitersID)
+	assert.Equal(t, 0.8, event.Threshold)
+	assert.Equal(t, 8, event.Used)
+	assert.Equal(t, 10, event.Limit)
+	assert.Equal(t, event.WindowStart.Add(time.Hour), event.WindowEnd)
+
+	// another instance sharing the storage does not notify the same threshold again
+	other := newClient()
+	assert.True(t, other.Check(context.Background(), "acme", "premium").Allowed)
+	assert.True(t, c.Check(context.Background(), "acme", "premium").Allowed)
+	require.Len(t, notifier.events, 2)
+	assert.Equal(t, 1.0, notifier.events[1].Threshold)
+
+	for i := 0; i < 3; i++ {
+		assert.False(t, c.Check(context.Background(), "acme", "premium").Allowed)
+	}
+	assert.Len(t, notifier.events, 2, "rejections do not notify a threshold twice")
+}
+
+func TestClient_Check_UsageNotifications_Rejected(t *testing.T) {
+	notifier := &fakeUsageNotifier{}
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		cfg: &config.Config{
+			Notifications: config.NotificationsConfig{Enabled: true, Thresholds: []float64{0.8, 1}},
+		},
+		notifier: notifier,
+	}
+
+	// a burst smaller than the hourly quota is rejected before using it all
+	rph := config.RateLimiterConfig{
+		ID:         "rph",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   2,
+		RefillRate: 10.0 / 3600,
+		Expiration: 3600,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"premium": {{id: rph.ID, rl: c.newRateLimiter("premium", rph), cfg: rph}},
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.True(t, c.Check(context.Background(), "acme", "premium").Allowed)
+	}
+	assert.False(t, c.Check(context.Background(), "acme", "premium").Allowed)
+
+	require.Len(t, notifier.events, 2, "a rejection by the hourly rate limiter uses the whole quota")
+	assert.Equal(t, 0.8, notifier.events[0].Threshold)
+	assert.Equal(t, 1.0, notifier.events[1].Threshold)
+	assert.Equal(t, 10, notifier.events[1].Used)
+}
+
+func TestClient_Check_UsageNotifications_CloseThresholds(t *testing.T) {
+	notifier := &fakeUsageNotifier{}
+	c := &Client{
+		rateStorage: NewMemoryStorage(),
+		cfg: &config.Config{
+			Notifications: config.NotificationsConfig{Enabled: true, Thresholds: []float64{0.28, 0.29}},
+		},
+		notifier: notifier,
+	}
+	rph := config.RateLimiterConfig{
+		ID:         "rph",
+		Algorithm:  enum.TokenBucket,
+		Capacity:   100,
+		RefillRate: 100.0 / 3600,
+		Expiration: 3600,
+	}
+	c.rateLimiters = map[string][]rateLimiterWithID{
+		"premium": {{id: rph.ID, rl: c.newRateLimiter("premium", rph), cfg: rph}},
+	}
+
+	for i := 0; i < 29; i++ {
+		assert.True(t, c.Check(context.Background(), "acme", "premium").Allowed)
+	}
+
+	require.Len(t, notifier.events, 2, "each threshold is deduplicated on its own")
+	assert.Equal(t, 0.28, notifier.events[0].Threshold)
+	assert.Equal(t, 0.29, notifier.events[1].Threshold)
+	assert.Equal(t, 29, notifier.events[1].Used)
+}
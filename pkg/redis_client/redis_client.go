@@ -0,0 +1,38 @@
+package redis_client
+
+import (
+	"github.com/redis/go-redis/v9"
+	"github/martinmaurice/rlim/pkg/env"
+	"log/slog"
+)
+
+// New creates the redis client of the env: a sentinel failover client when
+// a sentinel master name is set, a cluster client when cluster seed addresses
+// are set and a single node client on RedisAddr otherwise. The deadline of
+// the context of a command bounds its network calls.
+func New() redis.UniversalClient {
+	envObj := env.GetEnv()
+	options := &redis.UniversalOptions{
+		Addrs:                 []string{envObj.RedisAddr},
+		Password:              envObj.RedisPassword,
+		DB:                    envObj.RedisDb,
+		PoolSize:              envObj.RedisPoolSize,
+		ContextTimeoutEnabled: true,
+	}
+
+	switch {
+	case envObj.RedisSentinelMasterName != "":
+		slog.Info("creating the redis client", "mode", "sentinel", "master", envObj.RedisSentinelMasterName)
+		options.MasterName = envObj.RedisSentinelMasterName
+		options.Addrs = envObj.RedisSentinelAddrs
+		options.SentinelPassword = envObj.RedisSentinelPassword
+		return redis.NewFailoverClient(options.Failover())
+	case len(envObj.RedisClusterAddrs) > 0:
+		slog.Info("creating the redis client", "mode", "cluster", "seeds", envObj.RedisClusterAddrs)
+		options.Addrs = envObj.RedisClusterAddrs
+		return redis.NewClusterClient(options.Cluster())
+	default:
+		slog.Info("creating the redis client", "mode", "single", "addr", envObj.RedisAddr)
+		return redis.NewClient(options.Simple())
+	}
+}
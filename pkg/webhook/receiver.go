@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	maxPayloadBytes = 1 << 20
+
+	// DefaultTolerance bounds the age of the webhooks accepted by the receiver
+	DefaultTolerance = 5 * time.Minute
+)
+
+// NewReceiver returns a handler accepting the webhooks signed with the secret
+// and passing their payload to onPayload, e.g. to test an integration locally.
+// The signature is not checked when the secret is empty.
+func NewReceiver(secret string, onPayload func(Payload)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPayloadBytes))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if secret != "" {
+			err = Verify(secret, r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body, DefaultTolerance)
+			if err != nil {
+				slog.Warn("rejecting webhook", "error", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var payload Payload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		onPayload(payload)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Rlim-Signature"
+	TimestampHeader = "X-Rlim-Timestamp"
+
+	signaturePrefix = "sha256="
+)
+
+var InvalidSignatureErr = errors.New("invalid webhook signature")
+
+// Sign returns the signature of the body sent at timestamp (unix seconds):
+// the hex encoded HMAC-SHA256, keyed by the secret, of "<timestamp>.<body>"
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a received webhook, the timestamp must be
+// within tolerance of now to prevent replays
+func Verify(secret, timestamp, signature string, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", InvalidSignatureErr)
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp out of tolerance", InvalidSignatureErr)
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("%w: unsupported scheme", InvalidSignatureErr)
+	}
+
+	if !hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature)) {
+		return InvalidSignatureErr
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	UsageThresholdEventType = "usage.threshold"
+
+	defaultQueueSize      = 1000
+	defaultInitialBackoff = time.Second
+
+	deliveredResult = "delivered"
+	failedResult    = "failed"
+	droppedResult   = "dropped"
+)
+
+var deliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rlim_webhook_deliveries_total",
+	Help: "Number of webhooks by result (delivered, failed after every retry, dropped because the queue was full or the notifier closed).",
+}, []string{"result"})
+
+// Payload is the JSON body of the webhooks, ID is the same for every
+// delivery attempt so that receivers can ignore duplicates
+type Payload struct {
+	ID        string                  `json:"id"`
+	Type      string                  `json:"type"`
+	CreatedAt time.Time               `json:"created_at"`
+	Data      rate_limiter.UsageEvent `json:"data"`
+}
+
+type Options struct {
+	URL        string
+	Secret     string        // key of the HMAC signature, the webhooks are not signed when empty
+	MaxRetries int           // retries of a failed delivery
+	Timeout    time.Duration // timeout of a delivery attempt
+	QueueSize  int           // events waiting for delivery, new events are dropped when full (default: 1000)
+}
+
+// Notifier delivers the usage events as signed JSON webhooks in the
+// background. A delivery failing with a network error, a 429 or a 5xx is
+// retried with an exponential backoff, the other statuses are final.
+type Notifier struct {
+	url            string
+	secret         string
+	maxRetries     int
+	initialBackoff time.Duration
+	client         *http.Client
+	queue          chan Payload
+	wg             sync.WaitGroup
+	ctx            context.Context // canceled once Close gives up on the pending deliveries
+	cancel         context.CancelFunc
+}
+
+func New(options Options) *Notifier {
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	n := &Notifier{
+		url:            options.URL,
+		secret:         options.Secret,
+		maxRetries:     options.MaxRetries,
+		initialBackoff: defaultInitialBackoff,
+		client:         &http.Client{Timeout: options.Timeout},
+		queue:          make(chan Payload, queueSize),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	n.wg.Add(1)
+	go n.run()
+
+	return n
+}
+
+// Notify queues the event for delivery without blocking the request
+func (n *Notifier) Notify(ctx context.Context, event rate_limiter.UsageEvent) {
+	payload := Payload{
+		ID:        fmt.Sprintf("%s:%d:%s", event.Key, event.WindowStart.Unix(), thresholdPercent(event.Threshold)),
+		Type:      UsageThresholdEventType,
+		CreatedAt: time.Now(),
+		Data:      event,
+	}
+
+	select {
+	case n.queue <- payload:
+	default:
+		slog.Error("webhook queue is full, dropping the event", "id", payload.ID)
+		deliveriesTotal.WithLabelValues(droppedResult).Inc()
+	}
+}
+
+// thresholdPercent formats the threshold as a percentage rounded to the
+// hundredth, 0.29 is "29" where int(0.29*100) would be 28
+func thresholdPercent(threshold float64) string {
+	return strconv.FormatFloat(math.Round(threshold*10000)/100, 'f', -1, 64)
+}
+
+// Close stops accepting events and waits for the queued ones to be delivered
+// until ctx is done. The delivery in progress and its backoff are then cut
+// short and the pending events dropped, ctx.Err() is returned.
+func (n *Notifier) Close(ctx context.Context) error {
+	close(n.queue)
+
+	delivered := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		n.cancel()
+		return nil
+	case <-ctx.Done():
+		n.cancel()
+		<-delivered
+		return ctx.Err()
+	}
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for payload := range n.queue {
+		if n.ctx.Err() != nil {
+			slog.Error("webhook notifier closed, dropping the event", "id", payload.ID)
+			deliveriesTotal.WithLabelValues(droppedResult).Inc()
+			continue
+		}
+		if err := n.deliver(payload); err != nil {
+			slog.Error("could not deliver the webhook", "id", payload.ID, "error", err)
+			deliveriesTotal.WithLabelValues(failedResult).Inc()
+			continue
+		}
+		deliveriesTotal.WithLabelValues(deliveredResult).Inc()
+	}
+}
+
+func (n *Notifier) deliver(payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.initialBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := n.send(body)
+		if err == nil {
+			slog.Debug("webhook delivered", "id", payload.ID, "attempt", attempt+1)
+			return nil
+		}
+		if !retryable || attempt >= n.maxRetries {
+			return err
+		}
+
+		slog.Warn("webhook delivery failed, retrying", "id", payload.ID, "attempt", attempt+1, "backoff", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-n.ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w, last attempt: %w", n.ctx.Err(), err)
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// send makes one delivery attempt and tells whether a failure is worth retrying
+func (n *Notifier) send(body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(SignatureHeader, Sign(n.secret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("webhook receiver answered %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("webhook receiver answered %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github/martinmaurice/rlim/pkg/rate_limiter"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testEvent = rate_limiter.UsageEvent{
+	Key:            "auth:acme:premium",
+	RateLimitersID: "premium",
+	Threshold:      0.8,
+	Used:           800,
+	Limit:          1000,
+	WindowStart:    time.Unix(3600, 0).UTC(),
+	WindowEnd:      time.Unix(7200, 0).UTC(),
+}
+
+func TestNotifier_Deliver(t *testing.T) {
+	received := make(chan Payload, 1)
+	receiver := httptest.NewServer(NewReceiver("s3cr3t", func(payload Payload) {
+		received <- payload
+	}))
+	defer receiver.Close()
+
+	notifier := New(Options{URL: receiver.URL, Secret: "s3cr3t", Timeout: time.Second})
+	notifier.Notify(context.Background(), testEvent)
+	require.NoError(t, notifier.Close(context.Background()))
+
+	payload := <-received
+	assert.Equal(t, "auth:acme:premium:3600:80", payload.ID)
+	assert.Equal(t, UsageThresholdEventType, payload.Type)
+	assert.Equal(t, testEvent, payload.Data)
+}
+
+func TestThresholdPercent(t *testing.T) {
+	tests := []struct {
+		threshold float64
+		expected  string
+	}{
+		{0.8, "80"},
+		{1, "100"},
+		{0.28, "28"},
+		{0.29, "29"},
+		{0.285, "28.5"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, thresholdPercent(tt.threshold), "threshold %v", tt.threshold)
+	}
+}
+
+func TestNotifier_Retries(t *testing.T) {
+	tests := []struct {
+		name             string
+		statuses         []int
+		maxRetries       int
+		expectedAttempts int32
+	}{
+		{"Server errors are retried", []int{500, 503, 204}, 3, 3},
+		{"Too many requests are retried", []int{429, 204}, 3, 2},
+		{"Retries are bounded", []int{500, 500, 500, 500}, 2, 3},
+		{"Client errors are final", []int{400, 204}, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[attempts.Add(1)-1])
+			}))
+			defer receiver.Close()
+
+			notifier := New(Options{URL: receiver.URL, MaxRetries: tt.maxRetries, Timeout: time.Second})
+			notifier.initialBackoff = time.Millisecond
+			notifier.Notify(context.Background(), testEvent)
+			require.NoError(t, notifier.Close(context.Background()))
+
+			assert.Equal(t, tt.expectedAttempts, attempts.Load())
+		})
+	}
+}
+
+func TestNotifier_CloseDeadline(t *testing.T) {
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	notifier := New(Options{URL: receiver.URL, MaxRetries: 10, Timeout: time.Second})
+	notifier.initialBackoff = time.Hour
+	notifier.Notify(context.Background(), testEvent)
+	notifier.Notify(context.Background(), testEvent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.ErrorIs(t, notifier.Close(ctx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "the backoff is cut short")
+	assert.Equal(t, int32(1), attempts.Load(), "the pending event is dropped")
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	now := time.Now().Unix()
+	signature := Sign("s3cr3t", now, body)
+
+	require.NoError(t, Verify("s3cr3t", strconv.FormatInt(now, 10), signature, body, time.Minute))
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+	}{
+		{"Wrong secret", "other", strconv.FormatInt(now, 10), signature, body},
+		{"Tampered body", "s3cr3t", strconv.FormatInt(now, 10), signature, []byte(`{"id":"2"}`)},
+		{"Replayed timestamp", "s3cr3t", strconv.FormatInt(now-3600, 10), Sign("s3cr3t", now-3600, body), body},
+		{"Malformed timestamp", "s3cr3t", "yesterday", signature, body},
+		{"Unsupported scheme", "s3cr3t", strconv.FormatInt(now, 10), "md5=abc", body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.timestamp, tt.signature, tt.body, time.Minute)
+			assert.ErrorIs(t, err, InvalidSignatureErr)
+		})
+	}
+}
+
+func TestReceiver_RejectsUnsignedWebhooks(t *testing.T) {
+	receiver := httptest.NewServer(NewReceiver("s3cr3t", func(payload Payload) {
+		t.Error("unsigned webhooks must not be passed on")
+	}))
+	defer receiver.Close()
+
+	notifier := New(Options{URL: receiver.URL, Timeout: time.Second})
+	notifier.Notify(context.Background(), testEvent)
+	require.NoError(t, notifier.Close(context.Background()))
+}